@@ -0,0 +1,4222 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package analysis implements rtcheck's static deadlock analysis of
+// the Go runtime. The rtcheck command is a thin wrapper around it;
+// see the rtcheck command documentation for how the analysis works
+// and its limitations.
+//
+// Analyze runs the analysis and returns a Report, which has methods
+// for each of rtcheck's output formats.
+package analysis
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/constant"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"go/types"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/tools/go/buildutil"
+	"golang.org/x/tools/go/callgraph"
+	"golang.org/x/tools/go/callgraph/cha"
+	"golang.org/x/tools/go/loader"
+	"golang.org/x/tools/go/pointer"
+	"golang.org/x/tools/go/ssa"
+	"golang.org/x/tools/go/ssa/ssautil"
+)
+
+// options control the behavior of the analysis.
+type options struct {
+	// packages, if non-empty, is a list of import paths to
+	// analyze instead of the runtime.
+	packages []string
+
+	// rootLocks specifies how to handle paths that return from
+	// a root with locks still held. "warn" prints a warning,
+	// "ignore" suppresses it, "list" additionally lists where
+	// each held lock was acquired and where the path returned,
+	// and "error" is like "list", but also makes rtcheck exit
+	// with a non-zero status.
+	rootLocks string
+
+	// classOverrides reassigns the lock classes of locks with
+	// specific lock paths or classes.
+	classOverrides []LockClassOverride
+
+	// conservative makes calls whose callees can't be resolved
+	// acquire a special "unresolved call" lock class rather than
+	// assuming they have no effect on locks.
+	conservative bool
+
+	// external specifies how to model calls to external
+	// functions, which have neither a body nor a stub. "assume"
+	// assumes they don't affect locks. "worst" warns about every
+	// external function reached and treats each call as acquiring
+	// a lock class for that function that is ordered after every
+	// lock currently held.
+	external string
+
+	// showSource prints the source line of each diagnostic, with
+	// context lines of context on either side.
+	showSource bool
+	context    int
+
+	// maxWarnings, if positive, is the number of diagnostics below
+	// SevError to print to diagOut. Later ones are still recorded,
+	// but only counted in the summary at the end.
+	maxWarnings int
+
+	// cacheDir, if non-empty, is a directory in which to cache
+	// the call graph computed by pointer analysis, keyed by
+	// cacheKey (see runtimeCacheKey). cacheKey is set by analyze;
+	// if it's empty, the cache isn't used.
+	cacheDir string
+	cacheKey string
+
+	// rewrittenPkgs is the set of import paths of the packages
+	// analyze rewrote. It's set by analyze.
+	rewrittenPkgs map[string]bool
+
+	// incremental, if non-empty, is the path of the incremental
+	// analysis state. Only roots affected by functions that
+	// changed since the last run are analyzed. What the other
+	// roots found is merged from the last run (see mergeClean).
+	incremental string
+
+	// checkInitOrder enables the init-order check, which reports
+	// locks acquired before the runtime has initialized them (see
+	// initLocks).
+	checkInitOrder bool
+
+	// keepSynthetic keeps synthetic functions (wrappers, thunks,
+	// and bound method closures) in the call graph. Dynamic calls
+	// then resolve to the synthetic function, so it appears in
+	// lock acquisition paths, and dynamic calls made by a
+	// synthetic function that is itself called statically can
+	// be resolved. Without it, calls through synthetic functions
+	// are attributed directly to their targets, which gives
+	// shorter, less noisy paths, but dynamic calls inside
+	// synthetic functions have no call graph and are dropped.
+	keepSynthetic bool
+
+	// dumpRewritten, if non-empty, is a directory to write the
+	// rewritten runtime sources to.
+	dumpRewritten string
+
+	// traceEdge, if its elements are non-empty, names the lock
+	// classes of a lock graph edge to trace. The blocks walked on
+	// the first path that adds that edge are recorded (see
+	// traceNewEdge).
+	traceEdge [2]string
+
+	// observer, if non-nil, is called on every lock set
+	// transition.
+	observer LockObserver
+
+	// usage enables collection of the lock usage report.
+	usage bool
+
+	// listLocks enables collection of the lock class inventory
+	// (see writeLockList).
+	listLocks bool
+
+	// nesting, if positive, is the number of deepest lock
+	// nestings to report (see writeNesting).
+	nesting int
+
+	// maxStates is the number of path states that differ only in
+	// their value states that may reach a block before further
+	// paths reaching it are trimmed. If it is 0, DefaultMaxStates
+	// is used.
+	maxStates int
+
+	// timeout, if positive, limits how long explore walks the
+	// roots. Once it expires, no more path states are explored
+	// and the analysis returns the partial results so far.
+	timeout time.Duration
+
+	// requirePreemptoff is the set of lock classes that must only
+	// be acquired with m.preemptoff set, named as for lock order
+	// specifications (see specName).
+	requirePreemptoff map[string]bool
+
+	// systemStackLocks and userStackLocks are the sets of lock
+	// classes that must only be held on the system stack and on
+	// a user stack, respectively, named as for lock order
+	// specifications. Acquiring such a lock on the wrong stack,
+	// or switching stacks while holding it, is reported.
+	systemStackLocks map[string]bool
+	userStackLocks   map[string]bool
+
+	// checkBlocking enables the blocking check, which reports
+	// locks held across channel sends and receives that may
+	// block.
+	checkBlocking bool
+
+	// checkPreempt enables the preemption check, which reports
+	// unbalanced acquirem/releasem and blocking operations
+	// reached while the M is acquired.
+	checkPreempt bool
+
+	// checkGosched enables the gosched check, which reports locks
+	// held across yielding the processor with mcall(gosched_m)
+	// and similar calls.
+	checkGosched bool
+
+	// stubs are additional stub sources that override the
+	// built-in stubs (see selectStubs).
+	stubs []string
+
+	// rewritePkgs lists the packages other than the runtime to
+	// rewrite and stub. If nil, DefaultRewritePackages is used.
+	rewritePkgs []string
+
+	// debugFuncs is a set of functions to enable extra debugging
+	// tracing for. Each function in debugFuncs will generate a
+	// dot file containing the block exploration graph of that
+	// function.
+	debugFuncs map[string]bool
+
+	// diagOut, if non-nil, receives each diagnostic as it is
+	// emitted.
+	diagOut io.Writer
+
+	// syncOnly disables the handlers for runtime functions, so only
+	// sync package locks are modeled. This is used when analyzing
+	// code that wasn't rewritten with rtcheck's runtime stubs.
+	syncOnly bool
+}
+
+// analyze loads the runtime package from ctxt, rewrites it for
+// analysis, and explores it starting from roots. It returns the final
+// analysis state, which includes the lock graph.
+//
+// If opts.packages is non-empty, analyze instead loads those packages
+// without rewriting and explores them starting from their exported
+// functions and methods and any func main. roots is ignored.
+func analyze(ctxt *build.Context, roots []string, opts options) (*state, error) {
+	if len(opts.packages) > 0 {
+		return analyzePackages(ctxt, opts)
+	}
+
+	var conf loader.Config
+
+	// TODO: Check all reasonable arch/OS combos. For now, the
+	// platform is whatever ctxt says, which can be set with
+	// -goos and -goarch.
+	if err := selectStubs(ctxt.GOOS, opts.stubs); err != nil {
+		return nil, err
+	}
+
+	// TODO: This would be so much easier and nicer if I could
+	// just plug (path, AST)s into the loader, or at least slip in
+	// between when the loader has parsed everything and when it
+	// type-checks everything. Currently it's only possible to
+	// provide ASTs for non-importable packages to the
+	// loader.Config.
+
+	if opts.checkInitOrder {
+		roots = append(roots[:len(roots):len(roots)], initRoots...)
+	}
+
+	newSources := make(map[string][]byte)
+	rewritePkgs := opts.rewritePkgs
+	if rewritePkgs == nil {
+		rewritePkgs = DefaultRewritePackages
+	}
+	rewrittenPkgs := make(map[string]bool)
+	for _, pkgName := range append([]string{"runtime"}, rewritePkgs...) {
+		if rewrittenPkgs[pkgName] {
+			continue
+		}
+		if pkgName != "runtime" {
+			// Not every runtime has every internal
+			// package, so skip those that don't exist.
+			if _, err := ctxt.Import(pkgName, "", build.FindOnly); err != nil {
+				continue
+			}
+		}
+		buildPkg, err := ctxt.Import(pkgName, "", 0)
+		if err != nil {
+			return nil, err
+		}
+		if !buildPkg.Goroot {
+			// The rewritten sources must replace the
+			// GOROOT's own runtime, not some other copy
+			// found in GOPATH.
+			return nil, fmt.Errorf("package %s found in %s, not in GOROOT %s", pkgName, buildPkg.Dir, ctxt.GOROOT)
+		}
+		var pkgRoots []string
+		if pkgName == "runtime" {
+			pkgRoots = roots
+		}
+		diags, err := rewriteSources(buildPkg, pkgRoots, newSources)
+		if err != nil {
+			return nil, err
+		}
+		// There's no state to record these in yet, so they're
+		// only printed.
+		if opts.diagOut != nil {
+			for _, d := range diags {
+				fmt.Fprintf(opts.diagOut, "%s: %s: %s\n", d.Pos, d.Sev, d.Msg)
+			}
+		}
+		rewrittenPkgs[pkgName] = true
+	}
+	opts.rewrittenPkgs = rewrittenPkgs
+
+	if opts.dumpRewritten != "" {
+		if err := dumpSources(opts.dumpRewritten, ctxt.GOROOT, newSources); err != nil {
+			return nil, err
+		}
+	}
+
+	conf.Build = buildutil.OverlayContext(ctxt, newSources)
+	conf.Import("runtime")
+
+	lprog, err := conf.Load()
+	if err != nil {
+		return nil, fmt.Errorf("loading runtime: %v", err)
+	}
+	fset := lprog.Fset
+	if opts.cacheDir != "" {
+		opts.cacheKey, err = runtimeCacheKey(ctxt, lprog, newSources)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	prog := ssautil.CreateProgram(lprog, 0)
+	prog.Build()
+	runtimePkg := prog.ImportedPackage("runtime")
+	if err := lookupMembers(runtimePkg, runtimeFns); err != nil {
+		return nil, err
+	}
+	clearMembers(syncFns)
+
+	// TODO: Teach it that you can jump to sigprof at any point?
+	//
+	// TODO: Teach it about implicit write barriers?
+
+	var rootFns []*ssa.Function
+	for _, name := range roots {
+		m, ok := runtimePkg.Members[name].(*ssa.Function)
+		if !ok {
+			return nil, fmt.Errorf("unknown root: %s", name)
+		}
+		rootFns = append(rootFns, m)
+	}
+
+	return explore(prog, fset, []*ssa.Package{runtimePkg}, rootFns, opts)
+}
+
+// analyzePackages loads opts.packages from ctxt and explores them
+// starting from their exported functions and methods and func main.
+// The runtime is not rewritten and runtime functions that implement
+// language operations (maps, channels, append, etc.) are not modeled,
+// except that channel sends are still blocking points.
+func analyzePackages(ctxt *build.Context, opts options) (*state, error) {
+	var conf loader.Config
+	conf.Build = ctxt
+	for _, path := range opts.packages {
+		conf.Import(path)
+	}
+	lprog, err := conf.Load()
+	if err != nil {
+		return nil, fmt.Errorf("loading packages: %v", err)
+	}
+
+	prog := ssautil.CreateProgram(lprog, 0)
+	prog.Build()
+	var pkgs []*ssa.Package
+	for _, path := range opts.packages {
+		pkgs = append(pkgs, prog.ImportedPackage(path))
+	}
+	return explorePackages(prog, lprog.Fset, pkgs, true, opts)
+}
+
+// isNewAlloc returns whether alloc is a heap allocation the compiler
+// implements with newobject, such as new(T) or &T{}. ssa also turns
+// variables captured by closures into heap Allocs, but those are
+// allocated along with the closure, so they're excluded.
+func isNewAlloc(alloc *ssa.Alloc) bool {
+	if !alloc.Heap {
+		return false
+	}
+	for _, ref := range *alloc.Referrers() {
+		if mc, ok := ref.(*ssa.MakeClosure); ok {
+			for _, b := range mc.Bindings {
+				if b == alloc {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+// runtimeCallees returns the runtime functions that instr implicitly
+// calls, or nil if it doesn't call any. This covers the instructions
+// that are just a runtime call. Calls that panic, and channel
+// operations, are modeled directly by walkBlock.
+func runtimeCallees(instr ssa.Instruction) []*ssa.Function {
+	var fn *ssa.Function
+	switch instr := instr.(type) {
+	case *ssa.Lookup:
+		if _, ok := instr.X.Type().Underlying().(*types.Map); !ok {
+			return nil
+		}
+		if instr.CommaOk {
+			fn = fns.mapaccess2
+		} else {
+			fn = fns.mapaccess1
+		}
+
+	case *ssa.Alloc:
+		if !isNewAlloc(instr) {
+			return nil
+		}
+		fn = fns.newobject
+
+	case *ssa.MakeMap:
+		fn = fns.makemap
+
+	case *ssa.MakeSlice:
+		fn = fns.newarray
+
+	case *ssa.MapUpdate:
+		fn = fns.mapassign // Go 1.8
+		if fn == nil {
+			fn = fns.mapassign1
+		}
+
+	case *ssa.Range:
+		// Ranging over a string doesn't call into the
+		// runtime.
+		if _, ok := instr.X.Type().Underlying().(*types.Map); !ok {
+			return nil
+		}
+		fn = fns.mapiterinit
+
+	case *ssa.Next:
+		if instr.IsString {
+			return nil
+		}
+		fn = fns.mapiternext
+
+	case *ssa.MakeInterface:
+		// Pointer-shaped values are stored directly in the
+		// interface. Anything else is boxed, which allocates.
+		if isDirectIface(instr.X.Type()) {
+			return nil
+		}
+		if isEmptyIface(instr.Type()) {
+			fn = fns.convT2E
+		} else {
+			fn = fns.convT2I
+		}
+
+	case *ssa.ChangeInterface:
+		// Converting to a non-empty interface looks up the
+		// itab, which may allocate and acquires itabLock.
+		if isEmptyIface(instr.Type()) {
+			return nil
+		}
+		fn = fns.convI2I
+
+	case *ssa.TypeAssert:
+		// Asserting to a concrete type compares type words
+		// inline, and asserting to interface{} is just a nil
+		// check.
+		if !isInterface(instr.AssertedType) || isEmptyIface(instr.AssertedType) {
+			return nil
+		}
+		switch {
+		case isEmptyIface(instr.X.Type()) && instr.CommaOk:
+			fn = fns.assertE2I2
+		case isEmptyIface(instr.X.Type()):
+			fn = fns.assertE2I
+		case instr.CommaOk:
+			fn = fns.assertI2I2
+		default:
+			fn = fns.assertI2I
+		}
+
+	default:
+		return nil
+	}
+	return []*ssa.Function{fn}
+}
+
+// isInterface returns whether t is an interface type.
+func isInterface(t types.Type) bool {
+	_, ok := t.Underlying().(*types.Interface)
+	return ok
+}
+
+// isEmptyIface returns whether t is an interface type with no methods.
+func isEmptyIface(t types.Type) bool {
+	iface, ok := t.Underlying().(*types.Interface)
+	return ok && iface.NumMethods() == 0
+}
+
+// isDirectIface returns whether values of type t are stored directly
+// in an interface's data word, rather than boxed. This follows the
+// compiler's isdirectiface.
+func isDirectIface(t types.Type) bool {
+	switch t := t.Underlying().(type) {
+	case *types.Pointer, *types.Chan, *types.Map, *types.Signature:
+		return true
+	case *types.Basic:
+		return t.Kind() == types.UnsafePointer
+	case *types.Array:
+		return t.Len() == 1 && isDirectIface(t.Elem())
+	case *types.Struct:
+		return t.NumFields() == 1 && isDirectIface(t.Field(0).Type())
+	}
+	return false
+}
+
+// isSyncFunc returns whether fn is in package sync.
+func isSyncFunc(fn *ssa.Function) bool {
+	obj := fn.Object()
+	return obj != nil && obj.Pkg() != nil && obj.Pkg().Path() == "sync"
+}
+
+// explorePackages explores pkgs in prog starting from their exported
+// functions and methods and func main. If usePTA is set and any of
+// pkgs has a func main, the call graph is computed by pointer
+// analysis.
+func explorePackages(prog *ssa.Program, fset *token.FileSet, pkgs []*ssa.Package, usePTA bool, opts options) (*state, error) {
+	clearMembers(runtimeFns)
+	clearMembers(syncFns)
+	if syncPkg := prog.ImportedPackage("sync"); syncPkg != nil {
+		if err := lookupMethods(prog, syncPkg, syncFns); err != nil {
+			return nil, err
+		}
+	}
+
+	var mains []*ssa.Package
+	var rootFns []*ssa.Function
+	for _, pkg := range pkgs {
+		if usePTA && pkg.Func("main") != nil {
+			mains = append(mains, pkg)
+		}
+		rootFns = append(rootFns, packageRoots(prog, pkg)...)
+	}
+
+	return explore(prog, fset, mains, rootFns, opts)
+}
+
+// packageRoots returns the roots to explore in pkg: its exported
+// functions, the exported methods of its exported types, and func
+// main.
+func packageRoots(prog *ssa.Program, pkg *ssa.Package) []*ssa.Function {
+	var names []string
+	for name := range pkg.Members {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var roots []*ssa.Function
+	for _, name := range names {
+		switch m := pkg.Members[name].(type) {
+		case *ssa.Function:
+			if m.Object() != nil && (ast.IsExported(name) || name == "main") {
+				roots = append(roots, m)
+			}
+		case *ssa.Type:
+			if !ast.IsExported(name) {
+				continue
+			}
+			// The method set of *T includes the methods
+			// of T.
+			mset := prog.MethodSets.MethodSet(types.NewPointer(m.Type()))
+			for i := 0; i < mset.Len(); i++ {
+				sel := mset.At(i)
+				if !sel.Obj().Exported() || sel.Obj().Pkg() != pkg.Pkg {
+					continue
+				}
+				if fn := prog.MethodValue(sel); fn != nil && fn.Synthetic == "" {
+					roots = append(roots, fn)
+				}
+			}
+		}
+	}
+	return roots
+}
+
+// explore builds the call graph of prog and explores it starting from
+// roots. If mains is non-empty, the call graph is computed by pointer
+// analysis of mains, or read from the call graph cache if opts.cacheKey
+// is set. Otherwise, it's computed by class hierarchy analysis, which
+// doesn't require a main function, but is less precise.
+func explore(prog *ssa.Program, fset *token.FileSet, mains []*ssa.Package, roots []*ssa.Function, opts options) (*state, error) {
+	var cg *callgraph.Graph
+	var pta *pointer.Result
+	if len(mains) > 0 && opts.cacheKey != "" {
+		var err error
+		cg, err = readCallGraphCache(opts.cacheDir, opts.cacheKey, prog)
+		if err != nil {
+			return nil, err
+		}
+		if cg != nil && opts.diagOut != nil {
+			fmt.Fprintf(opts.diagOut, "cache: using call graph from %s\n", opts.cacheDir)
+		}
+	}
+	if cg == nil && len(mains) > 0 {
+		// Prepare for pointer analysis.
+		ptrConfig := pointer.Config{
+			Mains:          mains,
+			BuildCallGraph: true,
+			//Log:            os.Stderr,
+		}
+
+		// Run pointer analysis.
+		var err error
+		pta, err = pointer.Analyze(&ptrConfig)
+		if err != nil {
+			return nil, err
+		}
+		cg = pta.CallGraph
+		if opts.cacheKey != "" {
+			if err := writeCallGraphCache(opts.cacheDir, opts.cacheKey, cg); err != nil {
+				return nil, err
+			}
+		}
+	} else if cg == nil {
+		cg = cha.CallGraph(prog)
+	}
+
+	if !opts.keepSynthetic {
+		cg.DeleteSyntheticNodes()
+	}
+	if opts.maxStates <= 0 {
+		opts.maxStates = DefaultMaxStates
+	}
+
+	s := state{
+		opts: opts,
+		prog: prog,
+		fset: fset,
+		cg:   cg,
+		pta:  pta,
+		fns:  make(map[*ssa.Function]*funcInfo),
+
+		lockOrder: NewLockOrder(fset),
+
+		roots:         nil,
+		rootSet:       make(map[*ssa.Function]struct{}),
+		explicitRoots: make(map[*ssa.Function]bool),
+		calledFns:     make(map[*ssa.Function]map[*ssa.Function]bool),
+		neutral:       make(map[*ssa.Function]bool),
+	}
+	s.gscanLock = s.lca.NewLockClass("_Gscan", false)
+	if opts.traceEdge[0] != "" {
+		s.lockOrder.newEdge = s.traceNewEdge
+	}
+	s.lockOrder.added = s.addEffect
+	if opts.usage {
+		s.usage = make(map[int]*lockUsage)
+	}
+	if opts.listLocks {
+		s.lockSites = make(map[int]map[token.Position]struct{})
+	}
+	if opts.nesting > 0 {
+		s.nestings = make(map[string]*lockNesting)
+	}
+	if opts.listLocks || opts.nesting > 0 {
+		s.lockOrder.acquired = func(locked, locking *LockSet, stack *StackFrame) {
+			if s.lockSites != nil {
+				s.recordLockSites(locked, locking, stack)
+			}
+			if s.nestings != nil {
+				s.recordNesting(locked, locking, stack)
+			}
+		}
+	}
+
+	// Create heap objects we care about.
+	s.heap.curG = NewHeapObject("curG")
+	userG := NewHeapObject("userG")
+	userG_m := NewHeapObject("userG.m")
+	s.heap.g0 = NewHeapObject("g0")
+	g0_m := NewHeapObject("g0.m")
+	s.heap.curM = NewHeapObject("curM")
+	curM_g0 := NewHeapObject("curM.g0")
+	curM_curg := NewHeapObject("curM.curg")
+	s.heap.curM_locks = NewHeapObject("curM.locks")
+	curM_printlock := NewHeapObject("curM.printlock")
+	// curM_acquirem is not a real field. It counts outstanding
+	// acquirems for the preemption check.
+	s.heap.curM_acquirem = NewHeapObject("curM.acquirem")
+	s.heap.curM_preemptoff = NewHeapObject("curM.preemptoff")
+	// For the init-order check, inited tracks whether each
+	// initialization function has returned.
+	s.heap.inited = make(map[string]*HeapObject)
+	for fn := range initLocks {
+		s.heap.inited[fn] = NewHeapObject("inited " + fn)
+	}
+	initRootSet := make(map[string]bool)
+	for _, name := range initRoots {
+		initRootSet[name] = true
+	}
+
+	// Add roots to state.
+	for _, m := range roots {
+		s.addRoot(m)
+		s.explicitRoots[m] = true
+	}
+
+	var incState *incrementalState
+	var cleanRoots map[string]bool
+	if opts.incremental != "" {
+		var err error
+		incState, err = readIncrementalState(opts.incremental)
+		if err != nil {
+			return nil, err
+		}
+		funcs := make(map[string]*ssa.Function)
+		for fn := range ssautil.AllFunctions(prog) {
+			funcs[fn.String()] = fn
+		}
+		var dirty []*ssa.Function
+		dirty, cleanRoots = incState.dirtyRoots(s.roots, funcs)
+		if opts.diagOut != nil {
+			fmt.Fprintf(opts.diagOut, "incremental: analyzing %d of %d roots\n", len(dirty), len(dirty)+len(cleanRoots))
+		}
+		// Clean roots are not re-analyzed, even if a dirty
+		// root starts them with a go statement.
+		s.roots, s.rootSet = nil, make(map[*ssa.Function]struct{})
+		for _, root := range dirty {
+			s.addRoot(root)
+		}
+		for name := range cleanRoots {
+			s.rootSet[funcs[name]] = struct{}{}
+		}
+	}
+
+	if opts.timeout > 0 {
+		timer := time.AfterFunc(opts.timeout, func() {
+			atomic.StoreInt32(&s.timedOut, 1)
+		})
+		defer timer.Stop()
+	}
+
+	// Analyze each root. Analysis may add more roots.
+	for i := 0; i < len(s.roots); i++ {
+		if s.expired() {
+			break
+		}
+		root := s.roots[i]
+
+		// Create initial heap state for entering from user space.
+		var vs ValState
+		vs = vs.ExtendHeap(s.heap.curG, DynHeapPtr{userG})
+		vs = vs.ExtendHeap(userG, DynStruct{"m": userG_m})
+		vs = vs.ExtendHeap(userG_m, DynHeapPtr{s.heap.curM})
+		vs = vs.ExtendHeap(s.heap.g0, DynStruct{"m": g0_m})
+		vs = vs.ExtendHeap(g0_m, DynHeapPtr{s.heap.curM})
+		vs = vs.ExtendHeap(s.heap.curM, DynStruct{"curg": curM_curg, "g0": curM_g0, "locks": s.heap.curM_locks, "printlock": curM_printlock, "preemptoff": s.heap.curM_preemptoff})
+		vs = vs.ExtendHeap(curM_g0, DynHeapPtr{s.heap.g0})
+		// Initially we're on the user stack.
+		vs = vs.ExtendHeap(curM_curg, DynHeapPtr{userG})
+		// And hold no locks.
+		vs = vs.ExtendHeap(s.heap.curM_locks, DynConst{constant.MakeInt64(0)})
+		vs = vs.ExtendHeap(curM_printlock, DynConst{constant.MakeInt64(0)})
+		vs = vs.ExtendHeap(s.heap.curM_acquirem, DynConst{constant.MakeInt64(0)})
+		// And preemption isn't disabled.
+		vs = vs.ExtendHeap(s.heap.curM_preemptoff, DynConst{constant.MakeString("")})
+		for _, h := range s.heap.inited {
+			inited := !(opts.checkInitOrder && initRootSet[root.Name()])
+			vs = vs.ExtendHeap(h, DynConst{constant.MakeBool(inited)})
+		}
+
+		// Create the initial PathState.
+		ps := PathState{
+			lockSet: NewLockSet(),
+			vs:      vs,
+		}
+
+		// Walk the function.
+		s.curRoot = root.String()
+		exitStates := s.walkFunction(root, ps)
+
+		s.checkRootExit(root, exitStates)
+		if opts.checkPreempt {
+			s.checkRootPreempt(root, exitStates)
+		}
+		s.curRoot = ""
+	}
+
+	if s.expired() {
+		s.stats.TimedOut = true
+		s.warnl(SevWarning, token.NoPos, "analysis timed out after %v; results only reflect the paths explored until then", opts.timeout)
+	}
+
+	if incState != nil && incState.Graph != nil {
+		if err := s.mergeClean(incState, cleanRoots); err != nil {
+			return nil, fmt.Errorf("%s: %v", opts.incremental, err)
+		}
+	}
+
+	// A partial analysis doesn't cover the dirty roots, so don't
+	// record them as analyzed.
+	if incState != nil && !s.expired() {
+		if err := s.writeIncrementalState(opts.incremental, incState); err != nil {
+			return nil, err
+		}
+	}
+
+	s.writeDiagSummary()
+	return &s, nil
+}
+
+// DefaultRoots returns a list of functions in the runtime package to
+// use as roots.
+//
+// It parses $GOROOT/src/cmd/compile/internal/gc/builtin/runtime.go in
+// goroot to get this list, since these are the functions the compiler
+// can generate calls to.
+func DefaultRoots(goroot string) ([]string, error) {
+	path := filepath.Join(goroot, "src/cmd/compile/internal/gc/builtin/runtime.go")
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, path, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var roots []string
+	for _, decl := range f.Decls {
+		decl, ok := decl.(*ast.FuncDecl)
+		if !ok {
+			continue
+		}
+		switch decl.Name.Name {
+		case "cmpstring", "eqstring",
+			"int64div", "uint64div", "int64mod", "uint64mod",
+			"float64toint64", "float64touint64",
+			"int64tofloat64", "uint64tofloat64",
+			// Go 1.8:
+			"float64touint32", "uint32tofloat64":
+			// These are declared only in assembly.
+			continue
+		}
+		if strings.HasPrefix(decl.Name.Name, "race") {
+			// These functions are declared by runtime.go,
+			// but only exist in race mode.
+			continue
+		}
+		roots = append(roots, decl.Name.Name)
+	}
+	return roots, nil
+}
+
+// rewriteSources rewrites all of the Go files in pkg to eliminate
+// runtime-isms, make them easier for go/ssa to process, to add stubs
+// for internal functions, and to generate init-time calls to analysis
+// root functions. It fills rewritten with path -> new source
+// mappings. It returns warnings about stubs that can't be applied to
+// pkg, or an error if pkg can't be parsed or any of roots isn't found
+// in pkg.
+func rewriteSources(pkg *build.Package, roots []string, rewritten map[string][]byte) ([]Diagnostic, error) {
+	rootSet := make(map[string]struct{})
+	for _, root := range roots {
+		rootSet[root] = struct{}{}
+	}
+
+	var diags []Diagnostic
+	for _, fname := range pkg.GoFiles {
+		path := filepath.Join(pkg.Dir, fname)
+
+		// Parse source.
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, path, nil, parser.ParseComments)
+		if err != nil {
+			return nil, err
+		}
+
+		isNosplit := map[ast.Decl]bool{}
+		findNosplit(f, isNosplit)
+		diags = append(diags, rewriteStubs(fset, f, isNosplit)...)
+		if pkg.Name == "runtime" {
+			addRootCalls(f, rootSet)
+			rewriteRuntime(f)
+		}
+		insertMorestack(f, isNosplit, morestackName(pkg))
+
+		// Back to source.
+		var buf bytes.Buffer
+		if err := (&printer.Config{Mode: printer.SourcePos, Tabwidth: 8}).Fprint(&buf, fset, f); err != nil {
+			return nil, fmt.Errorf("outputting replacement %s: %s", path, err)
+		}
+
+		if pkg.Name == "runtime" && fname == "stubs.go" {
+			// Declare functions used during rewriting.
+			buf.Write([]byte(`
+// systemstack is transformed into a call to presystemstack, then
+// the operation, then postsystemstack. These functions are handled
+// specially.
+func rtcheck۰presystemstack() *g { return nil }
+func rtcheck۰postsystemstack(*g) { }
+
+// gopark and goparkunlock are transformed into calls to these
+// markers, which check for locks held while parked.
+func rtcheck۰gopark(unlocked bool) { }
+func rtcheck۰goparkunlock(l *mutex) { }
+
+// mcall of a function in goschedFuncs is preceded by a call to this
+// marker, which checks for locks held while yielding.
+func rtcheck۰gosched() { }
+`))
+		}
+		if pkg.Name != "runtime" && fname == pkg.GoFiles[0] {
+			// Declare the morestack marker (see
+			// morestackName).
+			buf.Write([]byte(`
+func rtcheck۰morestack() { }
+`))
+		}
+
+		rewritten[path] = buf.Bytes()
+	}
+
+	// Check that we found all of the roots.
+	if len(rootSet) > 0 {
+		var unknown []string
+		for root := range rootSet {
+			unknown = append(unknown, root)
+		}
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("unknown roots: %s", strings.Join(unknown, " "))
+	}
+	return diags, nil
+}
+
+// dumpSources writes the rewritten sources to dir, at the same paths
+// relative to dir that they have relative to goroot. Files outside
+// goroot are written at their full path under dir.
+func dumpSources(dir, goroot string, sources map[string][]byte) error {
+	for path, src := range sources {
+		rel, err := filepath.Rel(goroot, path)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			rel = path
+		}
+		out := filepath.Join(dir, rel)
+		if err := os.MkdirAll(filepath.Dir(out), 0777); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(out, src, 0666); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newStubs maps from package name to function name to the stub
+// declaration that replaces that function's body. It is set by
+// selectStubs.
+var newStubs map[string]map[string]*ast.FuncDecl
+
+// DefaultRewritePackages lists the packages other than the runtime
+// whose sources are rewritten and stubbed by default. Packages that
+// don't exist in the analyzed GOROOT are skipped. Of these, only
+// runtime/internal/atomic and runtime/internal/sys exist in the
+// supported runtimes (see CheckGoVersion); the rest, like the stubs
+// for newer runtimes, only take effect with rtcheck -force.
+var DefaultRewritePackages = []string{
+	"runtime/internal/atomic",
+	"runtime/internal/sys",
+	"runtime/internal/math",
+	"internal/cpu",
+}
+
+// TODO: Perhaps I should do most of these as "special" functions, and
+// do the few that affect pointers (like noescape) as call rewrites.
+
+// Stubs provide implementations for assembly functions that are not
+// declared in the Go source code. All of these are automatically
+// marked go:nosplit.
+//
+// runtimeStubs are used on every platform. runtimeOSStubs are
+// additionally used only on the given GOOS.
+var runtimeStubs = `
+package runtime
+
+// stubs.go
+// getg is handled specially.
+// mcall and systemstack are eliminated during rewriting.
+func memclr() { }
+func memmove() { }
+func fastrand1() uint32 { return 0 }
+func memequal() bool { return false }
+func noescape(p unsafe.Pointer) unsafe.Pointer { return p }
+func cgocallback() { }
+func gogo() { for { } }
+func gosave() { }
+func mincore() int32 { return 0 }
+func jmpdefer() { for { } }
+func exit1() { for { } }
+func setg() { }
+func breakpoint() { }
+func reflectcall() { }
+func procyield() { }
+func cgocallback_gofunc() { }
+func publicationBarrier() { }
+func setcallerpc() { }
+func getcallerpc() uintptr { return 0 }
+func getcallersp() uintptr { return 0 }
+func asmcgocall() int32 { return 0 }
+// morestack is handled specially.
+func time_now() (int64, int32) { return 0, 0 }
+
+// stubs2.go
+func read() { return 0 }
+func closefd() { return 0 }
+func exit() { for {} }
+func nanotime() { return 0 }
+func usleep() {}
+func munmap() {}
+func write() int32 { return 0 }
+func open() int32 { return 0 }
+func madvise() {}
+
+// cputicks.go
+func cputicks() { return 0 }
+
+// cgo_mmap.go
+func sysMmap() unsafe.Pointer { return nil }
+func callCgoMmap() uintptr { return 0 }
+
+// alg.go
+func aeshash(p unsafe.Pointer, h, s uintptr) uintptr { return 0 }
+func aeshash32(p unsafe.Pointer, h uintptr) uintptr { return 0 }
+func aeshash64(p unsafe.Pointer, h uintptr) uintptr { return 0 }
+func aeshashstr(p unsafe.Pointer, h uintptr) uintptr { return 0 }
+`
+
+var runtimeOSStubs = map[string]string{
+	"linux": `
+package runtime
+
+// os_linux.go
+func futex() int32 { return 0 }
+func clone() int32 { return 0 }
+func gettid() uint32 { return 0 }
+func sigreturn() { for { } }
+func rt_sigaction() int32 { return 0 }
+func sigaltstack() { }
+func setitimer() { }
+func rtsigprocmask() { }
+func getrlimit() int32 { return 0 }
+func raise() { for { } }
+func raiseproc() { for { } }
+func sched_getaffinity() int32 { return 0 }
+func osyield() { }
+
+// netpoll_epoll.go
+func epollcreate(size int32) int32 { return 0 }
+func epollcreate1(flags int32) int32 { return 0 }
+func epollctl(epfd, op, fd int32, ev *epollevent) int32 { return 0 }
+func epollwait(epfd int32, ev *epollevent, nev, timeout int32) int32 { return 0 }
+func closeonexec(fd int32) {}
+`,
+
+	"darwin": `
+package runtime
+
+// os_darwin.go
+func bsdthread_create() int32 { return 0 }
+func bsdthread_register() int32 { return 0 }
+func mach_msg_trap() int32 { return 0 }
+func mach_reply_port() uint32 { return 0 }
+func mach_task_self() uint32 { return 0 }
+func mach_thread_self() uint32 { return 0 }
+func mach_semaphore_wait() int32 { return 0 }
+func mach_semaphore_timedwait() int32 { return 0 }
+func mach_semaphore_signal() int32 { return 0 }
+func mach_semaphore_signal_all() int32 { return 0 }
+func sysctl() int32 { return 0 }
+func sigprocmask() { }
+func sigaction() { }
+func sigaltstack() { }
+func sigtramp() { }
+func setitimer() { }
+func raise() { for { } }
+func raiseproc() { for { } }
+func osyield() { }
+
+// netpoll_kqueue.go
+func kqueue() int32 { return 0 }
+func kevent() int32 { return 0 }
+func closeonexec(fd int32) {}
+`,
+
+	"windows": `
+package runtime
+
+// os_windows.go
+func asmstdcall(fn unsafe.Pointer) { }
+func tstart_stdcall() uint32 { return 0 }
+func ctrlhandler() uint32 { return 0 }
+func profileloop() { for { } }
+func getlasterror() uint32 { return 0 }
+func setlasterror(err uint32) { }
+func usleep1(usec uint32) { }
+func onosstack(fn unsafe.Pointer, arg uint32) { }
+func osyield() { }
+`,
+}
+
+var atomicStubs = `
+package atomic
+
+// stubs.go
+func Cas(ptr *uint32, old, new uint32) bool {
+	if *ptr == old { *ptr = new; return true }
+	return false
+}
+func Casp1(ptr *unsafe.Pointer, old, new unsafe.Pointer) bool {
+	if *ptr == old { *ptr = new; return true }
+	return false
+}
+func Casuintptr(ptr *uintptr, old, new uintptr) bool {
+	if *ptr == old { *ptr = new; return true }
+	return false
+}
+func Storeuintptr(ptr *uintptr, new uintptr) { *ptr = new }
+func Loaduintptr(ptr *uintptr) uintptr { return *ptr }
+func Loaduint(ptr *uint) uint { return *ptr }
+func Loadint64(ptr *int64) int64 { return *ptr }
+func Xaddint64(ptr *int64, delta int64) int64 {
+	*ptr += delta
+	return *ptr
+}
+
+// atomic_*.go
+func Load(ptr *uint32) uint32 { return *ptr }
+func Loadp(ptr unsafe.Pointer) unsafe.Pointer { return *(*unsafe.Pointer)(ptr) }
+func Load64(ptr *uint64) uint64 { return *ptr }
+func Xadd(ptr *uint32, delta int32) uint32 {
+	*ptr += uint32(delta)
+	return *ptr
+}
+func Xadd64(ptr *uint64, delta int64) uint64 {
+	*ptr += uint64(delta)
+	return *ptr
+}
+func Xadduintptr(ptr *uintptr, delta uintptr) uintptr {
+	*ptr += delta
+	return *ptr
+}
+func Xchg(ptr *uint32, new uint32) uint32 {
+	old := *ptr
+	*ptr = new
+	return old
+}
+func Xchg64(ptr *uint64, new uint64) uint64 {
+	old := *ptr
+	*ptr = new
+	return old
+}
+func Xchguintptr(ptr *uintptr, new uintptr) uintptr {
+	old := *ptr
+	*ptr = new
+	return old
+}
+func And8(ptr *uint8, val uint8) { *ptr &= val }
+func Or8(ptr *uint8, val uint8) { *ptr |= val }
+func Cas64(ptr *uint64, old, new uint64) bool {
+	if *ptr == old { *ptr = new; return true }
+	return false
+}
+func Store(ptr *uint32, val uint32) { *ptr = val }
+func Store64(ptr *uint64, val uint64) { *ptr = val }
+func StorepNoWB(ptr unsafe.Pointer, val unsafe.Pointer) {
+	*(*unsafe.Pointer)(ptr) = val
+}
+
+// Added in later releases. Stubs for functions the analyzed runtime
+// doesn't declare are never used.
+func Load8(ptr *uint8) uint8 { return *ptr }
+func Loadint32(ptr *int32) int32 { return *ptr }
+func Loadacq(ptr *uint32) uint32 { return *ptr }
+func Loadacq64(ptr *uint64) uint64 { return *ptr }
+func LoadAcquintptr(ptr *uintptr) uintptr { return *ptr }
+func Store8(ptr *uint8, val uint8) { *ptr = val }
+func Storeint32(ptr *int32, new int32) { *ptr = new }
+func Storeint64(ptr *int64, new int64) { *ptr = new }
+func StoreRel(ptr *uint32, val uint32) { *ptr = val }
+func StoreRel64(ptr *uint64, val uint64) { *ptr = val }
+func StoreReluintptr(ptr *uintptr, val uintptr) { *ptr = val }
+func Storerel(ptr *uint32, val uint32) { *ptr = val }
+func Storerel64(ptr *uint64, val uint64) { *ptr = val }
+func Xaddint32(ptr *int32, delta int32) int32 {
+	*ptr += delta
+	return *ptr
+}
+func Xchgint32(ptr *int32, new int32) int32 {
+	old := *ptr
+	*ptr = new
+	return old
+}
+func Xchgint64(ptr *int64, new int64) int64 {
+	old := *ptr
+	*ptr = new
+	return old
+}
+func Casint32(ptr *int32, old, new int32) bool {
+	if *ptr == old { *ptr = new; return true }
+	return false
+}
+func Casint64(ptr *int64, old, new int64) bool {
+	if *ptr == old { *ptr = new; return true }
+	return false
+}
+func CasRel(ptr *uint32, old, new uint32) bool {
+	if *ptr == old { *ptr = new; return true }
+	return false
+}
+func And(ptr *uint32, val uint32) { *ptr &= val }
+func Or(ptr *uint32, val uint32) { *ptr |= val }
+func And32(ptr *uint32, val uint32) uint32 {
+	old := *ptr
+	*ptr &= val
+	return old
+}
+func Or32(ptr *uint32, val uint32) uint32 {
+	old := *ptr
+	*ptr |= val
+	return old
+}
+func And64(ptr *uint64, val uint64) uint64 {
+	old := *ptr
+	*ptr &= val
+	return old
+}
+func Or64(ptr *uint64, val uint64) uint64 {
+	old := *ptr
+	*ptr |= val
+	return old
+}
+func Anduintptr(ptr *uintptr, val uintptr) uintptr {
+	old := *ptr
+	*ptr &= val
+	return old
+}
+func Oruintptr(ptr *uintptr, val uintptr) uintptr {
+	old := *ptr
+	*ptr |= val
+	return old
+}
+`
+
+// sysStubs and cpuStubs replace the assembly functions of
+// runtime/internal/sys and internal/cpu. None of them affect locks.
+var sysStubs = `
+package sys
+
+// intrinsics_stubs.go
+func Ctz64(x uint64) int { return 0 }
+func Ctz32(x uint32) int { return 0 }
+func Ctz8(x uint8) int { return 0 }
+func Bswap64(x uint64) uint64 { return x }
+func Bswap32(x uint32) uint32 { return x }
+`
+
+var cpuStubs = `
+package cpu
+
+// cpu_x86.go
+func cpuid(eaxArg, ecxArg uint32) (eax, ebx, ecx, edx uint32) { return 0, 0, 0, 0 }
+func xgetbv() (eax, edx uint32) { return 0, 0 }
+func getGOAMD64level() int32 { return 1 }
+`
+
+// selectStubs sets newStubs to the stubs for the given GOOS. If there
+// are no OS-specific stubs for goos, assembly functions specific to
+// that OS are left as external functions. extra are additional stub
+// sources in the same form as runtimeStubs. They are applied last, so
+// they override the built-in stubs.
+func selectStubs(goos string, extra []string) error {
+	newStubs = make(map[string]map[string]*ast.FuncDecl)
+	all := append([]string{runtimeStubs, runtimeOSStubs[goos], atomicStubs, sysStubs, cpuStubs}, extra...)
+	for _, stubs := range all {
+		if stubs == "" {
+			continue
+		}
+		f, err := parser.ParseFile(token.NewFileSet(), "<newStubs>", stubs, 0)
+		if err != nil {
+			return fmt.Errorf("parsing replacement stubs: %v", err)
+		}
+
+		// Strip token.Pos information from stubs. It confuses
+		// the printer, which winds up producing invalid Go code.
+		ast.Inspect(f, func(n ast.Node) bool {
+			if n == nil {
+				return true
+			}
+			rn := reflect.ValueOf(n).Elem()
+			for i := 0; i < rn.NumField(); i++ {
+				f := rn.Field(i)
+				if _, ok := f.Interface().(token.Pos); ok {
+					f.Set(reflect.Zero(f.Type()))
+				}
+			}
+			return true
+		})
+
+		newMap := newStubs[f.Name.Name]
+		if newMap == nil {
+			newMap = make(map[string]*ast.FuncDecl)
+			newStubs[f.Name.Name] = newMap
+		}
+		for _, decl := range f.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok {
+				return fmt.Errorf("stubs for package %s may only declare functions", f.Name.Name)
+			}
+			newMap[fn.Name.Name] = fn
+		}
+	}
+	return nil
+}
+
+// rewriteStubs replaces the bodies of f's body-less functions with
+// their stubs. It returns a warning for each stub that can't be used.
+func rewriteStubs(fset *token.FileSet, f *ast.File, isNosplit map[ast.Decl]bool) []Diagnostic {
+	var diags []Diagnostic
+	// Replace declaration bodies.
+	for _, decl := range f.Decls {
+		switch decl := decl.(type) {
+		case *ast.FuncDecl:
+			if decl.Body != nil {
+				continue
+			}
+			newDecl, ok := newStubs[f.Name.Name][decl.Name.Name]
+			if !ok {
+				continue
+			}
+			if name := missingParam(newDecl, decl); name != "" {
+				// The function's signature changed in
+				// this runtime. Using the stub body
+				// would fail to type check, so leave
+				// it external.
+				msg := fmt.Sprintf("stub for %s.%s uses parameter %s, which is not declared by the analyzed runtime; treating it as external", f.Name.Name, decl.Name.Name, name)
+				diags = append(diags, Diagnostic{SevWarning, fset.Position(decl.Pos()), msg})
+				continue
+			}
+			decl.Body = newDecl.Body
+			isNosplit[decl] = true
+		}
+	}
+	return diags
+}
+
+// missingParam returns the name of a parameter or result of stub that
+// stub's body uses but decl doesn't declare, or "" if there is none.
+func missingParam(stub, decl *ast.FuncDecl) string {
+	params := func(typ *ast.FuncType) map[string]bool {
+		m := make(map[string]bool)
+		for _, fl := range []*ast.FieldList{typ.Params, typ.Results} {
+			if fl == nil {
+				continue
+			}
+			for _, field := range fl.List {
+				for _, name := range field.Names {
+					m[name.Name] = true
+				}
+			}
+		}
+		return m
+	}
+	stubParams, have := params(stub.Type), params(decl.Type)
+	missing := ""
+	ast.Inspect(stub.Body, func(n ast.Node) bool {
+		if id, ok := n.(*ast.Ident); ok && missing == "" {
+			if stubParams[id.Name] && !have[id.Name] {
+				missing = id.Name
+			}
+		}
+		return missing == ""
+	})
+	return missing
+}
+
+func addRootCalls(f *ast.File, rootSet map[string]struct{}) {
+	var body []ast.Stmt
+	for _, decl := range f.Decls {
+		decl, ok := decl.(*ast.FuncDecl)
+		if !ok || decl.Recv != nil {
+			continue
+		}
+		if _, ok := rootSet[decl.Name.Name]; !ok {
+			continue
+		}
+		delete(rootSet, decl.Name.Name)
+
+		// Construct a valid call.
+		args := []ast.Expr{}
+		for _, aspec := range decl.Type.Params.List {
+			n := len(aspec.Names)
+			if aspec.Names == nil {
+				n = 1
+			}
+			for i := 0; i < n; i++ {
+				switch atype := aspec.Type.(type) {
+				case *ast.ChanType, *ast.FuncType,
+					*ast.InterfaceType, *ast.MapType,
+					*ast.StarExpr:
+					args = append(args, &ast.Ident{Name: "nil"})
+				case *ast.StructType:
+					log.Fatal("not implemented: struct args")
+				case *ast.ArrayType, *ast.Ident, *ast.SelectorExpr:
+					name := fmt.Sprintf("x%d", len(body))
+					adecl := &ast.DeclStmt{
+						&ast.GenDecl{
+							Tok: token.VAR,
+							Specs: []ast.Spec{
+								&ast.ValueSpec{
+									Names: []*ast.Ident{{Name: name}},
+									Type:  atype,
+								},
+							},
+						},
+					}
+					body = append(body, adecl)
+					args = append(args, &ast.Ident{Name: name})
+				default:
+					log.Fatalf("unexpected function argument type: %s", aspec)
+				}
+			}
+		}
+		body = append(body, &ast.ExprStmt{&ast.CallExpr{
+			Fun:  &ast.Ident{Name: decl.Name.Name},
+			Args: args,
+		}})
+	}
+	if len(body) > 0 {
+		f.Decls = append(f.Decls,
+			&ast.FuncDecl{
+				Name: &ast.Ident{Name: "init"},
+				Type: &ast.FuncType{Params: &ast.FieldList{}},
+				Body: &ast.BlockStmt{List: body},
+			})
+	}
+}
+
+// goschedFuncs is the set of runtime functions that yield the
+// processor when called by mcall. goschedImpl does the work of each.
+var goschedFuncs = map[string]bool{
+	"gosched_m":        true,
+	"goschedguarded_m": true,
+	"gopreempt_m":      true,
+}
+
+func rewriteRuntime(f *ast.File) {
+	// TODO: Do identifier resolution so I know I'm actually
+	// getting the runtime globals.
+	id := func(name string) *ast.Ident {
+		return &ast.Ident{Name: name}
+	}
+	Rewrite(func(node ast.Node) ast.Node {
+		switch node := node.(type) {
+		case *ast.CallExpr:
+			id, ok := node.Fun.(*ast.Ident)
+			if !ok {
+				break
+			}
+			switch id.Name {
+			case "systemstack":
+				log.Fatal("systemstack not at statement level")
+			case "mcall":
+				// mcall(f) -> f(nil)
+				return &ast.CallExpr{Fun: node.Args[0], Args: []ast.Expr{&ast.Ident{Name: "nil"}}}
+			case "gopark":
+				// gopark(nil, ...) -> rtcheck۰gopark(true)
+				// gopark(fn, arg, ...) -> rtcheck۰gopark(fn(nil, arg))
+				//
+				// The unlock function runs after the
+				// goroutine has parked, so the marker sees
+				// the locks that remain held while parked.
+				var unlocked ast.Expr = &ast.Ident{Name: "true"}
+				if cb, ok := node.Args[0].(*ast.Ident); !ok || cb.Name != "nil" {
+					unlocked = &ast.CallExpr{
+						Fun: node.Args[0],
+						Args: []ast.Expr{
+							&ast.Ident{Name: "nil"},
+							node.Args[1],
+						},
+					}
+				}
+				return &ast.CallExpr{
+					Fun:  &ast.Ident{Name: "rtcheck۰gopark"},
+					Args: []ast.Expr{unlocked},
+				}
+			case "goparkunlock":
+				// goparkunlock(x, ...) -> rtcheck۰goparkunlock(x)
+				return &ast.CallExpr{
+					Fun:  &ast.Ident{Name: "rtcheck۰goparkunlock"},
+					Args: []ast.Expr{node.Args[0]},
+				}
+			}
+
+		case *ast.ExprStmt:
+			// Rewrite:
+			//   systemstack(f) -> {g := presystemstack(); f(); postsystemstack(g) }
+			//   systemstack(func() { x }) -> {g := presystemstack(); x; postsystemstack(g) }
+			expr, ok := node.X.(*ast.CallExpr)
+			if !ok {
+				break
+			}
+			fnid, ok := expr.Fun.(*ast.Ident)
+			if ok && fnid.Name == "mcall" {
+				// Rewrite:
+				//   mcall(gosched_m) -> {rtcheck۰gosched(); gosched_m(nil)}
+				//
+				// Other mcalls are rewritten as calls
+				// below.
+				arg, ok := expr.Args[0].(*ast.Ident)
+				if !ok || !goschedFuncs[arg.Name] {
+					break
+				}
+				mark := &ast.ExprStmt{&ast.CallExpr{Fun: id("rtcheck۰gosched")}}
+				call := &ast.ExprStmt{&ast.CallExpr{Fun: arg, Args: []ast.Expr{id("nil")}}}
+				return &ast.BlockStmt{List: []ast.Stmt{mark, call}}
+			}
+			if !ok || fnid.Name != "systemstack" {
+				break
+			}
+			var x ast.Stmt
+			if arg, ok := expr.Args[0].(*ast.FuncLit); ok {
+				x = arg.Body
+			} else {
+				x = &ast.ExprStmt{&ast.CallExpr{Fun: expr.Args[0]}}
+			}
+			pre := &ast.AssignStmt{
+				Lhs: []ast.Expr{id("rtcheck۰g")},
+				Tok: token.DEFINE,
+				Rhs: []ast.Expr{&ast.CallExpr{Fun: id("rtcheck۰presystemstack")}},
+			}
+			post := &ast.ExprStmt{&ast.CallExpr{Fun: id("rtcheck۰postsystemstack"), Args: []ast.Expr{id("rtcheck۰g")}}}
+			return &ast.BlockStmt{List: []ast.Stmt{pre, x, post}}
+
+		case *ast.FuncDecl:
+			// TODO: Some functions are just too hairy for
+			// the analysis right now.
+			switch node.Name.Name {
+			case "throw":
+				node.Body = &ast.BlockStmt{
+					List: []ast.Stmt{
+						&ast.ForStmt{
+							Body: &ast.BlockStmt{},
+						},
+					},
+				}
+
+			case "traceEvent", "cgoContextPCs", "callCgoSymbolizer":
+				// TODO: If we handle traceEvent, we
+				// still can't handle inter-procedural
+				// correlated control flow between
+				// traceAcquireBuffer and
+				// traceReleaseBuffer, so hard-code
+				// that traceReleaseBuffer releases
+				// runtime.trace.bufLock.
+				//
+				// TODO: A bunch of false positives
+				// come from callCgoSymbolizer and
+				// cgoContextPCs, which dynamically
+				// call either cgocall or asmcgocall
+				// depending on whether we're on the
+				// system stack. We don't flow enough
+				// information through to tell, so we
+				// assume it can always call cgocall,
+				// which leads to all sorts of bad
+				// lock edges.
+				node.Body = &ast.BlockStmt{}
+			}
+		}
+		return node
+	}, f)
+}
+
+// findNosplit records the top-level declarations of f that have a
+// go:nosplit directive in isNosplit.
+func findNosplit(f *ast.File, isNosplit map[ast.Decl]bool) {
+	// We have to use f.Comments because go/ast drops comments
+	// separated by newlines from the AST, leaving them only in
+	// File.Comments. But to agree with the compiler's
+	// interpretation of these comments, we need all of the
+	// comments.
+	cgs := f.Comments
+	for _, decl := range f.Decls {
+		// Process comments before decl.
+		for len(cgs) > 0 && cgs[0].Pos() < decl.Pos() {
+			for _, c := range cgs[0].List {
+				if c.Text == "//go:nosplit" {
+					isNosplit[decl] = true
+				}
+			}
+			cgs = cgs[1:]
+		}
+		// Ignore comments in decl.
+		for len(cgs) > 0 && cgs[0].Pos() < decl.End() {
+			cgs = cgs[1:]
+		}
+	}
+}
+
+// morestackName returns the name of the function that the morestack
+// prologue calls in pkg. Other packages can't call runtime.morestack,
+// so they call a marker declared in the package, which is handled
+// like runtime.morestack.
+func morestackName(pkg *build.Package) string {
+	if pkg.Name == "runtime" {
+		return "morestack"
+	}
+	return "rtcheck۰morestack"
+}
+
+// insertMorestack inserts a call to the function morestack at the
+// beginning of every function in f that may grow the stack. This
+// skips nosplit functions and functions with empty bodies.
+func insertMorestack(f *ast.File, isNosplit map[ast.Decl]bool, morestack string) {
+	for _, decl := range f.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Body == nil || len(fn.Body.List) == 0 || isNosplit[fn] {
+			continue
+		}
+		call := &ast.ExprStmt{&ast.CallExpr{Fun: &ast.Ident{Name: morestack}, Args: []ast.Expr{}, Lparen: fn.Body.Pos()}}
+		fn.Body.List = append([]ast.Stmt{call}, fn.Body.List...)
+	}
+}
+
+var fns struct {
+	// Locking functions.
+	lock, unlock *ssa.Function
+
+	// Allocation functions.
+	newobject, newarray, makemap, makechan *ssa.Function
+
+	// Slice functions.
+	growslice, slicecopy, slicestringcopy, typedslicecopy *ssa.Function
+
+	// Map functions.
+	mapaccess1, mapaccess2, mapassign1, mapassign, mapdelete *ssa.Function
+	mapiterinit, mapiternext                                 *ssa.Function
+
+	// Interface functions.
+	convT2E, convT2I, convI2I                    *ssa.Function
+	assertE2I, assertE2I2, assertI2I, assertI2I2 *ssa.Function
+
+	// Channel functions.
+	chansend1, closechan *ssa.Function
+
+	// Note functions.
+	notesleep, notetsleep, notewakeup *ssa.Function
+
+	// Semaphore functions.
+	semacquire, semrelease *ssa.Function
+
+	// Misc.
+	gopanic *ssa.Function
+
+	// sync package locks. These are only set when analyzing
+	// packages with -packages.
+	mutexLock, mutexUnlock                                   *ssa.Function
+	rwmutexLock, rwmutexUnlock, rwmutexRLock, rwmutexRUnlock *ssa.Function
+}
+
+var runtimeFns = map[string]interface{}{
+	"lock": &fns.lock, "unlock": &fns.unlock,
+	"newobject": &fns.newobject, "newarray": &fns.newarray,
+	"makemap": &fns.makemap, "makechan": &fns.makechan,
+	"growslice": &fns.growslice, "slicecopy": &fns.slicecopy,
+	"slicestringcopy": &fns.slicestringcopy,
+	"typedslicecopy":  &fns.typedslicecopy,
+	"mapaccess1":      &fns.mapaccess1, "mapaccess2": &fns.mapaccess2,
+	//"mapassign1": &fns.mapassign1, // Pre-1.8
+	"mapassign":   &fns.mapassign, // Go 1.8
+	"mapdelete":   &fns.mapdelete,
+	"mapiterinit": &fns.mapiterinit, "mapiternext": &fns.mapiternext,
+	"convT2E": &fns.convT2E, "convT2I": &fns.convT2I, "convI2I": &fns.convI2I,
+	"assertE2I": &fns.assertE2I, "assertE2I2": &fns.assertE2I2,
+	"assertI2I": &fns.assertI2I, "assertI2I2": &fns.assertI2I2,
+	"chansend1": &fns.chansend1, "closechan": &fns.closechan,
+	"notesleep": &fns.notesleep, "notetsleep": &fns.notetsleep,
+	"notewakeup": &fns.notewakeup,
+	"semacquire": &fns.semacquire, "semrelease": &fns.semrelease,
+	"gopanic": &fns.gopanic,
+}
+
+// syncFns maps from "Type.Method" to the field of fns for each
+// method of a sync type that rtcheck models. The methods are those of
+// the pointer type.
+var syncFns = map[string]interface{}{
+	"Mutex.Lock": &fns.mutexLock, "Mutex.Unlock": &fns.mutexUnlock,
+	"RWMutex.Lock": &fns.rwmutexLock, "RWMutex.Unlock": &fns.rwmutexUnlock,
+	"RWMutex.RLock": &fns.rwmutexRLock, "RWMutex.RUnlock": &fns.rwmutexRUnlock,
+}
+
+// isLockOp returns whether fn is a function that acquires or releases
+// a lock.
+func isLockOp(fn *ssa.Function) bool {
+	if fn == nil {
+		return false
+	}
+	switch fn {
+	case fns.lock, fns.unlock,
+		fns.semacquire, fns.semrelease,
+		fns.mutexLock, fns.mutexUnlock,
+		fns.rwmutexLock, fns.rwmutexUnlock, fns.rwmutexRLock, fns.rwmutexRUnlock:
+		return true
+	}
+	return runtimeRWMutexOps[fn.String()]
+}
+
+// runtimeRWMutexOps is the set of runtime.rwmutex methods. These
+// only exist in Go 1.9 and later, so unlike runtimeFns, they're
+// matched by name.
+var runtimeRWMutexOps = map[string]bool{
+	"(*runtime.rwmutex).lock":    true,
+	"(*runtime.rwmutex).unlock":  true,
+	"(*runtime.rwmutex).rlock":   true,
+	"(*runtime.rwmutex).runlock": true,
+}
+
+// clearMembers sets each pointer in out to its zero value.
+func clearMembers(out map[string]interface{}) {
+	for _, ptr := range out {
+		v := reflect.ValueOf(ptr).Elem()
+		v.Set(reflect.Zero(v.Type()))
+	}
+}
+
+// memberHints gives, for members rtcheck depends on that are known to
+// have changed between Go releases, a hint about what happened to
+// them.
+var memberHints = map[string]string{
+	"mapassign":       "called mapassign1 before Go 1.8",
+	"convT2E":         "replaced by convT in newer releases",
+	"convT2I":         "replaced by convT in newer releases",
+	"slicestringcopy": "string copies use slicecopy in newer releases",
+}
+
+// lookupMembers sets each pointer in out to the member of pkg named by
+// its key. If any members are missing, it returns an error listing all
+// of them.
+func lookupMembers(pkg *ssa.Package, out map[string]interface{}) error {
+	var missing []string
+	for name, ptr := range out {
+		member, ok := pkg.Members[name]
+		if !ok {
+			missing = append(missing, name)
+			continue
+		}
+		reflect.ValueOf(ptr).Elem().Set(reflect.ValueOf(member))
+	}
+	return missingError(pkg, "members", missing)
+}
+
+// missingError returns an error describing the missing members of pkg,
+// or nil if there are none.
+func missingError(pkg *ssa.Package, what string, missing []string) error {
+	if missing == nil {
+		return nil
+	}
+	sort.Strings(missing)
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s is missing %s rtcheck depends on (is this a supported Go version?):", pkg.Pkg.Path(), what)
+	for _, name := range missing {
+		fmt.Fprintf(&buf, "\n\t%s", name)
+		if hint := memberHints[name]; hint != "" {
+			fmt.Fprintf(&buf, " (%s)", hint)
+		}
+	}
+	return errors.New(buf.String())
+}
+
+// lookupMethods is like lookupMembers, but looks up methods of the
+// pointer types of pkg. Each key in out has the form "Type.Method".
+func lookupMethods(prog *ssa.Program, pkg *ssa.Package, out map[string]interface{}) error {
+	var missing []string
+	for name, ptr := range out {
+		i := strings.Index(name, ".")
+		typ := pkg.Type(name[:i])
+		if typ == nil {
+			missing = append(missing, name)
+			continue
+		}
+		sel := prog.MethodSets.MethodSet(types.NewPointer(typ.Type())).Lookup(pkg.Pkg, name[i+1:])
+		if sel == nil {
+			missing = append(missing, name)
+			continue
+		}
+		reflect.ValueOf(ptr).Elem().Set(reflect.ValueOf(prog.MethodValue(sel)))
+	}
+	return missingError(pkg, "methods", missing)
+}
+
+// StringSpace interns strings into small integers.
+type StringSpace struct {
+	m map[string]int
+	s []string
+}
+
+// NewStringSpace returns a new, empty StringSpace.
+func NewStringSpace() *StringSpace {
+	return &StringSpace{m: make(map[string]int)}
+}
+
+// Intern turns str into a small integer where Intern(x) == Intern(y)
+// iff x == y.
+func (sp *StringSpace) Intern(str string) int {
+	if id, ok := sp.m[str]; ok {
+		return id
+	}
+	id := len(sp.s)
+	sp.s = append(sp.s, str)
+	sp.m[str] = id
+	return id
+}
+
+// TryIntern interns str if it has been interned before. Otherwise, it
+// does not intern the string and returns 0, false.
+func (sp *StringSpace) TryIntern(str string) (int, bool) {
+	id, ok := sp.m[str]
+	return id, ok
+}
+
+// LockSet represents a set of locks and where they were acquired.
+// Lock sets are almost always small, so the locks are kept in a slice
+// sorted by lock class ID. LockSets are immutable once constructed.
+type LockSet struct {
+	lca   *LockClassAnalysis
+	locks []heldLock
+}
+
+// A heldLock is a lock class in a LockSet and the stack where it was
+// acquired.
+type heldLock struct {
+	id    int
+	stack *StackFrame
+}
+
+type LockSetKey string
+
+func NewLockSet() *LockSet {
+	return &LockSet{}
+}
+
+// clone returns a copy of set with room for extra more locks.
+func (set *LockSet) clone(extra int) *LockSet {
+	out := &LockSet{lca: set.lca, locks: make([]heldLock, len(set.locks), len(set.locks)+extra)}
+	copy(out.locks, set.locks)
+	return out
+}
+
+func (set *LockSet) withLCA(lca *LockClassAnalysis) *LockSet {
+	if set.lca == nil {
+		set.lca = lca
+	} else if set.lca != lca {
+		panic("cannot mix locks from different LockClassAnalyses")
+	}
+	return set
+}
+
+// Len returns the number of locks in set.
+func (set *LockSet) Len() int {
+	return len(set.locks)
+}
+
+// search returns the index of lock class id in set.locks, or where it
+// would be inserted, and whether it is present.
+func (set *LockSet) search(id int) (int, bool) {
+	i := sort.Search(len(set.locks), func(i int) bool {
+		return set.locks[i].id >= id
+	})
+	return i, i < len(set.locks) && set.locks[i].id == id
+}
+
+// Key returns a string such that two LockSet's Keys are == iff both
+// LockSets have the same locks acquired at the same stacks.
+func (set *LockSet) Key() LockSetKey {
+	// TODO: This is complex enough now that maybe I just want a
+	// hash function and an equality function.
+	k := []byte(set.HashKey())
+	for _, l := range set.locks {
+		k = append(k, ':')
+		for sf := l.stack; sf != nil; sf = sf.parent {
+			k = strconv.AppendInt(k, int64(sf.call.Pos()), 10)
+			k = append(k, ',')
+		}
+	}
+	return LockSetKey(k)
+}
+
+// HashKey returns a key such that set1.Equal(set2) implies
+// set1.HashKey() == set2.HashKey().
+func (set *LockSet) HashKey() string {
+	k := make([]byte, 0, 4*len(set.locks))
+	for i, l := range set.locks {
+		if i > 0 {
+			k = append(k, ',')
+		}
+		k = strconv.AppendInt(k, int64(l.id), 16)
+	}
+	return string(k)
+}
+
+// Equal returns whether set and set2 contain the same locks acquired
+// at the same stacks.
+func (set *LockSet) Equal(set2 *LockSet) bool {
+	if set.lca != set2.lca || len(set.locks) != len(set2.locks) {
+		return false
+	}
+	for i, l := range set.locks {
+		if set2.locks[i] != l {
+			return false
+		}
+	}
+	return true
+}
+
+// Contains returns true if set contains lock class lc.
+func (set *LockSet) Contains(lc *LockClass) bool {
+	if set.lca != lc.Analysis() {
+		return false
+	}
+	_, ok := set.search(lc.Id())
+	return ok
+}
+
+// Stack returns the stack at which lock class lc in set was acquired,
+// or nil if lc isn't in set.
+func (set *LockSet) Stack(lc *LockClass) *StackFrame {
+	if set.lca != lc.Analysis() {
+		return nil
+	}
+	i, ok := set.search(lc.Id())
+	if !ok {
+		return nil
+	}
+	return set.locks[i].stack
+}
+
+// Plus returns a LockSet that extends set with lock class lc,
+// acquired at stack. If lc is already in set, it does not get
+// re-added and Plus returns set.
+func (set *LockSet) Plus(lc *LockClass, stack *StackFrame) *LockSet {
+	i, ok := set.search(lc.Id())
+	if ok {
+		return set
+	}
+	out := set.clone(1).withLCA(lc.Analysis())
+	out.locks = append(out.locks, heldLock{})
+	copy(out.locks[i+1:], out.locks[i:])
+	out.locks[i] = heldLock{lc.Id(), stack}
+	return out
+}
+
+// Union returns a LockSet that is the union of set and o. If both set
+// and o contain the same lock, the stack from set is preferred.
+func (set *LockSet) Union(o *LockSet) *LockSet {
+	// Count the locks in o that aren't in set.
+	n := 0
+	for _, l := range o.locks {
+		if _, ok := set.search(l.id); !ok {
+			n++
+		}
+	}
+	if n == 0 {
+		// Nothing to add.
+		return set
+	}
+
+	// Merge the two sorted lists.
+	out := &LockSet{lca: set.lca, locks: make([]heldLock, 0, len(set.locks)+n)}
+	i, j := 0, 0
+	for i < len(set.locks) || j < len(o.locks) {
+		if j == len(o.locks) || i < len(set.locks) && set.locks[i].id <= o.locks[j].id {
+			if j < len(o.locks) && set.locks[i].id == o.locks[j].id {
+				j++
+			}
+			out.locks = append(out.locks, set.locks[i])
+			i++
+		} else {
+			out.locks = append(out.locks, o.locks[j])
+			j++
+		}
+	}
+	return out.withLCA(o.lca)
+}
+
+// Minus returns a LockSet that is like set, but does not contain lock
+// class lc.
+func (set *LockSet) Minus(lc *LockClass) *LockSet {
+	i, ok := set.search(lc.Id())
+	if !ok {
+		return set
+	}
+	out := set.clone(0).withLCA(lc.Analysis())
+	out.locks = append(out.locks[:i], out.locks[i+1:]...)
+	return out
+}
+
+func (set *LockSet) String() string {
+	b := []byte("{")
+	for i, l := range set.locks {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = append(b, set.lca.Lookup(l.id).String()...)
+	}
+	return string(append(b, '}'))
+}
+
+// A LockSetSet is a set of LockSets.
+type LockSetSet struct {
+	M map[LockSetKey]*LockSet
+}
+
+func NewLockSetSet() *LockSetSet {
+	return &LockSetSet{make(map[LockSetKey]*LockSet)}
+}
+
+func (lss *LockSetSet) Add(ss *LockSet) {
+	lss.M[ss.Key()] = ss
+}
+
+func (lss *LockSetSet) Union(lss2 *LockSetSet) {
+	if lss2 == nil {
+		return
+	}
+	for k, ss := range lss2.M {
+		lss.M[k] = ss
+	}
+}
+
+func (lss *LockSetSet) ToSlice() []*LockSet {
+	// TODO: Make deterministic?
+	slice := make([]*LockSet, 0, len(lss.M))
+	for _, ss := range lss.M {
+		slice = append(slice, ss)
+	}
+	return slice
+}
+
+func (lss *LockSetSet) String() string {
+	b := []byte("{")
+	first := true
+	for _, ss := range lss.M {
+		if !first {
+			b = append(b, ',')
+		}
+		first = false
+		b = append(b, ss.String()...)
+	}
+	return string(append(b, '}'))
+}
+
+// funcInfo contains analysis state for a single function.
+type funcInfo struct {
+	// exitStates is a memoization cache that maps from the enter
+	// PathState of state.walkFunction to its exit *PathStateSet.
+	exitStates *PathStateMap
+
+	// ifDeps records the set of control-flow dependencies for
+	// each ssa.BasicBlock of this function. These are the values
+	// at entry to each block that may affect future control flow
+	// decisions.
+	ifDeps []map[ssa.Value]struct{}
+
+	// loopHeaders is the set of indexes of blocks that are the
+	// target of a back edge. Path states are widened at these
+	// blocks so loops converge instead of being unrolled.
+	loopHeaders map[int]bool
+
+	// walks maps from the enter PathState of each completed walk
+	// of this function to its *walkSummary. When a later walk
+	// reuses exitStates, it uses this to credit what the first
+	// walk found and to fix up the returned lock stacks.
+	walks *PathStateMap
+
+	// debugTree is the block trace debug tree for this function.
+	// If nil, this function is not being debug traced.
+	debugTree *DebugTree
+}
+
+// StackFrame is a stack of call sites. A nil *StackFrame represents
+// an empty stack.
+type StackFrame struct {
+	parent *StackFrame
+	call   ssa.Instruction
+}
+
+var internedStackFrames = make(map[StackFrame]*StackFrame)
+
+// Flatten turns sf into a list of calls where the outer-most call is
+// first.
+func (sf *StackFrame) Flatten(into []ssa.Instruction) []ssa.Instruction {
+	if sf == nil {
+		if into == nil {
+			return nil
+		}
+		return into[:0]
+	}
+	return append(sf.parent.Flatten(into), sf.call)
+}
+
+// Extend returns a new StackFrame that extends sf with call. call is
+// typically an *ssa.Call, but other instructions can invoke runtime
+// function calls as well.
+func (sf *StackFrame) Extend(call ssa.Instruction) *StackFrame {
+	return &StackFrame{sf, call}
+}
+
+// Intern returns a canonical *StackFrame such that a.Intern() ==
+// b.Intern() iff a and b have the same sequence of calls.
+func (sf *StackFrame) Intern() *StackFrame {
+	if sf == nil {
+		return nil
+	}
+	if sf, ok := internedStackFrames[*sf]; ok {
+		return sf
+	}
+	nsf := sf.parent.Intern().Extend(sf.call)
+	if nsf, ok := internedStackFrames[*nsf]; ok {
+		return nsf
+	}
+	internedStackFrames[*nsf] = nsf
+	return nsf
+}
+
+// TrimCommonPrefix eliminates the outermost frames that sf and other
+// have in common and returns their distinct suffixes.
+func (sf *StackFrame) TrimCommonPrefix(other *StackFrame, minLen int) (*StackFrame, *StackFrame) {
+	var buf [64]ssa.Instruction
+	f1 := sf.Flatten(buf[:])
+	f2 := other.Flatten(f1[len(f1):cap(f1)])
+
+	// Find the common prefix.
+	var common int
+	for common < len(f1)-minLen && common < len(f2)-minLen && f1[common] == f2[common] {
+		common++
+	}
+
+	// Reconstitute.
+	if common == 0 {
+		return sf, other
+	}
+	var nsf1, nsf2 *StackFrame
+	for _, call := range f1[common:] {
+		nsf1 = nsf1.Extend(call)
+	}
+	for _, call := range f2[common:] {
+		nsf2 = nsf2.Extend(call)
+	}
+	return nsf1, nsf2
+}
+
+type state struct {
+	opts  options
+	prog  *ssa.Program
+	fset  *token.FileSet
+	cg    *callgraph.Graph
+	pta   *pointer.Result
+	fns   map[*ssa.Function]*funcInfo
+	stack *StackFrame
+
+	// heap contains handles to heap objects that are needed by
+	// specially handled functions.
+	heap struct {
+		curG       *HeapObject
+		g0         *HeapObject
+		curM       *HeapObject
+		curM_locks *HeapObject
+
+		curM_acquirem   *HeapObject
+		curM_preemptoff *HeapObject
+
+		// chans maps from MakeChan instructions to the heap
+		// objects tracking their buffer lengths.
+		chans map[*ssa.MakeChan]*HeapObject
+
+		inited map[string]*HeapObject
+	}
+
+	lca       LockClassAnalysis
+	gscanLock *LockClass
+
+	lockOrder *LockOrder
+
+	// messages maps the diagnostics that have been emitted,
+	// keyed by severity, position, and message, not including the
+	// stack, to their index in diags and diagSrcs. diagCounts
+	// counts them by severity, diags records them in order, and
+	// diagSrcs records their message and stack separately, and
+	// the roots that reach them.
+	messages   map[string]int
+	diagCounts [numSeverities]int
+	diags      []Diagnostic
+	diagSrcs   []diagSource
+
+	// duplicateDiags counts diagnostics dropped because one with
+	// the same message was already emitted at the same position.
+	// printedDiags counts diagnostics below SevError written to
+	// diagOut, and unprintedDiags those not written because of
+	// maxWarnings.
+	duplicateDiags int
+	printedDiags   int
+	unprintedDiags int
+
+	// srcLines caches the lines of source files for printing
+	// context in diagnostics.
+	srcLines sourceCache
+
+	// roots is the list of root functions to visit.
+	roots   []*ssa.Function
+	rootSet map[*ssa.Function]struct{}
+
+	// usage aggregates how each lock class is used, keyed by lock
+	// class ID. It is nil unless opts.usage is set.
+	usage map[int]*lockUsage
+
+	// lockSites is the set of positions at which each lock class
+	// is acquired, keyed by lock class ID. It is nil unless
+	// opts.listLocks is set.
+	lockSites map[int]map[token.Position]struct{}
+
+	// nestings records each set of locks held at once, keyed by
+	// their sorted names, with the first stack that acquired the
+	// innermost of them. It is nil unless opts.nesting is
+	// positive.
+	nestings map[string]*lockNesting
+
+	// curRoot is the name of the root being analyzed, or "" if
+	// none is.
+	curRoot string
+
+	// effectSets is a stack with the set of effects found so far
+	// by each walkFunction in progress. See funcInfo.effects.
+	effectSets []map[interface{}]struct{}
+
+	// stats records analysis precision statistics.
+	stats analysisStats
+
+	// stubsReached and externalReached are the stubbed and
+	// external functions reached by the walk (see
+	// recordReached).
+	stubsReached, externalReached map[*ssa.Function]bool
+
+	// trail is the stack of blocks being walked, if the
+	// traceEdge option is set. edgeTrail, edgeStack, and edgeName
+	// record the trail, call stack, and lock class names when the
+	// traced edge was first added.
+	trail     []*ssa.BasicBlock
+	edgeTrail []*ssa.BasicBlock
+	edgeStack *StackFrame
+	edgeName  [2]string
+
+	// neutralSeen is the set of functions in lock-neutral call
+	// trees that recordNeutral has visited.
+	neutralSeen map[*ssa.Function]bool
+
+	// timedOut is set to 1, atomically, when opts.timeout
+	// expires. See expired.
+	timedOut int32
+
+	// rootLockLeaks lists the names of the roots that may return
+	// with locks held.
+	rootLockLeaks []string
+
+	// unresolvedLock is the lock class acquired by calls with
+	// unknown callees in conservative mode. unresolvedCalls is
+	// the set of such calls.
+	unresolvedLock  *LockClass
+	unresolvedCalls map[ssa.Instruction]struct{}
+
+	// externalLocks are the lock classes acquired by calls to
+	// external functions in worst-case mode (see externalCall).
+	externalLocks map[*ssa.Function]*LockClass
+
+	// explicitRoots is the set of roots requested by the user, as
+	// opposed to roots added because they're started by a go
+	// statement. goRootSpawners records, for each function started
+	// by a go statement, the roots from which the go statement was
+	// found.
+	explicitRoots  map[*ssa.Function]bool
+	goRootSpawners map[string]map[string]struct{}
+
+	// calledFns records the callees of each function observed
+	// during exploration.
+	calledFns map[*ssa.Function]map[*ssa.Function]bool
+
+	// neutral caches whether each function is lock-neutral (see
+	// lockNeutral).
+	neutral map[*ssa.Function]bool
+
+	// primitiveClasses caches the classification of functions by
+	// registered Primitives.
+	primitiveClasses map[*ssa.Function]primitiveClass
+
+	// lockOpsVisited is the set of lock and unlock calls reached
+	// by the analysis.
+	lockOpsVisited map[ssa.Instruction]struct{}
+
+	// doubleLocks records the paths that acquired a lock class
+	// they already held, in the order they were found.
+	// doubleLockRoots records the roots from which each was
+	// found, and deduplicates them.
+	doubleLocks     []doubleLock
+	doubleLockRoots map[doubleLock]map[string]struct{}
+
+	// unbalanced records, for each function, the locks that were
+	// held at some but not all of its exit paths.
+	unbalanced map[*ssa.Function]map[*LockClass]*unbalancedLock
+
+	// debugTree, if non-nil is the function CFG debug tree.
+	debugTree *DebugTree
+	// debugging indicates that we're debugging this subgraph of
+	// the CFG.
+	debugging bool
+}
+
+// Severity is the severity of a diagnostic.
+type Severity int
+
+const (
+	// SevInfo diagnostics are notes about imprecision in the
+	// analysis, such as calls it couldn't resolve.
+	SevInfo Severity = iota
+	// SevWarning diagnostics indicate the analysis gave up on
+	// a path or found something suspicious.
+	SevWarning
+	// SevError diagnostics are likely bugs in the runtime.
+	SevError
+
+	numSeverities
+)
+
+var severityNames = [...]string{"info", "warning", "error"}
+
+func (sev Severity) String() string {
+	return severityNames[sev]
+}
+
+// A Diagnostic is a message emitted during analysis, such as a
+// warning about a path the analysis gave up on.
+type Diagnostic struct {
+	Sev Severity
+	Pos token.Position // Zero if the message has no position
+	Msg string
+}
+
+// ParseSeverity returns the severity named name.
+func ParseSeverity(name string) (Severity, error) {
+	for i, n := range severityNames {
+		if n == name {
+			return Severity(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown severity %q", name)
+}
+
+func (s *state) warnl(sev Severity, pos token.Pos, format string, args ...interface{}) {
+	s.diag(sev, pos, fmt.Sprintf(format, args...), "")
+}
+
+func (s *state) warnp(sev Severity, pos token.Pos, format string, args ...interface{}) {
+	s.diag(sev, pos, fmt.Sprintf(format, args...), s.stackString(s.stack))
+}
+
+// diag emits a diagnostic with message msg at pos. If stack isn't "",
+// it's the stack the diagnostic was found on. Diagnostics that repeat
+// the message of an earlier one at the same position are dropped,
+// even if their stacks differ.
+func (s *state) diag(sev Severity, pos token.Pos, msg, stack string) {
+	// TODO: Have a different message for path terminating conditions.
+	var p token.Position
+	if pos.IsValid() {
+		p = s.fset.Position(pos)
+	}
+	key := diagKey(sev, p, msg)
+	if i, ok := s.messages[key]; ok {
+		s.duplicateDiags++
+		s.found(diagEffect(i))
+		return
+	}
+	s.addDiag(sev, p, msg, stack)
+}
+
+// A diagSource is the message and stack of a diagnostic, and the
+// roots from which it was found.
+type diagSource struct {
+	msg, stack string
+	roots      map[string]struct{}
+}
+
+// diagKey returns the key of a diagnostic in state.messages.
+func diagKey(sev Severity, p token.Position, msg string) string {
+	return fmt.Sprintf("%s: %s: %s", p, sev, msg)
+}
+
+// addDiag emits a new diagnostic at p, which may be the zero
+// Position. See diag.
+func (s *state) addDiag(sev Severity, p token.Position, msg, stack string) {
+	if s.messages == nil {
+		s.messages = make(map[string]int)
+	}
+	s.messages[diagKey(sev, p, msg)] = len(s.diags)
+	s.diagSrcs = append(s.diagSrcs, diagSource{msg: msg, stack: stack})
+	s.found(diagEffect(len(s.diags)))
+	s.diagCounts[sev]++
+	if stack != "" {
+		msg += " at\n" + stack
+	}
+	s.diags = append(s.diags, Diagnostic{sev, p, msg})
+	if s.opts.diagOut == nil {
+		return
+	}
+	if sev < SevError && s.opts.maxWarnings > 0 {
+		if s.printedDiags >= s.opts.maxWarnings {
+			s.unprintedDiags++
+			return
+		}
+		s.printedDiags++
+	}
+	var buf bytes.Buffer
+	if p.IsValid() {
+		fmt.Fprintf(&buf, "%s: ", p)
+	}
+	fmt.Fprintf(&buf, "%s: %s\n", sev, msg)
+	if p.IsValid() && s.opts.showSource {
+		s.writeContext(&buf, p, s.opts.context)
+	}
+	io.WriteString(s.opts.diagOut, buf.String())
+}
+
+// writeDiagSummary writes to diagOut how many diagnostics weren't
+// printed, if any.
+func (s *state) writeDiagSummary() {
+	n := s.duplicateDiags + s.unprintedDiags
+	if s.opts.diagOut == nil || n == 0 {
+		return
+	}
+	fmt.Fprintf(s.opts.diagOut, "...and %d more (%d repeated at the same position, %d over the warning limit)\n", n, s.duplicateDiags, s.unprintedDiags)
+}
+
+// A sourceCache caches the lines of source files, keyed by file name.
+type sourceCache map[string][]string
+
+// lines returns the lines of file name, or nil if it can't be read.
+func (c *sourceCache) lines(name string) []string {
+	lines, ok := (*c)[name]
+	if !ok {
+		// Positions refer to the original sources (the
+		// rewritten sources use line directives), so read
+		// those.
+		if data, err := ioutil.ReadFile(name); err == nil {
+			lines = strings.Split(string(data), "\n")
+		}
+		if *c == nil {
+			*c = make(sourceCache)
+		}
+		(*c)[name] = lines
+	}
+	return lines
+}
+
+// writeContext writes the source line at p to w with a caret under
+// p's column, surrounded by n lines of context on either side.
+func (s *state) writeContext(w io.Writer, p token.Position, n int) {
+	lines := s.srcLines.lines(p.Filename)
+	for l := p.Line - n; l <= p.Line+n; l++ {
+		if l < 1 || l > len(lines) {
+			continue
+		}
+		line := lines[l-1]
+		fmt.Fprintf(w, "%6d | %s\n", l, line)
+		if l != p.Line || p.Column < 1 {
+			continue
+		}
+		// Preserve tabs so the caret lines up.
+		col := p.Column - 1
+		if col > len(line) {
+			col = len(line)
+		}
+		caret := []byte(line[:col])
+		for i, c := range caret {
+			if c != '\t' {
+				caret[i] = ' '
+			}
+		}
+		fmt.Fprintf(w, "%6s | %s^\n", "", caret)
+	}
+}
+
+// failed returns whether any diagnostic of severity min or higher
+// has been emitted.
+func (s *state) failed(min Severity) bool {
+	for sev := min; sev < numSeverities; sev++ {
+		if s.diagCounts[sev] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// stackString formats stack as a traceback, innermost call first.
+func (s *state) stackString(stack *StackFrame) string {
+	var buf bytes.Buffer
+	for ; stack != nil; stack = stack.parent {
+		fmt.Fprintf(&buf, "    %s\n", stack.call.Parent().String())
+		fmt.Fprintf(&buf, "        %s\n", s.fset.Position(stack.call.Pos()))
+	}
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// exitPos guesses the source position of the end of b. Annoyingly,
+// the last instruction in an ssa.BasicBlock doesn't have a location,
+// even if it obviously corresponds to a source statement.
+func exitPos(b *ssa.BasicBlock) token.Pos {
+	for b != nil {
+		for i := len(b.Instrs) - 1; i >= 0; i-- {
+			if pos := b.Instrs[i].Pos(); pos != 0 {
+				return pos
+			}
+		}
+		if len(b.Preds) == 0 {
+			break
+		}
+		b = b.Preds[0]
+	}
+	return 0
+}
+
+// checkRootExit reports paths that return from root with locks still
+// held, according to s.opts.rootLocks. Roots that legitimately hand
+// off lock ownership trigger this, but more often it means the
+// analysis failed to match the control flow of a lock and its
+// unlock.
+func (s *state) checkRootExit(root *ssa.Function, exitStates *PathStateSet) {
+	if s.opts.rootLocks == "ignore" {
+		return
+	}
+	sev := SevWarning
+	if s.opts.rootLocks == "error" {
+		sev = SevError
+	}
+	leaked := false
+	exitStates.ForEach(func(ps PathState) {
+		if ps.lockSet.Len() == 0 {
+			return
+		}
+		leaked = true
+		var msg bytes.Buffer
+		fmt.Fprintf(&msg, "locks at return from root %s: %s", root, ps.lockSet)
+		if s.opts.rootLocks == "warn" {
+			fmt.Fprintf(&msg, "\n\t(likely analysis failed to match control flow for unlock)")
+		} else {
+			for _, l := range ps.lockSet.locks {
+				fmt.Fprintf(&msg, "\n\t%s acquired at\n%s", ps.lockSet.lca.Lookup(l.id), s.stackString(l.stack))
+			}
+			if ps.ret != nil {
+				pos := ps.ret.Pos()
+				if !pos.IsValid() {
+					pos = exitPos(ps.ret.Block())
+				}
+				fmt.Fprintf(&msg, "\n\treturns at\n    %s\n        %s", root, s.fset.Position(pos))
+			}
+		}
+		s.warnl(sev, root.Pos(), "%s", msg.String())
+	})
+	if leaked {
+		s.rootLockLeaks = append(s.rootLockLeaks, root.String())
+	}
+}
+
+// acquiremCount returns the number of outstanding acquirems in vs. It
+// returns false if the count isn't known, for example because it
+// differed between iterations of a loop and was widened away.
+func (s *state) acquiremCount(vs ValState) (int64, bool) {
+	return heapInt(vs, s.heap.curM_acquirem)
+}
+
+// heapInt returns the integer value of heap object h in vs. It
+// returns false if h isn't bound to a known integer. Loop widening
+// unbinds heap objects whose values differ between paths, so callers
+// must treat this as unknown.
+func heapInt(vs ValState, h *HeapObject) (int64, bool) {
+	c, ok := vs.GetHeap(h).(DynConst)
+	if !ok || c.c.Kind() != constant.Int {
+		return 0, false
+	}
+	return constant.Int64Val(c.c)
+}
+
+// A doubleLock is a path that acquired a lock class it already held.
+// Since runtime locks aren't reentrant, this is a self-deadlock unless
+// the two acquisitions are of different instances of the class.
+type doubleLock struct {
+	lock          *LockClass
+	first, second *StackFrame
+
+	// text, if non-nil, is the rendered first and second stacks
+	// of a double lock carried over by incremental analysis,
+	// which has no stacks.
+	text *[2]string
+}
+
+// addDoubleLock reports that instr acquires lock, which the current
+// path already acquired at first. For reader/writer locks, the first
+// acquisition may have been in the other mode.
+func (s *state) addDoubleLock(lock *LockClass, first *StackFrame, instr ssa.Instruction) {
+	d := doubleLock{lock: lock, first: first.Intern(), second: s.stack.Intern()}
+	s.warnl(SevError, instr.Pos(), "possible double lock of %s; trimming path\n\tfirst acquired at\n%s\n\tacquired again at\n%s", lock, s.stackString(d.first), s.stackString(d.second))
+	s.recordDoubleLock(d)
+	s.found(d)
+}
+
+// recordDoubleLock adds d to the double locks, if it is new.
+func (s *state) recordDoubleLock(d doubleLock) {
+	if _, ok := s.doubleLockRoots[d]; ok {
+		return
+	}
+	if s.doubleLockRoots == nil {
+		s.doubleLockRoots = make(map[doubleLock]map[string]struct{})
+	}
+	s.doubleLockRoots[d] = nil
+	s.doubleLocks = append(s.doubleLocks, d)
+}
+
+// doubleLockStacks returns the rendered first and second stacks of d.
+func (s *state) doubleLockStacks(d doubleLock) (first, second string) {
+	if d.text != nil {
+		return d.text[0], d.text[1]
+	}
+	return s.stackString(d.first), s.stackString(d.second)
+}
+
+// writeDoubleLocks writes the double locks found by the analysis to w.
+func (s *state) writeDoubleLocks(w io.Writer) {
+	fmt.Fprintf(w, "%d possible double lock(s):\n\n", len(s.doubleLocks))
+	for _, d := range s.doubleLocks {
+		first, second := s.doubleLockStacks(d)
+		fmt.Fprintf(w, "%s acquired while already held\n", d.lock)
+		fmt.Fprintf(w, "  first acquired at\n%s\n", first)
+		fmt.Fprintf(w, "  acquired again at\n%s\n\n", second)
+	}
+}
+
+// checkGoSpawn reports if instr starts a goroutine running root on
+// a path in pathStates that holds locks, unless root is an explicit
+// root. Roots started by go statements are analyzed starting with no
+// locks held, which is right for a new goroutine, but the spawner's
+// locks may still order with the goroutine's if it waits for the
+// goroutine. Either way, the assumption is worth auditing.
+func (s *state) checkGoSpawn(root *ssa.Function, instr *ssa.Go, pathStates *PathStateSet) {
+	if s.explicitRoots[root] {
+		return
+	}
+	pathStates.ForEach(func(ps PathState) {
+		if ps.lockSet.Len() == 0 {
+			return
+		}
+		s.warnl(SevInfo, root.Pos(), "goroutine root %s analyzed with no locks held, but started while holding %s at\n%s", root, ps.lockSet, s.stackString(s.stack.Extend(instr)))
+	})
+}
+
+// checkRootPreempt reports paths that return from root without
+// releasing every M they acquired.
+func (s *state) checkRootPreempt(root *ssa.Function, exitStates *PathStateSet) {
+	exitStates.ForEach(func(ps PathState) {
+		if n, ok := s.acquiremCount(ps.vs); ok && n != 0 {
+			s.warnl(SevWarning, root.Pos(), "root %s returns with %d unreleased acquirem(s)", root, n)
+		}
+	})
+}
+
+// checkInitOrder reports if lock, which is being acquired by instr,
+// must not be acquired until some initialization function has
+// returned, but ps may not have called that function.
+func (s *state) checkInitOrder(ps PathState, instr ssa.Instruction, lock *LockClass) {
+	for fn, locks := range initLocks {
+		// If it isn't known whether fn has run, don't
+		// report.
+		inited, ok := ps.vs.GetHeap(s.heap.inited[fn]).(DynConst)
+		if !ok || inited.c.Kind() != constant.Bool || constant.BoolVal(inited.c) {
+			continue
+		}
+		for _, name := range locks {
+			if name == lock.String() {
+				s.warnp(SevError, instr.Pos(), "%s acquired before %s", lock, fn)
+			}
+		}
+	}
+}
+
+// checkPreemptoff reports if lock, which is being acquired by instr,
+// requires m.preemptoff to be set, but it isn't set on path ps. Paths
+// where m.preemptoff isn't known are not reported.
+func (s *state) checkPreemptoff(ps PathState, instr ssa.Instruction, lock *LockClass) {
+	if !s.opts.requirePreemptoff[specName(lock.String())] {
+		return
+	}
+	reason, ok := ps.vs.GetHeap(s.heap.curM_preemptoff).(DynConst)
+	if !ok || reason.c.Kind() != constant.String {
+		return
+	}
+	if constant.StringVal(reason.c) == "" {
+		s.warnp(SevError, instr.Pos(), "%s acquired without m.preemptoff set", lock)
+	}
+}
+
+// onSystemStack returns whether path ps is running on the system
+// stack. If the current G isn't known, ok is false.
+func (s *state) onSystemStack(ps PathState) (system, ok bool) {
+	curG, ok := ps.vs.GetHeap(s.heap.curG).(DynHeapPtr)
+	if !ok {
+		return false, false
+	}
+	return curG.elem == s.heap.g0, true
+}
+
+// stackName returns the name of the system stack if system is true,
+// and of a user stack otherwise, for diagnostics.
+func stackName(system bool) string {
+	if system {
+		return "system stack"
+	}
+	return "user stack"
+}
+
+// checkStackAcquire reports if lock, which is being acquired by instr,
+// must only be held on the other stack from the one ps is running on.
+func (s *state) checkStackAcquire(ps PathState, instr ssa.Instruction, lock *LockClass) {
+	system, ok := s.onSystemStack(ps)
+	if !ok {
+		return
+	}
+	name := specName(lock.String())
+	if system && s.opts.userStackLocks[name] || !system && s.opts.systemStackLocks[name] {
+		s.warnp(SevError, instr.Pos(), "%s acquired on the %s", lock, stackName(system))
+	}
+}
+
+// checkStackSwitch reports the locks held by ps that must only be held
+// on the stack that instr switches away from. toSystem is true if
+// instr switches from a user stack to the system stack, and false if
+// it switches back.
+func (s *state) checkStackSwitch(ps PathState, instr ssa.Instruction, toSystem bool) {
+	only := s.opts.userStackLocks
+	if !toSystem {
+		only = s.opts.systemStackLocks
+	}
+	for _, l := range ps.lockSet.locks {
+		lock := ps.lockSet.lca.Lookup(l.id)
+		if only[specName(lock.String())] {
+			s.warnp(SevError, instr.Pos(), "%s held while switching to the %s", lock, stackName(toSystem))
+		}
+	}
+}
+
+// expired returns whether the analysis timeout has expired, in which
+// case exploration stops as soon as possible.
+func (s *state) expired() bool {
+	return atomic.LoadInt32(&s.timedOut) != 0
+}
+
+// addRoot adds fn as a root of the control flow graph to visit.
+func (s *state) addRoot(fn *ssa.Function) {
+	if _, ok := s.rootSet[fn]; ok {
+		return
+	}
+	s.roots = append(s.roots, fn)
+	s.rootSet[fn] = struct{}{}
+}
+
+// lockClass returns the lock class of lock v, which is the argument
+// to a lock operation. If vs knows that v is the address of a global,
+// lockClass uses that global. Lock class overrides of v's lock path
+// or class take precedence over the class computed from v.
+func (s *state) lockClass(vs ValState, v ssa.Value) (*LockClass, error) {
+	if g, ok := vs.Get(v).(DynGlobal); ok {
+		v = g.global
+	}
+	lc, err := s.lca.Get(v)
+	if len(s.opts.classOverrides) > 0 {
+		path := lockPath(v)
+		for i := range s.opts.classOverrides {
+			o := &s.opts.classOverrides[i]
+			if o.path == path || (err == nil && o.path == lc.String()) {
+				return s.lca.Named(o.label), nil
+			}
+		}
+	}
+	return lc, err
+}
+
+// unresolvedCall models a call with no known callees in conservative
+// mode. Since the callee could do anything, it is treated as acquiring
+// a lock that is ordered after every lock currently held.
+func (s *state) unresolvedCall(instr ssa.CallInstruction, pathStates *PathStateSet) {
+	if s.unresolvedLock == nil {
+		s.unresolvedLock = s.lca.NewLockClass("<unresolved call>", false)
+		s.unresolvedCalls = make(map[ssa.Instruction]struct{})
+	}
+	s.unresolvedCalls[instr] = struct{}{}
+	stack := s.stack.Extend(instr)
+	unresolved := NewLockSet().Plus(s.unresolvedLock, stack)
+	pathStates.ForEach(func(ps PathState) {
+		s.lockOrder.Add(ps.lockSet, unresolved, stack)
+	})
+}
+
+// writeUnresolvedCalls writes a summary of the calls that were
+// treated conservatively because their callees are unknown.
+func (s *state) writeUnresolvedCalls(w io.Writer) {
+	var lines []string
+	for instr := range s.unresolvedCalls {
+		lines = append(lines, fmt.Sprintf("  %s: %s", s.fset.Position(instr.Pos()), instr.Parent()))
+	}
+	sort.Strings(lines)
+	fmt.Fprintf(w, "%d call site(s) with unresolved callees:\n", len(lines))
+	for _, line := range lines {
+		fmt.Fprintln(w, line)
+	}
+}
+
+// visitLockOp records that the analysis reached lock operation instr.
+func (s *state) visitLockOp(instr ssa.Instruction) {
+	if s.lockOpsVisited == nil {
+		s.lockOpsVisited = make(map[ssa.Instruction]struct{})
+	}
+	s.lockOpsVisited[instr] = struct{}{}
+}
+
+// unreachableLockOps returns the lock and unlock calls in the program
+// that the analysis never reached, grouped by the function containing
+// them. These are either dead code or indicate missing roots.
+func (s *state) unreachableLockOps() map[*ssa.Function][]ssa.Instruction {
+	out := make(map[*ssa.Function][]ssa.Instruction)
+	for fn := range ssautil.AllFunctions(s.prog) {
+		for _, b := range fn.Blocks {
+			for _, instr := range b.Instrs {
+				var call *ssa.CallCommon
+				switch instr := instr.(type) {
+				case *ssa.Call:
+					call = &instr.Call
+				case *ssa.Defer:
+					call = &instr.Call
+				default:
+					continue
+				}
+				if !isLockOp(call.StaticCallee()) {
+					continue
+				}
+				if _, ok := s.lockOpsVisited[instr]; !ok {
+					out[fn] = append(out[fn], instr)
+				}
+			}
+		}
+	}
+	return out
+}
+
+// writeUnreachableLockOps writes a report of unreachableLockOps to w.
+func (s *state) writeUnreachableLockOps(w io.Writer) {
+	byFn := s.unreachableLockOps()
+	fnNames := make([]string, 0, len(byFn))
+	fnMap := make(map[string]*ssa.Function)
+	for fn := range byFn {
+		fnNames = append(fnNames, fn.String())
+		fnMap[fn.String()] = fn
+	}
+	sort.Strings(fnNames)
+	fmt.Fprintf(w, "%d function(s) with unreachable lock operations:\n", len(fnNames))
+	for _, name := range fnNames {
+		fmt.Fprintf(w, "  %s\n", name)
+		for _, instr := range byFn[fnMap[name]] {
+			callee := instr.(ssa.CallInstruction).Common().StaticCallee()
+			fmt.Fprintf(w, "    %s: %s\n", s.fset.Position(instr.Pos()), callee.Name())
+		}
+	}
+}
+
+// An unbalancedLock counts how many exit paths of a function held a
+// lock that other exit paths of the same function released.
+type unbalancedLock struct {
+	held, paths int
+}
+
+// checkUnbalanced records the locks held at some, but not all, of the
+// exit paths in exitStates of a walk of f. A function that acquires a
+// lock on only some of its returns is occasionally intentional, but
+// usually means the analysis failed to correlate the branch that
+// acquires the lock with the one that releases it.
+func (s *state) checkUnbalanced(f *ssa.Function, exitStates *PathStateSet) {
+	paths := 0
+	held := make(map[int]int)
+	exitStates.ForEach(func(ps PathState) {
+		paths++
+		for _, l := range ps.lockSet.locks {
+			held[l.id]++
+		}
+	})
+	for id, n := range held {
+		if n == paths {
+			continue
+		}
+		if s.unbalanced == nil {
+			s.unbalanced = make(map[*ssa.Function]map[*LockClass]*unbalancedLock)
+		}
+		if s.unbalanced[f] == nil {
+			s.unbalanced[f] = make(map[*LockClass]*unbalancedLock)
+		}
+		lc := s.lca.Lookup(id)
+		u := s.unbalanced[f][lc]
+		if u == nil {
+			u = new(unbalancedLock)
+			s.unbalanced[f][lc] = u
+		}
+		u.held += n
+		u.paths += paths
+	}
+}
+
+// writeUnbalancedLocks writes a summary of the functions that return
+// with a lock held on some paths but not others, grouped by function.
+func (s *state) writeUnbalancedLocks(w io.Writer) {
+	fnNames := make([]string, 0, len(s.unbalanced))
+	fnMap := make(map[string]*ssa.Function)
+	for fn := range s.unbalanced {
+		fnNames = append(fnNames, fn.String())
+		fnMap[fn.String()] = fn
+	}
+	sort.Strings(fnNames)
+	fmt.Fprintf(w, "%d function(s) hold locks at some but not all returns (likely analysis failed to match control flow for unlock):\n", len(fnNames))
+	for _, name := range fnNames {
+		fn := fnMap[name]
+		fmt.Fprintf(w, "  %s\n", name)
+		fmt.Fprintf(w, "    %s\n", s.fset.Position(fn.Pos()))
+		var lines []string
+		for lc, u := range s.unbalanced[fn] {
+			lines = append(lines, fmt.Sprintf("    %s held at %d of %d exit path(s)", lc, u.held, u.paths))
+		}
+		sort.Strings(lines)
+		for _, line := range lines {
+			fmt.Fprintln(w, line)
+		}
+	}
+}
+
+// callees returns the set of functions that call could possibly
+// invoke. It returns nil for built-in functions or if pointer
+// analysis failed.
+func (s *state) callees(call ssa.CallInstruction) []*ssa.Function {
+	if builtin, ok := call.Common().Value.(*ssa.Builtin); ok {
+		// TODO: cap, len for map and channel
+		switch builtin.Name() {
+		case "append":
+			return []*ssa.Function{fns.growslice}
+		case "close":
+			return []*ssa.Function{fns.closechan}
+		case "copy":
+			params := builtin.Type().(*types.Signature).Params()
+			src := params.At(1).Type().Underlying()
+			if b, ok := src.(*types.Basic); ok && b.Kind() == types.String {
+				return []*ssa.Function{fns.slicestringcopy}
+			}
+			// Copying pointers requires write barriers,
+			// so the compiler uses typedslicecopy.
+			dst := params.At(0).Type().Underlying().(*types.Slice)
+			if hasPointers(dst.Elem()) {
+				return []*ssa.Function{fns.typedslicecopy}
+			}
+			return []*ssa.Function{fns.slicecopy}
+		case "delete":
+			return []*ssa.Function{fns.mapdelete}
+		}
+
+		// Ignore others.
+		return nil
+	}
+
+	if fn := call.Common().StaticCallee(); fn != nil {
+		return []*ssa.Function{fn}
+	} else if cnode := s.cg.Nodes[call.Parent()]; cnode != nil {
+		var callees []*ssa.Function
+		// TODO: Build an index in walkFunction?
+		for _, o := range cnode.Out {
+			if o.Site != call {
+				continue
+			}
+			callees = append(callees, o.Callee.Func)
+		}
+		return callees
+	}
+
+	s.warnl(SevInfo, call.Pos(), "no call graph for %v", call)
+	return nil
+}
+
+// hasPointers returns whether values of type t contain pointers.
+func hasPointers(t types.Type) bool {
+	switch t := t.Underlying().(type) {
+	case *types.Basic:
+		return t.Kind() == types.String || t.Kind() == types.UnsafePointer
+	case *types.Array:
+		return t.Len() > 0 && hasPointers(t.Elem())
+	case *types.Struct:
+		for i := 0; i < t.NumFields(); i++ {
+			if hasPointers(t.Field(i).Type()) {
+				return true
+			}
+		}
+		return false
+	}
+	// Pointers, slices, maps, channels, functions, and
+	// interfaces.
+	return true
+}
+
+// closureCallee returns the closure called by instr on the path ps, if
+// instr is a call of a function value whose closure is known on that
+// path.
+func (s *state) closureCallee(ps PathState, instr ssa.Instruction) (DynClosure, bool) {
+	call, ok := instr.(ssa.CallInstruction)
+	if !ok || call.Common().IsInvoke() {
+		return DynClosure{}, false
+	}
+	closure, ok := ps.vs.Get(call.Common().Value).(DynClosure)
+	return closure, ok
+}
+
+// allClosureCallees returns whether the closure called by instr is
+// known on every path in pathStates.
+func (s *state) allClosureCallees(pathStates *PathStateSet, instr ssa.Instruction) bool {
+	all := true
+	pathStates.ForEach(func(ps PathState) {
+		if _, ok := s.closureCallee(ps, instr); !ok {
+			all = false
+		}
+	})
+	return all && !pathStates.Empty()
+}
+
+// lockNeutral returns whether walking f can't affect the analysis
+// except by returning: f can return, and its entire call tree never
+// acquires or releases a lock, blocks, uses a channel, starts a
+// goroutine, panics, calls a function value, or calls a specially
+// handled or external function. This is computed lazily and cached.
+//
+// Functions on a call graph cycle are conservatively not neutral.
+func (s *state) lockNeutral(f *ssa.Function) bool {
+	if neutral, ok := s.neutral[f]; ok {
+		return neutral
+	}
+	// Assume f isn't neutral while we compute this, so recursion
+	// terminates.
+	s.neutral[f] = false
+	neutral := s.computeLockNeutral(f)
+	s.neutral[f] = neutral
+	return neutral
+}
+
+func (s *state) computeLockNeutral(f *ssa.Function) bool {
+	// External functions are walked so they're reported.
+	if f.Blocks == nil || s.opts.debugFuncs[f.String()] {
+		return false
+	}
+	canReturn := false
+	for _, b := range f.Blocks {
+		for _, instr := range b.Instrs {
+			if _, ok := instr.(*ssa.Return); ok {
+				canReturn = true
+			}
+			if !s.neutralInstr(instr) {
+				return false
+			}
+		}
+	}
+	return canReturn
+}
+
+// neutralInstr returns whether instr, including any calls it makes,
+// can't affect the analysis except by continuing to the next
+// instruction.
+func (s *state) neutralInstr(instr ssa.Instruction) bool {
+	switch instr := instr.(type) {
+	case *ssa.Go, *ssa.Panic, *ssa.Send, *ssa.Select, *ssa.MakeChan, *ssa.SliceToArrayPointer:
+		return false
+	case *ssa.UnOp:
+		if instr.Op == token.ARROW {
+			return false
+		}
+	case *ssa.TypeAssert:
+		if !instr.CommaOk && !isInterface(instr.AssertedType) {
+			// This may panic.
+			return false
+		}
+	case ssa.CallInstruction:
+		if !s.neutralCall(instr) {
+			return false
+		}
+	}
+	for _, fn := range runtimeCallees(instr) {
+		if fn != nil && !s.neutralCallee(fn) {
+			return false
+		}
+	}
+	return true
+}
+
+// lockRelevantBlocks returns, for each block in f, whether it contains
+// an instruction that may affect the analysis (see neutralInstr).
+// RunDefers is relevant if any deferred call is.
+func (s *state) lockRelevantBlocks(f *ssa.Function) []bool {
+	relevant := make([]bool, len(f.Blocks))
+	relevantDefer := false
+	for _, b := range f.Blocks {
+		for _, instr := range b.Instrs {
+			if !s.neutralInstr(instr) {
+				relevant[b.Index] = true
+				if _, ok := instr.(*ssa.Defer); ok {
+					relevantDefer = true
+				}
+			}
+		}
+	}
+	if relevantDefer {
+		for _, b := range f.Blocks {
+			for _, instr := range b.Instrs {
+				if _, ok := instr.(*ssa.RunDefers); ok {
+					relevant[b.Index] = true
+				}
+			}
+		}
+	}
+	return relevant
+}
+
+// neutralCall returns whether every callee of call is lock-neutral.
+func (s *state) neutralCall(call ssa.CallInstruction) bool {
+	common := call.Common()
+	_, builtin := common.Value.(*ssa.Builtin)
+	if common.IsInvoke() {
+		if s.cg.Nodes[call.Parent()] == nil {
+			return false
+		}
+	} else if common.StaticCallee() == nil && !builtin {
+		// The callee is resolved per path.
+		return false
+	}
+	callees := s.callees(call)
+	if len(callees) == 0 && !builtin && s.opts.conservative {
+		// This would acquire the unresolved call lock.
+		return false
+	}
+	for _, fn := range callees {
+		if fn != nil && !s.neutralCallee(fn) {
+			return false
+		}
+	}
+	return true
+}
+
+// neutralCallee returns whether calling fn is lock-neutral, including
+// how doCall handles fn.
+func (s *state) neutralCallee(fn *ssa.Function) bool {
+	name := fn.String()
+	if _, ok := s.callHandler(fn); ok {
+		return false
+	}
+	if _, ok := returnHandlers[name]; ok {
+		return false
+	}
+	if isLockOp(fn) || trackArgs[name] || s.heap.inited[name] != nil || s.isBlocking(fn) || s.classify(fn).ok {
+		return false
+	}
+	return s.lockNeutral(fn)
+}
+
+// walkFunction explores f, starting at the given path state. It
+// returns the set of path states possible on exit from f.
+//
+// ps should have block and mask set to nil, and ps.vs may contain
+// heap values and parameter/free variable values for this function.
+// ps.vs should not contain anything else.
+//
+// Path states returned from walkFunction will likewise have block and
+// mask set to nil and ps.vs will be restricted to just heap values.
+// Each exit state pairs a lock set with the heap at that exit, so the
+// caller sees f's effect on heap state such as m.locks and
+// m.preemptoff, not just on the held locks.
+//
+// This implements the lockset algorithm from Engler and Ashcroft,
+// SOSP 2003, plus simple path sensitivity to reduce mistakes from
+// correlated control flow.
+//
+// Function values passed as arguments are bound in the callee's
+// value state, so a higher-order function calls only what each path
+// passed it. TODO: Function values loaded from the heap still use the
+// call graph, whose flow is not segregated by PathState.
+//
+// Call trees that can't affect the analysis (see lockNeutral) are
+// not walked: their exit state is just their entry state.
+func (s *state) walkFunction(f *ssa.Function, ps PathState) *PathStateSet {
+	if s.stack != nil {
+		caller := s.stack.call.Parent()
+		if s.calledFns[caller] == nil {
+			s.calledFns[caller] = make(map[*ssa.Function]bool)
+		}
+		s.calledFns[caller][f] = true
+	}
+
+	// Incremental analysis needs every explored function's
+	// callees, so it can't skip call trees.
+	if s.opts.incremental == "" && s.lockNeutral(f) {
+		s.stats.NeutralCalls++
+		s.recordNeutral(f)
+		pss := NewPathStateSet()
+		pss.Add(ps.ExitState())
+		return pss
+	}
+
+	fInfo := s.fns[f]
+	if fInfo == nil {
+		// First visit of this function.
+
+		// Compute control-flow dependencies.
+		//
+		// Only branches that decide whether a lock-relevant
+		// instruction runs are tracked. Other branches, such
+		// as the condition of a simple counting loop, would
+		// otherwise keep their values live and split path
+		// states that are the same as far as locking is
+		// concerned.
+		//
+		// Calls of function values are control flow too: the
+		// function value decides which callee we walk. So are
+		// the operands of lock operations, since lockClass
+		// resolves a lock from its value on each path.
+		relevantIfs := controlsRelevant(f, s.lockRelevantBlocks(f))
+		var ifInstrs []ssa.Instruction
+		var dynCalls []ssa.CallInstruction
+		for _, b := range f.Blocks {
+			for _, instr := range b.Instrs {
+				call, ok := instr.(ssa.CallInstruction)
+				if !ok || call.Common().IsInvoke() {
+					continue
+				}
+				if callee := call.Common().StaticCallee(); callee == nil {
+					dynCalls = append(dynCalls, call)
+				} else if isLockOp(callee) || s.classify(callee).ok {
+					ifInstrs = append(ifInstrs, instr)
+				}
+			}
+			if len(b.Instrs) == 0 {
+				continue
+			}
+			instr, ok := b.Instrs[len(b.Instrs)-1].(*ssa.If)
+			if !ok || !relevantIfs[b.Index] {
+				continue
+			}
+			ifInstrs = append(ifInstrs, instr)
+		}
+		ifDeps := livenessFor(f, ifInstrs, dynCalls)
+		if s.opts.debugFuncs[f.String()] {
+			f.WriteTo(os.Stderr)
+			fmt.Fprintf(os.Stderr, "if deps:\n")
+			for bid, vals := range ifDeps {
+				fmt.Fprintf(os.Stderr, "  %d: ", bid)
+				for dep := range vals {
+					fmt.Fprintf(os.Stderr, " %s", dep.(ssa.Value).Name())
+				}
+				fmt.Fprintf(os.Stderr, "\n")
+			}
+		}
+
+		// Find loop headers. A block is a loop header if it
+		// dominates one of its predecessors.
+		loopHeaders := make(map[int]bool)
+		for _, b := range f.Blocks {
+			for _, pred := range b.Preds {
+				if b.Dominates(pred) {
+					loopHeaders[b.Index] = true
+				}
+			}
+		}
+
+		fInfo = &funcInfo{
+			exitStates:  NewPathStateMap(),
+			walks:       NewPathStateMap(),
+			ifDeps:      ifDeps,
+			loopHeaders: loopHeaders,
+		}
+		s.fns[f] = fInfo
+
+		s.stats.Functions++
+		s.recordReached(f)
+
+		if s.opts.debugFuncs[f.String()] {
+			fInfo.debugTree = new(DebugTree)
+		}
+	}
+
+	if f.Blocks == nil {
+		// External function. Assume it doesn't affect locks
+		// or heap state, other than recording an edge in
+		// worst-case mode.
+		if s.opts.external == "worst" {
+			s.externalCall(f, ps)
+		}
+		pss1 := NewPathStateSet()
+		pss1.Add(ps)
+		return pss1
+	}
+
+	if s.opts.debugFuncs[f.String()] && s.debugging == false {
+		// Turn on debugging of this subtree.
+		if s.debugTree == nil {
+			s.debugTree = new(DebugTree)
+		}
+		s.debugging = true
+		defer func() { s.debugging = false }()
+	}
+
+	if s.debugging {
+		var buf bytes.Buffer
+		fmt.Fprintf(&buf, "%s\n- enter -\n", f)
+		ps.WriteTo(&buf)
+		s.debugTree.Push(buf.String())
+		defer s.debugTree.Pop()
+	}
+
+	// Check memoization cache.
+	//
+	// TODO: Our lockset can differ from a cached lockset by only
+	// the stacks of the locks. Can we do something smarter than
+	// recomputing the entire sub-graph in that situation? It's
+	// rather complex because we may alter the lock order graph
+	// with new stacks in the process. One could imagine tracking
+	// a "predicate" and a compressed "delta" for the computation
+	// and caching that.
+	if memo := fInfo.exitStates.Get(ps); memo == walkingPathStateSet {
+		// f is already being walked from this entry state, so
+		// this is a recursive call. Terminate this code path.
+		s.stats.RecursionCuts++
+		if s.debugging {
+			s.debugTree.Appendf("\n- recursive call cut -")
+		}
+		return emptyPathStateSet
+	} else if memo != nil {
+		s.stats.CacheHits++
+		exitStates := memo.(*PathStateSet)
+		if w := fInfo.walks.Get(ps); w != nil {
+			w := w.(*walkSummary)
+			s.reuseEffects(w.effects)
+			exitStates = s.rebaseExits(exitStates, w.stack)
+		}
+		if s.debugging {
+			s.debugTree.Appendf("\n- cached exit -\n%v", exitStates)
+		}
+		return exitStates
+	}
+	s.stats.CacheMisses++
+
+	if fInfo.debugTree != nil {
+		var buf bytes.Buffer
+		fmt.Fprintf(&buf, "%s\n- enter -\n", f)
+		ps.WriteTo(&buf)
+		fInfo.debugTree.Push(buf.String())
+		defer fInfo.debugTree.Pop()
+	}
+
+	// Resolve function cycles by marking this entry state as being
+	// walked. A recursive call that reaches it again gets an empty
+	// set of locksets, which terminates that code path.
+	//
+	// TODO: RacerX detects cycles *without* regard to the entry
+	// lock set. We could do that, but it doesn't seem to be an
+	// issue to include the lock set. However, since we have the
+	// lock set, maybe if we have a cycle with a non-empty lock
+	// set we should report a self-deadlock.
+	fInfo.exitStates.Set(ps, walkingPathStateSet)
+
+	blockCache := NewPathStateSet()
+	enterPathState := PathState{block: f.Blocks[0], lockSet: ps.lockSet, vs: ps.vs}
+	exitStates := NewPathStateSet()
+	s.effectSets = append(s.effectSets, make(map[interface{}]struct{}))
+	s.walkBlock(blockCache, enterPathState, exitStates)
+	fInfo.exitStates.Set(ps, exitStates)
+	s.checkUnbalanced(f, exitStates)
+	fInfo.walks.Set(ps, &walkSummary{s.stack, s.effectSets[len(s.effectSets)-1]})
+	s.effectSets = s.effectSets[:len(s.effectSets)-1]
+	//log.Printf("%s: %s -> %s", f.Name(), locks, exitStates)
+	if s.debugging {
+		s.debugTree.Appendf("\n- exit -\n%v", exitStates)
+	}
+	return exitStates
+}
+
+// A walkSummary records a completed walk of a function.
+type walkSummary struct {
+	// stack is the stack the function was called at.
+	stack *StackFrame
+	// effects is the set of effects found by the walk, including
+	// in callees.
+	effects map[interface{}]struct{}
+}
+
+// rebaseExits returns exitStates, which a walk of a function called
+// at stack returned, with the locks acquired by that walk moved to
+// the current stack. Exit states are memoized by entry state, so
+// callers at different stacks share them, but the locks they return
+// holding must show the caller that reached them. Otherwise, later
+// edges would depend on which caller happened to walk the function
+// first.
+func (s *state) rebaseExits(exitStates *PathStateSet, stack *StackFrame) *PathStateSet {
+	if exitStates == emptyPathStateSet {
+		return exitStates
+	}
+	old, cur := stack.Flatten(nil), s.stack.Flatten(nil)
+	if len(old) == len(cur) && hasCallPrefix(cur, old) {
+		return exitStates
+	}
+	out := NewPathStateSet()
+	exitStates.ForEach(func(ps PathState) {
+		var locks *LockSet
+		for i, l := range ps.lockSet.locks {
+			calls := l.stack.Flatten(nil)
+			if len(calls) <= len(old) || !hasCallPrefix(calls, old) {
+				continue
+			}
+			nstack := s.stack
+			for _, call := range calls[len(old):] {
+				nstack = nstack.Extend(call)
+			}
+			if locks == nil {
+				locks = ps.lockSet.clone(0)
+			}
+			locks.locks[i].stack = nstack
+		}
+		if locks != nil {
+			ps.lockSet = locks
+		}
+		out.Add(ps)
+	})
+	return out
+}
+
+// hasCallPrefix returns whether calls starts with prefix.
+func hasCallPrefix(calls, prefix []ssa.Instruction) bool {
+	if len(calls) < len(prefix) {
+		return false
+	}
+	for i, call := range prefix {
+		if calls[i] != call {
+			return false
+		}
+	}
+	return true
+}
+
+// An effect is something a walk finds that is reported per root: a
+// lockOrderPath, a blockingPath, a diagEffect, a goRootEffect, or a
+// doubleLock.
+//
+// A diagEffect is the index in state.diags of a diagnostic. A
+// goRootEffect is the name of a function started by a go statement.
+type (
+	diagEffect   int
+	goRootEffect string
+)
+
+// found records that the current root found effect, and that effect
+// was found during the walks of every function currently being
+// walked.
+func (s *state) found(effect interface{}) {
+	if s.curRoot != "" {
+		s.credit(effect, s.curRoot)
+	}
+	s.addEffect(effect)
+}
+
+// addEffect records that effect was found during the walks of every
+// function currently being walked. LockOrder credits its own paths,
+// so it calls this directly.
+func (s *state) addEffect(effect interface{}) {
+	for _, effects := range s.effectSets {
+		effects[effect] = struct{}{}
+	}
+}
+
+// credit records that root reaches effect.
+func (s *state) credit(effect interface{}, root string) {
+	switch e := effect.(type) {
+	case diagEffect:
+		s.diagSrcs[e].roots = addName(s.diagSrcs[e].roots, root)
+	case goRootEffect:
+		if s.goRootSpawners == nil {
+			s.goRootSpawners = make(map[string]map[string]struct{})
+		}
+		s.goRootSpawners[string(e)] = addName(s.goRootSpawners[string(e)], root)
+	case doubleLock:
+		s.doubleLockRoots[e] = addName(s.doubleLockRoots[e], root)
+	default:
+		s.lockOrder.credit(effect, root)
+	}
+}
+
+// reuseEffects records that the current walk reuses memoized exit
+// states whose walk found effects. The effects are credited to the
+// current root, and to the functions being walked, since the current
+// root reaches them just as the root that first walked the function
+// did.
+func (s *state) reuseEffects(effects map[interface{}]struct{}) {
+	for effect := range effects {
+		s.found(effect)
+	}
+}
+
+// PathState is the state during execution of a particular function.
+type PathState struct {
+	block   *ssa.BasicBlock
+	lockSet *LockSet
+	vs      ValState
+	mask    map[ssa.Value]struct{}
+
+	// defers is the stack of defer statements this path has
+	// executed in the current function.
+	defers *deferList
+
+	// ret is, in an exit state, the return the path took. Exit
+	// states that differ only in ret are the same state, so this
+	// is the first return seen.
+	ret *ssa.Return
+}
+
+type pathStateKey struct {
+	block   *ssa.BasicBlock
+	lockSet string
+	defers  *deferList
+}
+
+// HashKey returns a key such that ps1.Equal(ps2) implies
+// ps1.HashKey() == ps2.HashKey().
+func (ps *PathState) HashKey() pathStateKey {
+	// Note that PathStateSet.Contains depends on this capturing
+	// everything except the stacks and value state.
+	return pathStateKey{ps.block, ps.lockSet.HashKey(), ps.defers}
+}
+
+// Equal returns whether ps and ps2 have represent the same program
+// state.
+func (ps *PathState) Equal(ps2 *PathState) bool {
+	// ps.block == ps2.block implies ps.mask == ps2.mask, so this
+	// is symmetric. Maybe we should just keep pre-masked
+	// ValStates.
+	return ps.block == ps2.block && ps.defers == ps2.defers && ps.lockSet.Equal(ps2.lockSet) && ps.vs.EqualAt(ps2.vs, ps.mask)
+}
+
+// A deferList is a stack of defer statements, most recent first.
+// deferLists are interned, so paths that executed the same defer
+// statements have the same *deferList.
+type deferList struct {
+	d    *ssa.Defer
+	next *deferList
+}
+
+var internedDeferLists = make(map[deferList]*deferList)
+
+// Push returns l with d pushed on top. If l already contains d, as it
+// does on later iterations of a loop containing d, Push returns l, so
+// a defer in a loop runs once.
+func (l *deferList) Push(d *ssa.Defer) *deferList {
+	for l2 := l; l2 != nil; l2 = l2.next {
+		if l2.d == d {
+			return l
+		}
+	}
+	key := deferList{d, l}
+	if nl, ok := internedDeferLists[key]; ok {
+		return nl
+	}
+	nl := &key
+	internedDeferLists[key] = nl
+	return nl
+}
+
+// ExitState returns ps narrowed to the path state tracked across a
+// function return.
+func (ps *PathState) ExitState() PathState {
+	return PathState{
+		lockSet: ps.lockSet,
+		vs:      ps.vs.LimitToHeap(),
+		ret:     ps.ret,
+	}
+}
+
+func (ps *PathState) WriteTo(w io.Writer) {
+	if ps.block == nil {
+		fmt.Fprintf(w, "PathState for function:\n")
+	} else {
+		fmt.Fprintf(w, "PathState for %s block %d:\n", ps.block.Parent(), ps.block.Index)
+	}
+	fmt.Fprintf(w, "  locks: %v\n", ps.lockSet)
+	fmt.Fprintf(w, "  values:\n")
+	ps.vs.WriteTo(&IndentWriter{W: w, Indent: []byte("    ")})
+}
+
+// PathStateSet is a mutable set of PathStates.
+type PathStateSet struct {
+	m map[pathStateKey][]PathState
+}
+
+// NewPathStateSet returns a new, empty PathStateSet.
+func NewPathStateSet() *PathStateSet {
+	return &PathStateSet{make(map[pathStateKey][]PathState)}
+}
+
+var emptyPathStateSet = NewPathStateSet()
+
+// walkingPathStateSet is the memoized exit state set of a function
+// entry state whose walk hasn't finished yet.
+var walkingPathStateSet = NewPathStateSet()
+
+// loopUnroll is the number of path states with the same lock set that
+// may reach a loop header before the value state is widened. This
+// keeps the precision of the first few iterations, which often differ
+// from the rest.
+const loopUnroll = 2
+
+// DefaultMaxStates is the default for Config.MaxStates.
+const DefaultMaxStates = 10
+
+func (set *PathStateSet) Empty() bool {
+	return len(set.m) == 0
+}
+
+// Add adds PathState ps to set.
+func (set *PathStateSet) Add(ps PathState) {
+	key := ps.HashKey()
+	slice := set.m[key]
+	for i := range slice {
+		if slice[i].Equal(&ps) {
+			return
+		}
+	}
+	set.m[key] = append(slice, ps)
+}
+
+// Similar returns the PathStates in set that differ from ps only in
+// value state and lock stacks. The caller must not modify the
+// returned slice.
+func (set *PathStateSet) Similar(ps PathState) []PathState {
+	return set.m[ps.HashKey()]
+}
+
+// Contains returns whether set contains ps and the number of
+// PathStates that differ only in value state and lock stacks.
+func (set *PathStateSet) Contains(ps PathState) (bool, int) {
+	// The "similar" count depends on the implementation of
+	// PathState.HashKey.
+	key := ps.HashKey()
+	slice := set.m[key]
+	for i := range slice {
+		if slice[i].Equal(&ps) {
+			return true, len(slice)
+		}
+	}
+	return false, len(slice)
+}
+
+// MapInPlace applies f to each PathState in set and replaces that
+// PathState with f's result. This is optimized for the case where f
+// returns the same PathState.
+func (set *PathStateSet) MapInPlace(f func(ps PathState) PathState) {
+	var toAdd []PathState
+	for hashKey, slice := range set.m {
+		for i := 0; i < len(slice); i++ {
+			ps2 := f(slice[i])
+			if slice[i].Equal(&ps2) {
+				// ps2 is the same as far as the set
+				// is concerned, but it may bind
+				// values that don't affect control
+				// flow, such as addresses that are
+				// later stored to. Keep them.
+				slice[i] = ps2
+				continue
+			}
+			// Remove ps from the set and queue ps2 to add.
+			slice[i] = slice[len(slice)-1]
+			slice = slice[:len(slice)-1]
+			if len(slice) == 0 {
+				delete(set.m, hashKey)
+			} else {
+				set.m[hashKey] = slice
+			}
+			toAdd = append(toAdd, ps2)
+		}
+	}
+	for _, ps := range toAdd {
+		set.Add(ps)
+	}
+}
+
+// ForEach applies f to each PathState in set.
+func (set *PathStateSet) ForEach(f func(ps PathState)) {
+	for _, slice := range set.m {
+		for i := range slice {
+			f(slice[i])
+		}
+	}
+}
+
+// FlatMap applies f to each PathState in set and returns a new
+// PathStateSet consisting of the union of f's results. f may use
+// scratch as temporary space and may return it; this will always be a
+// slice with length 0.
+func (set *PathStateSet) FlatMap(f func(ps PathState, scatch []PathState) []PathState) *PathStateSet {
+	var scratch [16]PathState
+	out := NewPathStateSet()
+	for _, slice := range set.m {
+		for _, ps := range slice {
+			for _, nps := range f(ps, scratch[:0]) {
+				out.Add(nps)
+			}
+		}
+	}
+	return out
+}
+
+// PathStateMap is a mutable map keyed by PathState.
+type PathStateMap struct {
+	m map[pathStateKey][]pathStateMapEntry
+}
+
+type pathStateMapEntry struct {
+	ps  PathState
+	val interface{}
+}
+
+// NewPathStateMap returns a new empty PathStateMap.
+func NewPathStateMap() *PathStateMap {
+	return &PathStateMap{make(map[pathStateKey][]pathStateMapEntry)}
+}
+
+// Set sets the value associated with ps to val in psm.
+func (psm *PathStateMap) Set(ps PathState, val interface{}) {
+	key := ps.HashKey()
+	slice := psm.m[key]
+	for i := range slice {
+		if slice[i].ps.Equal(&ps) {
+			slice[i].val = val
+			return
+		}
+	}
+	psm.m[key] = append(slice, pathStateMapEntry{ps, val})
+}
+
+// Get returns the value associated with ps in psm.
+func (psm *PathStateMap) Get(ps PathState) interface{} {
+	slice := psm.m[ps.HashKey()]
+	for i := range slice {
+		if slice[i].ps.Equal(&ps) {
+			return slice[i].val
+		}
+	}
+	return nil
+}
+
+// walkBlock visits a block and all blocks reachable from it, starting
+// from the path state enterPathState. When walkBlock reaches the
+// return point of the function, it adds the possible path states at
+// that point to exitStates. blockCache is the set of already
+// visited path states within this function as of the beginning of
+// visited blocks.
+func (s *state) walkBlock(blockCache *PathStateSet, enterPathState PathState, exitStates *PathStateSet) {
+	if s.expired() {
+		// Stop exploring. Whatever is in the lock graph so
+		// far is still valid.
+		s.stats.BudgetExhausted++
+		return
+	}
+	b := enterPathState.block
+	f := b.Parent()
+	// Check the values that are live at this
+	// block. Note that the live set includes phis
+	// at the beginning of this block if they
+	// participate in control flow decisions, so
+	// we'll pick up any phi values assigned by
+	// our called.
+	enterPathState.mask = s.fns[f].ifDeps[b.Index]
+
+	debugTree := s.fns[f].debugTree
+	if debugTree != nil {
+		var buf bytes.Buffer
+		fmt.Fprintf(&buf, "block %v\n", b.Index)
+		enterPathState.WriteTo(&buf)
+		debugTree.Push(buf.String())
+		defer debugTree.Pop()
+	}
+
+	if cached, similar := blockCache.Contains(enterPathState); cached {
+		// Terminate recursion. Some other path has already
+		// visited here with this lock set and value state.
+		if debugTree != nil {
+			debugTree.Leaf("cached")
+		}
+		return
+	} else if similar >= loopUnroll && s.fns[f].loopHeaders[b.Index] {
+		// Widen the value state at the loop header by joining
+		// it with every state that has already reached the
+		// header with this lock set. Each widening drops at
+		// least one binding, so the loop reaches a fixed point
+		// rather than being unrolled until it's trimmed.
+		for _, ps2 := range blockCache.Similar(enterPathState) {
+			enterPathState.vs = enterPathState.vs.Join(ps2.vs)
+		}
+		if cached, _ := blockCache.Contains(enterPathState); cached {
+			if debugTree != nil {
+				debugTree.Leaf("cached after widening")
+			}
+			return
+		}
+		s.stats.Widened++
+	} else if similar > s.opts.maxStates {
+		s.stats.trim(f)
+		s.warnl(SevWarning, blockPos(b), "too many states, trimming path (block %d)", b.Index)
+		if debugTree != nil {
+			debugTree.Leaf("too many states")
+		}
+		return
+	}
+	blockCache.Add(enterPathState)
+	s.stats.PathStates++
+	if s.opts.traceEdge[0] != "" {
+		s.trail = append(s.trail, b)
+		defer func() { s.trail = s.trail[:len(s.trail)-1] }()
+	}
+
+	// Upon block entry there's just the one entry path state.
+	pathStates := NewPathStateSet()
+	pathStates.Add(enterPathState)
+
+	doCall := func(instr ssa.Instruction, fns []*ssa.Function) {
+		s.stack = s.stack.Extend(instr)
+		pathStates = pathStates.FlatMap(func(ps PathState, newps []PathState) []PathState {
+			psEntry := PathState{
+				lockSet: ps.lockSet,
+				vs:      ps.vs.LimitToHeap(),
+			}
+			callFns := fns
+			if closure, ok := s.closureCallee(ps, instr); ok {
+				// We know exactly which closure this
+				// path calls. Bind its free variables.
+				callFns = []*ssa.Function{closure.fn}
+				psEntry.vs = closure.Bind(psEntry.vs)
+			}
+			for _, fn := range callFns {
+				if fn == nil {
+					// This is a runtime function that
+					// isn't loaded because we're not
+					// analyzing the runtime. Assume it
+					// doesn't affect locks.
+					newps = append(newps, ps)
+					continue
+				}
+				if s.isBlocking(fn) {
+					s.recordBlocking(ps.lockSet, fn)
+					if s.opts.checkPreempt {
+						if n, ok := s.acquiremCount(ps.vs); ok && n > 0 {
+							s.warnp(SevError, instr.Pos(), "%s may block with %d acquirem(s) held", fn, n)
+						}
+					}
+				}
+				handled := false
+				if handler, ok := s.callHandler(fn); ok && (!s.opts.syncOnly || isSyncFunc(fn)) {
+					// TODO: Instead of using
+					// FlatMap, I could just pass
+					// the PathStateSet to add new
+					// states to.
+					newps = handler(s, ps, instr, newps)
+					handled = true
+				} else if c := s.classify(fn); c.ok {
+					newps, handled = s.handlePrimitive(c, ps, instr, newps)
+				}
+				if !handled {
+					// Bind arguments values if
+					// this function is marked for
+					// argument tracking. Function
+					// values are always bound so
+					// the callee calls only what
+					// this path passed it.
+					psEntry := psEntry
+					if call, ok := instr.(ssa.CallInstruction); ok && !call.Common().IsInvoke() && len(call.Common().Args) == len(fn.Params) {
+						track := trackArgs[fn.String()]
+						for i, arg := range call.Common().Args {
+							aval := ps.vs.Get(arg)
+							if _, ok := aval.(DynClosure); aval != nil && (track || ok) {
+								psEntry.vs = psEntry.vs.Extend(fn.Params[i], aval)
+							}
+						}
+					}
+
+					inited := s.heap.inited[fn.String()]
+					ret := returnHandlers[fn.String()]
+					if s.opts.syncOnly && !isSyncFunc(fn) {
+						ret = nil
+					}
+					s.walkFunction(fn, psEntry).ForEach(func(ps2 PathState) {
+						ps.lockSet = ps2.lockSet
+						ps.vs.heap = ps2.vs.heap
+						if inited != nil {
+							ps.vs = ps.vs.ExtendHeap(inited, DynConst{constant.MakeBool(true)})
+						}
+						if ret != nil {
+							newps = ret(s, ps, instr, newps)
+						} else {
+							newps = append(newps, ps)
+						}
+					})
+				}
+			}
+			return newps
+		})
+		s.stack = s.stack.parent
+	}
+
+	// doCallInstr resolves the callees of instr and calls them.
+	doCallInstr := func(instr ssa.CallInstruction) {
+		if instr.Common().StaticCallee() == nil && s.allClosureCallees(pathStates, instr) {
+			// Every path knows which closure this
+			// calls, so we don't need the call graph.
+			doCall(instr, nil)
+			return
+		}
+		outs := s.callees(instr)
+		if len(outs) == 0 {
+			if _, ok := instr.Common().Value.(*ssa.Builtin); !ok && s.opts.conservative {
+				s.unresolvedCall(instr, pathStates)
+				return
+			}
+			// This is a built-in like print or len.
+			// Assume it doesn't affect the locksets.
+			return
+		}
+		doCall(instr, outs)
+	}
+
+	// runDefers runs the deferred calls of each path in LIFO
+	// order. Paths that executed different defer statements run
+	// different calls. The arguments were evaluated at the defer
+	// statement, but SSA values are immutable, so they're still
+	// in the value state.
+	runDefers := func() {
+		var lists []*deferList
+		byList := make(map[*deferList]*PathStateSet)
+		pathStates.ForEach(func(ps PathState) {
+			set := byList[ps.defers]
+			if set == nil {
+				set = NewPathStateSet()
+				byList[ps.defers] = set
+				lists = append(lists, ps.defers)
+			}
+			ps.defers = nil
+			set.Add(ps)
+		})
+		out := NewPathStateSet()
+		for _, l := range lists {
+			pathStates = byList[l]
+			for ; l != nil; l = l.next {
+				doCallInstr(l.d)
+			}
+			pathStates.ForEach(func(ps PathState) {
+				out.Add(ps)
+			})
+		}
+		pathStates = out
+	}
+
+	// For each instruction, compute the effect of that
+	// instruction on all possible path states at that point.
+	var ifCond ssa.Value
+	for _, instr := range b.Instrs {
+		// Update value state with the effect of this
+		// instruction.
+		pathStates.MapInPlace(func(ps PathState) PathState {
+			ps.vs = ps.vs.Do(instr)
+			return ps
+		})
+
+		switch instr := instr.(type) {
+		case *ssa.If:
+			// We'll bind ifCond to true or false when we
+			// visit successors.
+			ifCond = instr.Cond
+
+		case *ssa.Call:
+			pathStates.MapInPlace(func(ps PathState) PathState {
+				return escapeChans(ps, instr)
+			})
+			doCallInstr(instr)
+
+		case *ssa.RunDefers:
+			runDefers()
+
+		case *ssa.Alloc, *ssa.Lookup, *ssa.MakeMap, *ssa.MakeSlice, *ssa.MapUpdate,
+			*ssa.Range, *ssa.Next, *ssa.ChangeInterface:
+			if callees := runtimeCallees(instr); callees != nil {
+				doCall(instr, callees)
+			}
+
+		case *ssa.MakeChan:
+			doCall(instr, []*ssa.Function{fns.makechan})
+			pathStates.MapInPlace(func(ps PathState) PathState {
+				return s.doMakeChan(ps, instr)
+			})
+
+		case *ssa.Panic:
+			// A panic runs the deferred calls before
+			// unwinding.
+			runDefers()
+			doCall(instr, []*ssa.Function{fns.gopanic})
+
+		case *ssa.SliceToArrayPointer:
+			// This panics if the slice is shorter than
+			// the array, which can only happen for
+			// non-empty arrays. We don't track slice
+			// lengths, so assume it may panic.
+			arr := instr.Type().Underlying().(*types.Pointer).Elem().Underlying().(*types.Array)
+			if arr.Len() == 0 {
+				break
+			}
+			// gopanic doesn't return, so only the
+			// non-panicking paths continue.
+			nonPanicking := pathStates
+			doCall(instr, []*ssa.Function{fns.gopanic})
+			pathStates = nonPanicking
+
+		case *ssa.Send:
+			pathStates.MapInPlace(func(ps PathState) PathState {
+				return s.doSend(ps, instr, instr.Chan)
+			})
+			doCall(instr, []*ssa.Function{fns.chansend1})
+
+		case *ssa.UnOp:
+			if instr.Op == token.ARROW {
+				pathStates.MapInPlace(func(ps PathState) PathState {
+					return s.doRecv(ps, instr, instr.X)
+				})
+			}
+
+		case *ssa.Select:
+			// A select is a branch point. Fork the path
+			// states across its cases, including the
+			// default case of a non-blocking select.
+			in := pathStates
+			out := NewPathStateSet()
+			first := 0
+			if !instr.Blocking {
+				first = -1
+			}
+			for i := first; i < len(instr.States); i++ {
+				pathStates = NewPathStateSet()
+				in.ForEach(func(ps PathState) {
+					pathStates.Add(s.doSelectCase(ps, instr, i))
+				})
+				if i >= 0 && instr.States[i].Dir == types.SendOnly {
+					doCall(instr, []*ssa.Function{fns.chansend1})
+				}
+				pathStates.ForEach(out.Add)
+			}
+			pathStates = out
+
+		case *ssa.MakeInterface:
+			pathStates.MapInPlace(func(ps PathState) PathState {
+				return escapeChans(ps, instr)
+			})
+			if callees := runtimeCallees(instr); callees != nil {
+				doCall(instr, callees)
+			}
+
+		case *ssa.TypeAssert:
+			if !isInterface(instr.AssertedType) {
+				// Asserting to a concrete type
+				// compares the type words inline and
+				// panics (via panicdottype) on failure.
+				if instr.CommaOk {
+					break
+				}
+				// gopanic doesn't return, so only the
+				// non-panicking paths continue.
+				nonPanicking := pathStates
+				doCall(instr, []*ssa.Function{fns.gopanic})
+				pathStates = nonPanicking
+				break
+			}
+			if callees := runtimeCallees(instr); callees != nil {
+				doCall(instr, callees)
+			}
+
+		case *ssa.Store, *ssa.MakeClosure:
+			pathStates.MapInPlace(func(ps PathState) PathState {
+				return escapeChans(ps, instr)
+			})
+
+		case *ssa.Defer:
+			// The call runs at RunDefers or Panic, on
+			// the paths that executed this.
+			pathStates.MapInPlace(func(ps PathState) PathState {
+				ps = escapeChans(ps, instr)
+				ps.defers = ps.defers.Push(instr)
+				return ps
+			})
+
+		case *ssa.Go:
+			pathStates.MapInPlace(func(ps PathState) PathState {
+				return escapeChans(ps, instr)
+			})
+			for _, o := range s.callees(instr) {
+				//log.Printf("found go %s; adding to roots", o)
+				s.addRoot(o)
+				s.found(goRootEffect(o.String()))
+				s.checkGoSpawn(o, instr, pathStates)
+			}
+
+		case *ssa.Return:
+			// We've reached function exit. Add the
+			// current lock sets to exitLockSets.
+			//
+			// TODO: Handle defers.
+
+			pathStates.ForEach(func(ps PathState) {
+				ps.ret = instr
+				exitStates.Add(ps.ExitState())
+				if debugTree != nil {
+					var buf bytes.Buffer
+					ps.WriteTo(&buf)
+					debugTree.Leaff("exit:\n%s", buf)
+				}
+			})
+		}
+	}
+
+	if len(pathStates.m) == 0 && debugTree != nil {
+		// This happens after functions that don't return.
+		debugTree.Leaf("no path states")
+	}
+
+	// Process successor blocks.
+	pathStates.ForEach(func(ps PathState) {
+		// If this is an "if", see if we have enough
+		// information to determine its direction.
+		succs := b.Succs
+		if ifCond != nil {
+			x := ps.vs.Get(ifCond)
+			if x != nil {
+				//log.Printf("determined control flow at %s: %v", s.fset.Position(exitPos(b)), x)
+				if constant.BoolVal(x.(DynConst).c) {
+					// Take true path.
+					succs = succs[:1]
+				} else {
+					// Take false path.
+					succs = succs[1:]
+				}
+			}
+		}
+
+		// Process block successors.
+		for _, b2 := range succs {
+			ps2 := ps
+			ps2.block = b2
+			if ifCond != nil {
+				// Bind ifCond, and whatever it implies
+				// about its operands, to the branch
+				// taken. succs may have been narrowed
+				// to just the false branch, so check
+				// b2 itself.
+				ps2.vs = ps2.vs.Assume(ifCond, b2 == b.Succs[0])
+			}
+
+			// Propagate values over phis at the beginning
+			// of b2.
+			for _, instr := range b2.Instrs {
+				instr, ok := instr.(*ssa.Phi)
+				if !ok {
+					break
+				}
+				for i, inval := range instr.Edges {
+					if b2.Preds[i] == b {
+						x := ps2.vs.Get(inval)
+						if x != nil {
+							ps2.vs = ps2.vs.Extend(instr, x)
+						}
+					}
+				}
+			}
+
+			if debugTree != nil && len(b.Succs) > 1 {
+				if b2 == b.Succs[0] {
+					debugTree.SetEdge("T")
+				} else if b2 == b.Succs[1] {
+					debugTree.SetEdge("F")
+				}
+			}
+			s.walkBlock(blockCache, ps2, exitStates)
+		}
+	})
+}
+
+// blockPos returns the best position it can for b.
+func blockPos(b *ssa.BasicBlock) token.Pos {
+	var visited []bool
+	for {
+		if visited != nil {
+			if visited[b.Index] {
+				// Give up.
+				return b.Parent().Pos()
+			}
+			visited[b.Index] = true
+		}
+		// Phis have useless line numbers. Find the first
+		// "real" instruction.
+		for _, i := range b.Instrs {
+			if _, ok := i.(*ssa.Phi); ok || !i.Pos().IsValid() {
+				continue
+			}
+			return i.Pos()
+		}
+		if len(b.Preds) == 0 {
+			return b.Parent().Pos()
+		}
+		// Try b's predecessor.
+		if visited == nil {
+			// Delayed allocation of visited.
+			visited = make([]bool, len(b.Parent().Blocks))
+			visited[b.Index] = true
+		}
+		b = b.Preds[0]
+	}
+}
@@ -0,0 +1,2131 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package analysis
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"go/build"
+	"go/token"
+	"go/types"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/tools/go/callgraph"
+	"golang.org/x/tools/go/ssa"
+)
+
+// analyzeTestdata runs the analysis over the fake runtime in
+// testdata/src/runtime, starting from roots.
+func analyzeTestdata(t *testing.T, roots ...string) *state {
+	return analyzeTestdataOpts(t, options{rootLocks: "warn"}, roots...)
+}
+
+// analyzeTestdataOpts is like analyzeTestdata, but uses the given
+// analysis options.
+func analyzeTestdataOpts(t *testing.T, opts options, roots ...string) *state {
+	goroot, err := filepath.Abs("testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctxt := build.Default
+	ctxt.GOROOT = goroot
+	ctxt.GOPATH = ""
+	s, err := analyze(&ctxt, roots, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// cycleStrings returns the lock cycles found by s, each formatted as
+// "a -> b -> ..." and rotated to start at its least lock name.
+func cycleStrings(s *state) []string {
+	var out []string
+	for _, cycle := range s.lockOrder.FindCycles() {
+		names := make([]string, len(cycle))
+		least := 0
+		for i, id := range cycle {
+			names[i] = s.lockOrder.name(id)
+			if names[i] < names[least] {
+				least = i
+			}
+		}
+		names = append(names[least:], names[:least]...)
+		out = append(out, strings.Join(names, " -> "))
+	}
+	sort.Strings(out)
+	return out
+}
+
+// hasEdge returns whether s's lock graph has an edge from lock class
+// from to lock class to.
+func hasEdge(s *state, from, to string) bool {
+	for edge := range s.lockOrder.m {
+		if s.lockOrder.name(edge.fromId) == from && s.lockOrder.name(edge.toId) == to {
+			return true
+		}
+	}
+	return false
+}
+
+func checkCycles(t *testing.T, s *state, want ...string) {
+	got := cycleStrings(s)
+	sort.Strings(want)
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("want cycles %q, got %q", want, got)
+	}
+}
+
+func TestNotesleep(t *testing.T) {
+	s := analyzeTestdata(t, "noteSleepLocked", "noteWakeupLocked")
+	checkCycles(t, s, "runtime.noteLock -> runtime.noteN")
+}
+
+func TestABBA(t *testing.T) {
+	s := analyzeTestdata(t, "lockAB", "lockBA")
+	checkCycles(t, s, "runtime.lockA -> runtime.lockB")
+}
+
+func TestLockClassOverrides(t *testing.T) {
+	parse := func(src string) []LockClassOverride {
+		overrides, err := ParseLockClassOverrides(strings.NewReader(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return overrides
+	}
+
+	// Without an override, ovChild's lock is in the same class
+	// as ovParent's.
+	s := analyzeTestdata(t, "ovLockChild")
+	if len(s.doubleLocks) != 1 {
+		t.Errorf("want double lock, got %d", len(s.doubleLocks))
+	}
+
+	// Split ovChild's lock into its own class by its lock path.
+	s = analyzeTestdataOpts(t, options{rootLocks: "warn", classOverrides: parse(`
+# The child is always locked after its parent.
+runtime.ovChild.mu ovChild
+`)}, "ovLockChild")
+	if len(s.doubleLocks) != 0 || len(s.diags) != 0 {
+		t.Errorf("want no double locks or diagnostics, got %d, %v", len(s.doubleLocks), s.diags)
+	}
+	if !hasEdge(s, "runtime.ovNode.mu*", "ovChild*") {
+		t.Errorf("want edge runtime.ovNode.mu* -> ovChild*")
+	}
+
+	// Renaming a class by its name applies to all of its locks,
+	// so the cycle remains.
+	s = analyzeTestdataOpts(t, options{rootLocks: "warn", classOverrides: parse("runtime.lockA otherA")}, "lockAB", "lockBA")
+	if !hasEdge(s, "otherA*", "runtime.lockB") || !hasEdge(s, "runtime.lockB", "otherA*") {
+		t.Errorf("want cycle between otherA* and runtime.lockB, got %v", cycleStrings(s))
+	}
+
+	if _, err := ParseLockClassOverrides(strings.NewReader("runtime.lockA")); err == nil {
+		t.Errorf("want error for missing class")
+	}
+	if _, err := ParseLockClassOverrides(strings.NewReader("abba.go:18 otherA")); err == nil {
+		t.Errorf("want error for file:line")
+	}
+}
+
+func TestConservative(t *testing.T) {
+	s := analyzeTestdata(t, "callHookLocked")
+	if len(s.lockOrder.m) != 0 {
+		t.Errorf("want no lock edges, got %d", len(s.lockOrder.m))
+	}
+
+	s = analyzeTestdataOpts(t, options{rootLocks: "warn", conservative: true}, "callHookLocked")
+	if len(s.unresolvedCalls) != 1 {
+		t.Errorf("want 1 unresolved call, got %d", len(s.unresolvedCalls))
+	}
+	if !hasEdge(s, "runtime.hookLock", s.unresolvedLock.String()) {
+		t.Errorf("want edge runtime.hookLock -> %s", s.unresolvedLock)
+	}
+}
+
+func TestClosure(t *testing.T) {
+	// If we didn't track which function f is on each path, we
+	// would think that closureA or closureB could still be held
+	// when acquiring closureOuter.
+	s := analyzeTestdata(t, "lockViaClosure")
+	if len(s.lockOrder.m) != 0 {
+		t.Errorf("want no lock edges, got %d", len(s.lockOrder.m))
+	}
+
+	// The method value closure must bind its receiver on each path,
+	// or it would seem to release either lock.
+	s = analyzeTestdata(t, "lockViaMethodValue")
+	if len(s.lockOrder.m) != 0 {
+		t.Errorf("method value: want no lock edges, got %d", len(s.lockOrder.m))
+	}
+	if len(s.diags) != 0 {
+		t.Errorf("method value: want no diagnostics, got %v", s.diags)
+	}
+}
+
+func TestLockViaVar(t *testing.T) {
+	// lockClass must resolve l to the global it points to on
+	// each path.
+	s := analyzeTestdata(t, "lockViaVar")
+	for _, from := range []string{"runtime.lockVarA", "runtime.lockVarB"} {
+		if !hasEdge(s, from, "runtime.lockVarOuter") {
+			t.Errorf("want edge %s -> runtime.lockVarOuter", from)
+		}
+	}
+	if len(s.diags) != 0 {
+		t.Errorf("want no diagnostics, got %v", s.diags)
+	}
+}
+
+func TestHigherOrder(t *testing.T) {
+	// applyLocked's f must be tracked from each call site, or
+	// each caller would seem to acquire both applyB and applyC.
+	for _, test := range []struct {
+		root         string
+		wantB, wantC bool
+	}{
+		{"applyOnlyB", true, false},
+		{"applyOnlyC", false, true},
+		{"applyBoth", true, true},
+	} {
+		s := analyzeTestdata(t, test.root)
+		if got := hasEdge(s, "runtime.applyHeld", "runtime.applyB"); got != test.wantB {
+			t.Errorf("%s: edge to applyB is %v, want %v", test.root, got, test.wantB)
+		}
+		if got := hasEdge(s, "runtime.applyHeld", "runtime.applyC"); got != test.wantC {
+			t.Errorf("%s: edge to applyC is %v, want %v", test.root, got, test.wantC)
+		}
+	}
+}
+
+func TestSeverity(t *testing.T) {
+	s := analyzeTestdata(t, "lockAA")
+	if s.diagCounts[SevError] != 1 {
+		t.Errorf("want 1 error, got %d", s.diagCounts[SevError])
+	}
+	if !s.failed(SevWarning) {
+		t.Errorf("want failure at severity warning")
+	}
+
+	s = analyzeTestdata(t, "lockAB")
+	if s.failed(SevInfo) {
+		t.Errorf("want no diagnostics, got %v", s.diagCounts)
+	}
+
+	if sev, err := ParseSeverity("warning"); err != nil || sev != SevWarning {
+		t.Errorf("ParseSeverity(%q) = %v, %v; want %v", "warning", sev, err, SevWarning)
+	}
+	if _, err := ParseSeverity("fatal"); err == nil {
+		t.Errorf("want error for unknown severity")
+	}
+}
+
+func TestWriteJSONL(t *testing.T) {
+	s := analyzeTestdata(t, "lockAB", "lockBA")
+	var buf bytes.Buffer
+	s.lockOrder.WriteJSONL(&buf)
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("want 1 line, got %d:\n%s", len(lines), buf.String())
+	}
+	var rec jsonlCycle
+	if err := json.Unmarshal([]byte(lines[0]), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.Locks) != 2 || len(rec.Edges) != 2 {
+		t.Fatalf("want 2 locks and 2 edges, got %+v", rec)
+	}
+	// Both edges have 1 path, so the tie goes to the edge from
+	// the later lock class.
+	if rec.Fix < 0 || rec.Locks[rec.Fix] != "runtime.lockB" {
+		t.Errorf("want fix of edge from runtime.lockB, got fix %d", rec.Fix)
+	}
+	if rec.Severity != "error" {
+		t.Errorf("want severity error, got %q", rec.Severity)
+	}
+	for i, edge := range rec.Edges {
+		if edge.From != rec.Locks[i] || edge.To != rec.Locks[(i+1)%2] {
+			t.Errorf("edge %d is %s -> %s, want %s -> %s", i, edge.From, edge.To, rec.Locks[i], rec.Locks[(i+1)%2])
+		}
+		if len(edge.Paths) != 1 || len(edge.Paths[0].To) == 0 {
+			t.Errorf("edge %d: want 1 path, got %+v", i, edge.Paths)
+		}
+	}
+}
+
+func TestGroupPaths(t *testing.T) {
+	path := func(line, col int) Path {
+		pos := token.Position{Filename: "x.go", Line: line, Column: col}
+		return Path{"f", []Frame{{"acquires a", pos}}, []Frame{{"acquires b", pos}}}
+	}
+	groups := groupPaths([]Path{path(2, 1), path(1, 5), path(1, 3)})
+	if len(groups) != 2 {
+		t.Fatalf("want 2 groups, got %+v", groups)
+	}
+	if groups[0].count != 2 || groups[0].path.From[0].Pos.Line != 1 {
+		t.Errorf("want first group of 2 paths at line 1, got %+v", groups[0])
+	}
+	if groups[1].count != 1 || groups[1].path.From[0].Pos.Line != 2 {
+		t.Errorf("want second group of 1 path at line 2, got %+v", groups[1])
+	}
+	var buf bytes.Buffer
+	printPathGroup(&buf, groups[0])
+	if !strings.Contains(buf.String(), "(2 paths like this)") {
+		t.Errorf("missing count in report:\n%s", buf.String())
+	}
+}
+
+func TestWriteSARIF(t *testing.T) {
+	s := analyzeTestdata(t, "lockAB", "lockBA")
+	var buf bytes.Buffer
+	s.lockOrder.WriteSARIF(&buf)
+	var out sarifLog
+	if err := json.Unmarshal(buf.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Version != "2.1.0" || len(out.Runs) != 1 {
+		t.Fatalf("want 1 SARIF 2.1.0 run, got %+v", out)
+	}
+	results := out.Runs[0].Results
+	if len(results) != 1 {
+		t.Fatalf("want 1 result, got %d", len(results))
+	}
+	res := results[0]
+	if res.Level != "error" {
+		t.Errorf("want level error, got %q", res.Level)
+	}
+	if res.RuleID != "deadlock/cycle" || !strings.Contains(res.Message.Text, "runtime.lockA") {
+		t.Errorf("unexpected result %s: %s", res.RuleID, res.Message.Text)
+	}
+	if len(res.Locations) != 1 || !strings.HasSuffix(res.Locations[0].PhysicalLocation.ArtifactLocation.URI, "/abba.go") {
+		t.Errorf("want primary location in abba.go, got %+v", res.Locations)
+	}
+	if len(res.CodeFlows) != 1 || len(res.CodeFlows[0].ThreadFlows) != 2 {
+		t.Fatalf("want 1 code flow with 2 thread flows, got %+v", res.CodeFlows)
+	}
+	for i, tf := range res.CodeFlows[0].ThreadFlows {
+		if len(tf.Locations) == 0 {
+			t.Errorf("thread flow %d has no locations", i)
+		}
+	}
+}
+
+func TestUnreachableLockOps(t *testing.T) {
+	s := analyzeTestdata(t, "lockAB")
+	byFn := make(map[string]int)
+	for fn, instrs := range s.unreachableLockOps() {
+		byFn[fn.String()] = len(instrs)
+	}
+	if n := byFn["runtime.lockAB"]; n != 0 {
+		t.Errorf("want no unreachable lock ops in lockAB, got %d", n)
+	}
+	if n := byFn["runtime.lockBA"]; n != 4 {
+		t.Errorf("want 4 unreachable lock ops in lockBA, got %d", n)
+	}
+}
+
+func TestAcquiremLoop(t *testing.T) {
+	// m.locks and the acquirem count are widened away at the
+	// loop header. Locking and releasem afterward must treat them
+	// as unknown rather than crash.
+	for _, opts := range []options{
+		{rootLocks: "warn"},
+		{rootLocks: "warn", checkPreempt: true},
+	} {
+		s := analyzeTestdataOpts(t, opts, "acquiremLoop")
+		if s.stats.Widened == 0 {
+			t.Errorf("checkPreempt=%v: want the loop to be widened", opts.checkPreempt)
+		}
+		if len(s.lca.list) < 2 {
+			t.Errorf("checkPreempt=%v: lock after the loop wasn't reached", opts.checkPreempt)
+		}
+	}
+}
+
+func TestPreempt(t *testing.T) {
+	opts := options{rootLocks: "warn", checkPreempt: true}
+	for _, test := range []struct {
+		root             string
+		warnings, errors int
+	}{
+		{"acquiremBalanced", 0, 0},
+		{"acquiremLeak", 1, 0},
+		{"acquiremBlock", 0, 1},
+		{"acquiremCallee", 0, 1},
+	} {
+		s := analyzeTestdataOpts(t, opts, test.root)
+		if s.diagCounts[SevWarning] != test.warnings || s.diagCounts[SevError] != test.errors {
+			t.Errorf("%s: want %d warning(s) and %d error(s), got %d and %d", test.root, test.warnings, test.errors, s.diagCounts[SevWarning], s.diagCounts[SevError])
+		}
+	}
+}
+
+func TestDiagLimit(t *testing.T) {
+	var buf bytes.Buffer
+	s := &state{fset: token.NewFileSet(), opts: options{diagOut: &buf, maxWarnings: 2}}
+	s.diag(SevWarning, token.NoPos, "a", "stack 1")
+	s.diag(SevWarning, token.NoPos, "a", "stack 2")
+	s.warnl(SevInfo, token.NoPos, "b")
+	s.warnl(SevWarning, token.NoPos, "c")
+	s.warnl(SevError, token.NoPos, "d")
+	s.writeDiagSummary()
+
+	// The repeat of "a" is dropped. "c" is recorded but not
+	// printed, and errors are always printed.
+	want := "warning: a at\nstack 1\ninfo: b\nerror: d\n...and 2 more (1 repeated at the same position, 1 over the warning limit)\n"
+	if buf.String() != want {
+		t.Errorf("want:\n%s\ngot:\n%s", want, buf.String())
+	}
+	if len(s.diags) != 4 {
+		t.Errorf("want 4 recorded diagnostics, got %d", len(s.diags))
+	}
+}
+
+func TestRequirePreemptoff(t *testing.T) {
+	opts := options{rootLocks: "warn", requirePreemptoff: map[string]bool{"runtime.preemptoffLock": true}}
+	for _, test := range []struct {
+		root   string
+		errors int
+	}{
+		{"preemptoffSet", 0},
+		{"preemptoffUnset", 1},
+	} {
+		s := analyzeTestdataOpts(t, opts, test.root)
+		if s.diagCounts[SevError] != test.errors {
+			t.Errorf("%s: want %d error(s), got %d", test.root, test.errors, s.diagCounts[SevError])
+		}
+	}
+}
+
+func TestRequireStack(t *testing.T) {
+	opts := options{
+		rootLocks:        "warn",
+		systemStackLocks: map[string]bool{"runtime.sysLock": true},
+		userStackLocks:   map[string]bool{"runtime.userLock": true},
+	}
+	for _, test := range []struct {
+		root, err string
+	}{
+		{"sysLockSystem", ""},
+		{"sysLockUser", "runtime.sysLock acquired on the user stack"},
+		{"sysLockReturn", "runtime.sysLock held while switching to the user stack"},
+		{"userLockUser", ""},
+		{"userLockSystem", "runtime.userLock acquired on the system stack"},
+		{"userLockSwitch", "runtime.userLock held while switching to the system stack"},
+	} {
+		s := analyzeTestdataOpts(t, opts, test.root)
+		var errs []string
+		for _, d := range s.diags {
+			if d.Sev == SevError {
+				errs = append(errs, d.Msg)
+			}
+		}
+		if test.err == "" {
+			if len(errs) != 0 {
+				t.Errorf("%s: want no errors, got %q", test.root, errs)
+			}
+		} else if len(errs) != 1 || !strings.HasPrefix(errs[0], test.err+" at\n") {
+			t.Errorf("%s: want error %q, got %q", test.root, test.err, errs)
+		}
+	}
+}
+
+func TestReleasemTrim(t *testing.T) {
+	s := analyzeTestdata(t, "releasemUnbalanced")
+	if hasEdge(s, "runtime.mlocksA", "runtime.mlocksB") {
+		t.Errorf("path with negative m.locks was not trimmed")
+	}
+	if s.diagCounts[SevWarning] == 0 {
+		t.Errorf("want warning for releasem with m.locks <= 0")
+	}
+}
+
+func TestWriteContext(t *testing.T) {
+	var s state
+	p := token.Position{Filename: filepath.Join("testdata", "context", "context.go"), Line: 4, Column: 7}
+	for _, test := range []struct {
+		n    int
+		want string
+	}{
+		{0, "     4 | \tx := g(1)\n       | \t     ^\n"},
+		{1, "     3 | func f() {\n     4 | \tx := g(1)\n       | \t     ^\n     5 | }\n"},
+	} {
+		var buf bytes.Buffer
+		s.writeContext(&buf, p, test.n)
+		if buf.String() != test.want {
+			t.Errorf("context %d: want\n%s\ngot\n%s", test.n, test.want, buf.String())
+		}
+	}
+}
+
+func TestInitOrder(t *testing.T) {
+	s := analyzeTestdata(t, "schedinit")
+	if s.diagCounts[SevError] != 0 {
+		t.Errorf("want no errors without init-order check, got %d", s.diagCounts[SevError])
+	}
+
+	s = analyzeTestdataOpts(t, options{rootLocks: "warn", checkInitOrder: true})
+	if s.diagCounts[SevError] != 1 {
+		t.Errorf("want 1 error, got %d", s.diagCounts[SevError])
+	}
+}
+
+func TestCopy(t *testing.T) {
+	for _, test := range []struct {
+		root, want, notWant string
+	}{
+		{"copyScalars", "runtime.slicecopyLock", "runtime.typedslicecopyLock"},
+		{"copyPointers", "runtime.typedslicecopyLock", "runtime.slicecopyLock"},
+	} {
+		s := analyzeTestdata(t, test.root)
+		if !hasEdge(s, "runtime.copyLock", test.want) {
+			t.Errorf("%s: want edge runtime.copyLock -> %s", test.root, test.want)
+		}
+		if hasEdge(s, "runtime.copyLock", test.notWant) {
+			t.Errorf("%s: unexpected edge runtime.copyLock -> %s", test.root, test.notWant)
+		}
+	}
+}
+
+func TestMapRange(t *testing.T) {
+	s := analyzeTestdata(t, "rangeMap")
+	for _, lock := range []string{"runtime.mapiterinitLock", "runtime.mapiternextLock"} {
+		if !hasEdge(s, "runtime.rangeLock", lock) {
+			t.Errorf("rangeMap: want edge runtime.rangeLock -> %s", lock)
+		}
+	}
+
+	s = analyzeTestdata(t, "rangeString")
+	for _, lock := range []string{"runtime.mapiterinitLock", "runtime.mapiternextLock"} {
+		if hasEdge(s, "runtime.rangeLock", lock) {
+			t.Errorf("rangeString: unexpected edge runtime.rangeLock -> %s", lock)
+		}
+	}
+}
+
+func TestAlloc(t *testing.T) {
+	s := analyzeTestdata(t, "allocNew")
+	if !hasEdge(s, "runtime.allocLock", "runtime.newobjectLock") {
+		t.Errorf("allocNew: want edge runtime.allocLock -> runtime.newobjectLock")
+	}
+
+	s = analyzeTestdata(t, "allocCaptured")
+	if hasEdge(s, "runtime.allocLock", "runtime.newobjectLock") {
+		t.Errorf("allocCaptured: unexpected edge runtime.allocLock -> runtime.newobjectLock")
+	}
+}
+
+func TestIface(t *testing.T) {
+	for _, test := range []struct {
+		root string
+		want []string
+	}{
+		{"boxInt", []string{"runtime.convLock"}},
+		{"boxPointer", nil},
+		{"assertConcrete", []string{"runtime.panicLock"}},
+		{"assertConcreteOk", nil},
+		{"assertIface", []string{"runtime.assertLock"}},
+	} {
+		s := analyzeTestdata(t, test.root)
+		for _, lock := range []string{"runtime.convLock", "runtime.assertLock", "runtime.panicLock"} {
+			want := false
+			for _, w := range test.want {
+				want = want || w == lock
+			}
+			if got := hasEdge(s, "runtime.ifaceLock", lock); got != want {
+				t.Errorf("%s: edge runtime.ifaceLock -> %s is %v, want %v", test.root, lock, got, want)
+			}
+		}
+	}
+}
+
+func TestGoRoots(t *testing.T) {
+	for _, test := range []struct {
+		roots []string
+		want  int
+	}{
+		{[]string{"spawnLocked"}, 1},
+		{[]string{"spawnUnlocked"}, 0},
+		// Explicit roots aren't reported.
+		{[]string{"spawnLocked", "spawned"}, 0},
+	} {
+		s := analyzeTestdata(t, test.roots...)
+		if s.diagCounts[SevInfo] != test.want {
+			t.Errorf("%v: want %d info diagnostic(s), got %d", test.roots, test.want, s.diagCounts[SevInfo])
+		}
+	}
+}
+
+func TestIncremental(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rtcheck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	opts := options{rootLocks: "warn", incremental: filepath.Join(dir, "state.json")}
+	roots := []string{"lockViaClosure", "lockAB", "lockBA"}
+
+	rootNames := func(s *state) []string {
+		var names []string
+		for _, root := range s.roots {
+			names = append(names, root.Name())
+		}
+		sort.Strings(names)
+		return names
+	}
+	// changeHash simulates a change to fn by corrupting its hash
+	// in the saved state.
+	changeHash := func(fn string) {
+		st, err := readIncrementalState(opts.incremental)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, ok := st.Funcs[fn]
+		if !ok {
+			t.Fatalf("no state for %s", fn)
+		}
+		info.Hash = "changed"
+		st.Funcs[fn] = info
+		data, err := json.Marshal(st)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(opts.incremental, data, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The first run analyzes everything.
+	full := analyzeTestdataOpts(t, opts, roots...)
+	if got := rootNames(full); len(got) != 3 {
+		t.Fatalf("first run: want 3 roots, got %v", got)
+	}
+
+	// Nothing changed.
+	var diags bytes.Buffer
+	opts2 := opts
+	opts2.diagOut = &diags
+	s := analyzeTestdataOpts(t, opts2, roots...)
+	if got := rootNames(s); len(got) != 0 {
+		t.Errorf("no changes: want no roots, got %v", got)
+	}
+	if !strings.Contains(diags.String(), "incremental: analyzing 0 of 3 roots\n") {
+		t.Errorf("no changes: want root count in diagnostics, got:\n%s", diags.String())
+	}
+	// The lock graph of the clean roots is carried over.
+	if got, want := strings.Join(cycleStrings(s), "\n"), strings.Join(cycleStrings(full), "\n"); got != want {
+		t.Errorf("no changes: want cycles %q, got %q", want, got)
+	}
+	var buf bytes.Buffer
+	s.lockOrder.Check(&buf)
+	if !strings.Contains(buf.String(), "acquire runtime.lockA then runtime.lockB, found from runtime.lockAB:\n") {
+		t.Errorf("no changes: merged edge lost its paths or roots:\n%s", buf.String())
+	}
+
+	// A change to a callee dirties its callers.
+	changeHash("runtime.unlockClosureA")
+	s = analyzeTestdataOpts(t, opts, roots...)
+	if got := strings.Join(rootNames(s), " "); got != "lockViaClosure" {
+		t.Errorf("callee change: want roots lockViaClosure, got %s", got)
+	}
+	if got, want := strings.Join(cycleStrings(s), "\n"), strings.Join(cycleStrings(full), "\n"); got != want {
+		t.Errorf("callee change: want cycles %q, got %q", want, got)
+	}
+
+	// When every root is dirty, we get the same result as a
+	// full run.
+	for _, root := range roots {
+		changeHash("runtime." + root)
+	}
+	s = analyzeTestdataOpts(t, opts, roots...)
+	if got := rootNames(s); len(got) != 3 {
+		t.Errorf("all changed: want 3 roots, got %v", got)
+	}
+	if got, want := strings.Join(cycleStrings(s), "\n"), strings.Join(cycleStrings(full), "\n"); got != want {
+		t.Errorf("all changed: want cycles %q, got %q", want, got)
+	}
+
+	// A goroutine started by a clean root is carried over, but
+	// re-analyzed if it changes.
+	roots = append(roots, "spawnEdge")
+	s = analyzeTestdataOpts(t, opts, roots...)
+	if got := strings.Join(rootNames(s), " "); got != "spawnEdge spawnedEdge" {
+		t.Errorf("new root: want roots spawnEdge spawnedEdge, got %s", got)
+	}
+	s = analyzeTestdataOpts(t, opts, roots...)
+	if got := rootNames(s); len(got) != 0 || !hasEdge(s, "runtime.spawnLock", "runtime.lockA") {
+		t.Errorf("no changes: want no roots and edge from clean goroutine, got roots %v", got)
+	}
+	changeHash("runtime.spawnedEdge")
+	s = analyzeTestdataOpts(t, opts, roots...)
+	if got := strings.Join(rootNames(s), " "); got != "spawnedEdge" || !hasEdge(s, "runtime.spawnLock", "runtime.lockA") {
+		t.Errorf("goroutine change: want roots spawnedEdge and its edge, got %s", got)
+	}
+
+	// Roots that are no longer requested are dropped, along with
+	// the goroutines they started.
+	s = analyzeTestdataOpts(t, opts, "lockAB", "lockBA")
+	if got := rootNames(s); len(got) != 0 {
+		t.Errorf("dropped roots: want no roots, got %v", got)
+	}
+	if hasEdge(s, "runtime.spawnLock", "runtime.lockA") {
+		t.Errorf("dropped roots: edge from dropped goroutine root was carried over")
+	}
+	if cycles := cycleStrings(s); len(cycles) != 1 {
+		t.Errorf("dropped roots: want the lockA/lockB cycle, got %v", cycles)
+	}
+}
+
+// incrementalSummary returns what s reports per root, in a form that
+// doesn't depend on the order roots were analyzed in. Diagnostics
+// that include a stack are reported with the stack of whichever root
+// found them first, so only their first line is compared.
+func incrementalSummary(s *state) string {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetIndent("", "\t")
+	enc.Encode(s.lockOrder.saved())
+	enc.Encode(s.lockOrder.savedBlocking())
+
+	diags := make(map[string]map[string]struct{})
+	for i, d := range s.diags {
+		key := fmt.Sprintf("%s: %s: %s", d.Pos, d.Sev, strings.SplitN(d.Msg, "\n", 2)[0])
+		for root := range s.diagSrcs[i].roots {
+			diags[key] = addName(diags[key], root)
+		}
+	}
+	doubleLocks := make(map[string]map[string]struct{})
+	for d, roots := range s.doubleLockRoots {
+		for root := range roots {
+			doubleLocks[d.lock.String()] = addName(doubleLocks[d.lock.String()], root)
+		}
+	}
+	for _, m := range []map[string]map[string]struct{}{diags, doubleLocks} {
+		keys := make([]string, 0, len(m))
+		for key := range m {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(&buf, "%s from %s\n", key, strings.Join(sortedNames(m[key]), ", "))
+		}
+	}
+
+	leaks := append([]string(nil), s.rootLockLeaks...)
+	sort.Strings(leaks)
+	fmt.Fprintf(&buf, "leaks: %s\n", strings.Join(leaks, ", "))
+	return buf.String()
+}
+
+func TestIncrementalMatchesFull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rtcheck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	roots := []string{"lockAB", "lockBA", "lockABBA", "lockBC", "lockCA", "lockViaClosure", "doubleLockOuter", "rlockTwice", "sendLocked", "recvLocked", "goschedHeld", "releasemUnbalanced", "unbalTryLock", "unbalRoot", "spawnLocked", "spawnEdge"}
+	opts := options{rootLocks: "error", checkBlocking: true, checkPreempt: true, checkGosched: true}
+	want := incrementalSummary(analyzeTestdataOpts(t, opts, roots...))
+
+	opts.incremental = filepath.Join(dir, "state.json")
+	if got := incrementalSummary(analyzeTestdataOpts(t, opts, roots...)); got != want {
+		t.Fatalf("first incremental run differs from full run:\n%s\nwant:\n%s", got, want)
+	}
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 20; i++ {
+		// Change a random set of the explored functions.
+		st, err := readIncrementalState(opts.incremental)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var changed []string
+		for name, info := range st.Funcs {
+			if rng.Intn(8) == 0 {
+				info.Hash = "changed"
+				st.Funcs[name] = info
+				changed = append(changed, name)
+			}
+		}
+		sort.Strings(changed)
+		data, err := json.Marshal(st)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(opts.incremental, data, 0666); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := incrementalSummary(analyzeTestdataOpts(t, opts, roots...)); got != want {
+			t.Fatalf("changing %v: incremental run differs from full run:\n%s\nwant:\n%s", changed, got, want)
+		}
+	}
+}
+
+func TestCallGraphCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rtcheck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	opts := options{rootLocks: "warn", keepSynthetic: true, cacheDir: dir}
+	roots := []string{"lockViaClosure", "lockAB", "lockBA"}
+
+	// edges returns the call graph edges of s, formatted as
+	// "caller -> callee at site".
+	edges := func(s *state) []string {
+		var out []string
+		callgraph.GraphVisitEdges(s.cg, func(e *callgraph.Edge) error {
+			if e.Caller != s.cg.Root {
+				out = append(out, fmt.Sprintf("%s -> %s at %v", e.Caller.Func, e.Callee.Func, e.Site))
+			}
+			return nil
+		})
+		sort.Strings(out)
+		return out
+	}
+
+	// The first run fills the cache.
+	full := analyzeTestdataOpts(t, opts, roots...)
+	if full.pta == nil {
+		t.Fatal("first run: call graph read from empty cache")
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "callgraph-*.json")); len(files) != 1 {
+		t.Fatalf("want 1 cache entry, got %v", files)
+	}
+
+	// The second run uses it and gets the same results. It
+	// says so on the diagnostics writer.
+	var diags bytes.Buffer
+	opts2 := opts
+	opts2.diagOut = &diags
+	s := analyzeTestdataOpts(t, opts2, roots...)
+	if s.pta != nil {
+		t.Fatal("second run: pointer analysis wasn't skipped")
+	}
+	if !strings.Contains(diags.String(), "cache: using call graph from "+dir) {
+		t.Errorf("want cache use in diagnostics, got:\n%s", diags.String())
+	}
+	if got, want := strings.Join(edges(s), "\n"), strings.Join(edges(full), "\n"); got != want {
+		t.Errorf("cached call graph differs:\nwant:\n%s\ngot:\n%s", want, got)
+	}
+	if got, want := strings.Join(cycleStrings(s), "\n"), strings.Join(cycleStrings(full), "\n"); got != want {
+		t.Errorf("want cycles %q, got %q", want, got)
+	}
+
+	// Different roots change the rewritten sources, so they
+	// don't use the cache.
+	s = analyzeTestdataOpts(t, opts, "lockAB")
+	if s.pta == nil {
+		t.Error("changed roots: call graph read from stale cache")
+	}
+}
+
+func TestReportsDeterministic(t *testing.T) {
+	// Reports must not depend on map iteration order, so
+	// rendering them repeatedly gives the same output.
+	s := analyzeTestdata(t, "lockAB", "lockBA", "lockABBA", "lockBC", "lockCA")
+	s.lockOrder.allocLocks = map[string]bool{"runtime.lockA": true}
+	spec, err := ParseLockSpec(strings.NewReader("runtime.lockA < runtime.lockB < runtime.lockC"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, report := range []struct {
+		name  string
+		write func(w io.Writer)
+	}{
+		{"Check", s.lockOrder.Check},
+		{"WriteJSONL", s.lockOrder.WriteJSONL},
+		{"WriteAllocEdges", s.lockOrder.WriteAllocEdges},
+		{"CheckSpec", func(w io.Writer) { s.lockOrder.CheckSpec(w, spec) }},
+	} {
+		var first string
+		for i := 0; i < 20; i++ {
+			// Don't reuse the cycles found last time.
+			s.lockOrder.cycles = nil
+			var buf bytes.Buffer
+			report.write(&buf)
+			if i == 0 {
+				first = buf.String()
+			} else if buf.String() != first {
+				t.Errorf("%s: output changed between runs:\n%s\nthen:\n%s", report.name, first, buf.String())
+				break
+			}
+		}
+	}
+}
+
+func TestHTMLIndex(t *testing.T) {
+	s := analyzeTestdata(t, "lockAB", "lockBA", "rlockThenLock")
+	cycles, index := s.lockOrder.htmlIndex(map[lockOrderEdge]string{})
+	if len(cycles) != 2 {
+		t.Fatalf("want 2 cycles, got %d", len(cycles))
+	}
+	// Self-deadlocks come first in the table of contents.
+	for i, want := range []string{"self-deadlock", "cycle"} {
+		if cycles[i].Kind != want {
+			t.Errorf("cycle %d: want kind %s, got %s", i, want, cycles[i].Kind)
+		}
+		if cycles[i].Paths == 0 {
+			t.Errorf("cycle %d: want paths, got 0", i)
+		}
+		if cycles[i].Severity != "error" {
+			t.Errorf("cycle %d: want severity error, got %q", i, cycles[i].Severity)
+		}
+	}
+	// Cycle numbers depend on lock class IDs, which depend on
+	// the order roots are explored, so identify each cycle by its
+	// sorted locks.
+	var got []string
+	for _, owner := range index {
+		for _, class := range owner.Classes {
+			var inCycles []string
+			for _, c := range class.Cycles {
+				locks := append([]string(nil), cycles[c].Locks...)
+				sort.Strings(locks)
+				inCycles = append(inCycles, strings.Join(locks, ","))
+			}
+			got = append(got, fmt.Sprintf("%s: %s %v", owner.Owner, class.Name, inCycles))
+		}
+	}
+	want := []string{
+		"package runtime: runtime.lockA [runtime.lockA,runtime.lockB]",
+		"package runtime: runtime.lockB [runtime.lockA,runtime.lockB]",
+		"package runtime: runtime.rwLock []",
+		"package runtime: runtime.rwLock(read) [runtime.rwLock(read)]",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("want index:\n%s\ngot:\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+func TestWriteToGraphML(t *testing.T) {
+	s := analyzeTestdata(t, "lockAB", "lockBA", "lockBC")
+	var buf bytes.Buffer
+	s.lockOrder.WriteToGraphML(&buf)
+
+	type data struct {
+		Key   string `xml:"key,attr"`
+		Value string `xml:",chardata"`
+	}
+	var doc struct {
+		Nodes []struct {
+			ID   string `xml:"id,attr"`
+			Data []data `xml:"data"`
+		} `xml:"graph>node"`
+		Edges []struct {
+			Source string `xml:"source,attr"`
+			Target string `xml:"target,attr"`
+			Data   []data `xml:"data"`
+		} `xml:"graph>edge"`
+	}
+	if err := xml.Unmarshal(buf.Bytes(), &doc); err != nil {
+		t.Fatalf("%v:\n%s", err, buf.String())
+	}
+	labels := make(map[string]string)
+	for _, n := range doc.Nodes {
+		labels[n.ID] = n.Data[0].Value
+	}
+	var got []string
+	for _, e := range doc.Edges {
+		edge := labels[e.Source] + " -> " + labels[e.Target]
+		for _, d := range e.Data {
+			edge += fmt.Sprintf(" %s=%s", d.Key, d.Value)
+		}
+		got = append(got, edge)
+	}
+	sort.Strings(got)
+	want := []string{
+		"runtime.lockA -> runtime.lockB weight=1 cycle=true",
+		"runtime.lockB -> runtime.lockA weight=1 cycle=true",
+		"runtime.lockB -> runtime.lockC weight=1",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want edges:\n%s\ngot:\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+func TestWriteToDotCyclesOnly(t *testing.T) {
+	s := analyzeTestdata(t, "lockAB", "lockBA", "lockBC")
+	s.lockOrder.cyclesOnly = true
+	var buf bytes.Buffer
+	s.lockOrder.WriteToDot(&buf)
+	out := buf.String()
+	if strings.Contains(out, "runtime.lockC") {
+		t.Errorf("non-cycle lock runtime.lockC in cycles-only graph:\n%s", out)
+	}
+	if n := strings.Count(out, "->"); n != 2*2 {
+		// Each edge has "->" in its statement and tooltip.
+		t.Errorf("want 2 edges, got:\n%s", out)
+	}
+	if n := strings.Count(out, "label=1,") + strings.Count(out, "color=red"); n != 2*2 {
+		t.Errorf("want 2 red edges labeled with their path count, got:\n%s", out)
+	}
+}
+
+func TestWriteToDotClusters(t *testing.T) {
+	// Locks from a single package aren't clustered.
+	s := analyzeTestdata(t, "lockAB", "lockBA")
+	var buf bytes.Buffer
+	s.lockOrder.WriteToDot(&buf)
+	if strings.Contains(buf.String(), "subgraph") {
+		t.Errorf("want no clusters for one package, got:\n%s", buf.String())
+	}
+
+	s = analyzeTestdataOpts(t, options{packages: []string{"mutexapp", "rwapp"}})
+	buf.Reset()
+	s.lockOrder.WriteToDot(&buf)
+	clusterRe := regexp.MustCompile(`(?s)subgraph cluster[0-9]+ \{\n    label="([^"]*)";\n(.*?)  \}`)
+	var got []string
+	for _, m := range clusterRe.FindAllStringSubmatch(buf.String(), -1) {
+		got = append(got, fmt.Sprintf("%s: %d lock(s)", m[1], strings.Count(m[2], "\n")))
+	}
+	if want := "[mutexapp: 2 lock(s) rwapp: 3 lock(s)]"; fmt.Sprint(got) != want {
+		t.Errorf("want clusters %s, got %v in:\n%s", want, got, buf.String())
+	}
+}
+
+func TestWriteToMermaid(t *testing.T) {
+	s := analyzeTestdata(t, "lockAB", "lockBA", "lockBC")
+	write := func() string {
+		var buf bytes.Buffer
+		s.lockOrder.WriteToMermaid(&buf)
+		// Replace node IDs with their labels so the result
+		// doesn't depend on lock class numbering.
+		out := buf.String()
+		labels := make(map[string]string)
+		for _, m := range regexp.MustCompile(`(?m)^  (l[0-9]+)\["(.*)"\]\n`).FindAllStringSubmatch(out, -1) {
+			labels[m[1]] = m[2]
+		}
+		out = regexp.MustCompile(`(?m)^  l[0-9]+\[.*\n`).ReplaceAllString(out, "")
+		return regexp.MustCompile(`\bl[0-9]+\b`).ReplaceAllStringFunc(out, func(id string) string {
+			return labels[id]
+		})
+	}
+	want := `graph LR
+  runtime.lockA ==>|1| runtime.lockB
+  runtime.lockB ==>|1| runtime.lockA
+  runtime.lockB --> runtime.lockC
+  linkStyle 0,1 stroke:red,stroke-width:3px
+`
+	if got := write(); got != want {
+		t.Errorf("want:\n%sgot:\n%s", want, got)
+	}
+
+	s.lockOrder.cyclesOnly = true
+	want = `graph LR
+  runtime.lockA ==>|1| runtime.lockB
+  runtime.lockB ==>|1| runtime.lockA
+  linkStyle 0,1 stroke:red,stroke-width:3px
+`
+	if got := write(); got != want {
+		t.Errorf("with cyclesOnly, want:\n%sgot:\n%s", want, got)
+	}
+}
+
+func TestSaveLoadLockOrder(t *testing.T) {
+	s := analyzeTestdata(t, "lockAB", "lockBA", "lockBC")
+	var saved bytes.Buffer
+	s.lockOrder.Save(&saved)
+
+	lo, err := LoadLockOrder(bytes.NewReader(saved.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resaved bytes.Buffer
+	lo.Save(&resaved)
+	if saved.String() != resaved.String() {
+		t.Errorf("lock graph changed by round trip; saved:\n%s\nresaved:\n%s", saved.String(), resaved.String())
+	}
+
+	// The loaded graph reports the same cycles and paths, except
+	// that positions are only lines.
+	var want, got bytes.Buffer
+	s.lockOrder.Check(&want)
+	lo.Check(&got)
+	colRe := regexp.MustCompile(`(\.go:[0-9]+):[0-9]+`)
+	if w := colRe.ReplaceAllString(want.String(), "$1"); w != got.String() {
+		t.Errorf("want report:\n%s\ngot:\n%s", w, got.String())
+	}
+}
+
+func TestDiffLockGraphs(t *testing.T) {
+	var old, new bytes.Buffer
+	analyzeTestdata(t, "lockAB").lockOrder.Save(&old)
+	analyzeTestdata(t, "lockBA", "lockBC").lockOrder.Save(&new)
+
+	var buf bytes.Buffer
+	changed, err := DiffLockGraphs(&buf, bytes.NewReader(old.Bytes()), bytes.NewReader(new.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `-edge runtime.lockA -> runtime.lockB
++edge runtime.lockB -> runtime.lockA
++edge runtime.lockB -> runtime.lockC
+`
+	if !changed || buf.String() != want {
+		t.Errorf("want diff:\n%sgot:\n%s", want, buf.String())
+	}
+
+	// Adding lockAB back to new creates a cycle.
+	new.Reset()
+	analyzeTestdata(t, "lockAB", "lockBA").lockOrder.Save(&new)
+	buf.Reset()
+	changed, err = DiffLockGraphs(&buf, bytes.NewReader(old.Bytes()), bytes.NewReader(new.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = `+edge runtime.lockB -> runtime.lockA
++cycle {runtime.lockA, runtime.lockB}
+`
+	if !changed || buf.String() != want {
+		t.Errorf("want diff:\n%sgot:\n%s", want, buf.String())
+	}
+
+	// A graph doesn't differ from itself.
+	buf.Reset()
+	changed, err = DiffLockGraphs(&buf, bytes.NewReader(new.Bytes()), bytes.NewReader(new.Bytes()))
+	if err != nil || changed || buf.Len() != 0 {
+		t.Errorf("want no diff, got %v, %v:\n%s", changed, err, buf.String())
+	}
+}
+
+func TestDoubleLock(t *testing.T) {
+	s := analyzeTestdata(t, "doubleLockOuter", "rlockTwice")
+	if len(s.doubleLocks) != 1 {
+		t.Fatalf("want 1 double lock, got %d", len(s.doubleLocks))
+	}
+	d := s.doubleLocks[0]
+	if d.lock.String() != "runtime.doubleL" {
+		t.Errorf("want double lock of runtime.doubleL, got %s", d.lock)
+	}
+	if got := d.first.call.Parent().String(); got != "runtime.doubleLockOuter" {
+		t.Errorf("want first acquisition in runtime.doubleLockOuter, got %s", got)
+	}
+	if got := d.second.call.Parent().String(); got != "runtime.doubleLockInner" {
+		t.Errorf("want second acquisition in runtime.doubleLockInner, got %s", got)
+	}
+
+	var buf bytes.Buffer
+	s.writeDoubleLocks(&buf)
+	report := buf.String()
+	first, again := strings.Index(report, "first acquired at"), strings.Index(report, "acquired again at")
+	if !strings.HasPrefix(report, "1 possible double lock(s):\n\nruntime.doubleL acquired while already held\n") || first < 0 || again < first || !strings.Contains(report[again:], "runtime.doubleLockInner") {
+		t.Errorf("bad double lock report:\n%s", report)
+	}
+
+	n := 0
+	for _, d := range s.diags {
+		if strings.Contains(d.Msg, "double lock") {
+			n++
+			if d.Sev != SevError {
+				t.Errorf("want error, got %s: %s", d.Sev, d.Msg)
+			}
+		}
+	}
+	if n != 1 {
+		t.Errorf("want 1 double lock diagnostic, got %d", n)
+	}
+}
+
+func TestSelfDeadlockReport(t *testing.T) {
+	s := analyzeTestdata(t, "lockAB", "lockBA", "lockAA")
+	var buf bytes.Buffer
+	s.lockOrder.Check(&buf)
+	report := buf.String()
+	self, cycle := strings.Index(report, "self-deadlock: runtime.lockA -> runtime.lockA"), strings.Index(report, "lock cycle:")
+	if !strings.HasPrefix(report, "1 possible self-deadlock(s):") || self < 0 || cycle < self {
+		t.Errorf("want self-deadlock reported before lock cycle:\n%s", report)
+	}
+
+	buf.Reset()
+	s.lockOrder.WriteJSONL(&buf)
+	var kinds []string
+	for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		var rec jsonlCycle
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatal(err)
+		}
+		kinds = append(kinds, rec.Kind)
+	}
+	if want := "[self-deadlock cycle]"; fmt.Sprint(kinds) != want {
+		t.Errorf("want JSONL kinds %s, got %v", want, kinds)
+	}
+
+	buf.Reset()
+	s.lockOrder.WriteSARIF(&buf)
+	var out sarifLog
+	if err := json.Unmarshal(buf.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	var rules []string
+	for _, res := range out.Runs[0].Results {
+		rules = append(rules, res.RuleID)
+	}
+	if want := "[deadlock/self deadlock/cycle]"; fmt.Sprint(rules) != want {
+		t.Errorf("want SARIF rules %s, got %v", want, rules)
+	}
+}
+
+func TestCycleDedup(t *testing.T) {
+	s := analyzeTestdata(t, "lockAB", "lockBA", "lockABBA")
+	checkCycles(t, s, "runtime.lockA -> runtime.lockB")
+	var buf bytes.Buffer
+	s.lockOrder.Check(&buf)
+	if n := strings.Count(buf.String(), "lock cycle:"); n != 1 {
+		t.Errorf("want 1 cycle in report, got %d:\n%s", n, buf.String())
+	}
+	if !strings.Contains(buf.String(), "found from 3 root(s): runtime.lockAB, runtime.lockABBA, runtime.lockBA\n") {
+		t.Errorf("report doesn't list roots:\n%s", buf.String())
+	}
+}
+
+func TestFixEdge(t *testing.T) {
+	// lockAB acquires B after A on one path, while lockBA and
+	// lockBA2 acquire A after B on two.
+	s := analyzeTestdata(t, "lockAB", "lockBA", "lockBA2")
+	var buf bytes.Buffer
+	s.lockOrder.Check(&buf)
+	if !strings.Contains(buf.String(), "  suggested fix: the 1 path(s) that acquire runtime.lockA then runtime.lockB, the fewest of any edge\n") {
+		t.Errorf("report doesn't suggest edge to fix:\n%s", buf.String())
+	}
+	cycles, _ := s.lockOrder.htmlIndex(map[lockOrderEdge]string{})
+	if len(cycles) != 1 || cycles[0].Locks[cycles[0].Fix] != "runtime.lockA" {
+		t.Errorf("want HTML cycle to fix edge from runtime.lockA, got %+v", cycles)
+	}
+
+	// When edges tie, the edge from the lexically later lock
+	// class is suggested, and the report says it's a tie.
+	s = analyzeTestdata(t, "lockAB", "lockBA")
+	buf.Reset()
+	s.lockOrder.Check(&buf)
+	if !strings.Contains(buf.String(), "  suggested fix: the 1 path(s) that acquire runtime.lockB then runtime.lockA, tied for the fewest of any edge\n") {
+		t.Errorf("report doesn't suggest edge to fix on a tie:\n%s", buf.String())
+	}
+}
+
+func TestExplain(t *testing.T) {
+	s := analyzeTestdata(t, "lockAB", "lockBA", "lockBA2", "lockBC")
+	var buf bytes.Buffer
+	if err := s.lockOrder.Explain(&buf, "lockB", "runtime.lockA"); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	if !strings.HasPrefix(out, "2 path(s) acquire runtime.lockB then runtime.lockA, found from runtime.lockBA, runtime.lockBA2:\n") {
+		t.Errorf("wrong explanation header:\n%s", out)
+	}
+	if n := strings.Count(out, "acquires runtime.lockA at "); n != 2 {
+		t.Errorf("want 2 paths, got %d:\n%s", n, out)
+	}
+	if strings.Contains(out, "runtime.lockC") {
+		t.Errorf("explanation includes other edges:\n%s", out)
+	}
+
+	err := s.lockOrder.Explain(&buf, "lockC", "lockB")
+	if err == nil || !strings.Contains(err.Error(), "there is one from lockB to lockC") {
+		t.Errorf("want error pointing to reverse edge, got %v", err)
+	}
+	if err := s.lockOrder.Explain(&buf, "lockA", "lockC"); err == nil {
+		t.Errorf("want error for missing edge")
+	}
+}
+
+func TestLockList(t *testing.T) {
+	s := analyzeTestdataOpts(t, options{rootLocks: "warn", listLocks: true}, "lockAB", "lockBA")
+	var buf bytes.Buffer
+	s.writeLockList(&buf)
+	out := regexp.MustCompile(`\S*/(abba\.go)`).ReplaceAllString(buf.String(), "$1")
+	want := `lock classes:
+  _Gscan*
+    never acquired
+  runtime.lockA
+    acquired at abba.go:10
+    acquired at abba.go:18
+  runtime.lockB
+    acquired at abba.go:11
+    acquired at abba.go:17
+`
+	if out != want {
+		t.Errorf("want:\n%s\ngot:\n%s", want, out)
+	}
+}
+
+func TestNesting(t *testing.T) {
+	s := analyzeTestdataOpts(t, options{rootLocks: "warn", nesting: 2}, "lockAB", "lockNest3")
+	var buf bytes.Buffer
+	s.writeNesting(&buf)
+	out := regexp.MustCompile(`\S*/(nest\.go)`).ReplaceAllString(buf.String(), "$1")
+	want := `deepest lock nestings:
+  3 locks held: runtime.nestA, runtime.nestB, runtime.nestC
+  acquired at
+    runtime.lockNest3
+        nest.go:13
+  2 locks held: runtime.lockA, runtime.lockB
+  acquired at
+`
+	if !strings.HasPrefix(out, want) {
+		t.Errorf("want prefix:\n%s\ngot:\n%s", want, out)
+	}
+	if strings.Contains(out, "nestA, runtime.nestB\n") {
+		t.Errorf("want only the 2 deepest nestings, got:\n%s", out)
+	}
+}
+
+func TestTraceEdge(t *testing.T) {
+	opts := options{rootLocks: "warn", traceEdge: [2]string{"lockB", "lockA"}}
+	s := analyzeTestdataOpts(t, opts, "lockAB", "lockABBA")
+	var buf bytes.Buffer
+	s.writeEdgeTrace(&buf)
+	out := regexp.MustCompile(`\S*/(abba\.go)`).ReplaceAllString(buf.String(), "$1")
+	want := `first path that acquired runtime.lockA while holding runtime.lockB:
+  call stack:
+    runtime.lockBA
+        abba.go:18
+    runtime.lockABBA
+        abba.go:33
+  blocks walked:
+    runtime.lockABBA
+      block 0 at abba.go:31
+    runtime.lockBA
+      block 0 at abba.go:16
+`
+	if out != want {
+		t.Errorf("want:\n%sgot:\n%s", want, out)
+	}
+
+	opts.traceEdge = [2]string{"lockA", "lockC"}
+	s = analyzeTestdataOpts(t, opts, "lockAB")
+	buf.Reset()
+	s.writeEdgeTrace(&buf)
+	if want := "no path acquired lockC while holding lockA\n"; buf.String() != want {
+		t.Errorf("want %q, got %q", want, buf.String())
+	}
+}
+
+func TestWriteRootSummary(t *testing.T) {
+	s := analyzeTestdata(t, "lockAB", "lockBA", "lockABBA")
+	var buf bytes.Buffer
+	s.lockOrder.Check(&buf)
+	if !strings.Contains(buf.String(), "acquire runtime.lockB then runtime.lockA, found from runtime.lockABBA, runtime.lockBA:\n") {
+		t.Errorf("report doesn't list edge roots:\n%s", buf.String())
+	}
+	if !strings.Contains(buf.String(), "acquire runtime.lockA then runtime.lockB, found from runtime.lockAB, runtime.lockABBA:\n") {
+		t.Errorf("report doesn't credit the memoized edge to lockABBA:\n%s", buf.String())
+	}
+
+	// lockABBA's call to lockAB reuses the exit states memoized
+	// from the lockAB root, but lockABBA is still credited with
+	// lockA -> lockB.
+	buf.Reset()
+	s.lockOrder.WriteRootSummary(&buf)
+	want := `lock cycles by root:
+  runtime.lockAB (2 lock class(es): runtime.lockA, runtime.lockB)
+    runtime.lockA -> runtime.lockB -> runtime.lockA: acquires runtime.lockA then runtime.lockB
+  runtime.lockABBA (2 lock class(es): runtime.lockA, runtime.lockB)
+    runtime.lockA -> runtime.lockB -> runtime.lockA: acquires runtime.lockA then runtime.lockB; runtime.lockB then runtime.lockA
+  runtime.lockBA (2 lock class(es): runtime.lockA, runtime.lockB)
+    runtime.lockA -> runtime.lockB -> runtime.lockA: acquires runtime.lockB then runtime.lockA
+`
+	if buf.String() != want {
+		t.Errorf("want:\n%sgot:\n%s", want, buf.String())
+	}
+}
+
+func TestSliceToArrayPointer(t *testing.T) {
+	for _, test := range []struct {
+		root     string
+		mayPanic bool
+	}{
+		{"convertUnguarded", true},
+		// We don't track slice lengths, so we can't tell
+		// that the guard prevents the panic.
+		{"convertGuarded", true},
+		{"convertEmpty", false},
+	} {
+		s := analyzeTestdata(t, test.root)
+		if got := hasEdge(s, "runtime.convertLock", "runtime.panicLock"); got != test.mayPanic {
+			t.Errorf("%s: edge to panicLock is %v, want %v", test.root, got, test.mayPanic)
+		}
+		// Either way, the non-panicking path continues and
+		// releases convertLock.
+		if len(s.rootLockLeaks) != 0 {
+			t.Errorf("%s: root returned with locks held", test.root)
+		}
+	}
+}
+
+func TestLockNeutral(t *testing.T) {
+	s := analyzeTestdata(t, "lockNeutral")
+	if s.stats.NeutralCalls == 0 {
+		t.Errorf("want lock-neutral calls, got none")
+	}
+	for fn := range s.fns {
+		if name := fn.String(); name == "runtime.neutralCaller" || name == "runtime.neutralSum" {
+			t.Errorf("lock-neutral function %s was walked", name)
+		}
+	}
+	if len(s.lockOrder.m) != 0 {
+		t.Errorf("want no lock edges, got %d", len(s.lockOrder.m))
+	}
+
+	runtimePkg := s.prog.ImportedPackage("runtime")
+	if !s.lockNeutral(runtimePkg.Func("neutralCaller")) {
+		t.Errorf("neutralCaller isn't lock-neutral")
+	}
+	// Functions that lock aren't neutral, even indirectly.
+	for _, name := range []string{"lockNeutral", "lockAB", "gopanic", "copyScalars"} {
+		if s.lockNeutral(runtimePkg.Func(name)) {
+			t.Errorf("%s is lock-neutral, want not", name)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	s := analyzeTestdata(t, "lockAB", "lockBA", "lockABBA", "lockRecursive")
+	st := s.stats
+	if st.Functions == 0 || st.PathStates == 0 {
+		t.Errorf("want functions and path states explored, got %+v", st)
+	}
+	if st.CacheHits == 0 {
+		t.Errorf("want exit cache hits from lockABBA, got %+v", st)
+	}
+	if st.RecursionCuts != 1 {
+		t.Errorf("want 1 recursive call cut, got %+v", st)
+	}
+	if st.BudgetExhausted != 0 {
+		t.Errorf("want no budget exhaustions, got %+v", st)
+	}
+
+	var buf bytes.Buffer
+	st.WriteJSON(&buf)
+	var got analysisStats
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, st) {
+		t.Errorf("JSON round trip: got %+v, want %+v", got, st)
+	}
+}
+
+func TestStatsRecursionCuts(t *testing.T) {
+	// A cached empty set of exit states isn't a recursive call.
+	s := analyzeTestdata(t, "lockNoExitTwice")
+	if s.stats.CacheHits == 0 || s.stats.RecursionCuts != 0 {
+		t.Errorf("want a cache hit and no recursive calls cut, got %+v", s.stats)
+	}
+}
+
+func TestStatsBudgetExhausted(t *testing.T) {
+	s := analyzeTestdata(t, "manyAcquirem")
+	if s.stats.BudgetExhausted != 1 {
+		t.Errorf("want 1 budget exhaustion, got %+v", s.stats)
+	}
+	var buf bytes.Buffer
+	s.stats.WriteText(&buf)
+	if !strings.Contains(buf.String(), "budget exhaustions:    1") {
+		t.Errorf("budget exhaustions missing from statistics:\n%s", buf.String())
+	}
+}
+
+func TestMaxStates(t *testing.T) {
+	s := analyzeTestdata(t, "manyStates")
+	if s.stats.Trimmed != 0 {
+		t.Errorf("want no paths trimmed with the default -maxstates, got %+v", s.stats)
+	}
+
+	s = analyzeTestdataOpts(t, options{rootLocks: "warn", maxStates: 2}, "manyStates")
+	if s.stats.Trimmed == 0 || s.stats.TrimmedFunctions["runtime.manyStates"] != s.stats.Trimmed {
+		t.Errorf("want paths trimmed in runtime.manyStates, got %+v", s.stats)
+	}
+	var buf bytes.Buffer
+	s.stats.WriteText(&buf)
+	if !strings.Contains(buf.String(), "runtime.manyStates") {
+		t.Errorf("trimmed function missing from statistics:\n%s", buf.String())
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	// Stall the first acquisition until the timeout has surely
+	// expired. The first root finishes its block, but the second
+	// root is never explored.
+	stalled := false
+	obs := func(tr LockTransition, class *LockClass, stack *StackFrame, ps *PathState) {
+		if !stalled {
+			stalled = true
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	opts := options{rootLocks: "warn", observer: obs, timeout: time.Millisecond}
+	s := analyzeTestdataOpts(t, opts, "lockAB", "lockBA")
+	if !s.expired() || !s.stats.TimedOut {
+		t.Fatalf("want analysis to time out")
+	}
+	if !hasEdge(s, "runtime.lockA", "runtime.lockB") {
+		t.Errorf("want edge found before the timeout")
+	}
+	if hasEdge(s, "runtime.lockB", "runtime.lockA") {
+		t.Errorf("unexpected edge found after the timeout")
+	}
+	if s.diagCounts[SevWarning] == 0 {
+		t.Errorf("want warning that the results are partial")
+	}
+
+	s = analyzeTestdataOpts(t, options{rootLocks: "warn", timeout: time.Hour}, "lockAB", "lockBA")
+	if s.expired() || len(s.lockOrder.FindCycles()) != 1 {
+		t.Errorf("want complete analysis with a long timeout")
+	}
+}
+
+func TestDefaultRootsGOROOT(t *testing.T) {
+	goroot, err := filepath.Abs("testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := DefaultRoots(goroot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"newobject", "lockAB"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got roots %v, want %v", got, want)
+	}
+}
+
+func TestInversions(t *testing.T) {
+	s := analyzeTestdata(t, "lockAB", "lockBC", "lockCA")
+	checkCycles(t, s, "runtime.lockA -> runtime.lockB -> runtime.lockC")
+	if invs := s.lockOrder.Inversions(); len(invs) != 0 {
+		t.Errorf("want no inversions in a transitive cycle, got %v", invs)
+	}
+
+	s = analyzeTestdata(t, "lockAB", "lockBA", "lockBC", "lockCA")
+	var buf bytes.Buffer
+	if n := s.lockOrder.CheckInversions(&buf); n != 1 {
+		t.Fatalf("want 1 inversion, got %d:\n%s", n, buf.String())
+	}
+	out := buf.String()
+	if !strings.HasPrefix(out, "lock inversion: runtime.lockA <-> runtime.lockB (2 path(s))\n") {
+		t.Errorf("bad inversion report:\n%s", out)
+	}
+	if !strings.Contains(out, "acquires runtime.lockB at ") || !strings.Contains(out, "runtime.lockBA\n") {
+		t.Errorf("inversion report missing example paths:\n%s", out)
+	}
+}
+
+func TestKeepSynthetic(t *testing.T) {
+	for _, keep := range []bool{false, true} {
+		// Static calls to synthesized functions are walked
+		// either way, and their frames show up in the path.
+		s := analyzeTestdataOpts(t, options{keepSynthetic: keep}, "lockSynthetic")
+		if !hasEdge(s, "runtime.synthA", "runtime.synthB") {
+			t.Errorf("keepSynthetic=%v: want edge runtime.synthA -> runtime.synthB", keep)
+			continue
+		}
+		for edge := range s.lockOrder.m {
+			rinfo := s.lockOrder.examplePath(edge)
+			if len(rinfo.To) < 2 || rinfo.To[0].Op != "calls (*runtime.synthOuter).lockB$thunk" {
+				t.Errorf("keepSynthetic=%v: want path through wrapper, got %+v", keep, rinfo.To)
+			}
+		}
+
+		// Dynamic calls resolve to the wrapper only if it's
+		// kept. Otherwise, they resolve directly to the
+		// wrapped method.
+		s = analyzeTestdataOpts(t, options{rootLocks: "warn", packages: []string{"synthapp"}, keepSynthetic: keep})
+		if !hasEdge(s, "synthapp.outerMu", "synthapp.innerMu") {
+			t.Errorf("keepSynthetic=%v: want edge synthapp.outerMu -> synthapp.innerMu", keep)
+			continue
+		}
+		for edge, infos := range s.lockOrder.m {
+			for info := range infos {
+				rinfo := s.lockOrder.renderInfo(edge, info)
+				wrapper := false
+				for _, fr := range rinfo.To {
+					if strings.Contains(fr.Op, "synthapp.outer).lockInner") {
+						wrapper = true
+					}
+				}
+				if wrapper != keep {
+					t.Errorf("keepSynthetic=%v: edge %s -> %s path through wrapper is %v: %+v", keep, s.lockOrder.name(edge.fromId), s.lockOrder.name(edge.toId), wrapper, rinfo.To)
+				}
+			}
+		}
+	}
+}
+
+func TestLoopWidening(t *testing.T) {
+	s := analyzeTestdata(t, "lockLoop")
+	if !hasEdge(s, "runtime.loopA", "runtime.loopB") {
+		t.Errorf("want edge runtime.loopA -> runtime.loopB")
+	}
+	if s.stats.Trimmed != 0 {
+		t.Errorf("want no trimmed paths, got %d", s.stats.Trimmed)
+	}
+	if s.stats.Widened == 0 {
+		t.Errorf("want loop header widening")
+	}
+}
+
+func TestIrrelevantLoop(t *testing.T) {
+	s := analyzeTestdata(t, "countLoop")
+	if s.stats.Widened != 0 || s.stats.Trimmed != 0 {
+		t.Errorf("want no widening or trimming of counting loop, got %+v", s.stats)
+	}
+	// The loop body is walked once with the first counter value,
+	// and the loop header is reached once more from the body
+	// before it's found in the block cache.
+	if s.stats.PathStates > 5 {
+		t.Errorf("want at most 5 path states, got %d", s.stats.PathStates)
+	}
+	for _, d := range s.diags {
+		if strings.Contains(d.Msg, "locks at return") {
+			t.Errorf("countLoop: %s", d.Msg)
+		}
+	}
+}
+
+func TestDumpRewritten(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rtcheck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	analyzeTestdataOpts(t, options{dumpRewritten: dir}, "lockAB")
+
+	// Root calls are added to the file that declares the root,
+	// and functions get morestack prologues.
+	src, err := ioutil.ReadFile(filepath.Join(dir, "src", "runtime", "abba.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"func init() {\n", "\tlockAB()\n", "\tmorestack()\n"} {
+		if !strings.Contains(string(src), want) {
+			t.Errorf("rewritten abba.go doesn't contain %q:\n%s", want, src)
+		}
+	}
+
+	// Other packages call a local morestack marker, except from
+	// nosplit functions.
+	src, err = ioutil.ReadFile(filepath.Join(dir, "src", "runtime", "internal", "atomic", "atomic.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(src), "\trtcheck۰morestack()\n"); n != 1 {
+		t.Errorf("want 1 morestack prologue in rewritten atomic.go, got %d:\n%s", n, src)
+	}
+	if !strings.Contains(string(src), "func rtcheck۰morestack() {") {
+		t.Errorf("rewritten atomic.go doesn't declare rtcheck۰morestack:\n%s", src)
+	}
+}
+
+func TestChanCapacity(t *testing.T) {
+	for root, blocks := range map[string]bool{
+		"sendLocked":     true,
+		"sendBuffered":   false,
+		"sendFull":       true,
+		"sendDrained":    false,
+		"sendUnbuffered": true,
+		"sendEscaped":    true,
+	} {
+		s := analyzeTestdata(t, root)
+		edges := 0
+		for edge := range s.lockOrder.m {
+			if s.lockOrder.name(edge.fromId) == "runtime.chanLock" {
+				edges++
+			}
+		}
+		if blocks != (edges > 0) {
+			t.Errorf("%s: want blocking send %v, got %d edges from runtime.chanLock", root, blocks, edges)
+		}
+	}
+	s := analyzeTestdata(t, "sendLocked")
+	if !hasEdge(s, "runtime.chanLock", "runtime.lockChan") {
+		t.Errorf("want edge runtime.chanLock -> runtime.lockChan")
+	}
+}
+
+func TestCheckBlocking(t *testing.T) {
+	opts := options{rootLocks: "warn", checkBlocking: true}
+	for root, want := range map[string]string{
+		"sendLocked":   "channel send",
+		"sendBuffered": "",
+		"recvLocked":   "channel receive",
+		"recvBuffered": "",
+	} {
+		s := analyzeTestdataOpts(t, opts, root)
+		ops := s.lockOrder.blockingOps()
+		if want == "" {
+			if len(ops) != 0 {
+				t.Errorf("%s: want no blocking operations, got %d", root, len(ops))
+			}
+			continue
+		}
+		if len(ops) != 1 || ops[0].op != want || s.lockOrder.name(ops[0].lockId) != "runtime.chanLock" {
+			t.Errorf("%s: want runtime.chanLock held across %s, got %v", root, want, ops)
+			continue
+		}
+		var buf bytes.Buffer
+		s.lockOrder.CheckBlocking(&buf)
+		if !strings.Contains(buf.String(), "blocks in "+want) {
+			t.Errorf("%s: missing path in report:\n%s", root, buf.String())
+		}
+	}
+}
+
+func TestDefer(t *testing.T) {
+	for _, roots := range [][]string{{"deferLIFO", "deferClosure"}, {"deferCond"}} {
+		s := analyzeTestdata(t, roots...)
+		if !hasEdge(s, "runtime.deferA", "runtime.deferC") {
+			t.Errorf("%v: want edge runtime.deferA -> runtime.deferC", roots)
+		}
+		for _, d := range s.diags {
+			if strings.Contains(d.Msg, "locks at return") {
+				t.Errorf("%v: deferred unlock not applied: %s", roots, d.Msg)
+			}
+		}
+	}
+}
+
+func TestRuntimeRWMutex(t *testing.T) {
+	// Read locks are tracked as a set, so the inner runlock
+	// releases the read lock, but this shouldn't be a
+	// self-deadlock.
+	s := analyzeTestdata(t, "rlockTwice")
+	checkCycles(t, s)
+	for _, d := range s.diags {
+		if d.Sev == SevError {
+			t.Errorf("rlockTwice: unexpected error %s", d.Msg)
+		}
+	}
+	s = analyzeTestdata(t, "rlockOrder", "rlockOrderRev")
+	// The writer in rlockOrderRev waits for the reader in
+	// rlockOrder.
+	checkCycles(t, s, "runtime.rwLock(read) -> runtime.rwOtherLock")
+}
+
+func TestSelect(t *testing.T) {
+	opts := options{rootLocks: "warn", checkBlocking: true}
+	s := analyzeTestdataOpts(t, opts, "selectLocked")
+	if !hasEdge(s, "runtime.chanLock", "runtime.lockChan") {
+		t.Errorf("selectLocked: want edge runtime.chanLock -> runtime.lockChan")
+	}
+	var got []string
+	for _, op := range s.lockOrder.blockingOps() {
+		got = append(got, op.op)
+	}
+	sort.Strings(got)
+	if want := "[channel receive channel send]"; fmt.Sprint(got) != want {
+		t.Errorf("selectLocked: want blocking operations %s, got %v", want, got)
+	}
+
+	s = analyzeTestdataOpts(t, opts, "selectDefault")
+	if hasEdge(s, "runtime.chanLock", "runtime.lockChan") {
+		t.Errorf("selectDefault: unexpected edge runtime.chanLock -> runtime.lockChan")
+	}
+	if ops := s.lockOrder.blockingOps(); len(ops) != 0 {
+		t.Errorf("selectDefault: want no blocking operations, got %v", ops)
+	}
+}
+
+func TestGosched(t *testing.T) {
+	held := func(s *state) []string {
+		var got []string
+		for _, op := range s.lockOrder.blockingOps() {
+			got = append(got, op.op+" "+s.lockOrder.name(op.lockId))
+		}
+		return got
+	}
+	opts := options{rootLocks: "warn", checkGosched: true}
+	s := analyzeTestdataOpts(t, opts, "goschedHeld")
+	if got, want := fmt.Sprint(held(s)), "[gosched runtime.goschedLock]"; got != want {
+		t.Errorf("goschedHeld: want %s, got %s", want, got)
+	}
+	// mcall still calls gosched_m.
+	if !hasEdge(s, "runtime.goschedLock", "runtime.goschedQueueLock") {
+		t.Errorf("goschedHeld: want edge goschedLock -> goschedQueueLock")
+	}
+
+	s = analyzeTestdataOpts(t, opts, "goschedReleased")
+	if got := held(s); len(got) != 0 {
+		t.Errorf("goschedReleased: want no locks held across gosched, got %v", got)
+	}
+
+	// The check is off by default.
+	s = analyzeTestdata(t, "goschedHeld")
+	if got := held(s); len(got) != 0 {
+		t.Errorf("without checkGosched: want no locks held across gosched, got %v", got)
+	}
+}
+
+func TestGopark(t *testing.T) {
+	opts := options{rootLocks: "warn"}
+	for root, want := range map[string]string{
+		"parkUnlock":   "",
+		"parkHeld":     "runtime.parkOtherLock",
+		"parkCallback": "",
+		"parkNil":      "runtime.parkLock",
+	} {
+		s := analyzeTestdataOpts(t, opts, root)
+		var got []string
+		for _, op := range s.lockOrder.blockingOps() {
+			if op.op != "gopark" {
+				t.Errorf("%s: unexpected blocking operation %s", root, op.op)
+			}
+			got = append(got, s.lockOrder.name(op.lockId))
+		}
+		if want == "" {
+			if len(got) != 0 {
+				t.Errorf("%s: want no locks held across gopark, got %v", root, got)
+			}
+			continue
+		}
+		if len(got) != 1 || got[0] != want {
+			t.Errorf("%s: want %s held across gopark, got %v", root, want, got)
+		}
+	}
+}
+
+func TestNotesleepBlocking(t *testing.T) {
+	for root, want := range map[string]string{
+		"noteSleepLocked":  "notesleep",
+		"noteTsleepLocked": "notetsleep",
+		"noteWakeupLocked": "",
+	} {
+		s := analyzeTestdata(t, root)
+		ops := s.lockOrder.blockingOps()
+		if want == "" {
+			if len(ops) != 0 {
+				t.Errorf("%s: want no blocking operations, got %v", root, ops)
+			}
+			continue
+		}
+		if len(ops) != 1 || ops[0].op != want || s.lockOrder.name(ops[0].lockId) != "runtime.noteLock" {
+			t.Errorf("%s: want runtime.noteLock held across %s, got %v", root, want, ops)
+			continue
+		}
+		// The path ends at the note sleep.
+		path := s.lockOrder.blockingPaths(ops[0])[0]
+		if last := path.To[len(path.To)-1]; last.Op != "blocks in "+want {
+			t.Errorf("%s: want path to end in %s, got %s", root, want, last.Op)
+		}
+	}
+}
+
+func TestSemaphore(t *testing.T) {
+	s := analyzeTestdata(t, "semaThenLock", "lockThenSema")
+	if got, want := strings.Join(cycleStrings(s), "\n"), "runtime.semaA -> runtime.semaLock"; got != want {
+		t.Errorf("want cycle %q, got %q", want, got)
+	}
+	// The bodies of semacquire and semrelease are still walked.
+	// semacquire takes semaRootLock before it acquires semaA, and
+	// semrelease takes it before it releases semaA.
+	for _, edge := range [][2]string{
+		{"runtime.semaLock", "runtime.semaRootLock"},
+		{"runtime.semaA", "runtime.semaRootLock"},
+	} {
+		if !hasEdge(s, edge[0], edge[1]) {
+			t.Errorf("want edge %s -> %s", edge[0], edge[1])
+		}
+	}
+	if hasEdge(s, "runtime.semaRootLock", "runtime.semaA") {
+		t.Errorf("unexpected edge runtime.semaRootLock -> runtime.semaA")
+	}
+
+	// Releasing a semaphore that isn't held is a wakeup, not a
+	// bug.
+	s = analyzeTestdata(t, "semaSignal")
+	if n := s.diagCounts[SevWarning]; n != 0 {
+		t.Errorf("semaSignal: want no warnings, got %d", n)
+	}
+	if hasEdge(s, "runtime.semaLock", "runtime.semaA") {
+		t.Errorf("semaSignal: unexpected edge runtime.semaLock -> runtime.semaA")
+	}
+}
+
+func TestPackages(t *testing.T) {
+	s := analyzeTestdataOpts(t, options{packages: []string{"mutexapp"}})
+	var roots []string
+	for _, fn := range s.roots {
+		roots = append(roots, fn.String())
+	}
+	if want := "[(*mutexapp.Server).Handle mutexapp.Stats]"; fmt.Sprint(roots) != want {
+		t.Errorf("want roots %s, got %v", want, roots)
+	}
+	checkCycles(t, s, "mutexapp.Server.mu* -> mutexapp.Server.statsMu*")
+}
+
+func TestGOOS(t *testing.T) {
+	goroot, err := filepath.Abs("testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		goos, from, to, stub, notStub string
+	}{
+		{"linux", "runtime.osLockA", "runtime.osLockB", "futex", "asmstdcall"},
+		{"windows", "runtime.osLockB", "runtime.osLockA", "asmstdcall", "futex"},
+	} {
+		ctxt := build.Default
+		ctxt.GOROOT = goroot
+		ctxt.GOPATH = ""
+		ctxt.GOOS = test.goos
+		s, err := analyze(&ctxt, []string{"lockOS"}, options{rootLocks: "warn"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !hasEdge(s, test.from, test.to) {
+			t.Errorf("GOOS=%s: missing edge %s -> %s", test.goos, test.from, test.to)
+		}
+		if newStubs["runtime"][test.stub] == nil {
+			t.Errorf("GOOS=%s: missing stub for %s", test.goos, test.stub)
+		}
+		if newStubs["runtime"][test.notStub] != nil {
+			t.Errorf("GOOS=%s: unexpected stub for %s", test.goos, test.notStub)
+		}
+	}
+}
+
+func TestRWMutex(t *testing.T) {
+	s := analyzeTestdataOpts(t, options{packages: []string{"rwapp"}})
+	if fns.rwmutexRLock == nil || fns.rwmutexRLock.String() != "(*sync.RWMutex).RLock" {
+		t.Errorf("want fns.rwmutexRLock (*sync.RWMutex).RLock, got %v", fns.rwmutexRLock)
+	}
+	// Nested read locks are held in the read sub-class, so they
+	// don't form a self-cycle. The write/read inversion between
+	// Put and Flush is still a cycle.
+	checkCycles(t, s, "rwapp.Cache.mu* -> rwapp.Cache.rw*")
+	if !hasEdge(s, "rwapp.Cache.rw(read)*", "rwapp.Cache.rw*") {
+		t.Errorf("missing edge from read lock to write lock")
+	}
+}
+
+func TestUnbalancedLocks(t *testing.T) {
+	s := analyzeTestdata(t, "unbalRoot")
+	byName := make(map[string]map[*LockClass]*unbalancedLock)
+	for fn, locks := range s.unbalanced {
+		byName[fn.String()] = locks
+	}
+	if byName["runtime.unbalBalanced"] != nil {
+		t.Errorf("runtime.unbalBalanced reported as unbalanced")
+	}
+	try := byName["runtime.unbalTryLock"]
+	if try == nil {
+		t.Fatalf("runtime.unbalTryLock not reported as unbalanced")
+	}
+	for lc, u := range try {
+		if lc.String() != "runtime.unbalA" {
+			t.Errorf("unexpected unbalanced lock %s", lc)
+		}
+		if u.held != 1 || u.paths != 2 {
+			t.Errorf("want unbalA held at 1 of 2 paths, got %d of %d", u.held, u.paths)
+		}
+	}
+
+	var buf bytes.Buffer
+	s.writeUnbalancedLocks(&buf)
+	if !strings.Contains(buf.String(), "runtime.unbalA held at 1 of 2 exit path(s)") {
+		t.Errorf("missing lock in report:\n%s", buf.String())
+	}
+}
+
+func TestRootLocks(t *testing.T) {
+	// unbalTryLock returns with unbalA held on one path.
+	for _, test := range []struct {
+		mode      string
+		wantSev   Severity
+		wantDiags int
+		want      []string
+	}{
+		{"ignore", 0, 0, nil},
+		{"warn", SevWarning, 1, []string{"(likely analysis failed to match control flow for unlock)"}},
+		{"list", SevWarning, 1, []string{"runtime.unbalA acquired at\n    runtime.unbalTryLock\n", "unbalanced.go:16\n", "returns at\n    runtime.unbalTryLock\n", "unbalanced.go:17"}},
+		{"error", SevError, 1, []string{"runtime.unbalA acquired at\n", "returns at\n", "unbalanced.go:17"}},
+	} {
+		s := analyzeTestdataOpts(t, options{rootLocks: test.mode}, "unbalTryLock")
+		if len(s.diags) != test.wantDiags {
+			t.Errorf("%s: want %d diagnostics, got %v", test.mode, test.wantDiags, s.diags)
+			continue
+		}
+		if test.wantDiags == 0 {
+			if len(s.rootLockLeaks) != 0 {
+				t.Errorf("%s: want no leaks, got %v", test.mode, s.rootLockLeaks)
+			}
+			continue
+		}
+		d := s.diags[0]
+		if d.Sev != test.wantSev {
+			t.Errorf("%s: want severity %s, got %s", test.mode, test.wantSev, d.Sev)
+		}
+		if !strings.HasPrefix(d.Msg, "locks at return from root runtime.unbalTryLock: {runtime.unbalA}") {
+			t.Errorf("%s: unexpected message %q", test.mode, d.Msg)
+		}
+		for _, want := range test.want {
+			if !strings.Contains(d.Msg, want) {
+				t.Errorf("%s: message missing %q:\n%s", test.mode, want, d.Msg)
+			}
+		}
+		if got := fmt.Sprint(s.rootLockLeaks); got != "[runtime.unbalTryLock]" {
+			t.Errorf("%s: want leak from runtime.unbalTryLock, got %s", test.mode, got)
+		}
+		if got := s.failed(SevError); got != (test.wantSev == SevError) {
+			t.Errorf("%s: failed at error is %v", test.mode, got)
+		}
+	}
+}
+
+func TestAssume(t *testing.T) {
+	for _, root := range []string{"assumeEq", "assumeNil", "assumeNot", "assumeRange"} {
+		s := analyzeTestdata(t, root)
+		for fn := range s.unbalanced {
+			t.Errorf("%s: %s has unbalanced locks", root, fn)
+		}
+		for _, d := range s.diags {
+			if strings.Contains(d.Msg, "locks at return") {
+				t.Errorf("%s: %s", root, d.Msg)
+			}
+		}
+	}
+}
+
+func TestStubUsage(t *testing.T) {
+	opts := options{rootLocks: "warn", stubs: []string{"package runtime\nfunc stubbed() {}"}}
+	s := analyzeTestdataOpts(t, opts, "lockStubbed", "callExternal")
+	if s.stats.Stubbed != 1 || s.stats.External != 2 {
+		t.Errorf("want 1 stubbed and 2 external functions, got %+v", s.stats)
+	}
+	// Only the external function that looks like it may block is
+	// a warning.
+	var warned []string
+	for _, d := range s.diags {
+		if d.Sev == SevWarning {
+			warned = append(warned, d.Msg)
+		}
+	}
+	if len(warned) != 1 || !strings.Contains(warned[0], "runtime.futexwaitExt may affect locks") {
+		t.Errorf("want warning for runtime.futexwaitExt, got %q", warned)
+	}
+
+	var buf bytes.Buffer
+	s.writeStubUsage(&buf)
+	want := `1 stubbed function(s) reached:
+  runtime.stubbed
+2 external function(s) reached, assumed not to affect locks:
+    runtime.cputicksExt
+  ! runtime.futexwaitExt
+(! marks functions that may affect locks and probably need stubs)
+`
+	if buf.String() != want {
+		t.Errorf("want:\n%sgot:\n%s", want, buf.String())
+	}
+}
+
+func TestRewritePackages(t *testing.T) {
+	reached := func(s *state) []string {
+		var out []string
+		for fn := range s.stubsReached {
+			out = append(out, "stubbed "+fn.String())
+		}
+		for fn := range s.externalReached {
+			out = append(out, "external "+fn.String())
+		}
+		sort.Strings(out)
+		return out
+	}
+	// internal/cpu is rewritten by default, so its assembly
+	// function is stubbed.
+	s := analyzeTestdataOpts(t, options{rootLocks: "warn"}, "cpuinit")
+	if got, want := fmt.Sprint(reached(s)), "[stubbed internal/cpu.cpuid]"; got != want {
+		t.Errorf("default packages: want %s, got %s", want, got)
+	}
+
+	s = analyzeTestdataOpts(t, options{rootLocks: "warn", rewritePkgs: []string{"runtime/internal/atomic"}}, "cpuinit")
+	if got, want := fmt.Sprint(reached(s)), "[external internal/cpu.cpuid]"; got != want {
+		t.Errorf("without internal/cpu: want %s, got %s", want, got)
+	}
+}
+
+func TestLookupMembers(t *testing.T) {
+	prog := ssa.NewProgram(token.NewFileSet(), 0)
+	pkg := prog.CreatePackage(types.NewPackage("runtime", "runtime"), nil, nil, false)
+	var a, b *ssa.Function
+	err := lookupMembers(pkg, map[string]interface{}{"mapassign": &a, "lock": &b})
+	if err == nil {
+		t.Fatal("want error for missing members")
+	}
+	// Every missing member is reported, with a hint if one is
+	// known.
+	want := "runtime is missing members rtcheck depends on (is this a supported Go version?):\n\tlock\n\tmapassign (called mapassign1 before Go 1.8)"
+	if err.Error() != want {
+		t.Errorf("want:\n%s\ngot:\n%s", want, err)
+	}
+}
+
+func TestAtomicStubs(t *testing.T) {
+	// Loadacq and Xchgint64 are stubbed. The stub for Xadd uses a
+	// parameter the testdata's declaration renames, so it's left
+	// external.
+	var diags bytes.Buffer
+	s := analyzeTestdataOpts(t, options{rootLocks: "warn", diagOut: &diags}, "atomicOps")
+	if !strings.Contains(diags.String(), "warning: stub for atomic.Xadd uses parameter ptr") {
+		t.Errorf("want warning about the Xadd stub, got:\n%s", diags.String())
+	}
+	var got []string
+	for fn := range s.stubsReached {
+		got = append(got, "stubbed "+fn.String())
+	}
+	for fn := range s.externalReached {
+		got = append(got, "external "+fn.String())
+	}
+	sort.Strings(got)
+	want := "[external runtime/internal/atomic.Xadd stubbed runtime/internal/atomic.Loadacq stubbed runtime/internal/atomic.Xchgint64]"
+	if fmt.Sprint(got) != want {
+		t.Errorf("want %s, got %s", want, got)
+	}
+}
+
+func TestExternalWorst(t *testing.T) {
+	// By default, external functions don't affect locks.
+	s := analyzeTestdata(t, "lockExternal")
+	if len(s.lockOrder.m) != 0 {
+		t.Errorf("want no lock edges, got %d", len(s.lockOrder.m))
+	}
+
+	// In worst-case mode, the call is ordered after the locks
+	// held and every external function is a warning.
+	s = analyzeTestdataOpts(t, options{rootLocks: "warn", external: "worst"}, "lockExternal", "callExternal")
+	var lc *LockClass
+	for fn, c := range s.externalLocks {
+		if fn.String() == "runtime.cputicksExt" {
+			lc = c
+		}
+	}
+	if lc == nil {
+		t.Fatalf("no lock class for runtime.cputicksExt")
+	}
+	if !hasEdge(s, "runtime.externalLock", lc.String()) {
+		t.Errorf("want edge runtime.externalLock -> %s", lc)
+	}
+	warnings := 0
+	for _, d := range s.diags {
+		if d.Sev == SevWarning {
+			warnings++
+		}
+	}
+	if warnings != 2 {
+		t.Errorf("want 2 warnings, got %d: %+v", warnings, s.diags)
+	}
+}
@@ -0,0 +1,545 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package analysis
+
+import (
+	"fmt"
+	"go/build"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/tools/go/callgraph"
+	"golang.org/x/tools/go/ssa"
+)
+
+// Config configures an analysis. The zero Config analyzes the runtime
+// in build.Default's GOROOT, for the host platform, starting from the
+// default roots.
+type Config struct {
+	// Context is the build context to load sources from. Its
+	// GOROOT, GOOS, and GOARCH select the runtime and platform to
+	// analyze. If nil, build.Default is used.
+	Context *build.Context
+
+	// Packages, if non-empty, is a list of import paths to
+	// analyze instead of the runtime. Their exported functions
+	// and methods and func main are the roots, and Roots is
+	// ignored.
+	Packages []string
+
+	// Roots are the names of the runtime functions to start
+	// exploring from, such as "mallocgc" or "runtime.mallocgc".
+	// If nil, DefaultRoots is used.
+	Roots []string
+
+	// Stubs are Go sources of additional stub functions, each a
+	// file declaring only functions in the runtime or one of the
+	// RewritePackages. A stub replaces the body of the function of
+	// the same name, overriding rtcheck's built-in stubs.
+	Stubs []string
+
+	// RewritePackages lists the packages other than the runtime
+	// whose sources are rewritten and stubbed, such as the
+	// runtime's internal dependencies. Packages that don't exist
+	// in the GOROOT are skipped. If nil, DefaultRewritePackages is
+	// used.
+	RewritePackages []string
+
+	// RootLocks specifies how to handle paths that return from a
+	// root with locks still held: "warn" (the default), "ignore",
+	// "list", or "error".
+	RootLocks string
+
+	// ClassOverrides reassigns the lock classes of locks with
+	// specific lock paths or classes. See
+	// ParseLockClassOverrides.
+	ClassOverrides []LockClassOverride
+
+	// Conservative makes calls whose callees can't be resolved
+	// acquire a special "unresolved call" lock class.
+	Conservative bool
+
+	// External specifies how to model calls to functions with
+	// neither a body nor a stub: "assume" (the default) assumes
+	// they don't affect locks, and "worst" warns about each one
+	// and orders it after every lock held when it's called.
+	External string
+
+	// ShowSource prints the source line of each diagnostic, with
+	// SourceContext lines of context on either side.
+	ShowSource    bool
+	SourceContext int
+
+	// MaxWarnings, if positive, limits the number of info and
+	// warning diagnostics written to Diagnostics. Diagnostics
+	// over the limit are still recorded in the Report. Either
+	// way, a diagnostic that repeats the message of an earlier
+	// one at the same position is dropped, and Diagnostics ends
+	// with a count of the diagnostics that weren't written.
+	MaxWarnings int
+
+	// Incremental, if non-empty, is the path of the incremental
+	// analysis state. Only roots affected by functions that
+	// changed since the last run are analyzed. The lock graph
+	// paths, blocking operations, diagnostics, and double locks
+	// of the other roots are carried over from the last run, but
+	// the usage, lock list, nesting, and statistics reports only
+	// reflect the analyzed roots.
+	Incremental string
+
+	// CacheDir, if non-empty, is a directory in which to cache
+	// the runtime's call graph between runs.
+	CacheDir string
+
+	// CheckInitOrder, CheckBlocking, and CheckPreempt enable the
+	// init-order, blocking, and preemption checks.
+	CheckInitOrder bool
+	CheckBlocking  bool
+	CheckPreempt   bool
+
+	// CheckGosched enables the gosched check, which reports locks
+	// held across calls that yield the processor, such as
+	// mcall(gosched_m).
+	CheckGosched bool
+
+	// KeepSynthetic keeps synthetic wrapper functions in the
+	// call graph.
+	KeepSynthetic bool
+
+	// DumpRewritten, if non-empty, is a directory to write the
+	// rewritten runtime sources to.
+	DumpRewritten string
+
+	// Observer, if non-nil, is called on every lock set
+	// transition.
+	Observer LockObserver
+
+	// Usage enables collection of the lock usage report.
+	Usage bool
+
+	// ListLocks enables collection of the lock class inventory
+	// written by Report.WriteLockList.
+	ListLocks bool
+
+	// Nesting, if positive, is the number of deepest lock
+	// nestings, the sets of locks held at once, that
+	// Report.WriteNesting reports.
+	Nesting int
+
+	// MaxStates is the number of path states with the same locks
+	// that may reach a block before further paths are trimmed.
+	// If it is 0, DefaultMaxStates is used.
+	MaxStates int
+
+	// Timeout, if positive, limits how long the analysis explores
+	// paths. When it expires, exploration stops and Analyze
+	// returns a partial report of what was found so far (see
+	// Report.Partial). Loading and pointer analysis aren't
+	// limited.
+	Timeout time.Duration
+
+	// RequirePreemptoff lists lock classes that must only be
+	// acquired with m.preemptoff set.
+	RequirePreemptoff []string
+
+	// RequireSystemStack and RequireUserStack list lock classes
+	// that must only be held on the system stack and on a user
+	// stack, respectively. Acquiring one of these locks on the
+	// other stack, or holding it across a systemstack switch, is
+	// reported as an error.
+	RequireSystemStack []string
+	RequireUserStack   []string
+
+	// AllocLocks, if non-nil, lists the allocation and GC lock
+	// classes for Report.WriteAllocEdges.
+	AllocLocks []string
+
+	// CyclesOnly restricts the lock graphs written by
+	// LockOrder.WriteToDot and LockOrder.WriteToMermaid to edges
+	// in some cycle.
+	CyclesOnly bool
+
+	// TraceEdge, if its elements are non-empty, names the lock
+	// classes L1 and L2 of a lock graph edge to trace. The first
+	// path that acquires L2 while holding L1 is recorded for
+	// Report.WriteEdgeTrace. As for LockOrder.Explain, names may
+	// omit a trailing "*" or a "runtime." prefix.
+	TraceEdge [2]string
+
+	// DebugFuncs lists functions to write debug graphs for. See
+	// Report.DebugGraphs.
+	DebugFuncs []string
+
+	// Diagnostics, if non-nil, receives each diagnostic as it is
+	// emitted. All diagnostics are also recorded in the Report.
+	Diagnostics io.Writer
+}
+
+// analyzeMu serializes analyses, since the analysis keeps some state
+// in package variables.
+var analyzeMu sync.Mutex
+
+// Analyze runs the deadlock analysis described by cfg. It returns an
+// error if the sources can't be loaded or a root doesn't exist.
+func Analyze(cfg Config) (*Report, error) {
+	ctxt := cfg.Context
+	if ctxt == nil {
+		ctxt = &build.Default
+	}
+	opts, err := cfg.options()
+	if err != nil {
+		return nil, err
+	}
+
+	var roots []string
+	for _, root := range cfg.Roots {
+		roots = append(roots, strings.TrimPrefix(root, "runtime."))
+	}
+	if roots == nil && len(cfg.Packages) == 0 {
+		var err error
+		roots, err = DefaultRoots(ctxt.GOROOT)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	analyzeMu.Lock()
+	defer analyzeMu.Unlock()
+	s, err := analyze(ctxt, roots, opts)
+	if err != nil {
+		return nil, err
+	}
+	return cfg.report(s), nil
+}
+
+// AnalyzeSSA explores pkg, which must already be built, starting from
+// its exported functions and methods and func main, like
+// Config.Packages does. Unlike Analyze, it doesn't load anything: the
+// call graph is computed by class hierarchy analysis of pkg's
+// program, and calls to functions without bodies, such as functions
+// in packages that were created from export data, are assumed not to
+// affect locks. Only sync.Mutex and sync.RWMutex are recognized as
+// locks. cfg's Context, Packages, Roots, and Stubs are ignored.
+//
+// This is meant for tools that build SSA one package at a time, such
+// as go/analysis drivers.
+func AnalyzeSSA(pkg *ssa.Package, cfg Config) (*Report, error) {
+	opts, err := cfg.options()
+	if err != nil {
+		return nil, err
+	}
+	opts.syncOnly = true
+	analyzeMu.Lock()
+	defer analyzeMu.Unlock()
+	s, err := explorePackages(pkg.Prog, pkg.Prog.Fset, []*ssa.Package{pkg}, false, opts)
+	if err != nil {
+		return nil, err
+	}
+	return cfg.report(s), nil
+}
+
+// options returns the analysis options for cfg.
+func (cfg *Config) options() (options, error) {
+	opts := options{
+		packages:       cfg.Packages,
+		rootLocks:      cfg.RootLocks,
+		classOverrides: cfg.ClassOverrides,
+		conservative:   cfg.Conservative,
+		external:       cfg.External,
+		showSource:     cfg.ShowSource,
+		context:        cfg.SourceContext,
+		maxWarnings:    cfg.MaxWarnings,
+		incremental:    cfg.Incremental,
+		cacheDir:       cfg.CacheDir,
+		checkInitOrder: cfg.CheckInitOrder,
+		checkBlocking:  cfg.CheckBlocking,
+		checkPreempt:   cfg.CheckPreempt,
+		checkGosched:   cfg.CheckGosched,
+		keepSynthetic:  cfg.KeepSynthetic,
+		dumpRewritten:  cfg.DumpRewritten,
+		observer:       cfg.Observer,
+		usage:          cfg.Usage,
+		listLocks:      cfg.ListLocks,
+		nesting:        cfg.Nesting,
+		maxStates:      cfg.MaxStates,
+		timeout:        cfg.Timeout,
+		stubs:          cfg.Stubs,
+		rewritePkgs:    cfg.RewritePackages,
+		traceEdge:      cfg.TraceEdge,
+		debugFuncs:     make(map[string]bool),
+		diagOut:        cfg.Diagnostics,
+	}
+	if opts.rootLocks == "" {
+		opts.rootLocks = "warn"
+	}
+	switch opts.rootLocks {
+	case "warn", "ignore", "list", "error":
+	default:
+		return opts, fmt.Errorf("unknown root locks mode %q", opts.rootLocks)
+	}
+	if opts.external == "" {
+		opts.external = "assume"
+	}
+	switch opts.external {
+	case "assume", "worst":
+	default:
+		return opts, fmt.Errorf("unknown external mode %q", opts.external)
+	}
+	if len(cfg.RequirePreemptoff) > 0 {
+		opts.requirePreemptoff = make(map[string]bool)
+		for _, name := range cfg.RequirePreemptoff {
+			opts.requirePreemptoff[specName(name)] = true
+		}
+	}
+	stackLocks := func(names []string) map[string]bool {
+		if len(names) == 0 {
+			return nil
+		}
+		m := make(map[string]bool)
+		for _, name := range names {
+			m[specName(name)] = true
+		}
+		return m
+	}
+	opts.systemStackLocks = stackLocks(cfg.RequireSystemStack)
+	opts.userStackLocks = stackLocks(cfg.RequireUserStack)
+	for _, name := range cfg.DebugFuncs {
+		// Skip empty names, such as from splitting "a,,b",
+		// which would otherwise match nothing useful.
+		if name = strings.TrimSpace(name); name != "" {
+			opts.debugFuncs[name] = true
+		}
+	}
+	return opts, nil
+}
+
+// report returns the Report for the analysis state s.
+func (cfg *Config) report(s *state) *Report {
+	if cfg.AllocLocks != nil {
+		s.lockOrder.allocLocks = make(map[string]bool)
+		for _, name := range cfg.AllocLocks {
+			s.lockOrder.allocLocks[specName(name)] = true
+		}
+	}
+	s.lockOrder.cyclesOnly = cfg.CyclesOnly
+	return &Report{s.lockOrder, s}
+}
+
+// A Report is the result of an analysis. Its embedded LockOrder is the
+// lock graph, with methods to find and report lock cycles.
+type Report struct {
+	*LockOrder
+	s *state
+}
+
+// Roots returns the names of the root functions that were analyzed.
+// This includes roots found during analysis, such as the targets of go
+// statements.
+func (r *Report) Roots() []string {
+	var roots []string
+	for _, fn := range r.s.roots {
+		roots = append(roots, fn.String())
+	}
+	return roots
+}
+
+// Cycles returns the lock cycles found by the analysis, each as a
+// list of lock class names in cycle order.
+func (r *Report) Cycles() [][]string {
+	var cycles [][]string
+	for _, cycle := range r.FindCycles() {
+		names := make([]string, len(cycle))
+		for i, id := range cycle {
+			names[i] = r.name(id)
+		}
+		cycles = append(cycles, names)
+	}
+	return cycles
+}
+
+// An Edge is an edge in the lock graph: lock class To was acquired
+// while lock class From was held.
+type Edge struct {
+	From, To string
+	// Paths are the distinct ways the edge happens.
+	Paths []Path
+}
+
+// Edges returns the edges of the lock graph, sorted by lock class
+// names.
+func (r *Report) Edges() []Edge {
+	var edges []Edge
+	for edge := range r.m {
+		e := Edge{From: r.name(edge.fromId), To: r.name(edge.toId)}
+		for _, g := range r.edgePaths(edge) {
+			e.Paths = append(e.Paths, g.path)
+		}
+		edges = append(edges, e)
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].From != edges[j].From {
+			return edges[i].From < edges[j].From
+		}
+		return edges[i].To < edges[j].To
+	})
+	return edges
+}
+
+// Diagnostics returns the diagnostics emitted during analysis, in
+// order.
+func (r *Report) Diagnostics() []Diagnostic {
+	return r.s.diags
+}
+
+// Failed returns whether any diagnostic of severity min or higher was
+// emitted.
+func (r *Report) Failed(min Severity) bool {
+	return r.s.failed(min)
+}
+
+// DiagCount returns the number of diagnostics of severity sev.
+func (r *Report) DiagCount(sev Severity) int {
+	return r.s.diagCounts[sev]
+}
+
+// RootLockLeaks returns the number of roots that may return with
+// locks held.
+func (r *Report) RootLockLeaks() int {
+	return len(r.s.rootLockLeaks)
+}
+
+// DoubleLocks returns the number of distinct paths found that acquire
+// a lock they already hold.
+func (r *Report) DoubleLocks() int {
+	return len(r.s.doubleLocks)
+}
+
+// WriteDoubleLocks writes a report of the paths that acquire a lock
+// they already hold to w, with the stacks of both acquisitions.
+func (r *Report) WriteDoubleLocks(w io.Writer) {
+	r.s.writeDoubleLocks(w)
+}
+
+// HasBlocking returns whether any locks are held across blocking
+// operations. These are recorded for gopark and note sleeps even
+// without Config.CheckBlocking.
+func (r *Report) HasBlocking() bool {
+	return len(r.blocking) > 0
+}
+
+// WriteCallGraph writes the call graph in dot to w.
+func (r *Report) WriteCallGraph(w io.Writer) {
+	type edge struct{ a, b *callgraph.Node }
+	have := make(map[edge]struct{})
+	fmt.Fprintln(w, "digraph callgraph {")
+	callgraph.GraphVisitEdges(r.s.cg, func(e *callgraph.Edge) error {
+		if _, ok := have[edge{e.Caller, e.Callee}]; ok {
+			return nil
+		}
+		have[edge{e.Caller, e.Callee}] = struct{}{}
+		fmt.Fprintf(w, "%q -> %q;\n", e.Caller.Func, e.Callee.Func)
+		return nil
+	})
+	fmt.Fprintln(w, "}")
+}
+
+// DebugGraphs returns the debug graphs requested by Config.DebugFuncs,
+// as a map from file name to a function that writes the graph in dot.
+func (r *Report) DebugGraphs() map[string]func(io.Writer) {
+	graphs := make(map[string]func(io.Writer))
+	if r.s.debugTree != nil {
+		graphs["debug-functions.dot"] = r.s.debugTree.WriteToDot
+	}
+	for fn, fInfo := range r.s.fns {
+		if fInfo.debugTree != nil {
+			graphs[fmt.Sprintf("debug-%s.dot", fn)] = fInfo.debugTree.WriteToDot
+		}
+	}
+	return graphs
+}
+
+// WriteUnresolvedCalls writes a report of calls whose callees couldn't
+// be resolved to w. It's only meaningful with Config.Conservative.
+func (r *Report) WriteUnresolvedCalls(w io.Writer) {
+	r.s.writeUnresolvedCalls(w)
+}
+
+// WriteUnreachableLockOps writes a report of lock and unlock calls
+// that aren't reachable from any root to w.
+func (r *Report) WriteUnreachableLockOps(w io.Writer) {
+	r.s.writeUnreachableLockOps(w)
+}
+
+// UnbalancedFuncs returns the number of functions that may return
+// with a lock held on some paths but not others.
+func (r *Report) UnbalancedFuncs() int {
+	return len(r.s.unbalanced)
+}
+
+// WriteUnbalancedLocks writes a report of the functions that return
+// with a lock held on some paths but not others to w.
+func (r *Report) WriteUnbalancedLocks(w io.Writer) {
+	r.s.writeUnbalancedLocks(w)
+}
+
+// WriteEdgeTrace writes the blocks walked on the first path that added
+// the lock graph edge named by Config.TraceEdge to w, along with its
+// call stack.
+func (r *Report) WriteEdgeTrace(w io.Writer) {
+	r.s.writeEdgeTrace(w)
+}
+
+// WriteStubUsage writes a report of the stubbed and external
+// functions reached by the analysis to w. External functions that
+// look like they may affect locks are flagged, since they probably
+// need stubs.
+func (r *Report) WriteStubUsage(w io.Writer) {
+	r.s.writeStubUsage(w)
+}
+
+// WriteLockList writes every lock class the analysis discovered to w,
+// with the positions at which each is acquired. It requires
+// Config.ListLocks.
+func (r *Report) WriteLockList(w io.Writer) {
+	r.s.writeLockList(w)
+}
+
+// WriteNesting writes the deepest lock nestings found by the analysis
+// to w, with the path that reached each. It requires Config.Nesting.
+func (r *Report) WriteNesting(w io.Writer) {
+	r.s.writeNesting(w)
+}
+
+// WriteUsage writes the text lock usage report to w. It requires
+// Config.Usage.
+func (r *Report) WriteUsage(w io.Writer) {
+	r.s.WriteUsage(w)
+}
+
+// WriteUsageJSON writes the lock usage report as JSON to w. It
+// requires Config.Usage.
+func (r *Report) WriteUsageJSON(w io.Writer) {
+	r.s.WriteUsageJSON(w)
+}
+
+// Partial returns whether the analysis stopped early because
+// Config.Timeout expired. If so, the lock graph and other results
+// only reflect the paths explored before then.
+func (r *Report) Partial() bool {
+	return r.s.expired()
+}
+
+// WriteStats writes a text summary of the analysis statistics to w.
+func (r *Report) WriteStats(w io.Writer) {
+	r.s.stats.WriteText(w)
+}
+
+// WriteStatsJSON writes the analysis statistics as JSON to w.
+func (r *Report) WriteStatsJSON(w io.Writer) {
+	r.s.stats.WriteJSON(w)
+}
@@ -0,0 +1,112 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package analysis
+
+import (
+	"bytes"
+	"fmt"
+	"go/build"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAnalyze(t *testing.T) {
+	goroot, err := filepath.Abs("testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctxt := build.Default
+	ctxt.GOROOT = goroot
+	ctxt.GOPATH = ""
+	var diags bytes.Buffer
+	r, err := Analyze(Config{
+		Context:     &ctxt,
+		Roots:       []string{"lockAB", "runtime.lockBA", "lockStubbed"},
+		Stubs:       []string{"package runtime\nfunc stubbed() { lock(&stubLockB); unlock(&stubLockB) }"},
+		Diagnostics: &diags,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := fmt.Sprint(r.Roots()), "[runtime.lockAB runtime.lockBA runtime.lockStubbed]"; got != want {
+		t.Errorf("want roots %s, got %s", want, got)
+	}
+	cycles := r.Cycles()
+	if len(cycles) != 1 || len(cycles[0]) != 2 {
+		t.Fatalf("want one 2-lock cycle, got %v", cycles)
+	}
+
+	var edges []string
+	for _, e := range r.Edges() {
+		edges = append(edges, e.From+" -> "+e.To)
+		if len(e.Paths) == 0 {
+			t.Errorf("edge %s -> %s has no paths", e.From, e.To)
+		}
+	}
+	// The stub supplied the body of stubbed.
+	want := "runtime.lockA -> runtime.lockB, runtime.lockB -> runtime.lockA, runtime.stubLockA -> runtime.stubLockB"
+	if got := strings.Join(edges, ", "); got != want {
+		t.Errorf("want edges %s, got %s", want, got)
+	}
+
+	if len(r.Diagnostics()) != r.DiagCount(SevInfo)+r.DiagCount(SevWarning)+r.DiagCount(SevError) {
+		t.Errorf("diagnostic counts don't add up")
+	}
+	for _, d := range r.Diagnostics() {
+		if !strings.Contains(diags.String(), d.Msg) {
+			t.Errorf("diagnostic %q not written to Config.Diagnostics", d.Msg)
+		}
+	}
+}
+
+func TestAnalyzeErrors(t *testing.T) {
+	goroot, err := filepath.Abs("testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctxt := build.Default
+	ctxt.GOROOT = goroot
+	ctxt.GOPATH = ""
+	for _, test := range []struct {
+		cfg  Config
+		want string
+	}{
+		{Config{Context: &ctxt, Roots: []string{"noSuchRoot"}}, "unknown roots: noSuchRoot"},
+		{Config{Context: &ctxt, Roots: []string{"lockAB"}, RootLocks: "bogus"}, "unknown root locks mode"},
+		{Config{Context: &ctxt, Roots: []string{"lockAB"}, Stubs: []string{"package runtime\nvar x int"}}, "may only declare functions"},
+	} {
+		_, err := Analyze(test.cfg)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("want error containing %q, got %v", test.want, err)
+		}
+	}
+}
+
+func TestDebugFuncsOptions(t *testing.T) {
+	cfg := Config{DebugFuncs: []string{"", " runtime.lockAB ", "runtime.lockBA"}}
+	opts, err := cfg.options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(opts.debugFuncs), "map[runtime.lockAB:true runtime.lockBA:true]"; got != want {
+		t.Errorf("want %s, got %s", want, got)
+	}
+}
+
+func TestAllocLocksNormalized(t *testing.T) {
+	s := analyzeTestdata(t, "lockAB")
+	// Allocation lock names are normalized like the other lock
+	// class options.
+	for _, name := range []string{"runtime.lockB", "runtime.lockB*", " runtime.lockB "} {
+		cfg := Config{AllocLocks: []string{name}}
+		var buf bytes.Buffer
+		cfg.report(s).WriteAllocEdges(&buf)
+		if !strings.Contains(buf.String(), "allocation lock runtime.lockB:") {
+			t.Errorf("%q: want edges of runtime.lockB, got:\n%s", name, buf.String())
+		}
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package analysis
+
+import (
+	"fmt"
+	"go/token"
+	"io"
+	"sort"
+)
+
+// A blockingOp is a lock held across a channel operation that may
+// block, across gopark or gosched, or across sleeping on a note.
+// Holding a runtime lock across a blocking operation is almost always
+// a bug, even if it doesn't cause a lock cycle: the lock can't be
+// released until some other goroutine gets around to completing the
+// operation.
+type blockingOp struct {
+	lockId int
+	op     string // "channel send", "channel receive", "gopark", "gosched", "notesleep", or "notetsleep"
+	pos    token.Position
+}
+
+// A blockingPath is one path that holds a blockingOp's lock across
+// the operation.
+type blockingPath struct {
+	op   blockingOp
+	info lockOrderInfo
+}
+
+// AddBlocking records that the locks in held are held across
+// blocking operation op at stack. The innermost call of stack must be
+// the blocking operation.
+func (lo *LockOrder) AddBlocking(held *LockSet, op string, stack *StackFrame) {
+	if lo.lca == nil {
+		lo.lca = held.lca
+	}
+	if lo.blocking == nil {
+		lo.blocking = make(map[blockingOp]map[lockOrderInfo]struct{})
+	}
+	root := stackRoot(stack)
+	for _, l := range held.locks {
+		fromStack, toStack := l.stack.TrimCommonPrefix(stack, 1)
+		key := blockingOp{l.id, op, lo.fset.Position(stack.call.Pos())}
+		infos := lo.blocking[key]
+		if infos == nil {
+			infos = make(map[lockOrderInfo]struct{})
+			lo.blocking[key] = infos
+		}
+		info := lockOrderInfo{fromStack: fromStack.Intern(), toStack: toStack.Intern()}
+		infos[info] = struct{}{}
+
+		p := blockingPath{key, info}
+		lo.credit(p, root)
+		if lo.added != nil {
+			lo.added(p)
+		}
+	}
+}
+
+// blockingOps returns the recorded blocking operations, sorted by
+// position and then lock.
+func (lo *LockOrder) blockingOps() []blockingOp {
+	ops := make([]blockingOp, 0, len(lo.blocking))
+	for op := range lo.blocking {
+		ops = append(ops, op)
+	}
+	sort.Slice(ops, func(i, j int) bool {
+		pi, pj := ops[i].pos, ops[j].pos
+		if pi.Filename != pj.Filename {
+			return pi.Filename < pj.Filename
+		}
+		if pi.Offset != pj.Offset {
+			return pi.Offset < pj.Offset
+		}
+		return lo.name(ops[i].lockId) < lo.name(ops[j].lockId)
+	})
+	return ops
+}
+
+// blockingPaths renders the paths that hold op's lock across op.
+func (lo *LockOrder) blockingPaths(op blockingOp) []Path {
+	var paths []Path
+	for info := range lo.blocking[op] {
+		paths = append(paths, lo.renderPath(info, "acquires "+lo.name(op.lockId), "blocks in "+op.op))
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		return fmt.Sprint(paths[i]) < fmt.Sprint(paths[j])
+	})
+	return paths
+}
+
+// CheckBlocking writes a text report of locks held across blocking
+// operations to w, with an example path for each. It returns the
+// number of such operations.
+func (lo *LockOrder) CheckBlocking(w io.Writer) int {
+	ops := lo.blockingOps()
+	fmt.Fprintf(w, "%d lock(s) held across blocking operations\n", len(ops))
+	for _, op := range ops {
+		paths := lo.blockingPaths(op)
+		fmt.Fprintf(w, "%s held across %s at %s (%d path(s)), for example:\n", lo.name(op.lockId), op.op, op.pos, len(paths))
+		printPath(w, paths[0])
+	}
+	return len(ops)
+}
+
+// savedBlocking is a blockingOp and its paths in the form recorded by
+// incremental analysis. Lock classes are identified by name.
+type savedBlocking struct {
+	Lock  string
+	Op    string
+	Pos   token.Position
+	Paths []savedPath
+}
+
+// savedBlocking returns the recorded blocking operations in the form
+// recorded by incremental analysis, including the roots of each path.
+func (lo *LockOrder) savedBlocking() []savedBlocking {
+	var out []savedBlocking
+	for _, op := range lo.blockingOps() {
+		paths := make(map[lockOrderInfo]savedPath)
+		for info := range lo.blocking[op] {
+			paths[info] = savePath(lo.renderPath(info, "acquires "+lo.name(op.lockId), "blocks in "+op.op))
+		}
+		out = append(out, savedBlocking{
+			Lock: lo.name(op.lockId),
+			Op:   op.op,
+			Pos:  op.pos,
+			Paths: mergePaths(paths, func(info lockOrderInfo) map[string]struct{} {
+				return lo.blockingRoots[blockingPath{op, info}]
+			}),
+		})
+	}
+	return out
+}
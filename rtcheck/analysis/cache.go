@@ -0,0 +1,190 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package analysis
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"go/build"
+	"go/types"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"golang.org/x/tools/go/callgraph"
+	"golang.org/x/tools/go/loader"
+	"golang.org/x/tools/go/ssa"
+	"golang.org/x/tools/go/ssa/ssautil"
+)
+
+// The call graph cache stores the call graph computed by pointer
+// analysis of the runtime, which dominates rtcheck's running time, so
+// that re-running rtcheck on unchanged sources can skip it. Loading
+// and building SSA still happen on every run, so the cache only
+// stores the call graph's edges, naming functions by
+// ssa.Function.String() and call sites by their position in the
+// caller's blocks. These are stable as long as the sources are.
+
+// callGraphCache is the on-disk form of a call graph. It is stored as
+// JSON.
+type callGraphCache struct {
+	Edges []cachedEdge
+}
+
+// A cachedEdge is one call graph edge. Edges from the call graph's
+// synthetic root have an empty Caller and no call site.
+type cachedEdge struct {
+	Caller string `json:",omitempty"`
+	// Block and Instr are the indexes of the call site in
+	// Caller's blocks and in that block's instructions.
+	Block, Instr int
+	Callee       string
+}
+
+// runtimeCacheKey returns the call graph cache key for the runtime
+// loaded in lprog from ctxt. It hashes the contents of every file in
+// lprog, using the rewritten sources for the files in newSources, and
+// the build configuration.
+func runtimeCacheKey(ctxt *build.Context, lprog *loader.Program, newSources map[string][]byte) (string, error) {
+	var files []string
+	for _, pkg := range lprog.AllPackages {
+		for _, f := range pkg.Files {
+			files = append(files, lprog.Fset.File(f.Pos()).Name())
+		}
+	}
+	sort.Strings(files)
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s %q %v\n", ctxt.GOOS, ctxt.GOARCH, ctxt.GOROOT, ctxt.BuildTags)
+	for _, path := range files {
+		src, ok := newSources[path]
+		if !ok {
+			var err error
+			src, err = ioutil.ReadFile(path)
+			if err != nil {
+				return "", err
+			}
+		}
+		fmt.Fprintf(h, "%s %d\n", path, len(src))
+		h.Write(src)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// cachePath returns the path of the call graph cache entry for key in
+// dir.
+func cachePath(dir, key string) string {
+	return filepath.Join(dir, "callgraph-"+key+".json")
+}
+
+// writeCallGraphCache writes cg to the cache entry for key in dir.
+func writeCallGraphCache(dir, key string, cg *callgraph.Graph) error {
+	var c callGraphCache
+	err := callgraph.GraphVisitEdges(cg, func(e *callgraph.Edge) error {
+		edge := cachedEdge{Block: -1, Instr: -1, Callee: e.Callee.Func.String()}
+		if e.Caller != cg.Root {
+			edge.Caller = e.Caller.Func.String()
+			edge.Block, edge.Instr = siteIndex(e.Site)
+		}
+		c.Edges = append(c.Edges, edge)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(&c)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	// Write to a temporary file first so concurrent runs never
+	// see a partial entry.
+	tmp, err := ioutil.TempFile(dir, "callgraph-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err2 := tmp.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), cachePath(dir, key))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// siteIndex returns the indexes of site in its function's blocks and
+// in its block's instructions.
+func siteIndex(site ssa.CallInstruction) (block, instr int) {
+	b := site.Block()
+	for i, in := range b.Instrs {
+		if in == site {
+			return b.Index, i
+		}
+	}
+	panic(fmt.Sprintf("call site %v not in its block", site))
+}
+
+// readCallGraphCache reads the call graph cache entry for key in dir
+// and resolves it against prog. It returns nil if there is no entry,
+// or if the entry doesn't match prog.
+func readCallGraphCache(dir, key string, prog *ssa.Program) (*callgraph.Graph, error) {
+	data, err := ioutil.ReadFile(cachePath(dir, key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var c callGraphCache
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("%s: %v", cachePath(dir, key), err)
+	}
+
+	// Map function names to functions. Names that are ambiguous
+	// can't be resolved.
+	funcs := make(map[string]*ssa.Function)
+	for fn := range ssautil.AllFunctions(prog) {
+		name := fn.String()
+		if _, ok := funcs[name]; ok {
+			funcs[name] = nil
+		} else {
+			funcs[name] = fn
+		}
+	}
+
+	root := prog.NewFunction("<root>", new(types.Signature), "root of callgraph")
+	cg := callgraph.New(root)
+	for _, edge := range c.Edges {
+		callee := funcs[edge.Callee]
+		if callee == nil {
+			return nil, nil
+		}
+		if edge.Caller == "" {
+			callgraph.AddEdge(cg.Root, nil, cg.CreateNode(callee))
+			continue
+		}
+		caller := funcs[edge.Caller]
+		if caller == nil || edge.Block < 0 || edge.Block >= len(caller.Blocks) {
+			return nil, nil
+		}
+		instrs := caller.Blocks[edge.Block].Instrs
+		if edge.Instr < 0 || edge.Instr >= len(instrs) {
+			return nil, nil
+		}
+		site, ok := instrs[edge.Instr].(ssa.CallInstruction)
+		if !ok {
+			return nil, nil
+		}
+		callgraph.AddEdge(cg.CreateNode(caller), site, cg.CreateNode(callee))
+	}
+	return cg, nil
+}
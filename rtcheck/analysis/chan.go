@@ -0,0 +1,203 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package analysis
+
+import (
+	"fmt"
+	"go/constant"
+	"go/token"
+	"go/types"
+
+	"golang.org/x/tools/go/ssa"
+)
+
+// A channel send may block until another goroutine receives, so a
+// send is a blocking point like notesleep: every lock held at the
+// send is ordered before the channel. If the receiver needs one of
+// those locks, this is a deadlock.
+//
+// A send on a buffered channel with room in its buffer doesn't block.
+// For channels created by a MakeChan with a known size, the value
+// state tracks the channel's capacity and the number of buffered
+// elements, so such sends don't add edges.
+
+// DynChan is a channel created by an ssa.MakeChan with a known
+// capacity. The number of buffered elements is tracked as the value
+// of heap object buf.
+type DynChan struct {
+	buf *HeapObject
+	cap int64
+}
+
+func (x DynChan) Equal(y DynValue) bool {
+	y2, ok := y.(DynChan)
+	return ok && x.buf == y2.buf
+}
+
+func (x DynChan) BinOp(op token.Token, y DynValue) DynValue {
+	return comparableBinOp(x, op, y)
+}
+
+func (x DynChan) UnOp(op token.Token, vs ValState) DynValue {
+	if op == token.ARROW {
+		// The received value is unknown.
+		return dynUnknown{}
+	}
+	return addrUnOp(op)
+}
+
+// chanLen returns the number of buffered elements in ch in vs, or -1
+// if unknown.
+func chanLen(vs ValState, ch DynChan) int64 {
+	n, ok := vs.GetHeap(ch.buf).(DynConst)
+	if !ok {
+		return -1
+	}
+	l, exact := constant.Int64Val(n.c)
+	if !exact {
+		return -1
+	}
+	return l
+}
+
+// chanObject returns the heap object tracking the buffer of channels
+// created by instr.
+//
+// TODO: All channels created by instr share one heap object, so if
+// instr is in a loop and more than one of its channels is live, their
+// buffers are confused.
+func (s *state) chanObject(instr *ssa.MakeChan) *HeapObject {
+	obj := s.heap.chans[instr]
+	if obj == nil {
+		if s.heap.chans == nil {
+			s.heap.chans = make(map[*ssa.MakeChan]*HeapObject)
+		}
+		obj = NewHeapObject(fmt.Sprintf("chan %s.%s", instr.Parent(), instr.Name()))
+		s.heap.chans[instr] = obj
+	}
+	return obj
+}
+
+// doMakeChan binds the result of instr to a DynChan if its size is
+// known.
+func (s *state) doMakeChan(ps PathState, instr *ssa.MakeChan) PathState {
+	size, ok := ps.vs.Get(instr.Size).(DynConst)
+	if !ok {
+		return ps
+	}
+	n, exact := constant.Int64Val(size.c)
+	if !exact || n < 0 {
+		return ps
+	}
+	obj := s.chanObject(instr)
+	ps.vs = ps.vs.Extend(instr, DynChan{obj, n}).ExtendHeap(obj, MakeDynInt(0))
+	return ps
+}
+
+// chanClass returns the lock class representing channel ch for
+// ordering blocking sends.
+func (s *state) chanClass(vs ValState, ch ssa.Value) (*LockClass, error) {
+	switch ch := ch.(type) {
+	case *ssa.UnOp:
+		if ch.Op == token.MUL {
+			// Channel loaded from a global or field.
+			return s.lockClass(vs, ch.X)
+		}
+	case *ssa.MakeChan:
+		return s.lca.Named(fmt.Sprintf("%s.chan@%d", ch.Parent(), s.fset.Position(ch.Pos()).Line)), nil
+	}
+	return nil, fmt.Errorf("channel is not a field, global, or local make")
+}
+
+// doSend models the blocking effect of a send on channel chv by instr
+// on ps. If the send may block, it adds edges from the held locks to
+// the channel.
+func (s *state) doSend(ps PathState, instr ssa.Instruction, chv ssa.Value) PathState {
+	if ch, ok := ps.vs.Get(chv).(DynChan); ok {
+		if n := chanLen(ps.vs, ch); n >= 0 && n < ch.cap {
+			// Room in the buffer. This doesn't block.
+			ps.vs = ps.vs.ExtendHeap(ch.buf, MakeDynInt(n+1))
+			return ps
+		}
+	}
+	if ps.lockSet.Len() == 0 {
+		return ps
+	}
+	stack := s.stack.Extend(instr)
+	if s.opts.checkBlocking {
+		s.lockOrder.AddBlocking(ps.lockSet, "channel send", stack)
+	}
+	class, err := s.chanClass(ps.vs, chv)
+	if err != nil {
+		s.warnl(SevInfo, instr.Pos(), "%s", err)
+		return ps
+	}
+	s.lockOrder.Add(ps.lockSet, NewLockSet().Plus(class, stack), stack)
+	if fns.chansend1 != nil {
+		s.recordBlocking(ps.lockSet, fns.chansend1)
+	}
+	return ps
+}
+
+// doRecv models the effect of a receive from channel chv by instr on
+// ps. A receive from a channel with buffered elements doesn't block.
+// Otherwise, if the blocking check is enabled, it records the held
+// locks.
+func (s *state) doRecv(ps PathState, instr ssa.Instruction, chv ssa.Value) PathState {
+	if ch, ok := ps.vs.Get(chv).(DynChan); ok {
+		if n := chanLen(ps.vs, ch); n > 0 {
+			ps.vs = ps.vs.ExtendHeap(ch.buf, MakeDynInt(n-1))
+			return ps
+		}
+	}
+	if s.opts.checkBlocking && ps.lockSet.Len() != 0 {
+		s.lockOrder.AddBlocking(ps.lockSet, "channel receive", s.stack.Extend(instr))
+	}
+	return ps
+}
+
+// doSelectCase models select instr taking case i on ps, or its default
+// case if i is -1. It binds the select's index result to i, so later
+// branches on the index follow the case, and models the case's
+// channel operation. If the select has a default case, the operation
+// doesn't block.
+func (s *state) doSelectCase(ps PathState, instr *ssa.Select, i int) PathState {
+	for _, ref := range *instr.Referrers() {
+		if ext, ok := ref.(*ssa.Extract); ok && ext.Index == 0 {
+			ps.vs = ps.vs.Extend(ext, MakeDynInt(int64(i)))
+		}
+	}
+	if i < 0 {
+		return ps
+	}
+	st := instr.States[i]
+	if !instr.Blocking {
+		// We don't know whether the case was ready because
+		// of buffer space or a waiting goroutine.
+		if ch, ok := ps.vs.Get(st.Chan).(DynChan); ok {
+			ps.vs = ps.vs.ExtendHeap(ch.buf, dynUnknown{})
+		}
+		return ps
+	}
+	if st.Dir == types.SendOnly {
+		return s.doSend(ps, instr, st.Chan)
+	}
+	return s.doRecv(ps, instr, st.Chan)
+}
+
+// escapeChans forgets the buffer lengths of any tracked channels used
+// as operands of instr, since instr may send on or receive from them
+// in ways the analysis doesn't track.
+func escapeChans(ps PathState, instr ssa.Instruction) PathState {
+	for _, op := range instr.Operands(nil) {
+		if *op == nil {
+			continue
+		}
+		if ch, ok := ps.vs.Get(*op).(DynChan); ok {
+			ps.vs = ps.vs.ExtendHeap(ch.buf, dynUnknown{})
+		}
+	}
+	return ps
+}
@@ -0,0 +1,85 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package analysis
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update golden files in testdata/golden")
+
+// corpus is a set of known deadlock patterns in the fake runtime in
+// testdata/src/runtime. Each is analyzed from the given roots and the
+// result is compared against testdata/golden/name.json.
+//
+// Some of these document patterns the analysis doesn't yet catch. If
+// a change fixes one, rerun with -update and check the new report.
+var corpus = []struct {
+	name  string
+	roots []string
+}{
+	{"abba", []string{"lockAB", "lockBA"}},
+	{"selfdeadlock", []string{"lockAA"}},
+	{"rlocklock", []string{"rlockThenLock"}},
+	{"chansend", []string{"sendLocked"}},
+	{"deferunlock", []string{"deferUnlockAB", "deferLockBA"}},
+	{"correlated", []string{"corrAB", "corrBA"}},
+}
+
+// corpusReport is the golden report of a corpus entry.
+type corpusReport struct {
+	Cycles      []string `json:"cycles"`
+	Diagnostics []string `json:"diagnostics"`
+}
+
+func TestCorpus(t *testing.T) {
+	src, err := filepath.Abs(filepath.Join("testdata", "src"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range corpus {
+		s := analyzeTestdata(t, c.roots...)
+		report := corpusReport{Cycles: cycleStrings(s), Diagnostics: []string{}}
+		if report.Cycles == nil {
+			report.Cycles = []string{}
+		}
+		for _, d := range s.diags {
+			// Make paths relative so the report doesn't
+			// depend on where the tree is.
+			msg := fmt.Sprintf("%s:%d: %s: %s", filepath.Base(d.Pos.Filename), d.Pos.Line, d.Sev, d.Msg)
+			report.Diagnostics = append(report.Diagnostics, strings.Replace(msg, src+string(filepath.Separator), "", -1))
+		}
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "\t")
+		if err := enc.Encode(report); err != nil {
+			t.Fatal(err)
+		}
+		got := buf.Bytes()
+
+		golden := filepath.Join("testdata", "golden", c.name+".json")
+		if *update {
+			if err := ioutil.WriteFile(golden, got, 0666); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want, err := ioutil.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: report differs from %s; got:\n%s", c.name, golden, got)
+		}
+	}
+}
@@ -0,0 +1,624 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package analysis
+
+import (
+	"go/constant"
+	"log"
+
+	"golang.org/x/tools/go/ssa"
+)
+
+// TODO: Stack barrier locks, semaphores, etc.
+
+// A callHandler implements special handling of a function call. It
+// should append the updated PathState to newps and return the
+// resulting slice.
+type callHandler func(s *state, ps PathState, instr ssa.Instruction, newps []PathState) []PathState
+
+// callHandlers maps from function names (the result of
+// ssa.Function.String()) to handlers for special functions.
+//
+// TODO: Several of these are not nosplit and hence should model the
+// implicit morestack.
+var callHandlers map[string]callHandler
+
+// callHandler returns the callHandler for fn, if any. In addition to
+// callHandlers, this resolves the morestack marker of each package
+// analyze rewrote (see morestackName).
+func (s *state) callHandler(fn *ssa.Function) (callHandler, bool) {
+	if h, ok := callHandlers[fn.String()]; ok {
+		return h, true
+	}
+	if fn.Pkg != nil && fn.Name() == "rtcheck۰morestack" && s.opts.rewrittenPkgs[fn.Pkg.Pkg.Path()] {
+		return handleRuntimeMorestack, true
+	}
+	return nil, false
+}
+
+// returnHandlers maps from function names (ssa.Function.String()) to
+// handlers that, unlike callHandlers, don't replace walking the
+// function's body. Instead, doCall walks the body and then applies
+// the handler to each path state it returns in. This is for functions
+// whose own locking matters as well as their special effect.
+var returnHandlers map[string]callHandler
+
+// trackArgs is a set of function names (ssa.Function.String()) to
+// track the argument values of.
+var trackArgs = map[string]bool{
+	// copystack's locking behavior is significantly affected by
+	// the "sync" argument.
+	"runtime.copystack": true,
+
+	// TODO: chan.go:recv takes an unlock closure. Can we track
+	// that? Pointer analysis says the unlock function could be
+	// selunlock, which has a path that unlocks nothing.
+}
+
+// blockingFuncs is a set of function names (ssa.Function.String())
+// that may block the calling goroutine. These must not be called with
+// the M acquired.
+var blockingFuncs = map[string]bool{
+	"runtime.notesleep":    true,
+	"runtime.notetsleep":   true,
+	"runtime.notetsleepg":  true,
+	"runtime.gopark":       true,
+	"runtime.goparkunlock": true,
+	"runtime.semacquire":   true,
+
+	// goparkunlock is rewritten to rtcheck۰goparkunlock, which
+	// releases its lock before it blocks, so it's handled by
+	// handleRuntimeGoparkunlock.
+	"runtime.rtcheck۰gopark": true,
+}
+
+// initLocks maps from runtime initialization functions
+// (ssa.Function.String()) to the lock classes that must not be
+// acquired until that function has returned. This is used by the
+// init-order check.
+var initLocks = map[string][]string{
+	"runtime.mallocinit": {
+		"runtime.mheap_.lock",
+		"runtime.mheap_.speciallock",
+		"runtime.mcentral.lock*",
+	},
+}
+
+// initRoots is the list of roots that run before the runtime is
+// initialized. The init-order check adds these roots and starts
+// them with none of the initLocks functions having run.
+var initRoots = []string{"schedinit"}
+
+func init() {
+	// Go's initialization order rule doesn't distinguish between
+	// function pointers and function calls, so we have to
+	// initialize callHandlers outside of the initialization order.
+	callHandlers = map[string]callHandler{
+		"runtime.lock":   handleRuntimeLock,
+		"runtime.unlock": handleRuntimeUnlock,
+
+		// runtime.rwmutex (Go 1.9 and later). Both modes
+		// increment m.locks: the writer holds wLock and a
+		// reader holds an acquirem.
+		"(*runtime.rwmutex).lock":    handleRuntimeRWLock,
+		"(*runtime.rwmutex).unlock":  handleRuntimeUnlock,
+		"(*runtime.rwmutex).rlock":   handleRuntimeRlock,
+		"(*runtime.rwmutex).runlock": handleRuntimeRunlock,
+
+		"runtime.casgstatus":          handleRuntimeCasgstatus,
+		"runtime.castogscanstatus":    handleRuntimeCastogscanstatus,
+		"runtime.casfrom_Gscanstatus": handleRuntimeCasfrom_Gscanstatus,
+
+		"runtime.getg":                    handleRuntimeGetg,
+		"runtime.acquirem":                handleRuntimeAcquirem,
+		"runtime.releasem":                handleRuntimeReleasem,
+		"runtime.rtcheck۰presystemstack":  handleRuntimePresystemstack,
+		"runtime.rtcheck۰postsystemstack": handleRuntimePostsystemstack,
+		"runtime.rtcheck۰gopark":          handleRuntimeGopark,
+		"runtime.rtcheck۰goparkunlock":    handleRuntimeGoparkunlock,
+		"runtime.rtcheck۰gosched":         handleRuntimeGosched,
+
+		// Other rewritten packages call a marker instead,
+		// which state.callHandler resolves. See
+		// morestackName.
+		"runtime.morestack": handleRuntimeMorestack,
+
+		"runtime.notesleep":  handleRuntimeNotesleep,
+		"runtime.notetsleep": handleRuntimeNotesleep,
+		"runtime.notewakeup": handleRuntimeNotewakeup,
+
+		"(*sync.Mutex).Lock":      handleSyncLock,
+		"(*sync.Mutex).Unlock":    handleSyncUnlock,
+		"(*sync.RWMutex).Lock":    handleSyncRWLock,
+		"(*sync.RWMutex).Unlock":  handleSyncUnlock,
+		"(*sync.RWMutex).RLock":   handleSyncRLock,
+		"(*sync.RWMutex).RUnlock": handleSyncRUnlock,
+
+		// restartg does a conditional unlock of _Gscan, but it's hard
+		// to track that condition. In practice, it always does the
+		// unlock, so handle it just like casefrom_Gscanstatus.
+		//
+		// TODO: This function is silly. We should probably remove it
+		// from the runtime.
+		"runtime.restartg": handleRuntimeCasfrom_Gscanstatus,
+	}
+
+	returnHandlers = map[string]callHandler{
+		// semacquire and semrelease take semaRoot.lock
+		// internally, so their bodies are walked before the
+		// semaphore is acquired or released.
+		"runtime.semacquire": handleRuntimeSemacquire,
+		"runtime.semrelease": handleRuntimeSemrelease,
+	}
+}
+
+// A lockMode is the way a lock operation acquires or releases a lock.
+type lockMode int
+
+const (
+	// modeMutex is a plain mutual exclusion lock.
+	modeMutex lockMode = iota
+
+	// modeWrite is the write side of a reader/writer lock.
+	modeWrite
+
+	// modeRead is the read side of a reader/writer lock. A read
+	// lock is held in the read sub-class of the lock's class (see
+	// LockClassAnalysis.Reader).
+	modeRead
+)
+
+// acquire returns ps updated to acquire lock l at instr. It returns
+// false if acquiring l would self-deadlock, in which case the path
+// should be terminated.
+func (s *state) acquire(ps PathState, instr ssa.Instruction, l ssa.Value) (PathState, bool) {
+	return s.acquireMode(ps, instr, l, modeMutex)
+}
+
+// acquireMode is like acquire, but acquires l in the given mode. A
+// read lock is ordered after the held locks like a write lock, since
+// a reader waits for writers. A write lock is also ordered after the
+// held locks as a read lock, since a writer waits for readers.
+// Acquiring a read lock while holding another read lock of the same
+// class is not a self-deadlock.
+func (s *state) acquireMode(ps PathState, instr ssa.Instruction, l ssa.Value, mode lockMode) (PathState, bool) {
+	s.visitLockOp(instr)
+	lock, err := s.lockClass(ps.vs, l)
+	if err != nil {
+		s.warnl(SevInfo, instr.Pos(), "%s", err)
+		return ps, true
+	}
+	held := lock
+	newls := NewLockSet().Plus(lock, s.stack)
+	switch mode {
+	case modeRead:
+		held = s.lca.Reader(lock)
+	case modeWrite:
+		newls = newls.Plus(s.lca.Reader(lock), s.stack)
+	}
+	s.lockOrder.Add(ps.lockSet, newls, s.stack)
+	s.recordAcquire(ps.lockSet, held, instr)
+	// If we self-deadlocked, terminate this path.
+	//
+	// TODO: This is only sound if we know it's the same lock
+	// *instance*.
+	prev := lock
+	if !ps.lockSet.Contains(prev) && mode == modeWrite {
+		prev = lock.reader
+	}
+	if prev != nil && ps.lockSet.Contains(prev) {
+		s.addDoubleLock(lock, ps.lockSet.Stack(prev), instr)
+		return ps, false
+	}
+	ps.lockSet = ps.lockSet.Plus(held, s.stack)
+	s.observe(LockAcquire, held, &ps)
+	if s.opts.checkInitOrder {
+		s.checkInitOrder(ps, instr, held)
+	}
+	if s.opts.requirePreemptoff != nil {
+		s.checkPreemptoff(ps, instr, held)
+	}
+	if s.opts.systemStackLocks != nil || s.opts.userStackLocks != nil {
+		s.checkStackAcquire(ps, instr, held)
+	}
+	return ps, true
+}
+
+// release returns ps updated to release lock l at instr, and whether
+// l was held.
+func (s *state) release(ps PathState, instr ssa.Instruction, l ssa.Value) (PathState, bool) {
+	return s.releaseMode(ps, instr, l, modeMutex)
+}
+
+// releaseMode is like release, but releases l in the given mode.
+func (s *state) releaseMode(ps PathState, instr ssa.Instruction, l ssa.Value, mode lockMode) (PathState, bool) {
+	s.visitLockOp(instr)
+	lock, err := s.lockClass(ps.vs, l)
+	if err != nil {
+		s.warnl(SevInfo, instr.Pos(), "%s", err)
+		return ps, false
+	}
+	if mode == modeRead {
+		lock = s.lca.Reader(lock)
+	}
+	held := ps.lockSet.Contains(lock)
+	ps.lockSet = ps.lockSet.Minus(lock)
+	s.observe(LockRelease, lock, &ps)
+	if !held {
+		// TODO: Perhaps warn more stringently if this is a
+		// single instance lock class, though even then we
+		// could be confused by control flow.
+		s.warnl(SevWarning, instr.Pos(), "possible unlock of unlocked lock")
+	}
+	return ps, held
+}
+
+func handleRuntimeLock(s *state, ps PathState, instr ssa.Instruction, newps []PathState) []PathState {
+	return s.runtimeLockMode(ps, instr, modeMutex, newps)
+}
+
+func handleRuntimeRWLock(s *state, ps PathState, instr ssa.Instruction, newps []PathState) []PathState {
+	return s.runtimeLockMode(ps, instr, modeWrite, newps)
+}
+
+func handleRuntimeRlock(s *state, ps PathState, instr ssa.Instruction, newps []PathState) []PathState {
+	return s.runtimeLockMode(ps, instr, modeRead, newps)
+}
+
+// runtimeLockMode acquires the runtime lock passed as the first
+// argument of call instr in the given mode and increments m.locks.
+func (s *state) runtimeLockMode(ps PathState, instr ssa.Instruction, mode lockMode, newps []PathState) []PathState {
+	ps, ok := s.acquireMode(ps, instr, instr.(ssa.CallInstruction).Common().Args[0], mode)
+	if !ok {
+		return newps
+	}
+
+	// m.locks++. If m.locks isn't known, it stays unknown.
+	nlocks, ok := heapInt(ps.vs, s.heap.curM_locks)
+	if !ok {
+		return append(newps, ps)
+	}
+	const maxLocks = 16
+	if nlocks >= maxLocks {
+		s.stats.BudgetExhausted++
+		s.warnp(SevWarning, instr.Pos(), "%d locks held; trimming path", nlocks)
+		return newps
+	}
+	ps.vs = ps.vs.ExtendHeap(s.heap.curM_locks, DynConst{constant.MakeInt64(nlocks + 1)})
+	return append(newps, ps)
+}
+
+func handleRuntimeUnlock(s *state, ps PathState, instr ssa.Instruction, newps []PathState) []PathState {
+	return s.runtimeUnlockMode(ps, instr, modeMutex, newps)
+}
+
+func handleRuntimeRunlock(s *state, ps PathState, instr ssa.Instruction, newps []PathState) []PathState {
+	return s.runtimeUnlockMode(ps, instr, modeRead, newps)
+}
+
+// runtimeUnlockMode is the inverse of runtimeLockMode.
+func (s *state) runtimeUnlockMode(ps PathState, instr ssa.Instruction, mode lockMode, newps []PathState) []PathState {
+	ps, held := s.releaseMode(ps, instr, instr.(ssa.CallInstruction).Common().Args[0], mode)
+
+	// m.locks-- if lock is held. We only do this conditionally
+	// because sometimes our handling of correlated control flow
+	// leads to *three* paths: both lock and unlock, neither lock
+	// or unlock, and just unlock.
+	if nlocks, ok := heapInt(ps.vs, s.heap.curM_locks); held && ok {
+		if nlocks <= 0 {
+			// Terminate path.
+			s.warnp(SevWarning, instr.Pos(), "unlock with m.locks <= 0; trimming path")
+			return newps
+		}
+		ps.vs = ps.vs.ExtendHeap(s.heap.curM_locks, DynConst{constant.MakeInt64(nlocks - 1)})
+	}
+	return append(newps, ps)
+}
+
+func handleRuntimeSemacquire(s *state, ps PathState, instr ssa.Instruction, newps []PathState) []PathState {
+	// A semaphore is ordered like a lock: semacquire waits for
+	// whoever holds it to semrelease it. Unlike runtime.lock,
+	// this doesn't increment m.locks.
+	ps, ok := s.acquire(ps, instr, instr.(ssa.CallInstruction).Common().Args[0])
+	if !ok {
+		return newps
+	}
+	return append(newps, ps)
+}
+
+func handleRuntimeSemrelease(s *state, ps PathState, instr ssa.Instruction, newps []PathState) []PathState {
+	// Semaphores are often released by a different goroutine
+	// than the one that acquired them, for example to wake up a
+	// waiter, so unlike release, don't warn if the semaphore
+	// isn't held.
+	s.visitLockOp(instr)
+	sema, err := s.lockClass(ps.vs, instr.(ssa.CallInstruction).Common().Args[0])
+	if err != nil {
+		s.warnl(SevInfo, instr.Pos(), "%s", err)
+		return append(newps, ps)
+	}
+	if ps.lockSet.Contains(sema) {
+		ps.lockSet = ps.lockSet.Minus(sema)
+		s.observe(LockRelease, sema, &ps)
+	}
+	return append(newps, ps)
+}
+
+// syncReceiver returns the receiver of a call to a sync.Mutex or
+// sync.RWMutex method.
+func syncReceiver(instr ssa.Instruction) ssa.Value {
+	call := instr.(ssa.CallInstruction).Common()
+	if call.IsInvoke() {
+		// Called through sync.Locker. The lock class of an
+		// interface value is unknown, so lockClass will
+		// report this.
+		return call.Value
+	}
+	return call.Args[0]
+}
+
+func handleSyncLock(s *state, ps PathState, instr ssa.Instruction, newps []PathState) []PathState {
+	ps, ok := s.acquire(ps, instr, syncReceiver(instr))
+	if !ok {
+		return newps
+	}
+	return append(newps, ps)
+}
+
+func handleSyncUnlock(s *state, ps PathState, instr ssa.Instruction, newps []PathState) []PathState {
+	ps, _ = s.release(ps, instr, syncReceiver(instr))
+	return append(newps, ps)
+}
+
+func handleSyncRWLock(s *state, ps PathState, instr ssa.Instruction, newps []PathState) []PathState {
+	ps, ok := s.acquireMode(ps, instr, syncReceiver(instr), modeWrite)
+	if !ok {
+		return newps
+	}
+	return append(newps, ps)
+}
+
+func handleSyncRLock(s *state, ps PathState, instr ssa.Instruction, newps []PathState) []PathState {
+	ps, ok := s.acquireMode(ps, instr, syncReceiver(instr), modeRead)
+	if !ok {
+		return newps
+	}
+	return append(newps, ps)
+}
+
+func handleSyncRUnlock(s *state, ps PathState, instr ssa.Instruction, newps []PathState) []PathState {
+	ps, _ = s.releaseMode(ps, instr, syncReceiver(instr), modeRead)
+	return append(newps, ps)
+}
+
+func handleRuntimeCasgstatus(s *state, ps PathState, instr ssa.Instruction, newps []PathState) []PathState {
+	// Equivalent to acquiring and releasing _Gscan.
+	gscan := NewLockSet().Plus(s.gscanLock, s.stack)
+	s.lockOrder.Add(ps.lockSet, gscan, s.stack)
+	return append(newps, ps)
+}
+
+func handleRuntimeCastogscanstatus(s *state, ps PathState, instr ssa.Instruction, newps []PathState) []PathState {
+	// This is a conditional acquisition of _Gscan. _Gscan is
+	// acquired on the true branch and not acquired on the false
+	// branch. Either way it participates in the lock order.
+	gscan := NewLockSet().Plus(s.gscanLock, s.stack)
+	s.lockOrder.Add(ps.lockSet, gscan, s.stack)
+
+	psT, psF := ps, ps
+
+	psT.lockSet = psT.lockSet.Plus(s.gscanLock, s.stack)
+	s.observe(LockAcquire, s.gscanLock, &psT)
+	psT.vs = psT.vs.Extend(instr.(ssa.Value), DynConst{constant.MakeBool(true)})
+
+	psF.vs = psF.vs.Extend(instr.(ssa.Value), DynConst{constant.MakeBool(false)})
+
+	return append(newps, psT, psF)
+}
+
+func handleRuntimeCasfrom_Gscanstatus(s *state, ps PathState, instr ssa.Instruction, newps []PathState) []PathState {
+	// Unlock of _Gscan.
+	ps.lockSet = ps.lockSet.Minus(s.gscanLock)
+	s.observe(LockRelease, s.gscanLock, &ps)
+	return append(newps, ps)
+}
+
+func handleRuntimeGetg(s *state, ps PathState, instr ssa.Instruction, newps []PathState) []PathState {
+	val := ps.vs.GetHeap(s.heap.curG)
+	if val == nil {
+		log.Fatal("failed to determine current G")
+	}
+	ps.vs = ps.vs.Extend(instr.(ssa.Value), val)
+	return append(newps, ps)
+}
+
+func handleRuntimeAcquirem(s *state, ps PathState, instr ssa.Instruction, newps []PathState) []PathState {
+	ps.vs = ps.vs.Extend(instr.(ssa.Value), DynHeapPtr{s.heap.curM})
+	// m.locks++. Counts that aren't known stay unknown.
+	if nlocks, ok := heapInt(ps.vs, s.heap.curM_locks); ok {
+		ps.vs = ps.vs.ExtendHeap(s.heap.curM_locks, DynConst{constant.MakeInt64(nlocks + 1)})
+	}
+	if n, ok := s.acquiremCount(ps.vs); ok && s.opts.checkPreempt {
+		ps.vs = ps.vs.ExtendHeap(s.heap.curM_acquirem, DynConst{constant.MakeInt64(n + 1)})
+	}
+	return append(newps, ps)
+}
+
+func handleRuntimeReleasem(s *state, ps PathState, instr ssa.Instruction, newps []PathState) []PathState {
+	// releasem does an m.locks--, but m comes in as an argument,
+	// so we can't tell that it's just curM. If we were to track
+	// argument and return values, we might be able to get this
+	// and acquirem right automatically.
+	//
+	// m.locks--. If m.locks is already 0, this path is
+	// impossible, usually because of control flow that's
+	// correlated with m.locks that we didn't follow. Continuing
+	// it would make m.locks negative and lead to more impossible
+	// paths, so terminate it.
+	//
+	// If m.locks isn't known, it stays unknown.
+	if nlocks, ok := heapInt(ps.vs, s.heap.curM_locks); ok {
+		if nlocks <= 0 {
+			s.warnp(SevWarning, instr.Pos(), "releasem with m.locks <= 0; trimming path")
+			return newps
+		}
+		ps.vs = ps.vs.ExtendHeap(s.heap.curM_locks, DynConst{constant.MakeInt64(nlocks - 1)})
+	}
+	if n, ok := s.acquiremCount(ps.vs); ok && s.opts.checkPreempt {
+		if n <= 0 {
+			s.warnp(SevWarning, instr.Pos(), "releasem without matching acquirem")
+		} else {
+			ps.vs = ps.vs.ExtendHeap(s.heap.curM_acquirem, DynConst{constant.MakeInt64(n - 1)})
+		}
+	}
+	return append(newps, ps)
+}
+
+func handleRuntimePresystemstack(s *state, ps PathState, instr ssa.Instruction, newps []PathState) []PathState {
+	// Get the current G.
+	curG := ps.vs.GetHeap(s.heap.curG)
+	if curG == nil {
+		log.Fatal("failed to determine current G")
+	}
+	if curG.(DynHeapPtr).elem != s.heap.g0 && s.opts.userStackLocks != nil {
+		s.checkStackSwitch(ps, instr, true)
+	}
+	// Set the current G to g0. This is a no-op if we're already
+	// on the system stack.
+	ps.vs = ps.vs.ExtendHeap(s.heap.curG, DynHeapPtr{s.heap.g0})
+	// Return the original G.
+	ps.vs = ps.vs.Extend(instr.(ssa.Value), curG)
+	return append(newps, ps)
+}
+
+func handleRuntimePostsystemstack(s *state, ps PathState, instr ssa.Instruction, newps []PathState) []PathState {
+	// Return the to g returned by presystemstack.
+	origG := ps.vs.Get(instr.(ssa.CallInstruction).Common().Args[0])
+	if origG == nil {
+		log.Fatal("failed to restore G returned by presystemstack")
+	}
+	if origG.(DynHeapPtr).elem != s.heap.g0 && s.opts.systemStackLocks != nil {
+		if system, ok := s.onSystemStack(ps); ok && system {
+			s.checkStackSwitch(ps, instr, false)
+		}
+	}
+	ps.vs = ps.vs.ExtendHeap(s.heap.curG, origG)
+	return append(newps, ps)
+}
+
+func handleRuntimeGopark(s *state, ps PathState, instr ssa.Instruction, newps []PathState) []PathState {
+	// The goroutine is parked until some other goroutine readies
+	// it. Any lock still held can't be released until then, so
+	// the waker must not need it. This is almost always a bug.
+	if ps.lockSet.Len() != 0 {
+		s.lockOrder.AddBlocking(ps.lockSet, "gopark", s.stack.Extend(instr))
+	}
+	return append(newps, ps)
+}
+
+func handleRuntimeGoparkunlock(s *state, ps PathState, instr ssa.Instruction, newps []PathState) []PathState {
+	// goparkunlock releases its lock before parking.
+	fn := instr.(ssa.CallInstruction).Common().StaticCallee()
+	for _, ps := range handleRuntimeUnlock(s, ps, instr, nil) {
+		s.recordBlocking(ps.lockSet, fn)
+		newps = handleRuntimeGopark(s, ps, instr, newps)
+	}
+	return newps
+}
+
+func handleRuntimeGosched(s *state, ps PathState, instr ssa.Instruction, newps []PathState) []PathState {
+	// Yielding puts the goroutine on the run queue, so it may not
+	// run again for a while. Locks held across the yield stay
+	// held until then.
+	if s.opts.checkGosched && ps.lockSet.Len() != 0 {
+		s.lockOrder.AddBlocking(ps.lockSet, "gosched", s.stack.Extend(instr))
+	}
+	return append(newps, ps)
+}
+
+func handleRuntimeMorestack(s *state, ps PathState, instr ssa.Instruction, newps []PathState) []PathState {
+	// Get the current G.
+	curG := ps.vs.GetHeap(s.heap.curG)
+	if curG == nil {
+		log.Fatal("failed to determine current G")
+	}
+	// If we're on the system stack we either have room or we
+	// panic, so just return from morestack.
+	if curG.(DynHeapPtr).elem == s.heap.g0 {
+		return append(newps, ps)
+	}
+
+	// Otherwise, we may or may not call newstack. Take both
+	// paths. This is important because newstack doesn't
+	// technically "return", so we're going to lose that execution
+	// path.
+	newps = append(newps, ps)
+
+	// Call newstack on the system stack.
+	//
+	// TODO: This duplicates some of doCall. Can I make the
+	// walkFunction API nicer so this is nicer?
+	newstack := instr.Parent().Prog.ImportedPackage("runtime").Func("newstack")
+	psEntry := PathState{
+		lockSet: ps.lockSet,
+		vs:      ps.vs.ExtendHeap(s.heap.curG, DynHeapPtr{s.heap.g0}).LimitToHeap(),
+	}
+	s.walkFunction(newstack, psEntry).ForEach(func(ps2 PathState) {
+		// Keep the caller's frame values.
+		ps := ps
+		ps.lockSet = ps2.lockSet
+		ps.vs.heap = ps2.vs.heap
+		// Leave system stack.
+		ps.vs = ps.vs.ExtendHeap(s.heap.curG, curG)
+		newps = append(newps, ps)
+	})
+	return newps
+}
+
+func handleRuntimeNotesleep(s *state, ps PathState, instr ssa.Instruction, newps []PathState) []PathState {
+	// Like gopark, sleeping on a note with a lock held is almost
+	// always a bug, even if the waker doesn't need the lock.
+	if ps.lockSet.Len() != 0 {
+		op := "notesleep"
+		if instr.(ssa.CallInstruction).Common().StaticCallee() == fns.notetsleep {
+			op = "notetsleep"
+		}
+		s.lockOrder.AddBlocking(ps.lockSet, op, s.stack.Extend(instr))
+	}
+
+	// notesleep blocks until some other thread calls notewakeup
+	// on the same note. Model this as acquiring the note: any
+	// lock held while sleeping gets an edge to the note, so if
+	// the waker needs one of those locks, we get a cycle.
+	//
+	// TODO: notetsleep can time out, so this is only a deadlock
+	// if the timeout is negative.
+	note, err := s.lockClass(ps.vs, instr.(ssa.CallInstruction).Common().Args[0])
+	if err != nil {
+		s.warnl(SevInfo, instr.Pos(), "%s", err)
+		return append(newps, ps)
+	}
+	s.lockOrder.Add(ps.lockSet, NewLockSet().Plus(note, s.stack), s.stack)
+	return append(newps, ps)
+}
+
+func handleRuntimeNotewakeup(s *state, ps PathState, instr ssa.Instruction, newps []PathState) []PathState {
+	// The sleeper can't proceed until the waker reaches
+	// notewakeup, so the note is effectively held until all of
+	// the locks the waker holds have been acquired. Add an edge
+	// from the note to each held lock. notewakeup itself never
+	// blocks, so holding locks across it is fine.
+	note, err := s.lockClass(ps.vs, instr.(ssa.CallInstruction).Common().Args[0])
+	if err != nil {
+		s.warnl(SevInfo, instr.Pos(), "%s", err)
+		return append(newps, ps)
+	}
+	noteSet := NewLockSet().Plus(note, s.stack)
+	for _, l := range ps.lockSet.locks {
+		lock := ps.lockSet.lca.Lookup(l.id)
+		s.lockOrder.Add(noteSet, NewLockSet().Plus(lock, l.stack), l.stack)
+	}
+	return append(newps, ps)
+}
@@ -0,0 +1,402 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package analysis
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/go/ssa"
+)
+
+// incrementalState is what incremental analysis records between
+// runs. It is stored as JSON.
+//
+// Everything the analysis reports per root is recorded with the roots
+// from which it was found, including from memoized walks, so that
+// what clean roots found can be carried over to the next run (see
+// mergeClean).
+type incrementalState struct {
+	// Version is incrementalStateVersion. States with other
+	// versions are discarded.
+	Version int
+
+	// Funcs maps from function name (ssa.Function.String()) to
+	// what we know about that function.
+	Funcs map[string]incrementalFunc
+
+	// Graph is the lock graph of the last run, including the
+	// paths merged from earlier runs.
+	Graph *savedLockGraph `json:",omitempty"`
+
+	// Blocking, Diags, and DoubleLocks are the locks held across
+	// blocking operations, the diagnostics, and the double locks
+	// of the last run.
+	Blocking    []savedBlocking   `json:",omitempty"`
+	Diags       []savedDiag       `json:",omitempty"`
+	DoubleLocks []savedDoubleLock `json:",omitempty"`
+
+	// Leaks lists the roots that may return with locks held.
+	Leaks []string `json:",omitempty"`
+
+	// GoRoots maps from the name of each function started by a go
+	// statement to the roots from which the go statement was
+	// found.
+	GoRoots map[string][]string `json:",omitempty"`
+}
+
+const incrementalStateVersion = 1
+
+// savedDiag is a diagnostic and the roots from which it was found.
+type savedDiag struct {
+	Sev   Severity
+	Pos   token.Position
+	Msg   string
+	Stack string `json:",omitempty"`
+	Roots []string
+}
+
+// savedDoubleLock is a doubleLock with its stacks rendered, and the
+// roots from which it was found.
+type savedDoubleLock struct {
+	Lock          string
+	First, Second string
+	Roots         []string
+}
+
+type incrementalFunc struct {
+	// Hash is the funcHash of the function.
+	Hash string
+	// Callees is the list of functions this function was
+	// observed to call during exploration.
+	Callees []string `json:",omitempty"`
+}
+
+// funcHash returns a hash of fn's SSA form. This changes if fn's code
+// changes, but not if fn merely moves in its file or one of its
+// callees changes.
+func funcHash(fn *ssa.Function) string {
+	var buf bytes.Buffer
+	ssa.WriteFunction(&buf, fn)
+	h := sha256.New()
+	sc := bufio.NewScanner(&buf)
+	for sc.Scan() {
+		if strings.HasPrefix(sc.Text(), "# Location:") {
+			continue
+		}
+		h.Write(sc.Bytes())
+		h.Write([]byte{'\n'})
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// readIncrementalState reads the incremental state from path. If path
+// doesn't exist, it returns an empty state.
+func readIncrementalState(path string) (*incrementalState, error) {
+	st := &incrementalState{Funcs: make(map[string]incrementalFunc)}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return st, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if st.Version != incrementalStateVersion || st.Graph == nil || st.Graph.Version != savedLockGraphVersion {
+		// We can't recover what the clean roots found, so
+		// start over.
+		return &incrementalState{Funcs: make(map[string]incrementalFunc)}, nil
+	}
+	return st, nil
+}
+
+// dirtyRoots splits roots into the roots that must be re-analyzed
+// given the previous incremental state old, and the names of the
+// clean roots, whose results can be carried over. A root is dirty if
+// it is new, or if it transitively calls a function whose hash has
+// changed. funcs maps from function names to the current functions.
+//
+// The functions that clean roots started with go statements in the
+// last run are roots too, since the clean roots would start them
+// again. Like other roots, they are dirty or clean depending on
+// their own callees.
+func (old *incrementalState) dirtyRoots(roots []*ssa.Function, funcs map[string]*ssa.Function) (dirtyRoots []*ssa.Function, clean map[string]bool) {
+	// Find changed functions.
+	dirty := make(map[string]bool)
+	for name, info := range old.Funcs {
+		if fn := funcs[name]; fn == nil || funcHash(fn) != info.Hash {
+			dirty[name] = true
+		}
+	}
+
+	// Propagate dirtiness to callers.
+	callers := make(map[string][]string)
+	for name, info := range old.Funcs {
+		for _, callee := range info.Callees {
+			callers[callee] = append(callers[callee], name)
+		}
+	}
+	var work []string
+	for name := range dirty {
+		work = append(work, name)
+	}
+	for len(work) > 0 {
+		name := work[len(work)-1]
+		work = work[:len(work)-1]
+		for _, caller := range callers[name] {
+			if !dirty[caller] {
+				dirty[caller] = true
+				work = append(work, caller)
+			}
+		}
+	}
+
+	clean = make(map[string]bool)
+	isRoot := make(map[string]bool)
+	addRoot := func(root *ssa.Function) {
+		isRoot[root.String()] = true
+		if _, ok := old.Funcs[root.String()]; !ok || dirty[root.String()] {
+			dirtyRoots = append(dirtyRoots, root)
+		} else {
+			clean[root.String()] = true
+		}
+	}
+	for _, root := range roots {
+		addRoot(root)
+	}
+	var goRoots []string
+	for name := range old.GoRoots {
+		goRoots = append(goRoots, name)
+	}
+	sort.Strings(goRoots)
+	for changed := true; changed; {
+		changed = false
+		for _, name := range goRoots {
+			if isRoot[name] || funcs[name] == nil {
+				continue
+			}
+			for _, spawner := range old.GoRoots[name] {
+				if clean[spawner] {
+					addRoot(funcs[name])
+					changed = true
+					break
+				}
+			}
+		}
+	}
+	return dirtyRoots, clean
+}
+
+// mergeClean adds what the clean roots found in the run that saved
+// old to s. Since those roots are clean, what they find hasn't
+// changed, so s then covers every root, not just the re-analyzed
+// ones. Paths, diagnostics, and double locks that were only found
+// from re-analyzed roots, or from roots that are no longer requested,
+// are dropped, since s found them again if they still exist.
+//
+// The usage, lock list, nesting, unbalanced lock, unvisited lock, and
+// statistics reports still only reflect the analyzed roots.
+func (s *state) mergeClean(old *incrementalState, clean map[string]bool) error {
+	cleanRoots := func(roots []string) []string {
+		var out []string
+		for _, root := range roots {
+			if clean[root] {
+				out = append(out, root)
+			}
+		}
+		return out
+	}
+	lo := s.lockOrder
+	if lo.lca == nil {
+		lo.lca = &s.lca
+	}
+	classes := make(map[string]*LockClass)
+	for _, lc := range s.lca.list {
+		classes[lc.String()] = lc
+	}
+	class := func(name string) *LockClass {
+		lc := classes[name]
+		if lc == nil {
+			// The class no longer exists in the code, but
+			// a clean root's path still acquires it.
+			if strings.HasSuffix(name, "*") {
+				lc = s.lca.NewLockClass(strings.TrimSuffix(name, "*"), false)
+			} else {
+				lc = s.lca.NewLockClass(name, true)
+			}
+			classes[name] = lc
+		}
+		return lc
+	}
+	// mergePaths adds the saved paths sps that clean roots found
+	// to infos, and credits those roots to the path made by
+	// mkPath. A path that s found again from an analyzed root is
+	// credited instead of added again. render renders an info
+	// like sps.
+	mergePaths := func(infos map[lockOrderInfo]struct{}, sps []savedPath, render func(lockOrderInfo) savedPath, mkPath func(lockOrderInfo) interface{}) error {
+		found := make(map[string]lockOrderInfo)
+		for info := range infos {
+			found[fmt.Sprint(render(info))] = info
+		}
+		for _, sp := range sps {
+			roots := cleanRoots(sp.Roots)
+			if len(roots) == 0 {
+				continue
+			}
+			key := sp
+			key.Roots = nil
+			info, ok := found[fmt.Sprint(key)]
+			if !ok {
+				p, err := loadPath(sp)
+				if err != nil {
+					return err
+				}
+				info = lockOrderInfo{saved: p}
+				infos[info] = struct{}{}
+			}
+			for _, root := range roots {
+				lo.credit(mkPath(info), root)
+			}
+		}
+		return nil
+	}
+
+	for _, e := range old.Graph.Edges {
+		edge := lockOrderEdge{class(e.From).Id(), class(e.To).Id()}
+		if lo.m[edge] == nil {
+			lo.m[edge] = make(map[lockOrderInfo]struct{})
+		}
+		err := mergePaths(lo.m[edge], e.Paths, func(info lockOrderInfo) savedPath {
+			return savePath(lo.renderInfo(edge, info))
+		}, func(info lockOrderInfo) interface{} {
+			return lockOrderPath{edge, info}
+		})
+		if err != nil {
+			return fmt.Errorf("edge %s -> %s: %v", e.From, e.To, err)
+		}
+		if len(lo.m[edge]) == 0 {
+			delete(lo.m, edge)
+		}
+	}
+	lo.cycles = nil
+
+	for _, b := range old.Blocking {
+		op := blockingOp{class(b.Lock).Id(), b.Op, b.Pos}
+		if lo.blocking == nil {
+			lo.blocking = make(map[blockingOp]map[lockOrderInfo]struct{})
+		}
+		if lo.blocking[op] == nil {
+			lo.blocking[op] = make(map[lockOrderInfo]struct{})
+		}
+		err := mergePaths(lo.blocking[op], b.Paths, func(info lockOrderInfo) savedPath {
+			return savePath(lo.renderPath(info, "acquires "+b.Lock, "blocks in "+b.Op))
+		}, func(info lockOrderInfo) interface{} {
+			return blockingPath{op, info}
+		})
+		if err != nil {
+			return fmt.Errorf("%s held across %s: %v", b.Lock, b.Op, err)
+		}
+		if len(lo.blocking[op]) == 0 {
+			delete(lo.blocking, op)
+		}
+	}
+
+	for _, d := range old.Diags {
+		roots := cleanRoots(d.Roots)
+		if len(roots) == 0 {
+			continue
+		}
+		i, ok := s.messages[diagKey(d.Sev, d.Pos, d.Msg)]
+		if !ok {
+			i = len(s.diags)
+			s.addDiag(d.Sev, d.Pos, d.Msg, d.Stack)
+		}
+		for _, root := range roots {
+			s.credit(diagEffect(i), root)
+		}
+	}
+
+	found := make(map[[3]string]doubleLock)
+	for _, d := range s.doubleLocks {
+		first, second := s.doubleLockStacks(d)
+		found[[3]string{d.lock.String(), first, second}] = d
+	}
+	for _, sd := range old.DoubleLocks {
+		roots := cleanRoots(sd.Roots)
+		if len(roots) == 0 {
+			continue
+		}
+		d, ok := found[[3]string{sd.Lock, sd.First, sd.Second}]
+		if !ok {
+			d = doubleLock{lock: class(sd.Lock), text: &[2]string{sd.First, sd.Second}}
+			s.recordDoubleLock(d)
+		}
+		for _, root := range roots {
+			s.credit(d, root)
+		}
+	}
+
+	for _, root := range old.Leaks {
+		if clean[root] {
+			s.rootLockLeaks = append(s.rootLockLeaks, root)
+		}
+	}
+
+	for name, spawners := range old.GoRoots {
+		for _, root := range cleanRoots(spawners) {
+			s.credit(goRootEffect(name), root)
+		}
+	}
+	return nil
+}
+
+// writeIncrementalState writes the incremental state of s to path.
+// Functions explored by s replace their entries in old; other entries
+// in old are retained, since they still describe clean roots.
+func (s *state) writeIncrementalState(path string, old *incrementalState) error {
+	for fn := range s.fns {
+		var callees []string
+		for callee := range s.calledFns[fn] {
+			callees = append(callees, callee.String())
+		}
+		sort.Strings(callees)
+		old.Funcs[fn.String()] = incrementalFunc{funcHash(fn), callees}
+	}
+	old.Version = incrementalStateVersion
+	old.Graph = s.lockOrder.saved()
+	old.Blocking = s.lockOrder.savedBlocking()
+	old.Diags = nil
+	for i, d := range s.diags {
+		src := s.diagSrcs[i]
+		if len(src.roots) == 0 {
+			continue
+		}
+		old.Diags = append(old.Diags, savedDiag{d.Sev, d.Pos, src.msg, src.stack, sortedNames(src.roots)})
+	}
+	old.DoubleLocks = nil
+	for _, d := range s.doubleLocks {
+		first, second := s.doubleLockStacks(d)
+		old.DoubleLocks = append(old.DoubleLocks, savedDoubleLock{d.lock.String(), first, second, sortedNames(s.doubleLockRoots[d])})
+	}
+	old.Leaks = s.rootLockLeaks
+	old.GoRoots = make(map[string][]string)
+	for name, roots := range s.goRootSpawners {
+		old.GoRoots[name] = sortedNames(roots)
+	}
+	data, err := json.MarshalIndent(old, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0666)
+}
@@ -0,0 +1,257 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package analysis
+
+import (
+	"log"
+	"os"
+
+	"golang.org/x/tools/go/ssa"
+)
+
+// livenessFor computes which values must be live in each basic block
+// in f in order to compute each value in vals and the function value
+// called by each call in calls. Note that a given
+// value may be may be marked live in the same block it's defined in,
+// so it may not yet exist upon entry to the block. deps is indexed by
+// basic block number in f.
+//
+// TODO: This doesn't account for control flow dependencies. For
+// example if a value depends on a phi, this will add all of the
+// values that go into that phi, but not the values necessary to
+// determine the control flow into that phi. In effect, the phi has an
+// implicit dependency on which predecessor it came from, and we don't
+// model that.
+func livenessFor(f *ssa.Function, vals []ssa.Instruction, calls []ssa.CallInstruction) (deps []map[ssa.Value]struct{}) {
+	deps = make([]map[ssa.Value]struct{}, len(f.Blocks))
+
+	// For each operand to def, keep the operand live in all
+	// blocks between the operand's definition and here.
+	var walk func(def ssa.Value, use *ssa.BasicBlock)
+	walk = func(def ssa.Value, use *ssa.BasicBlock) {
+		if _, ok := deps[use.Index][def]; ok {
+			return
+		}
+
+		if deps[use.Index] == nil {
+			deps[use.Index] = make(map[ssa.Value]struct{})
+		}
+		deps[use.Index][def] = struct{}{}
+
+		switch def := def.(type) {
+		case *ssa.Const, *ssa.Global, *ssa.Function, *ssa.Builtin:
+			// There are never defined.
+			return
+		case *ssa.Parameter, *ssa.FreeVar:
+			// These are defined at function entry, so
+			// flood to function entry.
+			if len(use.Preds) == 0 {
+				return
+			}
+		case ssa.Instruction:
+			if def.Block() == use {
+				// We've reached the defining block.
+				return
+			}
+		default:
+			log.Fatalf("unexpected value definition type %s (%T)", def, def)
+		}
+
+		if len(use.Preds) == 0 {
+			f.WriteTo(os.Stderr)
+			log.Fatalf("failed to find definition of %v", def)
+		}
+		for _, pred := range use.Preds {
+			walk(def, pred)
+		}
+	}
+
+	visited := make(map[ssa.Instruction]struct{})
+	var doInstr func(val ssa.Instruction)
+	doInstr = func(val ssa.Instruction) {
+		if _, ok := visited[val]; ok {
+			return
+		}
+		visited[val] = struct{}{}
+
+		if phi, ok := val.(*ssa.Phi); ok {
+			// A phi is special, as usual. It only uses
+			// each operand if it came from the
+			// corresponding predecessor.
+			if deps[phi.Block().Index] == nil {
+				deps[phi.Block().Index] = make(map[ssa.Value]struct{})
+			}
+			for i, rand := range phi.Edges {
+				deps[phi.Block().Index][rand] = struct{}{}
+				walk(rand, phi.Block().Preds[i])
+
+				// Recursively depend on the inputs to
+				// this operand.
+				if instr, ok := val.(ssa.Instruction); ok {
+					doInstr(instr)
+				}
+			}
+		} else {
+			// Regular instruction uses all of their operands.
+			rands := val.Operands(nil)
+			for _, rand := range rands {
+				if *rand == nil {
+					continue
+				}
+				walk(*rand, val.Block())
+
+				// Recursively depend on the inputs to
+				// the operands.
+				if instr, ok := (*rand).(ssa.Instruction); ok {
+					doInstr(instr)
+				}
+			}
+		}
+	}
+
+	for _, val := range vals {
+		doInstr(val)
+	}
+	for _, call := range calls {
+		fn := call.Common().Value
+		walk(fn, call.Block())
+		if instr, ok := fn.(ssa.Instruction); ok {
+			doInstr(instr)
+		}
+	}
+	return deps
+}
+
+// controlsRelevant returns, for each block in f, whether the branch
+// at the end of that block decides whether a relevant block runs.
+// That is, whether some block b with relevant[b.Index] is control
+// dependent on it: b post-dominates one successor of the branch, but
+// not the branch itself. If a branch leads to both a lock and its
+// unlock either way, it doesn't matter which way it goes.
+func controlsRelevant(f *ssa.Function, relevant []bool) []bool {
+	ipdom := postDominators(f)
+	out := make([]bool, len(f.Blocks))
+	for _, b := range f.Blocks {
+		if len(b.Succs) < 2 {
+			continue
+		}
+		if ipdom[b.Index] == -1 {
+			// b can't reach an exit, so we can't tell.
+			out[b.Index] = true
+			continue
+		}
+		// The blocks control dependent on b are those on the
+		// post-dominator tree path from each successor up to,
+		// but not including, b's immediate post-dominator.
+	succs:
+		for _, succ := range b.Succs {
+			for i := succ.Index; i != ipdom[b.Index]; i = ipdom[i] {
+				if i == -1 || i == len(f.Blocks) || relevant[i] {
+					out[b.Index] = true
+					break succs
+				}
+			}
+		}
+	}
+	return out
+}
+
+// postDominators returns the immediate post-dominator of each block
+// in f, indexed by block number. The post-dominator tree is rooted at
+// a virtual exit block numbered len(f.Blocks), which succeeds every
+// block that returns or panics. Blocks that can't reach an exit have
+// no post-dominator and are -1.
+//
+// This uses the algorithm from Cooper, Harvey, and Kennedy, "A Simple,
+// Fast Dominance Algorithm", run on the reversed control flow graph.
+func postDominators(f *ssa.Function) []int {
+	exit := len(f.Blocks)
+	// succs returns the successors of block i in the reversed
+	// control flow graph.
+	succs := func(i int) []int {
+		var out []int
+		if i == exit {
+			for _, b := range f.Blocks {
+				if len(b.Succs) == 0 {
+					out = append(out, b.Index)
+				}
+			}
+			return out
+		}
+		for _, pred := range f.Blocks[i].Preds {
+			out = append(out, pred.Index)
+		}
+		return out
+	}
+
+	// Number the blocks in postorder of the reversed graph.
+	order := make([]int, exit+1)
+	for i := range order {
+		order[i] = -1
+	}
+	var post []int
+	var visit func(i int)
+	visit = func(i int) {
+		order[i] = 0
+		for _, s := range succs(i) {
+			if order[s] == -1 {
+				visit(s)
+			}
+		}
+		order[i] = len(post)
+		post = append(post, i)
+	}
+	visit(exit)
+
+	ipdom := make([]int, exit+1)
+	for i := range ipdom {
+		ipdom[i] = -1
+	}
+	ipdom[exit] = exit
+	intersect := func(a, b int) int {
+		for a != b {
+			for order[a] < order[b] {
+				a = ipdom[a]
+			}
+			for order[b] < order[a] {
+				b = ipdom[b]
+			}
+		}
+		return a
+	}
+	for changed := true; changed; {
+		changed = false
+		// Visit in reverse postorder, skipping the root.
+		for j := len(post) - 2; j >= 0; j-- {
+			i := post[j]
+			// The predecessors of i in the reversed graph
+			// are its successors in f, plus the exit for
+			// blocks without successors.
+			var preds []int
+			if len(f.Blocks[i].Succs) == 0 {
+				preds = append(preds, exit)
+			}
+			for _, succ := range f.Blocks[i].Succs {
+				preds = append(preds, succ.Index)
+			}
+			newIdom := -1
+			for _, p := range preds {
+				if ipdom[p] == -1 {
+					continue
+				}
+				if newIdom == -1 {
+					newIdom = p
+				} else {
+					newIdom = intersect(p, newIdom)
+				}
+			}
+			if ipdom[i] != newIdom {
+				ipdom[i] = newIdom
+				changed = true
+			}
+		}
+	}
+	return ipdom[:exit]
+}
@@ -0,0 +1,77 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package analysis
+
+import (
+	"testing"
+
+	"golang.org/x/tools/go/ssa"
+)
+
+func TestControlsRelevant(t *testing.T) {
+	pkg := buildSSA(t, `
+func lock()
+func unlock()
+
+func f(n int, c bool) int {
+	x := 0
+	for i := 0; i < n; i++ {
+		x += i
+	}
+	if c {
+		lock()
+	}
+	if n > 0 {
+		x++
+	} else {
+		x--
+	}
+	unlock()
+	return x
+}
+`)
+	f := pkg.Func("f")
+	relevant := make([]bool, len(f.Blocks))
+	for _, b := range f.Blocks {
+		for _, instr := range b.Instrs {
+			if call, ok := instr.(*ssa.Call); ok && call.Common().StaticCallee() != nil {
+				relevant[b.Index] = true
+			}
+		}
+	}
+	got := make(map[string]bool)
+	for i, ctl := range controlsRelevant(f, relevant) {
+		b := f.Blocks[i]
+		if len(b.Instrs) == 0 {
+			continue
+		}
+		if instr, ok := b.Instrs[len(b.Instrs)-1].(*ssa.If); ok {
+			name := instr.Cond.Name()
+			if cond, ok := instr.Cond.(*ssa.BinOp); ok {
+				name = cond.Op.String()
+			}
+			got[name] = ctl
+		}
+	}
+	// Only the branch on c decides whether a lock runs. The loop
+	// and the branch on n reach the same lock operations either
+	// way.
+	want := map[string]bool{
+		"<": false,
+		"c": true,
+		">": false,
+	}
+	if len(got) != len(want) {
+		t.Errorf("want %d branches, got %v", len(want), got)
+	}
+	for cond, ctl := range got {
+		w, ok := want[cond]
+		if !ok {
+			t.Errorf("unexpected branch on %s", cond)
+		} else if w != ctl {
+			t.Errorf("branch on %s: want relevant %v, got %v", cond, w, ctl)
+		}
+	}
+}
@@ -0,0 +1,321 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package analysis
+
+import (
+	"bufio"
+	"fmt"
+	"go/token"
+	"go/types"
+	"io"
+	"strings"
+
+	"golang.org/x/tools/go/ssa"
+)
+
+// A LockClass represents a set of locks. LockClasses form equivalence
+// classes: a given lock instance belongs to exactly one lock class.
+// Often, a LockClass is identified by the struct type and field that
+// embeds the lock object. It may also simply be a package-level
+// variable.
+type LockClass struct {
+	label    string
+	owner    string
+	pkg      string
+	isUnique bool
+	id       int
+	lca      *LockClassAnalysis
+
+	// reader is the read sub-class of this lock class, or nil if
+	// no read locks of this class have been seen. See Reader.
+	reader *LockClass
+}
+
+func (lc *LockClass) Analysis() *LockClassAnalysis {
+	return lc.lca
+}
+
+// String returns the name of lc, which is derived from the source.
+// For a lock that is a global or a field of a global, this is the
+// variable and field path, such as "runtime.sched.lock". For a lock
+// in a struct reached through a pointer, it is the struct type and
+// field path followed by "*", such as "runtime.mcentral.lock*",
+// since the class may contain many locks. Read sub-classes append
+// "(read)" to the name of their class.
+func (lc *LockClass) String() string {
+	if !lc.isUnique {
+		return lc.label + "*"
+	}
+	return lc.label
+}
+
+// Owner returns a description of what lc's locks belong to. For a
+// lock in a struct, this is the struct type, such as
+// "runtime.mcentral". For a lock in a global, this is the type of the
+// global, or the package for locks that are themselves globals, such
+// as "package runtime". For lock classes that don't correspond to Go
+// objects, it is "other".
+func (lc *LockClass) Owner() string {
+	if lc.owner == "" {
+		return "other"
+	}
+	return lc.owner
+}
+
+// Package returns the import path of the package that declares the
+// global or struct type lc's locks belong to, or "" for lock classes
+// that don't correspond to Go objects.
+func (lc *LockClass) Package() string {
+	return lc.pkg
+}
+
+// IsUnique returns true if lc is inhabited by a single lock instance.
+func (lc *LockClass) IsUnique() bool {
+	return lc.isUnique
+}
+
+// Id returns a small integer ID for this lock class that is unique
+// within the LockClassAnalysis that returned this *LockClass.
+func (lc *LockClass) Id() int {
+	return lc.id
+}
+
+type lockClassKey struct {
+	parent interface{}
+	field  int
+	global *ssa.Global
+	typ    *types.Named
+}
+
+type LockClassAnalysis struct {
+	classes map[lockClassKey]*LockClass
+	named   map[string]*LockClass
+	list    []*LockClass
+}
+
+// Get returns the LockClass of the given ssa.Value, which must be a
+// pointer to a global or a field address expression. If Get cannot
+// resolve the lock class of v, it returns an error indicating why.
+//
+// The returned pointer uniquely identifies the lock class. That is,
+// a.Get(x) == a.Get(y) if and only if x and y are the same lock
+// class.
+func (a *LockClassAnalysis) Get(v ssa.Value) (*LockClass, error) {
+	// Strip away FieldAddrs until we get to something that's a
+	// global or a *struct value.
+	label := make([]string, 0, 10)
+	var key lockClassKey
+	var isUnique bool
+	var owner, pkg string
+loop:
+	for {
+		switch v2 := v.(type) {
+		case *ssa.FieldAddr:
+			// TODO: How does this handle nested structs?
+			label = append(label, v2.X.Type().Underlying().(*types.Pointer).Elem().Underlying().(*types.Struct).Field(v2.Field).Name())
+			key = lockClassKey{parent: key, field: v2.Field}
+			v = v2.X
+
+		case *ssa.Global:
+			// TODO: Check formatting
+			label = append(label, v2.String())
+			key = lockClassKey{parent: key, global: v2}
+			isUnique = true
+			owner = "package " + v2.Pkg.Pkg.Name()
+			pkg = v2.Pkg.Pkg.Path()
+			if named, ok := v2.Type().(*types.Pointer).Elem().(*types.Named); ok && len(label) > 1 {
+				owner = types.TypeString(named, nil)
+			}
+			break loop
+
+		default:
+			if len(label) == 0 {
+				// This wasn't a field of something,
+				// so we have no idea what its lock
+				// class is. This happens in the
+				// runtime for example in
+				// parkunlock_c, which cases an
+				// unsafe.Pointer argument to a
+				// *mutex.
+				return nil, fmt.Errorf("lock is not a field or global")
+			}
+			// This must be a *struct. Get the struct's
+			// name.
+			styp, ok := v.Type().Underlying().(*types.Pointer).Elem().(*types.Named)
+			if !ok {
+				return nil, fmt.Errorf("lock is a field of an unnamed struct")
+			}
+			sname := styp.Obj().Name()
+			label = append(label, styp.Obj().Pkg().Name()+"."+sname)
+			owner = types.TypeString(styp, nil)
+			if styp.Obj().Pkg() != nil {
+				pkg = styp.Obj().Pkg().Path()
+			}
+			key = lockClassKey{parent: key, typ: styp}
+			isUnique = false
+			break loop
+		}
+	}
+
+	if a.classes == nil {
+		a.classes = make(map[lockClassKey]*LockClass)
+	}
+	if lc, ok := a.classes[key]; ok {
+		return lc, nil
+	}
+
+	for i := 0; i < len(label)/2; i++ {
+		label[i], label[len(label)-i-1] = label[len(label)-i-1], label[i]
+	}
+	lc := &LockClass{
+		label:    strings.Join(label, "."),
+		owner:    owner,
+		pkg:      pkg,
+		isUnique: isUnique,
+		id:       len(a.list),
+		lca:      a,
+	}
+	a.classes[key] = lc
+	a.list = append(a.list, lc)
+	return lc, nil
+}
+
+// NewLockClass returns a new lock class that is distinct from every
+// other lock class. This can be used to model lock-like abstractions
+// that are not actually Go objects.
+func (a *LockClassAnalysis) NewLockClass(label string, isUnique bool) *LockClass {
+	lc := &LockClass{
+		label:    label,
+		isUnique: isUnique,
+		id:       len(a.list),
+		lca:      a,
+	}
+	a.list = append(a.list, lc)
+	return lc
+}
+
+// Named returns the lock class with the given label, creating it if
+// necessary. Named lock classes are distinct from the lock classes
+// returned by Get, even if they have the same label.
+func (a *LockClassAnalysis) Named(label string) *LockClass {
+	if lc, ok := a.named[label]; ok {
+		return lc
+	}
+	if a.named == nil {
+		a.named = make(map[string]*LockClass)
+	}
+	lc := a.NewLockClass(label, false)
+	a.named[label] = lc
+	return lc
+}
+
+// Reader returns the read sub-class of lc, creating it if necessary.
+// Read locks of an RWMutex are tracked in this sub-class so that
+// readers, which don't exclude each other, are distinct from writers.
+func (a *LockClassAnalysis) Reader(lc *LockClass) *LockClass {
+	if lc.reader == nil {
+		lc.reader = a.NewLockClass(lc.label+"(read)", lc.isUnique)
+		lc.reader.owner = lc.owner
+		lc.reader.pkg = lc.pkg
+	}
+	return lc.reader
+}
+
+// Lookup returns the *LockClass whose Id() is id.
+func (a *LockClassAnalysis) Lookup(id int) *LockClass {
+	return a.list[id]
+}
+
+// lockPath returns the global or field path of lock v. This is like
+// the label of v's lock class (see LockClassAnalysis.Get), but
+// follows pointers loaded from globals and fields, so it can tell
+// apart locks reached from different globals that Get puts in the
+// same class. For example, if runtime.x is a *T, the lock path of
+// &x.lock is "runtime.x.lock", while its class is "runtime.T.lock*".
+// lockPath returns "" if v isn't a field or global.
+func lockPath(v ssa.Value) string {
+	var path []string
+loop:
+	for {
+		switch v2 := v.(type) {
+		case *ssa.FieldAddr:
+			path = append(path, v2.X.Type().Underlying().(*types.Pointer).Elem().Underlying().(*types.Struct).Field(v2.Field).Name())
+			v = v2.X
+
+		case *ssa.UnOp:
+			if v2.Op != token.MUL || len(path) == 0 {
+				return ""
+			}
+			// A pointer loaded from a global or field.
+			v = v2.X
+
+		case *ssa.Global:
+			path = append(path, v2.String())
+			break loop
+
+		default:
+			if len(path) == 0 {
+				return ""
+			}
+			styp, ok := v.Type().Underlying().(*types.Pointer).Elem().(*types.Named)
+			if !ok {
+				return ""
+			}
+			path = append(path, styp.Obj().Pkg().Name()+"."+styp.Obj().Name())
+			break loop
+		}
+	}
+	for i := 0; i < len(path)/2; i++ {
+		path[i], path[len(path)-i-1] = path[len(path)-i-1], path[i]
+	}
+	return strings.Join(path, ".")
+}
+
+// A LockClassOverride assigns all locks with a lock path (see
+// lockPath) or lock class to a named lock class, overriding the class
+// computed by LockClassAnalysis.Get.
+type LockClassOverride struct {
+	path  string // Lock path or LockClass.String
+	label string
+}
+
+// ParseLockClassOverrides parses a lock class override file. Each
+// non-blank line that doesn't start with "#" has the form
+//
+//     lock class
+//
+// where lock is either the global or field path of a lock, such as
+// runtime.sched.lock, or the name of a lock class, such as
+// runtime.mcentral.lock*. Unlike lock class names, lock paths follow
+// pointers loaded from globals and fields, so if runtime.x is a *T,
+// runtime.x.lock is just the lock of the T that x points to, while
+// the class runtime.T.lock* is every T's lock.
+// Every lock operation (lock, unlock, etc.) on a matching lock is
+// assigned to the lock class named class.
+//
+// This is an escape hatch for splitting a lock class that the
+// analysis merges too coarsely, such as locks in different instances
+// of the same struct that are always acquired in a consistent order.
+// Misusing it can easily hide real deadlocks.
+func ParseLockClassOverrides(r io.Reader) ([]LockClassOverride, error) {
+	var out []LockClassOverride
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected \"lock class\"", lineno)
+		}
+		if strings.Contains(fields[0], ":") {
+			// Overrides used to be keyed by file:line.
+			return nil, fmt.Errorf("line %d: expected lock path or class, got %q", lineno, fields[0])
+		}
+		out = append(out, LockClassOverride{fields[0], fields[1]})
+	}
+	return out, scanner.Err()
+}
@@ -0,0 +1,291 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package analysis
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/token"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// savedLockGraph is the format written by LockOrder.Save. Lock
+// classes are identified by name, so graphs saved by different runs
+// can be compared.
+type savedLockGraph struct {
+	Version int `json:"version"`
+	// Locks lists the names of the lock classes in some edge.
+	Locks []string    `json:"locks"`
+	Edges []savedEdge `json:"edges"`
+}
+
+type savedEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	// Roots lists the root functions from which the edge was
+	// found.
+	Roots []string `json:"roots"`
+	// Paths lists the distinct code paths that acquire From and
+	// then To.
+	Paths []savedPath `json:"paths"`
+}
+
+// savedPath is a Path. Each frame is an operation and a "file:line"
+// position, separated by a space.
+type savedPath struct {
+	Root string   `json:"root"`
+	From []string `json:"from"`
+	To   []string `json:"to"`
+	// Roots lists the root functions from which the path was
+	// found. Unlike Root, which is where the path's two stacks
+	// diverge, these are the roots the analysis started from.
+	Roots []string `json:"roots,omitempty"`
+}
+
+// savedLockGraphVersion is the version of the saved lock graph
+// format. Version 2 graphs don't record the roots of each path, but
+// can still be loaded.
+const savedLockGraphVersion = 3
+
+// Save writes the lock graph to w as JSON, in sorted order so saved
+// graphs can be compared textually. It records each lock class by
+// name and each path of each edge as a list of operations and source
+// lines, so a report can be archived and reloaded with LoadLockOrder
+// without re-running the analysis. Suppressed cycles are still in the
+// graph. Locks held across blocking operations are not saved.
+func (lo *LockOrder) Save(w io.Writer) {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(lo.saved()); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// saved returns the lock graph in the format written by Save.
+func (lo *LockOrder) saved() *savedLockGraph {
+	g := &savedLockGraph{Version: savedLockGraphVersion, Locks: []string{}, Edges: []savedEdge{}}
+	locks := make(map[string]bool)
+	for edge, infos := range lo.m {
+		e := savedEdge{From: lo.name(edge.fromId), To: lo.name(edge.toId)}
+		locks[e.From], locks[e.To] = true, true
+		for root := range lo.roots[edge] {
+			e.Roots = append(e.Roots, root)
+		}
+		sort.Strings(e.Roots)
+		paths := make(map[lockOrderInfo]savedPath)
+		for info := range infos {
+			paths[info] = savePath(lo.renderInfo(edge, info))
+		}
+		e.Paths = mergePaths(paths, func(info lockOrderInfo) map[string]struct{} {
+			return lo.pathRoots[lockOrderPath{edge, info}]
+		})
+		g.Edges = append(g.Edges, e)
+	}
+	for name := range locks {
+		g.Locks = append(g.Locks, name)
+	}
+	sort.Strings(g.Locks)
+	sort.Slice(g.Edges, func(i, j int) bool {
+		if g.Edges[i].From != g.Edges[j].From {
+			return g.Edges[i].From < g.Edges[j].From
+		}
+		return g.Edges[i].To < g.Edges[j].To
+	})
+	return g
+}
+
+// mergePaths returns the distinct saved paths in paths, sorted, with
+// the roots of each path being the union of the roots of the infos
+// that render as it.
+func mergePaths(paths map[lockOrderInfo]savedPath, roots func(info lockOrderInfo) map[string]struct{}) []savedPath {
+	byKey := make(map[string]savedPath)
+	pathRoots := make(map[string]map[string]struct{})
+	for info, sp := range paths {
+		k := fmt.Sprint(sp)
+		byKey[k] = sp
+		for root := range roots(info) {
+			pathRoots[k] = addName(pathRoots[k], root)
+		}
+	}
+	keys := make([]string, 0, len(byKey))
+	for k := range byKey {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := make([]savedPath, len(keys))
+	for i, k := range keys {
+		out[i] = byKey[k]
+		if len(pathRoots[k]) > 0 {
+			out[i].Roots = sortedNames(pathRoots[k])
+		}
+	}
+	return out
+}
+
+func savePath(p Path) savedPath {
+	frames := func(frames []Frame) []string {
+		out := make([]string, len(frames))
+		for i, f := range frames {
+			out[i] = fmt.Sprintf("%s %s:%d", f.Op, f.Pos.Filename, f.Pos.Line)
+		}
+		return out
+	}
+	return savedPath{Root: p.RootFn, From: frames(p.From), To: frames(p.To)}
+}
+
+func loadPath(p savedPath) (*Path, error) {
+	frames := func(frames []string) ([]Frame, error) {
+		out := make([]Frame, len(frames))
+		for i, f := range frames {
+			sp := strings.LastIndex(f, " ")
+			colon := strings.LastIndex(f, ":")
+			if sp < 0 || colon < sp {
+				return nil, fmt.Errorf("malformed frame %q", f)
+			}
+			line, err := strconv.Atoi(f[colon+1:])
+			if err != nil {
+				return nil, fmt.Errorf("malformed frame %q", f)
+			}
+			out[i] = Frame{f[:sp], token.Position{Filename: f[sp+1 : colon], Line: line}}
+		}
+		return out, nil
+	}
+	from, err := frames(p.From)
+	if err != nil {
+		return nil, err
+	}
+	to, err := frames(p.To)
+	if err != nil {
+		return nil, err
+	}
+	return &Path{p.Root, from, to}, nil
+}
+
+// LoadLockOrder reads a lock graph written by LockOrder.Save. The
+// paths of the returned graph's edges are only known as source
+// lines, but it can be reported and saved just like the graph of an
+// analysis.
+func LoadLockOrder(r io.Reader) (*LockOrder, error) {
+	var g savedLockGraph
+	if err := json.NewDecoder(r).Decode(&g); err != nil {
+		return nil, err
+	}
+	if g.Version != savedLockGraphVersion && g.Version != 2 {
+		return nil, fmt.Errorf("unsupported lock graph version %d", g.Version)
+	}
+
+	lo := NewLockOrder(token.NewFileSet())
+	lo.lca = new(LockClassAnalysis)
+	classes := make(map[string]*LockClass)
+	for _, name := range g.Locks {
+		if strings.HasSuffix(name, "*") {
+			classes[name] = lo.lca.NewLockClass(strings.TrimSuffix(name, "*"), false)
+		} else {
+			classes[name] = lo.lca.NewLockClass(name, true)
+		}
+	}
+	for _, e := range g.Edges {
+		from, to := classes[e.From], classes[e.To]
+		if from == nil || to == nil {
+			return nil, fmt.Errorf("edge %s -> %s: unknown lock class", e.From, e.To)
+		}
+		edge := lockOrderEdge{from.Id(), to.Id()}
+		infos := make(map[lockOrderInfo]struct{})
+		for _, sp := range e.Paths {
+			p, err := loadPath(sp)
+			if err != nil {
+				return nil, fmt.Errorf("edge %s -> %s: %v", e.From, e.To, err)
+			}
+			info := lockOrderInfo{saved: p}
+			infos[info] = struct{}{}
+			for _, root := range sp.Roots {
+				lo.credit(lockOrderPath{edge, info}, root)
+			}
+		}
+		lo.m[edge] = infos
+		roots := make(map[string]struct{})
+		for _, root := range e.Roots {
+			roots[root] = struct{}{}
+		}
+		lo.roots[edge] = roots
+	}
+	return lo, nil
+}
+
+// edgeStrings returns the edges of lo, formatted as "from -> to".
+func (lo *LockOrder) edgeStrings() map[string]bool {
+	out := make(map[string]bool)
+	for edge := range lo.m {
+		out[lo.name(edge.fromId)+" -> "+lo.name(edge.toId)] = true
+	}
+	return out
+}
+
+// cycleStrings returns the cycles in lo, formatted as the sorted set
+// of their lock classes, such as "{a, b}". Like cycle suppressions,
+// this ignores the order of the locks in the cycle.
+func (lo *LockOrder) cycleStrings() map[string]bool {
+	cycles := make(map[string]bool)
+	for _, cycle := range lo.FindCycles() {
+		names := make([]string, len(cycle))
+		for i, id := range cycle {
+			names[i] = lo.name(id)
+		}
+		sort.Strings(names)
+		cycles["{"+strings.Join(names, ", ")+"}"] = true
+	}
+	return cycles
+}
+
+// DiffLockGraphs compares the lock graphs saved by LockOrder.Save in
+// old and new and writes the edges and cycles that were added or
+// removed to w, one per line, such as
+//
+//     +edge runtime.sched.lock -> runtime.allglock
+//     -cycle {runtime.mheap_.lock, runtime.mcentral.lock}
+//
+// It returns whether the graphs differ.
+func DiffLockGraphs(w io.Writer, old, new io.Reader) (bool, error) {
+	lo1, err := LoadLockOrder(old)
+	if err != nil {
+		return false, err
+	}
+	lo2, err := LoadLockOrder(new)
+	if err != nil {
+		return false, err
+	}
+	changed := false
+	diff := func(kind string, m1, m2 map[string]bool) {
+		var lines []string
+		for k := range m1 {
+			if !m2[k] {
+				lines = append(lines, "-"+kind+" "+k)
+			}
+		}
+		for k := range m2 {
+			if !m1[k] {
+				lines = append(lines, "+"+kind+" "+k)
+			}
+		}
+		// Sort by the item, then removals first.
+		sort.Slice(lines, func(i, j int) bool {
+			if lines[i][1:] != lines[j][1:] {
+				return lines[i][1:] < lines[j][1:]
+			}
+			return lines[i] < lines[j]
+		})
+		for _, line := range lines {
+			fmt.Fprintln(w, line)
+			changed = true
+		}
+	}
+	diff("edge", lo1.edgeStrings(), lo2.edgeStrings())
+	diff("cycle", lo1.cycleStrings(), lo2.cycleStrings())
+	return changed, nil
+}
@@ -0,0 +1,64 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package analysis
+
+import (
+	"fmt"
+	"go/token"
+	"io"
+	"sort"
+)
+
+// recordLockSites records the position of the call at the top of stack
+// as an acquisition site of each lock in locking. It's called by
+// LockOrder.Add.
+func (s *state) recordLockSites(locked, locking *LockSet, stack *StackFrame) {
+	if stack == nil || !stack.call.Pos().IsValid() {
+		return
+	}
+	pos := s.fset.Position(stack.call.Pos())
+	for _, l := range locking.locks {
+		sites := s.lockSites[l.id]
+		if sites == nil {
+			sites = make(map[token.Position]struct{})
+			s.lockSites[l.id] = sites
+		}
+		sites[pos] = struct{}{}
+	}
+}
+
+// writeLockList writes an inventory of the lock classes to w: every
+// class the analysis discovered, sorted by name, with the distinct
+// positions at which it's acquired. This includes classes that are
+// never acquired with another lock held, so it's useful even without
+// any lock edges, for example to spot a lock that is unexpectedly
+// global.
+func (s *state) writeLockList(w io.Writer) {
+	classes := append([]*LockClass(nil), s.lca.list...)
+	sort.Slice(classes, func(i, j int) bool {
+		return classes[i].String() < classes[j].String()
+	})
+	fmt.Fprintf(w, "lock classes:\n")
+	for _, lc := range classes {
+		fmt.Fprintf(w, "  %s\n", lc)
+		var sites []token.Position
+		for pos := range s.lockSites[lc.Id()] {
+			sites = append(sites, pos)
+		}
+		sort.Slice(sites, func(i, j int) bool {
+			pi, pj := sites[i], sites[j]
+			if pi.Filename != pj.Filename {
+				return pi.Filename < pj.Filename
+			}
+			return pi.Offset < pj.Offset
+		})
+		if len(sites) == 0 {
+			fmt.Fprintf(w, "    never acquired\n")
+		}
+		for _, pos := range sites {
+			fmt.Fprintf(w, "    acquired at %s\n", pos)
+		}
+	}
+}
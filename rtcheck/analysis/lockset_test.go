@@ -0,0 +1,157 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package analysis
+
+import (
+	"fmt"
+	"math/big"
+	"math/rand"
+	"testing"
+)
+
+// newTestLockClasses returns n lock classes from a new analysis.
+func newTestLockClasses(n int) []*LockClass {
+	var lca LockClassAnalysis
+	classes := make([]*LockClass, n)
+	for i := range classes {
+		classes[i] = lca.NewLockClass(fmt.Sprintf("lock%d", i), true)
+	}
+	return classes
+}
+
+func TestLockSet(t *testing.T) {
+	lcs := newTestLockClasses(4)
+	a := NewLockSet().Plus(lcs[2], nil).Plus(lcs[0], nil)
+	if got := a.String(); got != "{lock0,lock2}" {
+		t.Errorf("want {lock0,lock2}, got %s", got)
+	}
+	if a.Plus(lcs[2], nil) != a {
+		t.Error("adding a held lock made a new set")
+	}
+	if a.Minus(lcs[1]) != a {
+		t.Error("removing an unheld lock made a new set")
+	}
+	if b := a.Minus(lcs[0]); b.String() != "{lock2}" || a.String() != "{lock0,lock2}" {
+		t.Errorf("Minus: got %s, original %s", b, a)
+	}
+
+	b := NewLockSet().Plus(lcs[3], nil).Plus(lcs[2], nil).Plus(lcs[1], nil)
+	u := a.Union(b)
+	if got := u.String(); got != "{lock0,lock1,lock2,lock3}" {
+		t.Errorf("Union: want {lock0,lock1,lock2,lock3}, got %s", got)
+	}
+	if a.Union(NewLockSet().Plus(lcs[0], nil)) != a {
+		t.Error("union with a subset made a new set")
+	}
+	for _, lc := range lcs {
+		if !u.Contains(lc) {
+			t.Errorf("union doesn't contain %s", lc)
+		}
+	}
+
+	c := NewLockSet().Plus(lcs[0], nil).Plus(lcs[2], nil)
+	if !a.Equal(c) || a.Key() != c.Key() || a.HashKey() != c.HashKey() {
+		t.Errorf("%s and %s built in different orders aren't equal", a, c)
+	}
+	if a.Equal(u) || a.HashKey() == u.HashKey() {
+		t.Errorf("%s and %s are equal", a, u)
+	}
+}
+
+// bigLockSet is the previous LockSet representation, which used a
+// big.Int bitset of lock class IDs and a map of stacks. It's kept for
+// BenchmarkLockSet.
+type bigLockSet struct {
+	bits   big.Int
+	stacks map[int]*StackFrame
+}
+
+func (set *bigLockSet) clone() *bigLockSet {
+	out := &bigLockSet{stacks: map[int]*StackFrame{}}
+	out.bits.Set(&set.bits)
+	for k, v := range set.stacks {
+		out.stacks[k] = v
+	}
+	return out
+}
+
+func (set *bigLockSet) Plus(lc *LockClass, stack *StackFrame) *bigLockSet {
+	if set.bits.Bit(lc.Id()) != 0 {
+		return set
+	}
+	out := set.clone()
+	out.bits.SetBit(&out.bits, lc.Id(), 1)
+	out.stacks[lc.Id()] = stack
+	return out
+}
+
+func (set *bigLockSet) Minus(lc *LockClass) *bigLockSet {
+	if set.bits.Bit(lc.Id()) == 0 {
+		return set
+	}
+	out := set.clone()
+	out.bits.SetBit(&out.bits, lc.Id(), 0)
+	delete(out.stacks, lc.Id())
+	return out
+}
+
+func (set *bigLockSet) HashKey() string {
+	return set.bits.Text(16)
+}
+
+// BenchmarkLockSet compares LockSet with bigLockSet on a random
+// sequence of lock and unlock operations over many lock classes,
+// hashing the set after each operation as path state lookups do.
+func BenchmarkLockSet(b *testing.B) {
+	const nClasses, nOps = 500, 1000
+	lcs := newTestLockClasses(nClasses)
+	r := rand.New(rand.NewSource(1))
+	type op struct {
+		lc   *LockClass
+		lock bool
+	}
+	// Keep sets small, as they are in the runtime, and favor high
+	// IDs, which are the slow case for a bitset.
+	var ops []op
+	var held []*LockClass
+	for len(ops) < nOps {
+		if len(held) == 0 || len(held) < 4 && r.Intn(2) == 0 {
+			lc := lcs[nClasses-1-r.Intn(nClasses/4)]
+			held = append(held, lc)
+			ops = append(ops, op{lc, true})
+		} else {
+			i := r.Intn(len(held))
+			ops = append(ops, op{held[i], false})
+			held = append(held[:i], held[i+1:]...)
+		}
+	}
+
+	b.Run("slice", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			set := NewLockSet()
+			for _, op := range ops {
+				if op.lock {
+					set = set.Plus(op.lc, nil)
+				} else {
+					set = set.Minus(op.lc)
+				}
+				set.HashKey()
+			}
+		}
+	})
+	b.Run("big", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			set := &bigLockSet{}
+			for _, op := range ops {
+				if op.lock {
+					set = set.Plus(op.lc, nil)
+				} else {
+					set = set.Minus(op.lc)
+				}
+				set.HashKey()
+			}
+		}
+	})
+}
@@ -0,0 +1,82 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package analysis
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// A lockNesting is a set of locks held at once.
+type lockNesting struct {
+	// locks is the names of the locks, sorted.
+	locks []string
+	// stack is the first stack found acquiring the last of them.
+	stack *StackFrame
+}
+
+// recordNesting records the set of locks held once the locks in
+// locking are acquired while holding locked. It's called by
+// LockOrder.Add.
+//
+// The read sub-class of a lock being acquired for writing is also
+// acquired, but isn't counted separately.
+func (s *state) recordNesting(locked, locking *LockSet, stack *StackFrame) {
+	held := locked.Union(locking)
+	if held.Len() < 2 {
+		return
+	}
+	readers := make(map[*LockClass]bool)
+	for _, l := range held.locks {
+		if r := s.lca.Lookup(l.id).reader; r != nil {
+			readers[r] = true
+		}
+	}
+	var locks []string
+	for _, l := range held.locks {
+		if lc := s.lca.Lookup(l.id); !readers[lc] {
+			locks = append(locks, lc.String())
+		}
+	}
+	if len(locks) < 2 {
+		return
+	}
+	sort.Strings(locks)
+	key := strings.Join(locks, ", ")
+	if s.nestings[key] == nil {
+		s.nestings[key] = &lockNesting{locks, stack}
+	}
+}
+
+// writeNesting writes the opts.nesting deepest lock nestings to w,
+// deepest first, with the path that reached each. A path that holds
+// many locks at once is prone to deadlock and contention even if it
+// isn't part of a cycle.
+func (s *state) writeNesting(w io.Writer) {
+	nestings := make([]*lockNesting, 0, len(s.nestings))
+	for _, n := range s.nestings {
+		nestings = append(nestings, n)
+	}
+	sort.Slice(nestings, func(i, j int) bool {
+		ni, nj := nestings[i], nestings[j]
+		if len(ni.locks) != len(nj.locks) {
+			return len(ni.locks) > len(nj.locks)
+		}
+		return strings.Join(ni.locks, ", ") < strings.Join(nj.locks, ", ")
+	})
+	if len(nestings) > s.opts.nesting {
+		nestings = nestings[:s.opts.nesting]
+	}
+	fmt.Fprintf(w, "deepest lock nestings:\n")
+	if len(nestings) == 0 {
+		fmt.Fprintf(w, "  no path holds more than one lock\n")
+	}
+	for _, n := range nestings {
+		fmt.Fprintf(w, "  %d locks held: %s\n", len(n.locks), strings.Join(n.locks, ", "))
+		fmt.Fprintf(w, "  acquired at\n%s\n", s.stackString(n.stack))
+	}
+}
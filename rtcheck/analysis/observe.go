@@ -0,0 +1,43 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package analysis
+
+// A LockTransition is a kind of change to a path's lock set.
+type LockTransition int
+
+const (
+	// LockAcquire adds a lock class to the lock set.
+	LockAcquire LockTransition = iota
+	// LockRelease removes a lock class from the lock set.
+	LockRelease
+)
+
+// A LockObserver is called on each lock set transition during
+// exploration. It can be used to build custom models on top of the
+// exploration, such as additional edge types, without modifying it.
+//
+// class is the lock class being acquired or released, stack is the
+// call stack of the operation (innermost frame first), and ps is the
+// path state after the transition, so ps.lockSet already includes (or
+// excludes) class. The observer must not modify ps or retain its
+// value state.
+//
+// Transitions along a single path are observed in program order, but
+// the paths through a block are explored together and blocks are
+// explored depth-first, so transitions of different paths interleave. Because function exit states are memoized, the
+// transitions inside a function are observed once for each distinct
+// entry state, not once per call. An acquisition that would
+// self-deadlock terminates its path and is not observed.
+//
+// Set Config.Observer to install a LockObserver. If it is nil (the
+// default), there is no overhead.
+type LockObserver func(t LockTransition, class *LockClass, stack *StackFrame, ps *PathState)
+
+// observe calls the installed LockObserver, if any.
+func (s *state) observe(t LockTransition, class *LockClass, ps *PathState) {
+	if s.opts.observer != nil {
+		s.opts.observer(t, class, s.stack, ps)
+	}
+}
@@ -0,0 +1,1359 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package analysis
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"go/token"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/go/ssa"
+)
+
+// LockOrder tracks a lock graph and reports cycles that prevent the
+// graph from being a partial order.
+type LockOrder struct {
+	lca  *LockClassAnalysis
+	fset *token.FileSet
+	m    map[lockOrderEdge]map[lockOrderInfo]struct{}
+
+	// roots records the names of the root functions from which
+	// each edge was found. pathRoots records them for each path
+	// of each edge.
+	roots     map[lockOrderEdge]map[string]struct{}
+	pathRoots map[lockOrderPath]map[string]struct{}
+
+	// cycles is the cached result of FindCycles, or nil.
+	cycles [][]int
+
+	// suppress is the set of signatures of cycles to omit from
+	// FindCycles. suppressed is the number of cycles that were
+	// omitted.
+	suppress   map[string]bool
+	suppressed int
+
+	// blocking records locks held across blocking channel
+	// operations. See AddBlocking. blockingRoots records the
+	// names of the root functions from which each path was
+	// found.
+	blocking      map[blockingOp]map[lockOrderInfo]struct{}
+	blockingRoots map[blockingPath]map[string]struct{}
+
+	// allocLocks is the set of allocation and GC lock classes
+	// reported by WriteAllocEdges, normalized by specName. If nil,
+	// defaultAllocLocks is used.
+	allocLocks map[string]bool
+
+	// cyclesOnly restricts the graphs written by WriteToDot and
+	// WriteToMermaid to edges in some cycle.
+	cyclesOnly bool
+
+	// newEdge, if non-nil, is called when Add adds an edge to
+	// the graph for the first time.
+	newEdge func(edge lockOrderEdge)
+
+	// acquired, if non-nil, is called by Add with the locks held,
+	// the locks being acquired, and the stack acquiring them,
+	// whether or not any locks are held.
+	acquired func(locked, locking *LockSet, stack *StackFrame)
+
+	// added, if non-nil, is called by Add and AddBlocking with
+	// each lockOrderPath or blockingPath they record, whether or
+	// not it is new.
+	added func(p interface{})
+}
+
+type lockOrderEdge struct {
+	fromId, toId int
+}
+
+// A lockOrderPath is one path of a lock graph edge.
+type lockOrderPath struct {
+	edge lockOrderEdge
+	info lockOrderInfo
+}
+
+type lockOrderInfo struct {
+	fromStack, toStack *StackFrame // Must be interned and common trimmed
+
+	// saved is the path of an edge loaded by LoadLockOrder,
+	// which has no stacks.
+	saved *Path
+}
+
+// NewLockOrder returns an empty lock graph. Source locations in
+// reports will be resolved using fset.
+func NewLockOrder(fset *token.FileSet) *LockOrder {
+	return &LockOrder{
+		lca:       nil,
+		fset:      fset,
+		m:         make(map[lockOrderEdge]map[lockOrderInfo]struct{}),
+		roots:     make(map[lockOrderEdge]map[string]struct{}),
+		pathRoots: make(map[lockOrderPath]map[string]struct{}),
+	}
+}
+
+// Add adds lock edges to the lock order, given that the locks in
+// locked are currently held and the locks in locking are being
+// acquired at stack.
+func (lo *LockOrder) Add(locked *LockSet, locking *LockSet, stack *StackFrame) {
+	lo.cycles = nil
+	if lo.acquired != nil {
+		lo.acquired(locked, locking, stack)
+	}
+	if lo.lca == nil {
+		lo.lca = locked.lca
+	} else if locked.lca != nil && lo.lca != locked.lca {
+		panic("locks come from a different LockClassAnalyses")
+	}
+
+	root := stackRoot(stack)
+	for _, from := range locked.locks {
+		for _, to := range locking.locks {
+			// Trim the common prefix of the two stacks,
+			// since we only care about how we got from
+			// locked to locking.
+			fromStack, toStack := from.stack.TrimCommonPrefix(stack, 1)
+
+			// Add info to edge.
+			edge := lockOrderEdge{from.id, to.id}
+			info := lockOrderInfo{
+				fromStack: fromStack.Intern(),
+				toStack:   toStack.Intern(),
+			}
+			infos := lo.m[edge]
+			if infos == nil {
+				infos = make(map[lockOrderInfo]struct{})
+				lo.m[edge] = infos
+				if lo.newEdge != nil {
+					lo.newEdge(edge)
+				}
+			}
+			infos[info] = struct{}{}
+
+			p := lockOrderPath{edge, info}
+			lo.credit(p, root)
+			if lo.added != nil {
+				lo.added(p)
+			}
+		}
+	}
+}
+
+// stackRoot returns the name of the root function of stack.
+func stackRoot(stack *StackFrame) string {
+	var root string
+	for sf := stack; sf != nil; sf = sf.parent {
+		root = sf.call.Parent().String()
+	}
+	return root
+}
+
+// credit records that root reaches p, which is a lockOrderPath or a
+// blockingPath. Add and AddBlocking credit the root of the stack
+// that found p; memoized walks credit the other roots that reach it.
+func (lo *LockOrder) credit(p interface{}, root string) {
+	switch p := p.(type) {
+	case lockOrderPath:
+		if lo.pathRoots == nil {
+			lo.pathRoots = make(map[lockOrderPath]map[string]struct{})
+		}
+		lo.roots[p.edge] = addName(lo.roots[p.edge], root)
+		lo.pathRoots[p] = addName(lo.pathRoots[p], root)
+	case blockingPath:
+		if lo.blockingRoots == nil {
+			lo.blockingRoots = make(map[blockingPath]map[string]struct{})
+		}
+		lo.blockingRoots[p] = addName(lo.blockingRoots[p], root)
+	default:
+		panic(fmt.Sprintf("bad lock order path type %T", p))
+	}
+}
+
+// addName adds name to set, allocating set if it is nil, and returns
+// set.
+func addName(set map[string]struct{}, name string) map[string]struct{} {
+	if set == nil {
+		set = make(map[string]struct{})
+	}
+	set[name] = struct{}{}
+	return set
+}
+
+// sortedNames returns the names in set in sorted order.
+func sortedNames(set map[string]struct{}) []string {
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// FindCycles returns a list of cycles in the lock order. Each cycle
+// is a list of lock class IDs (see LockClass.Id) in cycle order
+// (without any repetition). Cycles suppressed by Suppress are omitted.
+func (lo *LockOrder) FindCycles() [][]int {
+	if lo.cycles != nil {
+		return lo.cycles
+	}
+
+	// Compute out-edge adjacency list.
+	out := map[int][]int{}
+	for edge := range lo.m {
+		out[edge.fromId] = append(out[edge.fromId], edge.toId)
+	}
+
+	// Cache the result.
+	cycles := lo.suppressCycles(findCycles(out))
+	lo.cycles = cycles
+	return cycles
+}
+
+// findCycles returns the elementary cycles in the graph with
+// out-edge adjacency list out.
+func findCycles(out map[int][]int) [][]int {
+	// Use DFS to find cycles.
+	//
+	// TODO: Implement a real cycle-finding algorithm. This one is
+	// terrible.
+	path, pathSet := []int{}, map[int]struct{}{}
+	cycles := [][]int{}
+	var dfs func(root, node int)
+	dfs = func(root, node int) {
+		if _, ok := pathSet[node]; ok {
+			// Only report as a cycle if we got back to
+			// where we started and this is the lowest
+			// numbered node in the cycle. This gets us
+			// each elementary cycle exactly once.
+			if node == root {
+				minNode := node
+				for _, n := range path {
+					if n < minNode {
+						minNode = n
+					}
+				}
+				if node == minNode {
+					pathCopy := append([]int(nil), path...)
+					cycles = append(cycles, pathCopy)
+				}
+			}
+			return
+		}
+		pathSet[node] = struct{}{}
+		path = append(path, node)
+		for _, next := range out[node] {
+			dfs(root, next)
+		}
+		path = path[:len(path)-1]
+		delete(pathSet, node)
+	}
+	// Visit roots and successors in order so the cycles are
+	// found in a deterministic order.
+	roots := make([]int, 0, len(out))
+	for root, next := range out {
+		roots = append(roots, root)
+		sort.Ints(next)
+	}
+	sort.Ints(roots)
+	for _, root := range roots {
+		dfs(root, root)
+	}
+	return cycles
+}
+
+// WriteToDot writes the lock graph in the dot language to w, with
+// cycle edges drawn in red and labeled with their number of paths. If
+// Config.CyclesOnly is set, it includes only the edges in cycles and
+// their locks.
+func (lo *LockOrder) WriteToDot(w io.Writer) {
+	lo.writeToDot(w, lo.cyclesOnly)
+}
+
+// maxMermaidLabel is the length to which WriteToMermaid truncates lock
+// class names.
+const maxMermaidLabel = 40
+
+// WriteToMermaid writes the lock graph as a Mermaid flowchart to w,
+// for embedding in Markdown. Like WriteToDot, it includes only locks
+// that participate in some ordering. Edges in cycles are drawn thick
+// and red and labeled with their number of code paths. Long lock class
+// names are shortened by eliding their middle.
+func (lo *LockOrder) WriteToMermaid(w io.Writer) {
+	cycleEdges := map[lockOrderEdge]bool{}
+	for _, cycle := range lo.FindCycles() {
+		for i, fromId := range cycle {
+			cycleEdges[lockOrderEdge{fromId, cycle[(i+1)%len(cycle)]}] = true
+		}
+	}
+	edges := make([]lockOrderEdge, 0, len(lo.m))
+	var nodes big.Int
+	for edge := range lo.m {
+		if lo.cyclesOnly && !cycleEdges[edge] {
+			continue
+		}
+		edges = append(edges, edge)
+		nodes.SetBit(&nodes, edge.fromId, 1)
+		nodes.SetBit(&nodes, edge.toId, 1)
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].fromId != edges[j].fromId {
+			return edges[i].fromId < edges[j].fromId
+		}
+		return edges[i].toId < edges[j].toId
+	})
+
+	label := func(id int) string {
+		name := lo.name(id)
+		if len(name) > maxMermaidLabel {
+			half := (maxMermaidLabel - 3) / 2
+			name = name[:half] + "..." + name[len(name)-half:]
+		}
+		return strings.Replace(name, `"`, "#quot;", -1)
+	}
+	fmt.Fprintf(w, "graph LR\n")
+	for i := 0; i < nodes.BitLen(); i++ {
+		if nodes.Bit(i) == 1 {
+			fmt.Fprintf(w, "  l%d[\"%s\"]\n", i, label(i))
+		}
+	}
+	var cycleLinks []string
+	for i, edge := range edges {
+		if cycleEdges[edge] {
+			fmt.Fprintf(w, "  l%d ==>|%d| l%d\n", edge.fromId, len(lo.m[edge]), edge.toId)
+			cycleLinks = append(cycleLinks, fmt.Sprint(i))
+		} else {
+			fmt.Fprintf(w, "  l%d --> l%d\n", edge.fromId, edge.toId)
+		}
+	}
+	if len(cycleLinks) > 0 {
+		fmt.Fprintf(w, "  linkStyle %s stroke:red,stroke-width:3px\n", strings.Join(cycleLinks, ","))
+	}
+}
+
+// WriteToGraphML writes the lock graph in GraphML to w, for loading
+// into interactive graph tools such as yEd or Gephi. Like WriteToDot,
+// it includes only locks that participate in some ordering. Each edge
+// is weighted by the number of distinct code paths that acquire its
+// locks in that order, and edges in cycles are marked.
+func (lo *LockOrder) WriteToGraphML(w io.Writer) {
+	cycleEdges := map[lockOrderEdge]bool{}
+	for _, cycle := range lo.FindCycles() {
+		for i, fromId := range cycle {
+			cycleEdges[lockOrderEdge{fromId, cycle[(i+1)%len(cycle)]}] = true
+		}
+	}
+	edges := make([]lockOrderEdge, 0, len(lo.m))
+	var nodes big.Int
+	for edge := range lo.m {
+		edges = append(edges, edge)
+		nodes.SetBit(&nodes, edge.fromId, 1)
+		nodes.SetBit(&nodes, edge.toId, 1)
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].fromId != edges[j].fromId {
+			return edges[i].fromId < edges[j].fromId
+		}
+		return edges[i].toId < edges[j].toId
+	})
+
+	esc := func(s string) string {
+		var buf bytes.Buffer
+		xml.EscapeText(&buf, []byte(s))
+		return buf.String()
+	}
+	fmt.Fprintf(w, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n")
+	fmt.Fprintf(w, "<graphml xmlns=\"http://graphml.graphdrawing.org/xmlns\">\n")
+	fmt.Fprintf(w, "  <key id=\"label\" for=\"node\" attr.name=\"label\" attr.type=\"string\"/>\n")
+	fmt.Fprintf(w, "  <key id=\"weight\" for=\"edge\" attr.name=\"weight\" attr.type=\"int\"/>\n")
+	fmt.Fprintf(w, "  <key id=\"cycle\" for=\"edge\" attr.name=\"cycle\" attr.type=\"boolean\">\n")
+	fmt.Fprintf(w, "    <default>false</default>\n")
+	fmt.Fprintf(w, "  </key>\n")
+	fmt.Fprintf(w, "  <graph id=\"locks\" edgedefault=\"directed\">\n")
+	for i := 0; i < nodes.BitLen(); i++ {
+		if nodes.Bit(i) == 1 {
+			fmt.Fprintf(w, "    <node id=\"l%d\"><data key=\"label\">%s</data></node>\n", i, esc(lo.name(i)))
+		}
+	}
+	for _, edge := range edges {
+		fmt.Fprintf(w, "    <edge id=\"edge%d-%d\" source=\"l%d\" target=\"l%d\">", edge.fromId, edge.toId, edge.fromId, edge.toId)
+		fmt.Fprintf(w, "<data key=\"weight\">%d</data>", len(lo.m[edge]))
+		if cycleEdges[edge] {
+			fmt.Fprintf(w, "<data key=\"cycle\">true</data>")
+		}
+		fmt.Fprintf(w, "</edge>\n")
+	}
+	fmt.Fprintf(w, "  </graph>\n")
+	fmt.Fprintf(w, "</graphml>\n")
+}
+
+func (lo *LockOrder) name(id int) string {
+	return lo.lca.Lookup(id).String()
+}
+
+func (lo *LockOrder) writeToDot(w io.Writer, cyclesOnly bool) map[lockOrderEdge]string {
+	// TODO: Compute the transitive reduction (of the SCC
+	// condensation, I guess) to reduce noise.
+
+	// Find cycles to highlight edges.
+	cycles := lo.FindCycles()
+	cycleEdges := map[lockOrderEdge]struct{}{}
+	var maxStack int
+	for _, cycle := range cycles {
+		for i, fromId := range cycle {
+			toId := cycle[(i+1)%len(cycle)]
+			edge := lockOrderEdge{fromId, toId}
+			cycleEdges[edge] = struct{}{}
+			if len(lo.m[edge]) > maxStack {
+				maxStack = len(lo.m[edge])
+			}
+		}
+	}
+
+	fmt.Fprintf(w, "digraph locks {\n")
+	fmt.Fprintf(w, "  tooltip=\" \";\n")
+	var nodes big.Int
+	nid := func(lockId int) string {
+		return fmt.Sprintf("l%d", lockId)
+	}
+	// Write edges.
+	edgeIds := make(map[lockOrderEdge]string)
+	for edge, stacks := range lo.m {
+		var props string
+		_, inCycle := cycleEdges[edge]
+		if cyclesOnly && !inCycle {
+			continue
+		}
+		if inCycle {
+			width := 1 + 6*float64(len(stacks))/float64(maxStack)
+			props = fmt.Sprintf(",label=%d,penwidth=%f,color=red,weight=2", len(stacks), width)
+		}
+		id := fmt.Sprintf("edge%d-%d", edge.fromId, edge.toId)
+		edgeIds[edge] = id
+		tooltip := fmt.Sprintf("%s -> %s", lo.name(edge.fromId), lo.name(edge.toId))
+		// We set the edge ID so Javascript can find the
+		// element in the SVG.
+		fmt.Fprintf(w, "  %s -> %s [id=%q,tooltip=%q%s];\n", nid(edge.fromId), nid(edge.toId), id, tooltip, props)
+		nodes.SetBit(&nodes, edge.fromId, 1)
+		nodes.SetBit(&nodes, edge.toId, 1)
+	}
+	// Write nodes. This excludes lone locks: these are only the
+	// locks that participate in some ordering. If the locks come
+	// from more than one package, each package's locks are
+	// grouped in a cluster so edges between packages stand out.
+	byPkg := make(map[string][]int)
+	for i := 0; i < nodes.BitLen(); i++ {
+		if nodes.Bit(i) == 1 {
+			pkg := lo.lca.Lookup(i).Package()
+			byPkg[pkg] = append(byPkg[pkg], i)
+		}
+	}
+	pkgs := make([]string, 0, len(byPkg))
+	for pkg := range byPkg {
+		pkgs = append(pkgs, pkg)
+	}
+	sort.Strings(pkgs)
+	for ci, pkg := range pkgs {
+		indent := "  "
+		cluster := pkg != "" && len(pkgs) > 1
+		if cluster {
+			fmt.Fprintf(w, "  subgraph cluster%d {\n", ci)
+			fmt.Fprintf(w, "    label=%q;\n", pkg)
+			indent = "    "
+		}
+		for _, i := range byPkg[pkg] {
+			// We set the fill color to white so
+			// mouseovers on this node work nicely.
+			fmt.Fprintf(w, "%s%s [label=%q,style=filled,fillcolor=white];\n", indent, nid(i), lo.name(i))
+		}
+		if cluster {
+			fmt.Fprintf(w, "  }\n")
+		}
+	}
+	fmt.Fprintf(w, "}\n")
+	return edgeIds
+}
+
+// A Path is one way a lock graph edge can happen: starting from root
+// function RootFn, the stack From acquires the edge's first lock,
+// then, while it is still held, the stack To acquires the second.
+// Both stacks are outermost call first and omit the calls they have
+// in common.
+type Path struct {
+	RootFn   string
+	From, To []Frame
+}
+
+// A Frame is one frame of a Path: an operation (a call, or the lock
+// acquisition itself) at a source position.
+type Frame struct {
+	Op  string
+	Pos token.Position
+}
+
+func (lo *LockOrder) renderInfo(edge lockOrderEdge, info lockOrderInfo) Path {
+	return lo.renderPath(info, "acquires "+lo.name(edge.fromId), "acquires "+lo.name(edge.toId))
+}
+
+// renderPath renders the stacks of info, ending them with the
+// operations fromOp and toOp.
+func (lo *LockOrder) renderPath(info lockOrderInfo, fromOp, toOp string) Path {
+	if info.saved != nil {
+		return *info.saved
+	}
+	fset := lo.fset
+	fromStack := info.fromStack.Flatten(nil)
+	toStack := info.toStack.Flatten(nil)
+	rootFn := fromStack[0].Parent()
+	renderStack := func(stack []ssa.Instruction, tail string) []Frame {
+		var frames []Frame
+		for i, call := range stack[1:] {
+			frames = append(frames, Frame{"calls " + call.Parent().String(), fset.Position(stack[i].Pos())})
+		}
+		frames = append(frames, Frame{tail, fset.Position(stack[len(stack)-1].Pos())})
+		return frames
+	}
+	return Path{
+		rootFn.String(),
+		renderStack(fromStack, fromOp),
+		renderStack(toStack, toOp),
+	}
+}
+
+// A pathGroup is a set of paths that render the same, ignoring
+// columns. Different paths often render the same when several calls
+// or instructions share a line, or when the stacks differ only in
+// frames that were trimmed.
+type pathGroup struct {
+	path  Path // Representative path
+	count int  // Number of paths in the group
+}
+
+// groupPaths merges paths into pathGroups. The groups are sorted by
+// decreasing count and then by rendering, so the result is
+// deterministic.
+func groupPaths(paths []Path) []pathGroup {
+	key := func(r Path) string {
+		var buf bytes.Buffer
+		fmt.Fprintf(&buf, "%s\n", r.RootFn)
+		for _, stack := range [][]Frame{r.From, r.To} {
+			for _, fr := range stack {
+				fmt.Fprintf(&buf, "%s %s:%d\n", fr.Op, fr.Pos.Filename, fr.Pos.Line)
+			}
+			buf.WriteString("\n")
+		}
+		return buf.String()
+	}
+	byKey := make(map[string]*pathGroup)
+	var keys []string
+	for _, r := range paths {
+		k := key(r)
+		if g := byKey[k]; g != nil {
+			g.count++
+			// Pick a deterministic representative.
+			if fmt.Sprint(r) < fmt.Sprint(g.path) {
+				g.path = r
+			}
+			continue
+		}
+		byKey[k] = &pathGroup{r, 1}
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		gi, gj := byKey[keys[i]], byKey[keys[j]]
+		if gi.count != gj.count {
+			return gi.count > gj.count
+		}
+		return keys[i] < keys[j]
+	})
+	groups := make([]pathGroup, len(keys))
+	for i, k := range keys {
+		groups[i] = *byKey[k]
+	}
+	return groups
+}
+
+// edgePaths returns the paths of edge, merged into pathGroups.
+func (lo *LockOrder) edgePaths(edge lockOrderEdge) []pathGroup {
+	var paths []Path
+	for info := range lo.m[edge] {
+		paths = append(paths, lo.renderInfo(edge, info))
+	}
+	return groupPaths(paths)
+}
+
+// edgeRoots returns the sorted names of the roots from which edge was
+// found.
+func (lo *LockOrder) edgeRoots(edge lockOrderEdge) []string {
+	return sortedNames(lo.roots[edge])
+}
+
+// cycleRoots returns the sorted names of the roots from which any edge
+// of cycle was found.
+func (lo *LockOrder) cycleRoots(cycle []int) []string {
+	set := make(map[string]struct{})
+	for i, fromId := range cycle {
+		for root := range lo.roots[lockOrderEdge{fromId, cycle[(i+1)%len(cycle)]}] {
+			set[root] = struct{}{}
+		}
+	}
+	roots := make([]string, 0, len(set))
+	for root := range set {
+		roots = append(roots, root)
+	}
+	sort.Strings(roots)
+	return roots
+}
+
+// A lockInversion is a pair of locks that are directly acquired in
+// both orders. Inversions are the core of most lock cycles and are
+// usually the most actionable part of a report.
+type lockInversion struct {
+	a, b   int // Lock IDs, with a < b
+	npaths int // Combined number of paths for both edges
+}
+
+// Inversions returns the pairs of distinct locks with an edge in each
+// direction, ordered by decreasing combined path count.
+func (lo *LockOrder) Inversions() []lockInversion {
+	var invs []lockInversion
+	for edge, infos := range lo.m {
+		if edge.fromId >= edge.toId {
+			continue
+		}
+		rinfos, ok := lo.m[lockOrderEdge{edge.toId, edge.fromId}]
+		if !ok {
+			continue
+		}
+		invs = append(invs, lockInversion{edge.fromId, edge.toId, len(infos) + len(rinfos)})
+	}
+	sort.Slice(invs, func(i, j int) bool {
+		if invs[i].npaths != invs[j].npaths {
+			return invs[i].npaths > invs[j].npaths
+		}
+		if invs[i].a != invs[j].a {
+			return lo.name(invs[i].a) < lo.name(invs[j].a)
+		}
+		return lo.name(invs[i].b) < lo.name(invs[j].b)
+	})
+	return invs
+}
+
+// examplePath returns a representative path for edge. It picks the
+// path with the fewest frames, breaking ties by root and position so
+// the choice is deterministic.
+func (lo *LockOrder) examplePath(edge lockOrderEdge) Path {
+	var best Path
+	var bestKey string
+	bestLen := -1
+	for info := range lo.m[edge] {
+		rinfo := lo.renderInfo(edge, info)
+		n := len(rinfo.From) + len(rinfo.To)
+		key := fmt.Sprint(rinfo)
+		if bestLen < 0 || n < bestLen || (n == bestLen && key < bestKey) {
+			best, bestKey, bestLen = rinfo, key, n
+		}
+	}
+	return best
+}
+
+// CheckInversions writes a text report of lock inversions to w, with
+// an example path for each order. It returns the number of
+// inversions.
+func (lo *LockOrder) CheckInversions(w io.Writer) int {
+	invs := lo.Inversions()
+	for _, inv := range invs {
+		ab, ba := lockOrderEdge{inv.a, inv.b}, lockOrderEdge{inv.b, inv.a}
+		fmt.Fprintf(w, "lock inversion: %s <-> %s (%d path(s))\n", lo.name(inv.a), lo.name(inv.b), inv.npaths)
+		for _, edge := range []lockOrderEdge{ab, ba} {
+			fmt.Fprintf(w, "  %d path(s) acquire %s then %s, for example:\n", len(lo.m[edge]), lo.name(edge.fromId), lo.name(edge.toId))
+			printPath(w, lo.examplePath(edge))
+		}
+		fmt.Fprintf(w, "\n")
+	}
+	return len(invs)
+}
+
+// printPath writes a text rendering of rinfo to w.
+func printPath(w io.Writer, rinfo Path) {
+	printStack := func(stack []Frame) {
+		indent := 6
+		for _, fr := range stack {
+			fmt.Fprintf(w, "%*s%s at %s\n", indent, "", fr.Op, fr.Pos)
+			indent += 2
+		}
+	}
+	fmt.Fprintf(w, "    %s\n", rinfo.RootFn)
+	printStack(rinfo.From)
+	printStack(rinfo.To)
+}
+
+// printPathGroup writes a text rendering of g to w.
+func printPathGroup(w io.Writer, g pathGroup) {
+	printPath(w, g.path)
+	if g.count > 1 {
+		fmt.Fprintf(w, "      (%d paths like this)\n", g.count)
+	}
+}
+
+// lockNameMatches returns whether the lock class named lname matches
+// name, ignoring any trailing "*". name may omit a "runtime." prefix.
+func lockNameMatches(lname, name string) bool {
+	name, lname = specName(name), specName(lname)
+	return lname == name || lname == "runtime."+name
+}
+
+// Explain writes every path of the lock graph edges that acquire lock
+// class to while holding lock class from to w. Lock classes are matched
+// by name, ignoring any trailing "*", and a "runtime." prefix may be
+// omitted. If there is no such edge, Explain returns an error.
+func (lo *LockOrder) Explain(w io.Writer, from, to string) error {
+	match := func(id int, name string) bool {
+		return lockNameMatches(lo.name(id), name)
+	}
+	var edges []lockOrderEdge
+	reverse := false
+	for edge := range lo.m {
+		if match(edge.fromId, from) && match(edge.toId, to) {
+			edges = append(edges, edge)
+		} else if match(edge.fromId, to) && match(edge.toId, from) {
+			reverse = true
+		}
+	}
+	if len(edges) == 0 {
+		if reverse {
+			return fmt.Errorf("no lock graph edge from %s to %s, but there is one from %s to %s", from, to, to, from)
+		}
+		return fmt.Errorf("no lock graph edge from %s to %s", from, to)
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		fi, fj := lo.name(edges[i].fromId), lo.name(edges[j].fromId)
+		if fi != fj {
+			return fi < fj
+		}
+		return lo.name(edges[i].toId) < lo.name(edges[j].toId)
+	})
+	for i, edge := range edges {
+		if i > 0 {
+			fmt.Fprintf(w, "\n")
+		}
+		fmt.Fprintf(w, "%d path(s) acquire %s then %s, found from %s:\n", len(lo.m[edge]), lo.name(edge.fromId), lo.name(edge.toId), strings.Join(lo.edgeRoots(edge), ", "))
+		for _, g := range lo.edgePaths(edge) {
+			printPathGroup(w, g)
+		}
+	}
+	return nil
+}
+
+// Check writes a text report of lock cycles to w.
+//
+// Each elementary cycle is reported once, with the paths for each of
+// its edges from all roots. This report is thorough, but can be quite
+// repetitive, since a single edge can participate in multiple cycles.
+func (lo *LockOrder) Check(w io.Writer) {
+	// Report self-deadlocks first. These are almost always real
+	// bugs, so they shouldn't get lost among ordering cycles.
+	self, multi := partitionCycles(lo.FindCycles())
+	if len(self) > 0 {
+		fmt.Fprintf(w, "%d possible self-deadlock(s):\n\n", len(self))
+		for _, cycle := range self {
+			lo.checkCycle(w, "self-deadlock", cycle)
+		}
+	}
+	if len(multi) > 0 && len(self) > 0 {
+		fmt.Fprintf(w, "%d lock order cycle(s):\n\n", len(multi))
+	}
+	for _, cycle := range multi {
+		lo.checkCycle(w, "lock cycle", cycle)
+	}
+
+	if lo.suppressed > 0 {
+		fmt.Fprintf(w, "%d lock cycle(s) suppressed\n", lo.suppressed)
+	}
+}
+
+// selfCycle returns whether cycle is a self-deadlock: a lock class
+// acquired while a lock of the same class is held.
+func selfCycle(cycle []int) bool {
+	return len(cycle) == 1
+}
+
+// cycleSeverity is the severity of every lock cycle in the reports.
+// Lock cycles aren't diagnostics, but like SevError diagnostics, they
+// are likely bugs, and rtcheck -fail-on counts them as errors.
+const cycleSeverity = SevError
+
+// cycleKind returns "self-deadlock" if cycle is a self-deadlock and
+// "cycle" otherwise.
+func cycleKind(cycle []int) string {
+	if selfCycle(cycle) {
+		return "self-deadlock"
+	}
+	return "cycle"
+}
+
+// fixEdge returns the index of the edge of cycle that is represented by
+// the fewest code paths, where edge i goes from cycle[i] to
+// cycle[(i+1)%len(cycle)]. Fixing those code paths is likely the
+// easiest way to break the cycle. If several edges tie for the fewest
+// paths, it picks the one with the lexically latest lock classes and
+// tied is true. If cycle is a self-deadlock, it returns -1.
+func (lo *LockOrder) fixEdge(cycle []int) (fix int, tied bool) {
+	if selfCycle(cycle) {
+		return -1, false
+	}
+	edge := func(i int) lockOrderEdge {
+		return lockOrderEdge{cycle[i], cycle[(i+1)%len(cycle)]}
+	}
+	// later returns whether edge i's lock classes sort after
+	// edge j's.
+	later := func(i, j int) bool {
+		ei, ej := edge(i), edge(j)
+		if fi, fj := lo.name(ei.fromId), lo.name(ej.fromId); fi != fj {
+			return fi > fj
+		}
+		return lo.name(ei.toId) > lo.name(ej.toId)
+	}
+	fix, min := -1, 0
+	for i := range cycle {
+		n := len(lo.m[edge(i)])
+		switch {
+		case fix == -1 || n < min:
+			fix, min, tied = i, n, false
+		case n == min:
+			tied = true
+			if later(i, fix) {
+				fix = i
+			}
+		}
+	}
+	return fix, tied
+}
+
+// partitionCycles splits cycles into self-deadlocks and cycles of
+// more than one lock class, preserving their order.
+func partitionCycles(cycles [][]int) (self, multi [][]int) {
+	for _, cycle := range cycles {
+		if selfCycle(cycle) {
+			self = append(self, cycle)
+		} else {
+			multi = append(multi, cycle)
+		}
+	}
+	return
+}
+
+// checkCycle writes the report of one cycle to w, headed by label.
+func (lo *LockOrder) checkCycle(w io.Writer, label string, cycle []int) {
+	roots := lo.cycleRoots(cycle)
+	cycle = append(cycle, cycle[0])
+	fmt.Fprintf(w, "%s: ", label)
+	for i, node := range cycle {
+		if i != 0 {
+			fmt.Fprintf(w, " -> ")
+		}
+		fmt.Fprintf(w, lo.name(node))
+	}
+	fmt.Fprintf(w, "\n")
+	fmt.Fprintf(w, "  found from %d root(s): %s\n", len(roots), strings.Join(roots, ", "))
+	if fix, tied := lo.fixEdge(cycle[:len(cycle)-1]); fix >= 0 {
+		edge := lockOrderEdge{cycle[fix], cycle[fix+1]}
+		fewest := "the fewest of any edge"
+		if tied {
+			fewest = "tied for the fewest of any edge"
+		}
+		fmt.Fprintf(w, "  suggested fix: the %d path(s) that acquire %s then %s, %s\n", len(lo.m[edge]), lo.name(edge.fromId), lo.name(edge.toId), fewest)
+	}
+
+	for i := 0; i < len(cycle)-1; i++ {
+		edge := lockOrderEdge{cycle[i], cycle[i+1]}
+		infos := lo.m[edge]
+
+		fmt.Fprintf(w, "  %d path(s) acquire %s then %s, found from %s:\n", len(infos), lo.name(edge.fromId), lo.name(edge.toId), strings.Join(lo.edgeRoots(edge), ", "))
+		for _, g := range lo.edgePaths(edge) {
+			printPathGroup(w, g)
+		}
+		fmt.Fprintf(w, "\n")
+	}
+}
+
+// WriteRootSummary writes a text report to w of the roots that
+// contribute to lock cycles. For each root, it lists the lock classes
+// of the edges found from it and, for each cycle it contributes to,
+// which of the cycle's edges it found. For a deadlock between several
+// goroutines, this shows which goroutine's code each edge comes from.
+// An edge is credited to every root that reaches it, including roots
+// that reuse a function's memoized exit states.
+func (lo *LockOrder) WriteRootSummary(w io.Writer) {
+	type rootCycle struct {
+		cycle string
+		edges []string
+	}
+	rootCycles := make(map[string][]rootCycle)
+	self, multi := partitionCycles(lo.FindCycles())
+	for _, cycle := range append(self, multi...) {
+		names := make([]string, len(cycle)+1)
+		for i, id := range cycle {
+			names[i] = lo.name(id)
+		}
+		names[len(cycle)] = names[0]
+		byRoot := make(map[string][]string)
+		for i := range cycle {
+			edge := lockOrderEdge{cycle[i], cycle[(i+1)%len(cycle)]}
+			for _, root := range lo.edgeRoots(edge) {
+				byRoot[root] = append(byRoot[root], names[i]+" then "+names[i+1])
+			}
+		}
+		for root, edges := range byRoot {
+			rootCycles[root] = append(rootCycles[root], rootCycle{strings.Join(names, " -> "), edges})
+		}
+	}
+	if len(rootCycles) == 0 {
+		return
+	}
+
+	// Collect the lock classes of each root's edges.
+	rootClasses := make(map[string]map[string]bool)
+	for edge, roots := range lo.roots {
+		for root := range roots {
+			if rootCycles[root] == nil {
+				continue
+			}
+			if rootClasses[root] == nil {
+				rootClasses[root] = make(map[string]bool)
+			}
+			rootClasses[root][lo.name(edge.fromId)] = true
+			rootClasses[root][lo.name(edge.toId)] = true
+		}
+	}
+
+	roots := make([]string, 0, len(rootCycles))
+	for root := range rootCycles {
+		roots = append(roots, root)
+	}
+	sort.Strings(roots)
+	fmt.Fprintf(w, "lock cycles by root:\n")
+	for _, root := range roots {
+		classes := make([]string, 0, len(rootClasses[root]))
+		for class := range rootClasses[root] {
+			classes = append(classes, class)
+		}
+		sort.Strings(classes)
+		fmt.Fprintf(w, "  %s (%d lock class(es): %s)\n", root, len(classes), strings.Join(classes, ", "))
+		for _, rc := range rootCycles[root] {
+			fmt.Fprintf(w, "    %s: acquires %s\n", rc.cycle, strings.Join(rc.edges, "; "))
+		}
+	}
+}
+
+// jsonlCycle is the schema of each line written by WriteJSONL.
+// Fields may be added, but existing fields will not change meaning.
+type jsonlCycle struct {
+	// Kind is "self-deadlock" if the cycle is a single lock class
+	// acquired while the same class is held, and "cycle"
+	// otherwise. Self-deadlocks are written first.
+	Kind string `json:"kind"`
+	// Severity is the cycle's severity, as named by
+	// Severity.String. Currently every cycle is an "error".
+	Severity string `json:"severity"`
+	// Locks is the names of the lock classes in the cycle, in
+	// cycle order.
+	Locks []string `json:"locks"`
+	// Edges is the edges of the cycle. Edges[i] goes from
+	// Locks[i] to Locks[(i+1)%len(Locks)].
+	Edges []jsonlEdge `json:"edges"`
+	// Roots is the sorted names of the root functions from which
+	// edges of this cycle were found.
+	Roots []string `json:"roots"`
+	// Fix is the index in Edges of the edge with the fewest
+	// paths, which is likely the easiest to fix, or -1 for a
+	// self-deadlock. Ties go to the edge with the lexically latest
+	// lock classes.
+	Fix int `json:"fix"`
+}
+
+type jsonlEdge struct {
+	From  string      `json:"from"`
+	To    string      `json:"to"`
+	Paths []jsonlPath `json:"paths"`
+}
+
+// jsonlPath is one path that acquires an edge's From lock and then
+// its To lock. From and To are the call stacks from Root to each
+// acquisition, outermost call first.
+type jsonlPath struct {
+	Root string       `json:"root"`
+	From []jsonlFrame `json:"from"`
+	To   []jsonlFrame `json:"to"`
+	// Count is the number of paths that render like this one,
+	// ignoring columns. Only one of them is written.
+	Count int `json:"count"`
+}
+
+type jsonlFrame struct {
+	Op     string `json:"op"`
+	File   string `json:"file"`
+	Line   int    `json:"line"`
+	Column int    `json:"column"`
+}
+
+// WriteJSONL writes the lock cycles to w in JSON Lines format, one
+// jsonlCycle object per line. The cycles are found once the analysis
+// is done, but each is rendered and written separately, so the whole
+// report is never held in memory.
+func (lo *LockOrder) WriteJSONL(w io.Writer) {
+	enc := json.NewEncoder(w)
+	xFrames := func(rs []Frame) []jsonlFrame {
+		out := make([]jsonlFrame, len(rs))
+		for i, r := range rs {
+			out[i] = jsonlFrame{r.Op, r.Pos.Filename, r.Pos.Line, r.Pos.Column}
+		}
+		return out
+	}
+	self, multi := partitionCycles(lo.FindCycles())
+	for _, cycle := range append(self, multi...) {
+		fix, _ := lo.fixEdge(cycle)
+		rec := jsonlCycle{Kind: cycleKind(cycle), Severity: cycleSeverity.String(), Locks: make([]string, len(cycle)), Roots: lo.cycleRoots(cycle), Fix: fix}
+		for i, fromId := range cycle {
+			rec.Locks[i] = lo.name(fromId)
+			edge := lockOrderEdge{fromId, cycle[(i+1)%len(cycle)]}
+			jedge := jsonlEdge{From: lo.name(edge.fromId), To: lo.name(edge.toId)}
+			for _, g := range lo.edgePaths(edge) {
+				jedge.Paths = append(jedge.Paths, jsonlPath{g.path.RootFn, xFrames(g.path.From), xFrames(g.path.To), g.count})
+			}
+			rec.Edges = append(rec.Edges, jedge)
+		}
+		if err := enc.Encode(rec); err != nil {
+			log.Fatal("writing JSONL: ", err)
+		}
+	}
+}
+
+// defaultAllocLocks is the set of lock classes that may be acquired
+// by the memory allocator or the garbage collector. Since any
+// allocation can acquire these, edges to them usually mean some lock
+// is held while allocating. Like allocLocks, the names are normalized
+// by specName.
+var defaultAllocLocks = map[string]bool{
+	"runtime.mheap_.lock":           true,
+	"runtime.mheap_.speciallock":    true,
+	"runtime.mcentral.lock":         true,
+	"runtime.work.assistQueue.lock": true,
+	"runtime.work.wbufSpans.lock":   true,
+	"runtime.gcBitsArenas.lock":     true,
+	"runtime.finlock":               true,
+	"runtime.proflock":              true,
+}
+
+// WriteAllocEdges writes a text report of lock graph edges that
+// involve an allocation or GC lock (see Config.AllocLocks and
+// defaultAllocLocks) to w, grouped by allocation lock. Edges into an
+// allocation lock typically mean some other lock is held while
+// allocating; the usual fix is to avoid allocating while holding that
+// lock.
+func (lo *LockOrder) WriteAllocEdges(w io.Writer) {
+	type group struct {
+		in, out []lockOrderEdge
+	}
+	groups := make(map[string]*group)
+	getGroup := func(id int) *group {
+		g := groups[lo.name(id)]
+		if g == nil {
+			g = new(group)
+			groups[lo.name(id)] = g
+		}
+		return g
+	}
+	allocLocks := lo.allocLocks
+	if allocLocks == nil {
+		allocLocks = defaultAllocLocks
+	}
+	for edge := range lo.m {
+		if allocLocks[specName(lo.name(edge.toId))] {
+			g := getGroup(edge.toId)
+			g.in = append(g.in, edge)
+		}
+		if allocLocks[specName(lo.name(edge.fromId))] {
+			g := getGroup(edge.fromId)
+			g.out = append(g.out, edge)
+		}
+	}
+	if len(groups) == 0 {
+		fmt.Fprintf(w, "no allocation lock edges\n")
+		return
+	}
+
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	byName := func(edges []lockOrderEdge, other func(lockOrderEdge) int) {
+		sort.Slice(edges, func(i, j int) bool {
+			return lo.name(other(edges[i])) < lo.name(other(edges[j]))
+		})
+	}
+	from := func(e lockOrderEdge) int { return e.fromId }
+	to := func(e lockOrderEdge) int { return e.toId }
+	printEdges := func(edges []lockOrderEdge) {
+		for _, edge := range edges {
+			infos := lo.m[edge]
+			fmt.Fprintf(w, "  %d path(s) acquire %s then %s, for example:\n", len(infos), lo.name(edge.fromId), lo.name(edge.toId))
+			printPath(w, lo.examplePath(edge))
+		}
+	}
+	for _, name := range names {
+		g := groups[name]
+		byName(g.in, from)
+		byName(g.out, to)
+		fmt.Fprintf(w, "allocation lock %s:\n", name)
+		if len(g.in) > 0 {
+			fmt.Fprintf(w, " acquired while holding %d other lock(s):\n", len(g.in))
+			printEdges(g.in)
+		}
+		if len(g.out) > 0 {
+			fmt.Fprintf(w, " held while acquiring %d other lock(s):\n", len(g.out))
+			printEdges(g.out)
+		}
+		fmt.Fprintf(w, "\n")
+	}
+}
+
+// htmlCycle is a lock cycle in the HTML report's table of contents.
+type htmlCycle struct {
+	Kind     string // As in jsonlCycle
+	Severity string // As in jsonlCycle
+	Locks    []string
+	Edges    []string // Edge IDs from writeToDot
+	Paths    int      // Total paths over all edges
+	Fix      int      // As in jsonlCycle
+}
+
+// htmlOwner is a group of lock classes with the same owner (see
+// LockClass.Owner) in the HTML report's index.
+type htmlOwner struct {
+	Owner   string
+	Classes []htmlClass
+}
+
+type htmlClass struct {
+	Name   string
+	Cycles []int // Indexes into the list of htmlCycles
+}
+
+// htmlIndex returns the lock cycles and an index of the lock classes
+// in the graph, grouped by owner, for the HTML report. Like the other
+// reports, self-deadlocks come first. edgeIds maps edges to their IDs
+// in the dot graph.
+func (lo *LockOrder) htmlIndex(edgeIds map[lockOrderEdge]string) ([]htmlCycle, []htmlOwner) {
+	cycles := []htmlCycle{}
+	classCycles := make(map[int][]int)
+	self, multi := partitionCycles(lo.FindCycles())
+	for i, cycle := range append(self, multi...) {
+		fix, _ := lo.fixEdge(cycle)
+		hc := htmlCycle{Kind: cycleKind(cycle), Severity: cycleSeverity.String(), Fix: fix}
+		for j, id := range cycle {
+			edge := lockOrderEdge{id, cycle[(j+1)%len(cycle)]}
+			hc.Locks = append(hc.Locks, lo.name(id))
+			hc.Edges = append(hc.Edges, edgeIds[edge])
+			hc.Paths += len(lo.m[edge])
+			classCycles[id] = append(classCycles[id], i)
+		}
+		cycles = append(cycles, hc)
+	}
+
+	byOwner := make(map[string][]htmlClass)
+	seen := make(map[int]bool)
+	addClass := func(id int) {
+		if seen[id] {
+			return
+		}
+		seen[id] = true
+		lc := lo.lca.Lookup(id)
+		byOwner[lc.Owner()] = append(byOwner[lc.Owner()], htmlClass{lc.String(), classCycles[id]})
+	}
+	for edge := range lo.m {
+		addClass(edge.fromId)
+		addClass(edge.toId)
+	}
+	owners := []htmlOwner{}
+	for owner, classes := range byOwner {
+		sort.Slice(classes, func(i, j int) bool {
+			return classes[i].Name < classes[j].Name
+		})
+		owners = append(owners, htmlOwner{owner, classes})
+	}
+	sort.Slice(owners, func(i, j int) bool {
+		return owners[i].Owner < owners[j].Owner
+	})
+	return cycles, owners
+}
+
+// WriteToHTML writes a self-contained, interactive HTML lock graph
+// report to w. It requires dot to be in $PATH.
+func (lo *LockOrder) WriteToHTML(w io.Writer) {
+	// Generate SVG from dot graph.
+	cmd := exec.Command("dot", "-Tsvg")
+	dotin, err := cmd.StdinPipe()
+	if err != nil {
+		log.Fatal("creating pipe to dot: ", err)
+	}
+	dotDone := make(chan bool)
+	var edgeIds map[lockOrderEdge]string
+	go func() {
+		edgeIds = lo.writeToDot(dotin, false)
+		dotin.Close()
+		dotDone <- true
+	}()
+	svg, err := cmd.Output()
+	if err != nil {
+		log.Fatal("error running dot: ", err)
+	}
+	<-dotDone
+	// Strip stuff before the SVG tag so we can put it into HTML.
+	if i := bytes.Index(svg, []byte("<svg")); i > 0 {
+		svg = svg[i:]
+	}
+
+	// Construct JSON for lock graph details. This is about an
+	// order of magnitude smaller than the naive renderedFrames.
+	jsonStrings := NewStringSpace()
+	// sources maps from file path ID to line number to source
+	// text for the lines around each acquisition, so the report
+	// doesn't depend on having the sources.
+	const sourceContext = 2
+	var srcCache sourceCache
+	sources := make(map[int]map[int]string)
+	addSource := func(pathID int, pos token.Position) {
+		lines := srcCache.lines(pos.Filename)
+		if lines == nil {
+			return
+		}
+		if sources[pathID] == nil {
+			sources[pathID] = make(map[int]string)
+		}
+		for l := pos.Line - sourceContext; l <= pos.Line+sourceContext; l++ {
+			if l >= 1 && l <= len(lines) {
+				sources[pathID][l] = lines[l-1]
+			}
+		}
+	}
+	// To save space, we use a struct of arrays.
+	type jsonStack struct {
+		Op     []int
+		PathID []int `json:"P"`
+		Line   []int `json:"L"`
+	}
+	xFrames := func(rs []Frame) jsonStack {
+		out := jsonStack{
+			make([]int, len(rs)),
+			make([]int, len(rs)),
+			make([]int, len(rs)),
+		}
+		for i, r := range rs {
+			out.Op[i] = jsonStrings.Intern(r.Op)
+			out.PathID[i] = jsonStrings.Intern(r.Pos.Filename)
+			out.Line[i] = r.Pos.Line
+		}
+		if len(rs) > 0 {
+			// The last frame is the acquisition.
+			last := len(rs) - 1
+			addSource(out.PathID[last], rs[last].Pos)
+		}
+		return out
+	}
+	type jsonPath struct {
+		RootFn   int
+		From, To jsonStack
+		Count    int `json:"N"`
+	}
+	xPath := func(g pathGroup) jsonPath {
+		return jsonPath{jsonStrings.Intern(g.path.RootFn), xFrames(g.path.From), xFrames(g.path.To), g.count}
+	}
+	type jsonEdge struct {
+		EdgeID string
+		Locks  [2]string
+		Paths  []jsonPath
+	}
+	jsonEdges := []jsonEdge{}
+	for edge := range lo.m {
+		var paths []jsonPath
+		for _, g := range lo.edgePaths(edge) {
+			paths = append(paths, xPath(g))
+		}
+		jsonEdges = append(jsonEdges, jsonEdge{
+			EdgeID: edgeIds[edge],
+			Locks:  [2]string{lo.name(edge.fromId), lo.name(edge.toId)},
+			Paths:  paths,
+		})
+	}
+
+	// Locks held across blocking operations are shown like edges
+	// to the blocking operation.
+	jsonBlocking := []jsonEdge{}
+	for _, op := range lo.blockingOps() {
+		var paths []jsonPath
+		for _, g := range groupPaths(lo.blockingPaths(op)) {
+			paths = append(paths, xPath(g))
+		}
+		pos := op.pos
+		jsonBlocking = append(jsonBlocking, jsonEdge{
+			Locks: [2]string{lo.name(op.lockId), fmt.Sprintf("%s at %s:%d", op.op, filepath.Base(pos.Filename), pos.Line)},
+			Paths: paths,
+		})
+	}
+
+	// Find the static file path.
+	//
+	// TODO: Optionally bake these into the binary.
+	var static string
+	var found bool
+	for _, gopath := range filepath.SplitList(os.Getenv("GOPATH")) {
+		static = filepath.Join(gopath, "src/github.com/aclements/go-misc/rtcheck/static")
+		if _, err := os.Stat(static); err == nil {
+			found = true
+			break
+		}
+	}
+	if !found {
+		log.Fatal("unable to find HTML template in $GOPATH")
+	}
+
+	// Generate HTML.
+	tmpl, err := template.ParseFiles(filepath.Join(static, "tmpl-order.html"))
+	if err != nil {
+		log.Fatal("loading HTML templates: ", err)
+	}
+	mainJS, err := ioutil.ReadFile(filepath.Join(static, "main.js"))
+	if err != nil {
+		log.Fatal("loading main.js: ", err)
+	}
+	cycles, index := lo.htmlIndex(edgeIds)
+	err = tmpl.Execute(w, map[string]interface{}{
+		"graph":    template.HTML(svg),
+		"strings":  jsonStrings.s,
+		"edges":    jsonEdges,
+		"cycles":   cycles,
+		"index":    index,
+		"blocking": jsonBlocking,
+		"sources":  sources,
+		"mainJS":   template.JS(mainJS),
+	})
+	if err != nil {
+		log.Fatal("executing HTML template: ", err)
+	}
+}
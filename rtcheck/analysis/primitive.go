@@ -0,0 +1,138 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package analysis
+
+import (
+	"golang.org/x/tools/go/ssa"
+)
+
+// A Primitive recognizes calls to custom synchronization functions,
+// such as ticket locks or hand-rolled wait queues, so the analysis
+// can model them alongside the built-in runtime primitives.
+//
+// Primitives are registered with RegisterPrimitive. The built-in
+// handling of runtime functions (see callHandlers) takes precedence
+// over registered primitives.
+type Primitive interface {
+	// Classify returns how a call to fn behaves. arg is the index
+	// of the argument that identifies the lock or resource; its
+	// lock class is computed just like the argument to
+	// runtime.lock. If fn is not a synchronization function,
+	// Classify returns ok == false.
+	Classify(fn *ssa.Function) (kind PrimitiveKind, arg int, ok bool)
+}
+
+// A PrimitiveKind is the behavior of a synchronization function.
+type PrimitiveKind int
+
+const (
+	// PrimLock acquires the resource.
+	PrimLock PrimitiveKind = iota
+	// PrimUnlock releases the resource.
+	PrimUnlock
+	// PrimBlocking waits for the resource without acquiring it,
+	// like runtime.notesleep. Any lock held while blocking is
+	// ordered before the resource.
+	PrimBlocking
+)
+
+// FuncTable is a Primitive that classifies functions by name
+// (ssa.Function.String()).
+//
+// For example, the following registers a ticket lock:
+//
+//     RegisterPrimitive(FuncTable{
+//         "example.com/tl.(*Ticket).Lock":   {PrimLock, 0},
+//         "example.com/tl.(*Ticket).Unlock": {PrimUnlock, 0},
+//     })
+type FuncTable map[string]FuncTableEntry
+
+// FuncTableEntry is the classification of a function in a FuncTable.
+type FuncTableEntry struct {
+	Kind PrimitiveKind
+	Arg  int
+}
+
+func (t FuncTable) Classify(fn *ssa.Function) (PrimitiveKind, int, bool) {
+	e, ok := t[fn.String()]
+	return e.Kind, e.Arg, ok
+}
+
+// primitives is the list of registered Primitives.
+var primitives []Primitive
+
+// RegisterPrimitive registers p to classify calls during analysis.
+// It must be called before analysis starts.
+func RegisterPrimitive(p Primitive) {
+	primitives = append(primitives, p)
+}
+
+// primitiveClass is the cached classification of a function.
+type primitiveClass struct {
+	kind PrimitiveKind
+	arg  int
+	ok   bool
+}
+
+// classify returns the classification of fn by the registered
+// primitives.
+func (s *state) classify(fn *ssa.Function) primitiveClass {
+	if c, ok := s.primitiveClasses[fn]; ok {
+		return c
+	}
+	var c primitiveClass
+	for _, p := range primitives {
+		if c.kind, c.arg, c.ok = p.Classify(fn); c.ok {
+			break
+		}
+	}
+	if s.primitiveClasses == nil {
+		s.primitiveClasses = make(map[*ssa.Function]primitiveClass)
+	}
+	s.primitiveClasses[fn] = c
+	return c
+}
+
+// isBlocking returns whether fn may block the calling goroutine.
+func (s *state) isBlocking(fn *ssa.Function) bool {
+	if blockingFuncs[fn.String()] {
+		return true
+	}
+	c := s.classify(fn)
+	return c.ok && c.kind == PrimBlocking
+}
+
+// handlePrimitive models a call instr to a function classified as c.
+// It is a callHandler, except that it returns false if instr isn't a
+// call that it can model.
+func (s *state) handlePrimitive(c primitiveClass, ps PathState, instr ssa.Instruction, newps []PathState) ([]PathState, bool) {
+	call, ok := instr.(ssa.CallInstruction)
+	if !ok || c.arg < 0 || c.arg >= len(call.Common().Args) {
+		return newps, false
+	}
+	arg := call.Common().Args[c.arg]
+	switch c.kind {
+	case PrimLock:
+		ps, ok := s.acquire(ps, instr, arg)
+		if !ok {
+			return newps, true
+		}
+		return append(newps, ps), true
+
+	case PrimUnlock:
+		ps, _ := s.release(ps, instr, arg)
+		return append(newps, ps), true
+
+	case PrimBlocking:
+		res, err := s.lockClass(ps.vs, arg)
+		if err != nil {
+			s.warnl(SevInfo, instr.Pos(), "%s", err)
+		} else {
+			s.lockOrder.Add(ps.lockSet, NewLockSet().Plus(res, s.stack), s.stack)
+		}
+		return append(newps, ps), true
+	}
+	return newps, false
+}
@@ -0,0 +1,62 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package analysis
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestPrimitive(t *testing.T) {
+	// Without registration, the ticket lock is invisible.
+	s := analyzeTestdata(t, "ticketThenMutex", "mutexThenWait")
+	if len(s.lockOrder.m) != 0 {
+		t.Errorf("want no lock edges, got %d", len(s.lockOrder.m))
+	}
+
+	defer func(old []Primitive) { primitives = old }(primitives)
+	RegisterPrimitive(FuncTable{
+		"(*runtime.ticketLock).acquire": {PrimLock, 0},
+		"(*runtime.ticketLock).release": {PrimUnlock, 0},
+		"(*runtime.waitq).wait":         {PrimBlocking, 0},
+	})
+	s = analyzeTestdata(t, "ticketThenMutex", "mutexThenWait")
+	if !hasEdge(s, "runtime.ticketObj.tl", "runtime.ticketMu") {
+		t.Errorf("want edge runtime.ticketObj.tl -> runtime.ticketMu")
+	}
+	if !hasEdge(s, "runtime.ticketMu", "runtime.ticketObj.wq") {
+		t.Errorf("want edge runtime.ticketMu -> runtime.ticketObj.wq")
+	}
+	if len(s.rootLockLeaks) != 0 {
+		t.Errorf("ticket lock not released")
+	}
+}
+
+func TestLockObserver(t *testing.T) {
+	var got []string
+	obs := func(tr LockTransition, class *LockClass, stack *StackFrame, ps *PathState) {
+		op := "acquire"
+		if tr == LockRelease {
+			op = "release"
+		}
+		ev := fmt.Sprintf("%s %s in %s -> %v", op, class, stack.call.Parent(), ps.lockSet)
+		// There are several paths through lockAB that differ
+		// only in value state. Their transitions interleave.
+		if len(got) == 0 || got[len(got)-1] != ev {
+			got = append(got, ev)
+		}
+	}
+	analyzeTestdataOpts(t, options{observer: obs}, "lockAB")
+	want := []string{
+		"acquire runtime.lockA in runtime.lockAB -> {runtime.lockA}",
+		"acquire runtime.lockB in runtime.lockAB -> {runtime.lockA,runtime.lockB}",
+		"release runtime.lockB in runtime.lockAB -> {runtime.lockA}",
+		"release runtime.lockA in runtime.lockAB -> {}",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got transitions:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
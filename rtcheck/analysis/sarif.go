@@ -0,0 +1,205 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package analysis
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+// This file writes lock cycles in the Static Analysis Results
+// Interchange Format (SARIF) 2.1.0, which is consumed by code scanning
+// tools and IDEs. Only the subset of the schema rtcheck needs is
+// modeled.
+
+const (
+	sarifCycleRule = "deadlock/cycle"
+	sarifSelfRule  = "deadlock/self"
+)
+
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name  string      `json:"name"`
+	Rules []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID               string       `json:"id"`
+	ShortDescription sarifMessage `json:"shortDescription"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+	CodeFlows []sarifCodeFlow `json:"codeFlows"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+	Message          *sarifMessage         `json:"message,omitempty"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+	Region           sarifRegion           `json:"region"`
+}
+
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+type sarifRegion struct {
+	StartLine   int `json:"startLine"`
+	StartColumn int `json:"startColumn,omitempty"`
+}
+
+// A sarifCodeFlow is one way a result can happen. For a lock cycle,
+// each edge is acquired by a different goroutine, so each edge is a
+// separate thread flow.
+type sarifCodeFlow struct {
+	Message     sarifMessage      `json:"message"`
+	ThreadFlows []sarifThreadFlow `json:"threadFlows"`
+}
+
+type sarifThreadFlow struct {
+	Message   sarifMessage              `json:"message"`
+	Locations []sarifThreadFlowLocation `json:"locations"`
+}
+
+type sarifThreadFlowLocation struct {
+	Location     sarifLocation `json:"location"`
+	NestingLevel int           `json:"nestingLevel"`
+}
+
+// sarifFrameLocation returns the SARIF location of fr, with fr's
+// operation as the location's message.
+func sarifFrameLocation(fr Frame) sarifLocation {
+	uri := filepath.ToSlash(fr.Pos.Filename)
+	if filepath.IsAbs(fr.Pos.Filename) {
+		if !strings.HasPrefix(uri, "/") {
+			// Windows drive letter path.
+			uri = "/" + uri
+		}
+		uri = "file://" + uri
+	}
+	return sarifLocation{
+		PhysicalLocation: sarifPhysicalLocation{
+			ArtifactLocation: sarifArtifactLocation{uri},
+			Region:           sarifRegion{fr.Pos.Line, fr.Pos.Column},
+		},
+		Message: &sarifMessage{fr.Op},
+	}
+}
+
+// sarifLevel returns the SARIF result level for severity sev.
+func sarifLevel(sev Severity) string {
+	switch sev {
+	case SevInfo:
+		return "note"
+	case SevWarning:
+		return "warning"
+	}
+	return "error"
+}
+
+// WriteSARIF writes the lock cycles to w as a SARIF 2.1.0 log. Each
+// cycle is a result whose primary location is the innermost
+// acquisition of the cycle's first edge. The result has one code flow
+// with a thread flow for the example path (see examplePath) of each
+// edge of the cycle. Self-deadlocks come first and have their own
+// rule.
+func (lo *LockOrder) WriteSARIF(w io.Writer) {
+	run := sarifRun{
+		Tool: sarifTool{sarifDriver{
+			Name: "rtcheck",
+			Rules: []sarifRule{{
+				ID:               sarifSelfRule,
+				ShortDescription: sarifMessage{"Lock acquired while a lock of the same class is held"},
+			}, {
+				ID:               sarifCycleRule,
+				ShortDescription: sarifMessage{"Lock order cycle that may deadlock"},
+			}},
+		}},
+		Results: []sarifResult{},
+	}
+	self, multi := partitionCycles(lo.FindCycles())
+	for _, cycle := range append(self, multi...) {
+		names := make([]string, len(cycle)+1)
+		for i, id := range cycle {
+			names[i] = lo.name(id)
+		}
+		names[len(cycle)] = names[0]
+		desc := strings.Join(names, " -> ")
+
+		var flow sarifCodeFlow
+		flow.Message = sarifMessage{fmt.Sprintf("%d goroutine(s) acquiring locks in a cycle", len(cycle))}
+		for i, fromId := range cycle {
+			edge := lockOrderEdge{fromId, cycle[(i+1)%len(cycle)]}
+			rinfo := lo.examplePath(edge)
+			tf := sarifThreadFlow{
+				Message: sarifMessage{fmt.Sprintf("%s acquires %s, then %s", rinfo.RootFn, lo.name(edge.fromId), lo.name(edge.toId))},
+			}
+			for _, stack := range [][]Frame{rinfo.From, rinfo.To} {
+				for level, fr := range stack {
+					tf.Locations = append(tf.Locations, sarifThreadFlowLocation{sarifFrameLocation(fr), level})
+				}
+			}
+			flow.ThreadFlows = append(flow.ThreadFlows, tf)
+		}
+
+		// The primary location is where the first edge's
+		// second lock is acquired.
+		first := flow.ThreadFlows[0].Locations
+		primary := first[len(first)-1].Location
+		primary.Message = nil
+
+		rule, msg := sarifCycleRule, "lock cycle: "+desc
+		if selfCycle(cycle) {
+			rule, msg = sarifSelfRule, "self-deadlock: "+desc
+		}
+		run.Results = append(run.Results, sarifResult{
+			RuleID:    rule,
+			Level:     sarifLevel(cycleSeverity),
+			Message:   sarifMessage{msg},
+			Locations: []sarifLocation{primary},
+			CodeFlows: []sarifCodeFlow{flow},
+		})
+	}
+
+	out := sarifLog{
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Version: "2.1.0",
+		Runs:    []sarifRun{run},
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(out); err != nil {
+		log.Fatal("writing SARIF: ", err)
+	}
+}
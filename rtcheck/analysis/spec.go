@@ -0,0 +1,175 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package analysis
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// A LockSpec is a user-supplied partial order over lock classes that
+// the code is intended to follow.
+type LockSpec struct {
+	// before maps from each lock class name to the lock classes
+	// that must be acquired after it, transitively closed.
+	before map[string]map[string]bool
+}
+
+// ParseLockSpec parses a lock order specification. Each non-blank
+// line that doesn't start with "#" is a chain of lock class names
+// separated by "<", such as
+//
+//     runtime.sched.lock < runtime.allpLock < runtime.mheap_.lock
+//
+// meaning each lock may be held while acquiring any lock to its
+// right, but not the other way around. Lock class names are as
+// printed by rtcheck; the trailing "*" on non-unique classes is
+// optional. The specification must not itself contain a cycle.
+func ParseLockSpec(r io.Reader) (*LockSpec, error) {
+	edges := make(map[string][]string)
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		names := strings.Split(line, "<")
+		if len(names) < 2 {
+			return nil, fmt.Errorf("line %d: want \"a < b\", got %q", lineno, line)
+		}
+		for i := range names {
+			names[i] = specName(names[i])
+			if names[i] == "" {
+				return nil, fmt.Errorf("line %d: empty lock class name", lineno)
+			}
+		}
+		for i := 0; i < len(names)-1; i++ {
+			edges[names[i]] = append(edges[names[i]], names[i+1])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return newLockSpec(edges)
+}
+
+// ParseLockRanks parses a lock rank file, in the style of the
+// runtime's lockrank.go. Each non-blank line that doesn't start with
+// "#" lists the lock classes of one rank, separated by spaces, from
+// the lowest rank to the highest, such as
+//
+//     runtime.sched.lock
+//     runtime.allpLock runtime.allglock
+//     runtime.mheap_.lock
+//
+// A lock may be held while acquiring any lock of a higher rank, but
+// not one of a lower rank. Locks of the same rank are unordered. Lock
+// class names are as for ParseLockSpec.
+func ParseLockRanks(r io.Reader) (*LockSpec, error) {
+	edges := make(map[string][]string)
+	rankOf := make(map[string]int)
+	var prev []string
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		names := strings.Fields(line)
+		for i := range names {
+			names[i] = specName(names[i])
+			if l, ok := rankOf[names[i]]; ok {
+				return nil, fmt.Errorf("line %d: %s already ranked on line %d", lineno, names[i], l)
+			}
+			rankOf[names[i]] = lineno
+		}
+		for _, from := range prev {
+			edges[from] = append(edges[from], names...)
+		}
+		prev = names
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return newLockSpec(edges)
+}
+
+// newLockSpec returns the LockSpec for the transitive closure of
+// edges, which maps from each lock class name to the lock classes
+// that must be acquired immediately after it.
+func newLockSpec(edges map[string][]string) (*LockSpec, error) {
+	spec := &LockSpec{make(map[string]map[string]bool)}
+	// Check in order, so a spec with several cycles always
+	// reports the same one.
+	froms := make([]string, 0, len(edges))
+	for from := range edges {
+		froms = append(froms, from)
+	}
+	sort.Strings(froms)
+	for _, from := range froms {
+		after := make(map[string]bool)
+		var visit func(name string)
+		visit = func(name string) {
+			for _, next := range edges[name] {
+				if !after[next] {
+					after[next] = true
+					visit(next)
+				}
+			}
+		}
+		visit(from)
+		if after[from] {
+			return nil, fmt.Errorf("lock order has a cycle through %s", from)
+		}
+		spec.before[from] = after
+	}
+	return spec, nil
+}
+
+// specName normalizes a lock class name for comparison with a
+// LockSpec.
+func specName(name string) string {
+	return strings.TrimSuffix(strings.TrimSpace(name), "*")
+}
+
+// allows returns whether spec allows acquiring lock class to while
+// holding lock class from. Pairs that spec doesn't order are allowed.
+func (spec *LockSpec) allows(from, to string) bool {
+	from, to = specName(from), specName(to)
+	return !spec.before[to][from]
+}
+
+// CheckSpec writes a report of every lock graph edge that violates
+// spec to w and returns the number of violating edges.
+func (lo *LockOrder) CheckSpec(w io.Writer, spec *LockSpec) int {
+	var bad []lockOrderEdge
+	for edge := range lo.m {
+		if !spec.allows(lo.name(edge.fromId), lo.name(edge.toId)) {
+			bad = append(bad, edge)
+		}
+	}
+	sort.Slice(bad, func(i, j int) bool {
+		fi, fj := lo.name(bad[i].fromId), lo.name(bad[j].fromId)
+		if fi != fj {
+			return fi < fj
+		}
+		return lo.name(bad[i].toId) < lo.name(bad[j].toId)
+	})
+
+	for _, edge := range bad {
+		infos := lo.m[edge]
+		fmt.Fprintf(w, "lock order violation: %s must be acquired before %s\n", lo.name(edge.toId), lo.name(edge.fromId))
+		fmt.Fprintf(w, "  %d path(s) acquire %s then %s:\n", len(infos), lo.name(edge.fromId), lo.name(edge.toId))
+		for _, g := range lo.edgePaths(edge) {
+			printPathGroup(w, g)
+		}
+		fmt.Fprintf(w, "\n")
+	}
+	fmt.Fprintf(w, "number of lock order violations: %d\n", len(bad))
+	return len(bad)
+}
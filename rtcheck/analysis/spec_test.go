@@ -0,0 +1,91 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package analysis
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestParseLockSpec(t *testing.T) {
+	spec, err := ParseLockSpec(strings.NewReader(`
+# Comment
+a < b < c*
+c < d
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		from, to string
+		want     bool
+	}{
+		{"a", "b", true},
+		{"a", "d", true},
+		{"d", "a", false},
+		{"c*", "b", false},
+		{"c", "b*", false},
+		{"a", "x", true},
+		{"x", "a", true},
+	} {
+		if got := spec.allows(test.from, test.to); got != test.want {
+			t.Errorf("allows(%s, %s) = %v, want %v", test.from, test.to, got, test.want)
+		}
+	}
+
+	for _, bad := range []string{"a", "a < ", "a < b\nb < a"} {
+		if _, err := ParseLockSpec(strings.NewReader(bad)); err == nil {
+			t.Errorf("want error for %q", bad)
+		}
+	}
+}
+
+func TestParseLockRanks(t *testing.T) {
+	spec, err := ParseLockRanks(strings.NewReader(`
+# Lowest rank first.
+a
+b c*
+d
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		from, to string
+		want     bool
+	}{
+		{"a", "b", true},
+		{"a", "d", true},
+		{"b", "c", true},
+		{"c", "b", true},
+		{"d", "c", false},
+		{"c", "a", false},
+		{"x", "a", true},
+	} {
+		if got := spec.allows(test.from, test.to); got != test.want {
+			t.Errorf("allows(%s, %s) = %v, want %v", test.from, test.to, got, test.want)
+		}
+	}
+
+	if _, err := ParseLockRanks(strings.NewReader("a\nb\na")); err == nil {
+		t.Errorf("want error for lock with two ranks")
+	}
+}
+
+func TestCheckSpec(t *testing.T) {
+	s := analyzeTestdata(t, "lockAB", "lockBA")
+	spec, err := ParseLockSpec(strings.NewReader("runtime.lockA < runtime.lockB"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if n := s.lockOrder.CheckSpec(&buf, spec); n != 1 {
+		t.Errorf("want 1 violation, got %d:\n%s", n, buf.String())
+	}
+	if !strings.Contains(buf.String(), "runtime.lockA must be acquired before runtime.lockB") {
+		t.Errorf("report doesn't describe violation:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package analysis
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+
+	"golang.org/x/tools/go/ssa"
+)
+
+// analysisStats records how much of the program was analyzed
+// precisely and where the analysis approximated. An empty lock cycle
+// report with many trimmed paths means something quite different from
+// one where every path was explored.
+type analysisStats struct {
+	// TimedOut is whether exploration stopped early because the
+	// analysis timeout expired.
+	TimedOut bool `json:"timedOut,omitempty"`
+	// Functions is the number of distinct functions walked,
+	// including external functions.
+	Functions int `json:"functions"`
+	// External is the number of functions without bodies, which
+	// are assumed not to affect locks.
+	External int `json:"external"`
+	// Stubbed is the number of functions whose bodies were
+	// replaced with rtcheck's stubs.
+	Stubbed int `json:"stubbed"`
+	// PathStates is the number of (block, path state) pairs
+	// explored.
+	PathStates int `json:"pathStates"`
+	// Trimmed is the number of paths abandoned because a block
+	// was reached with too many similar path states (see
+	// -maxstates). TrimmedFunctions breaks this down by the
+	// function containing the block.
+	Trimmed          int            `json:"trimmed"`
+	TrimmedFunctions map[string]int `json:"trimmedFunctions,omitempty"`
+	// BudgetExhausted is the number of paths abandoned because
+	// another exploration budget ran out: the limit on locks held
+	// at once, or the analysis timeout.
+	BudgetExhausted int `json:"budgetExhausted"`
+	// RecursionCuts is the number of recursive calls whose paths
+	// were terminated to break the recursion.
+	RecursionCuts int `json:"recursionCuts"`
+	// Widened is the number of times a loop header's value state
+	// was widened to make the loop converge.
+	Widened int `json:"widened"`
+	// CacheHits and CacheMisses count lookups in the per-function
+	// exit state cache.
+	CacheHits   int `json:"cacheHits"`
+	CacheMisses int `json:"cacheMisses"`
+	// NeutralCalls is the number of calls that weren't walked
+	// because the callee's call tree can't affect locks.
+	NeutralCalls int `json:"neutralCalls"`
+}
+
+// trim records that a path was trimmed in fn.
+func (st *analysisStats) trim(fn *ssa.Function) {
+	st.Trimmed++
+	if st.TrimmedFunctions == nil {
+		st.TrimmedFunctions = make(map[string]int)
+	}
+	st.TrimmedFunctions[fn.String()]++
+}
+
+// hitRate returns the fraction of exit state cache lookups that hit.
+func (st *analysisStats) hitRate() float64 {
+	if st.CacheHits+st.CacheMisses == 0 {
+		return 0
+	}
+	return float64(st.CacheHits) / float64(st.CacheHits+st.CacheMisses)
+}
+
+// WriteText writes a human-readable summary of st to w.
+func (st *analysisStats) WriteText(w io.Writer) {
+	fmt.Fprintf(w, "analysis statistics:\n")
+	if st.TimedOut {
+		fmt.Fprintf(w, "  timed out; exploration is incomplete\n")
+	}
+	fmt.Fprintf(w, "  functions explored:    %d (%d external, %d stubbed)\n", st.Functions, st.External, st.Stubbed)
+	fmt.Fprintf(w, "  path states explored:  %d\n", st.PathStates)
+	fmt.Fprintf(w, "  paths trimmed:         %d\n", st.Trimmed)
+	fmt.Fprintf(w, "  budget exhaustions:    %d\n", st.BudgetExhausted)
+	fmt.Fprintf(w, "  recursive calls cut:   %d\n", st.RecursionCuts)
+	fmt.Fprintf(w, "  loop widenings:        %d\n", st.Widened)
+	fmt.Fprintf(w, "  exit cache hit rate:   %.1f%% (%d/%d)\n", 100*st.hitRate(), st.CacheHits, st.CacheHits+st.CacheMisses)
+	fmt.Fprintf(w, "  lock-neutral calls:    %d\n", st.NeutralCalls)
+
+	if len(st.TrimmedFunctions) == 0 {
+		return
+	}
+	// List the functions that lost the most paths, since those
+	// are where raising -maxstates would help.
+	const maxShow = 10
+	fns := make([]string, 0, len(st.TrimmedFunctions))
+	for fn := range st.TrimmedFunctions {
+		fns = append(fns, fn)
+	}
+	sort.Slice(fns, func(i, j int) bool {
+		ni, nj := st.TrimmedFunctions[fns[i]], st.TrimmedFunctions[fns[j]]
+		if ni != nj {
+			return ni > nj
+		}
+		return fns[i] < fns[j]
+	})
+	fmt.Fprintf(w, "paths trimmed by function (raise -maxstates to explore more):\n")
+	for i, fn := range fns {
+		if i == maxShow {
+			fmt.Fprintf(w, "  ... and %d more function(s)\n", len(fns)-maxShow)
+			break
+		}
+		fmt.Fprintf(w, "  %6d %s\n", st.TrimmedFunctions[fn], fn)
+	}
+}
+
+// WriteJSON writes st to w as a JSON object.
+func (st *analysisStats) WriteJSON(w io.Writer) {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(st); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package analysis
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	"golang.org/x/tools/go/ssa"
+)
+
+// lockyNameRe matches the names of functions that may acquire,
+// release, or block on a lock.
+var lockyNameRe = regexp.MustCompile(`(?i)lock|mutex|sema|futex|note|park|sleep|wake`)
+
+// lockyFileRe matches the base names of runtime files that implement
+// locks.
+var lockyFileRe = regexp.MustCompile(`^(lock_|sema|.*futex)`)
+
+// isStubbed returns whether rtcheck replaced the body of fn with one
+// of the stubs in newStubs.
+func (s *state) isStubbed(fn *ssa.Function) bool {
+	if fn.Pkg == nil || fn.Signature.Recv() != nil || !s.opts.rewrittenPkgs[fn.Pkg.Pkg.Path()] {
+		return false
+	}
+	return newStubs[fn.Pkg.Pkg.Name()][fn.Name()] != nil
+}
+
+// mayLock returns whether external function fn looks like it may
+// affect locks, based on its name or the file it's declared in. Such
+// a function probably needs a stub.
+func (s *state) mayLock(fn *ssa.Function) bool {
+	if lockyNameRe.MatchString(fn.Name()) {
+		return true
+	}
+	if pos := s.fset.Position(fn.Pos()); pos.IsValid() {
+		return lockyFileRe.MatchString(filepath.Base(pos.Filename))
+	}
+	return false
+}
+
+// recordReached records that the walk reached f for the first time.
+// An external function that looks like it may affect locks gets a
+// warning, since we assume it doesn't.
+func (s *state) recordReached(f *ssa.Function) {
+	switch {
+	case f.Blocks == nil:
+		s.stats.External++
+		if s.externalReached == nil {
+			s.externalReached = make(map[*ssa.Function]bool)
+		}
+		s.externalReached[f] = true
+		if s.mayLock(f) || s.opts.external == "worst" {
+			s.warnl(SevWarning, f.Pos(), "external function %s may affect locks; it may need a stub (see -stubs)", f)
+		} else {
+			s.warnl(SevInfo, f.Pos(), "external function %s", f)
+		}
+
+	case s.isStubbed(f):
+		s.addStub(f)
+	}
+}
+
+// externalCall models a call to external function f from path state
+// ps in worst-case mode. Since f could do anything, it is treated as
+// acquiring a lock class of its own that is ordered after every lock
+// held by ps.
+func (s *state) externalCall(f *ssa.Function, ps PathState) {
+	lc := s.externalLocks[f]
+	if lc == nil {
+		if s.externalLocks == nil {
+			s.externalLocks = make(map[*ssa.Function]*LockClass)
+		}
+		lc = s.lca.NewLockClass("<external "+f.String()+">", false)
+		s.externalLocks[f] = lc
+	}
+	s.lockOrder.Add(ps.lockSet, NewLockSet().Plus(lc, s.stack), s.stack)
+}
+
+func (s *state) addStub(f *ssa.Function) {
+	if s.stubsReached[f] {
+		return
+	}
+	s.stats.Stubbed++
+	if s.stubsReached == nil {
+		s.stubsReached = make(map[*ssa.Function]bool)
+	}
+	s.stubsReached[f] = true
+}
+
+// recordNeutral records the stubs in the call tree of f, which is
+// lock-neutral and hence won't be walked. A lock-neutral call tree
+// can't contain external functions.
+func (s *state) recordNeutral(f *ssa.Function) {
+	if s.neutralSeen[f] {
+		return
+	}
+	if s.neutralSeen == nil {
+		s.neutralSeen = make(map[*ssa.Function]bool)
+	}
+	s.neutralSeen[f] = true
+	if s.isStubbed(f) {
+		s.addStub(f)
+	}
+	if node := s.cg.Nodes[f]; node != nil {
+		for _, out := range node.Out {
+			s.recordNeutral(out.Callee.Func)
+		}
+	}
+}
+
+// writeStubUsage writes a report of the stubbed and external
+// functions reached by the walk to w. External functions that look
+// like they may affect locks are marked with a "!".
+func (s *state) writeStubUsage(w io.Writer) {
+	names := func(fns map[*ssa.Function]bool) []string {
+		var out []string
+		for fn := range fns {
+			out = append(out, fn.String())
+		}
+		sort.Strings(out)
+		return out
+	}
+	fmt.Fprintf(w, "%d stubbed function(s) reached:\n", len(s.stubsReached))
+	for _, name := range names(s.stubsReached) {
+		fmt.Fprintf(w, "  %s\n", name)
+	}
+	assumed := "assumed not to affect locks"
+	if s.opts.external == "worst" {
+		assumed = "assumed to acquire any lock"
+	}
+	fmt.Fprintf(w, "%d external function(s) reached, %s:\n", len(s.externalReached), assumed)
+	mayLock := make(map[string]bool)
+	for fn := range s.externalReached {
+		if s.mayLock(fn) {
+			mayLock[fn.String()] = true
+		}
+	}
+	for _, name := range names(s.externalReached) {
+		mark := " "
+		if mayLock[name] {
+			mark = "!"
+		}
+		fmt.Fprintf(w, "  %s %s\n", mark, name)
+	}
+	if len(mayLock) > 0 {
+		fmt.Fprintf(w, "(! marks functions that may affect locks and probably need stubs)\n")
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package analysis
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// ParseSuppressions parses a cycle suppression file. Each non-blank
+// line that doesn't start with "#" lists the lock classes of one
+// cycle, separated by spaces, such as
+//
+//     runtime.sched.lock runtime.allglock
+//
+// The order of the lock classes doesn't matter. A line with a single
+// lock class suppresses a self-deadlock on that class. Lock class
+// names are as printed by rtcheck; the trailing "*" on non-unique
+// classes is optional. It returns the set of cycle signatures (see
+// cycleSignature).
+func ParseSuppressions(r io.Reader) (map[string]bool, error) {
+	sigs := make(map[string]bool)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		sigs[cycleSignature(strings.Fields(line))] = true
+	}
+	return sigs, scanner.Err()
+}
+
+// cycleSignature returns a canonical string for the cycle with the
+// given lock class names. It depends only on the set of lock class
+// names, so it's stable across runs and independent of where the
+// cycle's locks were acquired.
+func cycleSignature(names []string) string {
+	sorted := make([]string, len(names))
+	for i, name := range names {
+		sorted[i] = specName(name)
+	}
+	sort.Strings(sorted)
+	return strings.Join(sorted, " ")
+}
+
+// WriteBaseline writes the signatures of lo's cycles to w in the
+// format read by ParseSuppressions, one per line in sorted order, so
+// that baselines can be compared with diff.
+func (lo *LockOrder) WriteBaseline(w io.Writer) {
+	var sigs []string
+	for _, cycle := range lo.FindCycles() {
+		names := make([]string, len(cycle))
+		for i, id := range cycle {
+			names[i] = lo.name(id)
+		}
+		sigs = append(sigs, cycleSignature(names))
+	}
+	sort.Strings(sigs)
+	fmt.Fprintf(w, "# rtcheck lock cycle baseline. Cycles listed here are not reported\n# when this file is passed to -baseline.\n")
+	for i, sig := range sigs {
+		if i > 0 && sig == sigs[i-1] {
+			continue
+		}
+		fmt.Fprintln(w, sig)
+	}
+}
+
+// Suppress removes cycles whose signature is in sigs from the results
+// of FindCycles.
+func (lo *LockOrder) Suppress(sigs map[string]bool) {
+	lo.suppress = sigs
+	lo.cycles = nil
+}
+
+// suppressCycles removes the suppressed cycles from cycles, counting
+// them in lo.suppressed.
+func (lo *LockOrder) suppressCycles(cycles [][]int) [][]int {
+	lo.suppressed = 0
+	if len(lo.suppress) == 0 {
+		return cycles
+	}
+	out := cycles[:0]
+	for _, cycle := range cycles {
+		names := make([]string, len(cycle))
+		for i, id := range cycle {
+			names[i] = lo.name(id)
+		}
+		if lo.suppress[cycleSignature(names)] {
+			lo.suppressed++
+			continue
+		}
+		out = append(out, cycle)
+	}
+	return out
+}
@@ -0,0 +1,81 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package analysis
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestParseSuppressions(t *testing.T) {
+	sigs, err := ParseSuppressions(strings.NewReader("# comment\n\nb* a\nc b a\nd*\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A single lock class is a self-deadlock.
+	for _, sig := range []string{"a b", "a b c", "d"} {
+		if !sigs[sig] {
+			t.Errorf("missing signature %q in %v", sig, sigs)
+		}
+	}
+	if len(sigs) != 3 {
+		t.Errorf("want 3 signatures, got %v", sigs)
+	}
+}
+
+func TestSuppress(t *testing.T) {
+	s := analyzeTestdata(t, "lockAB", "lockBA", "lockBC", "lockCA")
+	checkCycles(t, s, "runtime.lockA -> runtime.lockB", "runtime.lockA -> runtime.lockB -> runtime.lockC")
+
+	sigs, err := ParseSuppressions(strings.NewReader("runtime.lockB runtime.lockA\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.lockOrder.Suppress(sigs)
+	checkCycles(t, s, "runtime.lockA -> runtime.lockB -> runtime.lockC")
+	var buf bytes.Buffer
+	s.lockOrder.Check(&buf)
+	if !strings.Contains(buf.String(), "1 lock cycle(s) suppressed") {
+		t.Errorf("missing suppression summary in:\n%s", buf.String())
+	}
+}
+
+func TestSuppressSelfDeadlock(t *testing.T) {
+	s := analyzeTestdata(t, "doubleLockOuter")
+	checkCycles(t, s, "runtime.doubleL")
+
+	sigs, err := ParseSuppressions(strings.NewReader("runtime.doubleL\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.lockOrder.Suppress(sigs)
+	checkCycles(t, s)
+}
+
+func TestBaseline(t *testing.T) {
+	s := analyzeTestdata(t, "lockAB", "lockBA", "lockBC", "lockCA", "doubleLockOuter")
+	var buf bytes.Buffer
+	s.lockOrder.WriteBaseline(&buf)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	var sigs []string
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "#") {
+			sigs = append(sigs, line)
+		}
+	}
+	want := "runtime.doubleL\nruntime.lockA runtime.lockB\nruntime.lockA runtime.lockB runtime.lockC"
+	if got := strings.Join(sigs, "\n"); got != want {
+		t.Errorf("want baseline:\n%s\ngot:\n%s", want, got)
+	}
+
+	// Reading the baseline back suppresses every cycle.
+	baseline, err := ParseSuppressions(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.lockOrder.Suppress(baseline)
+	checkCycles(t, s)
+}
@@ -0,0 +1,5 @@
+package p
+
+func f() {
+	x := g(1)
+}
@@ -0,0 +1,17 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cpu
+
+var X86 struct {
+	HasAVX bool
+}
+
+// cpuid is implemented in assembly.
+func cpuid(eaxArg, ecxArg uint32) (eax, ebx, ecx, edx uint32)
+
+func Initialize() {
+	_, _, ecx, _ := cpuid(1, 0)
+	X86.HasAVX = ecx != 0
+}
@@ -0,0 +1,37 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package mutexapp is a non-runtime package for testing -packages.
+package mutexapp
+
+import "sync"
+
+type Server struct {
+	mu      sync.Mutex
+	statsMu sync.Mutex
+	n       int
+}
+
+// Handle acquires mu, then statsMu.
+func (s *Server) Handle() {
+	s.mu.Lock()
+	s.record()
+	s.mu.Unlock()
+}
+
+func (s *Server) record() {
+	s.statsMu.Lock()
+	s.n++
+	s.statsMu.Unlock()
+}
+
+// Stats acquires statsMu, then mu.
+func Stats(s *Server) int {
+	s.statsMu.Lock()
+	s.mu.Lock()
+	n := s.n
+	s.mu.Unlock()
+	s.statsMu.Unlock()
+	return n
+}
@@ -0,0 +1,61 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package runtime
+
+var lockA, lockB mutex
+
+func lockAB() {
+	lock(&lockA)
+	lock(&lockB)
+	unlock(&lockB)
+	unlock(&lockA)
+}
+
+func lockBA() {
+	lock(&lockB)
+	lock(&lockA)
+	unlock(&lockA)
+	unlock(&lockB)
+}
+
+func lockAA() {
+	lock(&lockA)
+	lock(&lockA)
+	unlock(&lockA)
+	unlock(&lockA)
+}
+
+// lockABBA finds the same cycle as lockAB and lockBA.
+func lockABBA() {
+	lockAB()
+	lockBA()
+}
+
+var lockC mutex
+
+// lockBC and lockCA form a cycle lockA -> lockB -> lockC -> lockA
+// with lockAB, but no pair of locks in it is directly inverted.
+func lockBC() {
+	lock(&lockB)
+	lock(&lockC)
+	unlock(&lockC)
+	unlock(&lockB)
+}
+
+func lockCA() {
+	lock(&lockC)
+	lock(&lockA)
+	unlock(&lockA)
+	unlock(&lockC)
+}
+
+// lockBA2 acquires lockA after lockB like lockBA, but on a different
+// path.
+func lockBA2() {
+	lock(&lockB)
+	lock(&lockA)
+	unlock(&lockA)
+	unlock(&lockB)
+}
@@ -0,0 +1,31 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package runtime
+
+var allocLock mutex
+
+type allocT struct{ x int }
+
+var allocSink *allocT
+
+var allocCount int
+
+// allocNew allocates with new while holding allocLock.
+func allocNew() {
+	lock(&allocLock)
+	allocSink = new(allocT)
+	unlock(&allocLock)
+}
+
+// allocCaptured captures a variable in a closure while holding
+// allocLock, which doesn't call newobject.
+func allocCaptured() {
+	lock(&allocLock)
+	n := allocCount
+	f := func() { n++ }
+	f()
+	allocCount = n
+	unlock(&allocLock)
+}
@@ -0,0 +1,64 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package runtime
+
+var assumeA, assumeB mutex
+
+var assumeN int
+
+var assumeP *mutex
+
+// assumeEq locks and unlocks under separate, but equivalent,
+// comparisons. Only the paths where both comparisons agree are
+// possible.
+func assumeEq() {
+	n := assumeN
+	if n == 0 {
+		lock(&assumeA)
+	}
+	lock(&assumeB)
+	unlock(&assumeB)
+	if n == 0 {
+		unlock(&assumeA)
+	}
+}
+
+// assumeNil does the same with a nil check written two ways.
+func assumeNil() {
+	p := assumeP
+	if p != nil {
+		return
+	}
+	lock(&assumeA)
+	if p == nil {
+		unlock(&assumeA)
+	}
+}
+
+// assumeNot negates a comparison before branching on it.
+func assumeNot() {
+	n := assumeN
+	ok := !(n == 1)
+	if ok {
+		return
+	}
+	lock(&assumeA)
+	if n == 1 {
+		unlock(&assumeA)
+	}
+}
+
+// assumeRange locks and unlocks under different, but equivalent,
+// integer comparisons.
+func assumeRange() {
+	n := assumeN
+	if n > 0 {
+		lock(&assumeA)
+	}
+	m := n - 1
+	if m >= 0 {
+		unlock(&assumeA)
+	}
+}
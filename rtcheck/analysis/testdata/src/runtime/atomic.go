@@ -0,0 +1,16 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package runtime
+
+import "runtime/internal/atomic"
+
+var atomicU32 uint32
+var atomicI64 int64
+
+func atomicOps() {
+	atomic.Loadacq(&atomicU32)
+	atomic.Xchgint64(&atomicI64, 1)
+	atomic.Xadd(&atomicU32, 1)
+}
@@ -0,0 +1,109 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package runtime
+
+var chanLock mutex
+
+var lockChan chan int
+
+// sendLocked may block on a channel send while holding chanLock. If
+// the receiver needs chanLock, this deadlocks.
+func sendLocked() {
+	lock(&chanLock)
+	lockChan <- 1
+	unlock(&chanLock)
+}
+
+// sendBuffered sends on a buffered channel with room, which doesn't
+// block.
+func sendBuffered() {
+	c := make(chan int, 1)
+	lock(&chanLock)
+	c <- 1
+	unlock(&chanLock)
+}
+
+// sendFull sends on a full buffered channel, which blocks.
+func sendFull() {
+	c := make(chan int, 1)
+	c <- 1
+	lock(&chanLock)
+	c <- 2
+	unlock(&chanLock)
+}
+
+// sendDrained sends on a buffered channel that was filled and then
+// drained, which doesn't block.
+func sendDrained() {
+	c := make(chan int, 1)
+	c <- 1
+	<-c
+	lock(&chanLock)
+	c <- 2
+	unlock(&chanLock)
+}
+
+// sendUnbuffered sends on an unbuffered channel, which blocks.
+func sendUnbuffered() {
+	c := make(chan int)
+	lock(&chanLock)
+	c <- 1
+	unlock(&chanLock)
+}
+
+// sendEscaped sends on a buffered channel after passing it to a
+// function that may have filled it.
+func sendEscaped() {
+	c := make(chan int, 1)
+	fillChan(c)
+	lock(&chanLock)
+	c <- 2
+	unlock(&chanLock)
+}
+
+func fillChan(c chan int) {
+	c <- 1
+}
+
+// recvLocked may block on a channel receive while holding chanLock.
+func recvLocked() {
+	lock(&chanLock)
+	<-lockChan
+	unlock(&chanLock)
+}
+
+// recvBuffered receives from a buffered channel with an element,
+// which doesn't block.
+func recvBuffered() {
+	c := make(chan int, 1)
+	c <- 1
+	lock(&chanLock)
+	<-c
+	unlock(&chanLock)
+}
+
+var selectChan chan int
+
+// selectLocked may block in a select while holding chanLock. Either
+// case may be the one that blocks.
+func selectLocked() {
+	lock(&chanLock)
+	select {
+	case lockChan <- 1:
+	case <-selectChan:
+	}
+	unlock(&chanLock)
+}
+
+// selectDefault never blocks because its select has a default case.
+func selectDefault() {
+	lock(&chanLock)
+	select {
+	case lockChan <- 1:
+	case <-selectChan:
+	default:
+	}
+	unlock(&chanLock)
+}
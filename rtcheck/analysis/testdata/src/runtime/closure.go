@@ -0,0 +1,74 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package runtime
+
+var closureA, closureB, closureOuter mutex
+
+var closureFlag bool
+
+func unlockClosureA() { unlock(&closureA) }
+func unlockClosureB() { unlock(&closureB) }
+
+// lockViaClosure picks the unlock function to call along with the
+// lock. The call graph says f could be either function, but on each
+// path only one is possible.
+func lockViaClosure() {
+	var f func()
+	if closureFlag {
+		lock(&closureA)
+		f = unlockClosureA
+	} else {
+		lock(&closureB)
+		f = unlockClosureB
+	}
+	f()
+
+	lock(&closureOuter)
+	unlock(&closureOuter)
+}
+
+var applyHeld, applyB, applyC mutex
+
+// applyLocked calls f with applyHeld held. The call graph says f
+// could be either lockApplyB or lockApplyC, but each caller passes
+// just one.
+func applyLocked(f func()) {
+	lock(&applyHeld)
+	f()
+	unlock(&applyHeld)
+}
+
+func lockApplyB() { lock(&applyB); unlock(&applyB) }
+func lockApplyC() { lock(&applyC); unlock(&applyC) }
+
+func applyOnlyB() { applyLocked(lockApplyB) }
+func applyOnlyC() { applyLocked(lockApplyC) }
+
+func applyBoth() {
+	applyLocked(lockApplyB)
+	applyLocked(lockApplyC)
+}
+
+// closureFunc's method values capture the function to call.
+type closureFunc func()
+
+func (f closureFunc) call() { f() }
+
+// lockViaMethodValue is like lockViaClosure, but calls the unlock
+// function through a method value, whose closure binds it.
+func lockViaMethodValue() {
+	var f func()
+	if closureFlag {
+		lock(&closureA)
+		f = closureFunc(unlockClosureA).call
+	} else {
+		lock(&closureB)
+		f = closureFunc(unlockClosureB).call
+	}
+	f()
+
+	lock(&closureOuter)
+	unlock(&closureOuter)
+}
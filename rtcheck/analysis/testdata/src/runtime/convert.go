@@ -0,0 +1,29 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package runtime
+
+var convertLock mutex
+
+var convertSink *[4]int
+
+func convertUnguarded(s []int) {
+	lock(&convertLock)
+	convertSink = (*[4]int)(s)
+	unlock(&convertLock)
+}
+
+func convertGuarded(s []int) {
+	lock(&convertLock)
+	if len(s) >= 4 {
+		convertSink = (*[4]int)(s)
+	}
+	unlock(&convertLock)
+}
+
+func convertEmpty(s []int) {
+	lock(&convertLock)
+	_ = (*[0]int)(s)
+	unlock(&convertLock)
+}
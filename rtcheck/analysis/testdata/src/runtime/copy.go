@@ -0,0 +1,24 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package runtime
+
+var copyLock mutex
+
+type copyPtrs struct {
+	n int
+	p *int
+}
+
+func copyScalars(dst, src []int) {
+	lock(&copyLock)
+	copy(dst, src)
+	unlock(&copyLock)
+}
+
+func copyPointers(dst, src []copyPtrs) {
+	lock(&copyLock)
+	copy(dst, src)
+	unlock(&copyLock)
+}
@@ -0,0 +1,31 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package runtime
+
+var corrA, corrB mutex
+
+var corrFlag bool
+
+// corrAB only holds corrA while acquiring corrB if it's taken both
+// branches, which it can't. A path-insensitive analysis would report
+// a cycle with corrBA.
+func corrAB() {
+	c := corrFlag
+	if c {
+		lock(&corrA)
+	}
+	if c {
+		unlock(&corrA)
+	}
+	lock(&corrB)
+	unlock(&corrB)
+}
+
+func corrBA() {
+	lock(&corrB)
+	lock(&corrA)
+	unlock(&corrA)
+	unlock(&corrB)
+}
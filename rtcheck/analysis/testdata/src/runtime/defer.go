@@ -0,0 +1,61 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package runtime
+
+var deferA, deferB mutex
+
+// deferUnlockAB and lockBA form an AB-BA cycle where the unlock of A
+// is deferred.
+func deferUnlockAB() {
+	lock(&deferA)
+	defer unlock(&deferA)
+	lock(&deferB)
+	unlock(&deferB)
+}
+
+func deferLockBA() {
+	lock(&deferB)
+	lock(&deferA)
+	unlock(&deferA)
+	unlock(&deferB)
+}
+
+var deferC mutex
+
+// deferLIFO defers a call that acquires deferC after deferring the
+// unlock of deferA. Deferred calls run last-in first-out, so deferC
+// is acquired while deferA is still held.
+func deferLIFO() {
+	lock(&deferA)
+	defer unlock(&deferA)
+	defer deferLockC()
+}
+
+func deferLockC() {
+	lock(&deferC)
+	unlock(&deferC)
+}
+
+// deferClosure releases deferA from a deferred closure.
+func deferClosure() {
+	lock(&deferA)
+	defer func() {
+		unlock(&deferA)
+	}()
+}
+
+var deferCondFlag bool
+
+// deferCond locks deferA and defers its unlock only on one branch.
+// deferA is held until return on that path, so deferC is acquired
+// while it's held.
+func deferCond() {
+	if deferCondFlag {
+		lock(&deferA)
+		defer unlock(&deferA)
+	}
+	lock(&deferC)
+	unlock(&deferC)
+}
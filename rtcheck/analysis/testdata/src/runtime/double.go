@@ -0,0 +1,20 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package runtime
+
+var doubleL mutex
+
+// doubleLockOuter calls doubleLockInner, which acquires doubleL
+// again.
+func doubleLockOuter() {
+	lock(&doubleL)
+	doubleLockInner()
+	unlock(&doubleL)
+}
+
+func doubleLockInner() {
+	lock(&doubleL)
+	unlock(&doubleL)
+}
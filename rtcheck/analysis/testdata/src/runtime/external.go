@@ -0,0 +1,24 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package runtime
+
+// futexwaitExt and cputicksExt have no bodies and no stubs, so
+// they're external functions. futexwaitExt looks like it may block.
+func futexwaitExt()
+func cputicksExt() int64
+
+func callExternal() {
+	futexwaitExt()
+	cputicksExt()
+}
+
+var externalLock mutex
+
+// lockExternal calls an external function while holding externalLock.
+func lockExternal() {
+	lock(&externalLock)
+	cputicksExt()
+	unlock(&externalLock)
+}
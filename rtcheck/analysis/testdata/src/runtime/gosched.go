@@ -0,0 +1,30 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package runtime
+
+var goschedLock, goschedQueueLock mutex
+
+func gosched_m(gp *g) {
+	goschedImpl(gp)
+}
+
+func goschedImpl(gp *g) {
+	lock(&goschedQueueLock)
+	unlock(&goschedQueueLock)
+}
+
+// goschedHeld yields while holding goschedLock.
+func goschedHeld() {
+	lock(&goschedLock)
+	mcall(gosched_m)
+	unlock(&goschedLock)
+}
+
+// goschedReleased releases goschedLock before yielding.
+func goschedReleased() {
+	lock(&goschedLock)
+	unlock(&goschedLock)
+	mcall(gosched_m)
+}
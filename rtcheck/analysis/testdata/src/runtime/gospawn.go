@@ -0,0 +1,31 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package runtime
+
+var spawnLock mutex
+
+func spawnLocked() {
+	lock(&spawnLock)
+	go spawned()
+	unlock(&spawnLock)
+}
+
+func spawnUnlocked() {
+	go spawned()
+}
+
+func spawned() {}
+
+// spawnEdge starts a goroutine that orders spawnLock before lockA.
+func spawnEdge() {
+	go spawnedEdge()
+}
+
+func spawnedEdge() {
+	lock(&spawnLock)
+	lock(&lockA)
+	unlock(&lockA)
+	unlock(&spawnLock)
+}
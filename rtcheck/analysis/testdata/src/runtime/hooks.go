@@ -0,0 +1,18 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package runtime
+
+var hookLock mutex
+
+// hook is never assigned, so calls to it have no known callees.
+var hook func()
+
+func callHookLocked() {
+	lock(&hookLock)
+	if hook != nil {
+		hook()
+	}
+	unlock(&hookLock)
+}
@@ -0,0 +1,46 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package runtime
+
+var ifaceLock mutex
+
+type ifaceStringer interface {
+	String() string
+}
+
+var ifaceSink interface{}
+
+func boxInt(x int) {
+	lock(&ifaceLock)
+	ifaceSink = x
+	unlock(&ifaceLock)
+}
+
+func boxPointer(x *int) {
+	lock(&ifaceLock)
+	ifaceSink = x
+	unlock(&ifaceLock)
+}
+
+func assertConcrete(x interface{}) int {
+	lock(&ifaceLock)
+	n := x.(int)
+	unlock(&ifaceLock)
+	return n
+}
+
+func assertConcreteOk(x interface{}) int {
+	lock(&ifaceLock)
+	n, _ := x.(int)
+	unlock(&ifaceLock)
+	return n
+}
+
+func assertIface(x interface{}) ifaceStringer {
+	lock(&ifaceLock)
+	s, _ := x.(ifaceStringer)
+	unlock(&ifaceLock)
+	return s
+}
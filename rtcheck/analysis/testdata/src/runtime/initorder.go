@@ -0,0 +1,24 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package runtime
+
+type mheap struct {
+	lock mutex
+}
+
+var mheap_ mheap
+
+func mallocinit() {}
+
+func schedinit() {
+	// Too early.
+	lock(&mheap_.lock)
+	unlock(&mheap_.lock)
+
+	mallocinit()
+
+	lock(&mheap_.lock)
+	unlock(&mheap_.lock)
+}
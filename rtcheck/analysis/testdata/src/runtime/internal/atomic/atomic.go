@@ -0,0 +1,24 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package atomic
+
+func Load(ptr *uint32) uint32
+
+func LoadAdd(ptr *uint32, delta uint32) uint32 {
+	return Load(ptr) + delta
+}
+
+//go:nosplit
+func LoadNosplit(ptr *uint32) uint32 {
+	return Load(ptr)
+}
+
+func Loadacq(ptr *uint32) uint32
+
+func Xchgint64(ptr *int64, new int64) int64
+
+// Xadd's parameter is named differently than in its stub, so the stub
+// can't be used.
+func Xadd(addr *uint32, delta int32) uint32
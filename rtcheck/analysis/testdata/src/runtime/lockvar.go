@@ -0,0 +1,23 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package runtime
+
+var lockVarA, lockVarB, lockVarOuter mutex
+
+var lockVarFlag bool
+
+// lockViaVar locks whichever global l points to on each path. l is a
+// phi, which has no lock class of its own, but the value state knows
+// which global it is.
+func lockViaVar() {
+	l := &lockVarA
+	if lockVarFlag {
+		l = &lockVarB
+	}
+	lock(l)
+	lock(&lockVarOuter)
+	unlock(&lockVarOuter)
+	unlock(l)
+}
@@ -0,0 +1,41 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package runtime
+
+var loopA, loopB mutex
+
+// lockLoop acquires loopB under loopA only on late iterations of a
+// loop with several break and continue targets.
+func lockLoop() {
+	for i := 0; i < 100; i++ {
+		if i == 50 {
+			continue
+		}
+		lock(&loopA)
+		if i > 90 {
+			lock(&loopB)
+			unlock(&loopB)
+		}
+		unlock(&loopA)
+		if i == 95 {
+			break
+		}
+	}
+}
+
+var countLock mutex
+
+var countN, countSum int
+
+// countLoop runs a counting loop with a lock held. The loop condition
+// doesn't decide whether any lock operation runs, so the loop counter
+// shouldn't split path states.
+func countLoop() {
+	lock(&countLock)
+	for i := 0; i < countN; i++ {
+		countSum += i
+	}
+	unlock(&countLock)
+}
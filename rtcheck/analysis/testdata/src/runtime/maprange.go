@@ -0,0 +1,27 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package runtime
+
+var rangeLock mutex
+
+func rangeMap(m map[int]int) int {
+	lock(&rangeLock)
+	n := 0
+	for k := range m {
+		n += k
+	}
+	unlock(&rangeLock)
+	return n
+}
+
+func rangeString(s string) int {
+	lock(&rangeLock)
+	n := 0
+	for _, r := range s {
+		n += int(r)
+	}
+	unlock(&rangeLock)
+	return n
+}
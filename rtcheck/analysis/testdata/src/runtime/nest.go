@@ -0,0 +1,17 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package runtime
+
+var nestA, nestB, nestC mutex
+
+// lockNest3 holds three locks at once.
+func lockNest3() {
+	lock(&nestA)
+	lock(&nestB)
+	lock(&nestC)
+	unlock(&nestC)
+	unlock(&nestB)
+	unlock(&nestA)
+}
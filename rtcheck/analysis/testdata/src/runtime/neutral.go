@@ -0,0 +1,28 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package runtime
+
+var neutralLock mutex
+
+//go:nosplit
+func neutralSum(xs []int) int {
+	n := 0
+	for _, x := range xs {
+		n += x
+	}
+	return n
+}
+
+//go:nosplit
+func neutralCaller(xs []int) int {
+	return neutralSum(xs)
+}
+
+func lockNeutral(xs []int) int {
+	lock(&neutralLock)
+	n := neutralCaller(xs)
+	unlock(&neutralLock)
+	return n
+}
@@ -0,0 +1,31 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package runtime
+
+var noteLock mutex
+
+var noteN note
+
+// noteSleepLocked sleeps on noteN while holding noteLock.
+func noteSleepLocked() {
+	lock(&noteLock)
+	notesleep(&noteN)
+	unlock(&noteLock)
+}
+
+// noteTsleepLocked sleeps on noteN with a timeout while holding
+// noteLock.
+func noteTsleepLocked() {
+	lock(&noteLock)
+	notetsleep(&noteN, 1000)
+	unlock(&noteLock)
+}
+
+// noteWakeupLocked needs noteLock to wake noteN.
+func noteWakeupLocked() {
+	lock(&noteLock)
+	notewakeup(&noteN)
+	unlock(&noteLock)
+}
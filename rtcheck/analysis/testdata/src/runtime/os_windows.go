@@ -0,0 +1,15 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package runtime
+
+var osLockA, osLockB mutex
+
+// lockOS acquires osLockB, then osLockA on Windows.
+func lockOS() {
+	lock(&osLockB)
+	lock(&osLockA)
+	unlock(&osLockA)
+	unlock(&osLockB)
+}
@@ -0,0 +1,21 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package runtime
+
+type ovNode struct {
+	mu mutex
+}
+
+var ovParent, ovChild *ovNode
+
+// ovLockChild locks the child node while holding its parent. Both
+// locks are in class ovNode.mu*, so this looks like a double lock
+// unless the child's lock is given its own class.
+func ovLockChild() {
+	lock(&ovParent.mu)
+	lock(&ovChild.mu)
+	unlock(&ovChild.mu)
+	unlock(&ovParent.mu)
+}
@@ -0,0 +1,40 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package runtime
+
+var parkLock, parkOtherLock mutex
+
+// parkUnlock releases parkLock before parking, which is fine.
+func parkUnlock() {
+	lock(&parkLock)
+	goparkunlock(&parkLock, "park")
+}
+
+// parkHeld parks while still holding parkOtherLock.
+func parkHeld() {
+	lock(&parkOtherLock)
+	lock(&parkLock)
+	goparkunlock(&parkLock, "park")
+	unlock(&parkOtherLock)
+}
+
+// parkCallback releases parkLock from gopark's unlock function, which
+// runs after the goroutine has parked.
+func parkCallback() {
+	lock(&parkLock)
+	gopark(parkUnlockf, &parkLock, "park")
+}
+
+func parkUnlockf(gp *g, l *mutex) bool {
+	unlock(&parkLock)
+	return true
+}
+
+// parkNil parks with no unlock function while holding parkLock.
+func parkNil() {
+	lock(&parkLock)
+	gopark(nil, nil, "park")
+	unlock(&parkLock)
+}
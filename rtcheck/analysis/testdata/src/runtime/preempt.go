@@ -0,0 +1,78 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package runtime
+
+var preemptNote note
+
+func acquiremBalanced() {
+	mp := acquirem()
+	releasem(mp)
+}
+
+func acquiremLeak() {
+	acquirem()
+}
+
+func acquiremBlock() {
+	mp := acquirem()
+	notesleep(&preemptNote)
+	releasem(mp)
+}
+
+// acquiremCallee acquires the M in a callee. The callee's effect on
+// m.locks is visible here, so notesleep blocks with the M acquired.
+func acquiremCallee() {
+	mp := acquiremHelper()
+	notesleep(&preemptNote)
+	releasem(mp)
+}
+
+func acquiremHelper() *m {
+	return acquirem()
+}
+
+var mlocksA, mlocksB mutex
+
+// releasemUnbalanced releases the M more times than m.locks allows,
+// so the path can't happen and it never acquires mlocksB while
+// holding mlocksA.
+func releasemUnbalanced() {
+	lock(&mlocksA)
+	releasem(getg().m)
+	releasem(getg().m)
+	lock(&mlocksB)
+	unlock(&mlocksB)
+	unlock(&mlocksA)
+}
+
+var preemptoffLock mutex
+
+func preemptoffSet() {
+	mp := acquirem()
+	mp.preemptoff = "preemptoffSet"
+	lock(&preemptoffLock)
+	unlock(&preemptoffLock)
+	mp.preemptoff = ""
+	releasem(mp)
+}
+
+func preemptoffUnset() {
+	lock(&preemptoffLock)
+	unlock(&preemptoffLock)
+}
+
+var acquiremLoopLock mutex
+
+// acquiremLoop acquires the M a varying number of times, so m.locks
+// differs between loop iterations and is widened away at the loop
+// header. Locking afterward must cope with m.locks being unknown.
+func acquiremLoop(n int) {
+	for i := 0; i < n; i++ {
+		acquirem()
+	}
+	lock(&acquiremLoopLock)
+	unlock(&acquiremLoopLock)
+	releasem(getg().m)
+}
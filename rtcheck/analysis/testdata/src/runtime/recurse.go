@@ -0,0 +1,32 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package runtime
+
+func lockRecursive(n int) {
+	if n > 0 {
+		lockRecursive(n - 1)
+	}
+	lock(&lockA)
+	unlock(&lockA)
+}
+
+var noExitLock mutex
+
+// lockNoExit never returns because its only path double locks.
+func lockNoExit() {
+	lock(&noExitLock)
+	lock(&noExitLock)
+}
+
+// lockNoExitTwice calls lockNoExit on two paths with the same entry
+// state. The second call reuses the cached empty set of exit states,
+// which doesn't make it a recursive call.
+func lockNoExitTwice(b bool) {
+	if b {
+		lockNoExit()
+	} else {
+		lockNoExit()
+	}
+}
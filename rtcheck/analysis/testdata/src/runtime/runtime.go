@@ -0,0 +1,91 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package runtime is a minimal stand-in for the real runtime. It
+// defines just enough for rtcheck to analyze the test cases in the
+// other files of this package.
+package runtime
+
+type mutex struct{ key uintptr }
+
+type note struct{ key uintptr }
+
+type g struct {
+	m *m
+}
+
+type m struct {
+	curg, g0   *g
+	locks      int32
+	printlock  int8
+	preemptoff string
+}
+
+func getg() *g
+
+func lock(l *mutex)   {}
+func unlock(l *mutex) {}
+
+func notesleep(n *note)                 {}
+func notetsleep(n *note, ns int64) bool { return false }
+func notewakeup(n *note)                {}
+
+// semaRootLock stands in for semaRoot.lock, which semacquire and
+// semrelease take to queue and dequeue waiters.
+var semaRootLock mutex
+
+func semacquire(addr *uint32) { lock(&semaRootLock); unlock(&semaRootLock) }
+func semrelease(addr *uint32) { lock(&semaRootLock); unlock(&semaRootLock) }
+
+func acquirem() *m   { return getg().m }
+func releasem(mp *m) {}
+
+func morestack() {}
+func newstack()  {}
+
+func newobject()       { lock(&newobjectLock); unlock(&newobjectLock) }
+func newarray()        {}
+func makemap()         {}
+func makechan()        {}
+func growslice()       {}
+func slicecopy()       { lock(&slicecopyLock); unlock(&slicecopyLock) }
+func slicestringcopy() {}
+func typedslicecopy()  { lock(&typedslicecopyLock); unlock(&typedslicecopyLock) }
+func mapaccess1()      {}
+func mapaccess2()      {}
+func mapassign()       {}
+func mapdelete()       {}
+func mapiterinit()     { lock(&mapiterinitLock); unlock(&mapiterinitLock) }
+func mapiternext()     { lock(&mapiternextLock); unlock(&mapiternextLock) }
+func convT2E()         { lock(&convLock); unlock(&convLock) }
+func convT2I()         { lock(&convLock); unlock(&convLock) }
+func convI2I()         { lock(&convLock); unlock(&convLock) }
+func assertE2I()       { lock(&assertLock); unlock(&assertLock) }
+func assertE2I2()      { lock(&assertLock); unlock(&assertLock) }
+func assertI2I()       { lock(&assertLock); unlock(&assertLock) }
+func assertI2I2()      { lock(&assertLock); unlock(&assertLock) }
+func chansend1()       {}
+func closechan()       {}
+func gopanic()         { lock(&panicLock); unlock(&panicLock) }
+
+// newobjectLock makes it possible to tell if new was modeled.
+var newobjectLock mutex
+
+// slicecopyLock and typedslicecopyLock make it possible to tell
+// which copy function was called.
+var slicecopyLock, typedslicecopyLock mutex
+
+// mapiterinitLock and mapiternextLock make it possible to tell if
+// map iteration was modeled.
+var mapiterinitLock, mapiternextLock mutex
+
+// convLock and assertLock make it possible to tell if interface
+// conversions and assertions were modeled.
+var convLock, assertLock mutex
+
+// panicLock makes it possible to tell if gopanic was called.
+var panicLock mutex
+
+// main is required by the pointer analysis.
+func main() {}
@@ -0,0 +1,69 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package runtime
+
+// rwmutex is a simplified version of the runtime's reader/writer
+// lock. rtcheck models its methods directly, so their bodies aren't
+// analyzed.
+type rwmutex struct {
+	rLock mutex
+	wLock mutex
+}
+
+var rwLock rwmutex
+
+var rwOtherLock mutex
+
+func (rw *rwmutex) rlock() {
+	acquirem()
+	lock(&rw.rLock)
+	unlock(&rw.rLock)
+}
+
+func (rw *rwmutex) runlock() {}
+
+func (rw *rwmutex) lock() {
+	lock(&rw.wLock)
+	lock(&rw.rLock)
+	unlock(&rw.rLock)
+}
+
+func (rw *rwmutex) unlock() {
+	unlock(&rw.wLock)
+}
+
+// rlockThenLock deadlocks because a writer must wait for all
+// readers, including this one.
+func rlockThenLock() {
+	rwLock.rlock()
+	rwLock.lock()
+	rwLock.unlock()
+	rwLock.runlock()
+}
+
+// rlockTwice acquires two read locks on rwLock, which is fine.
+func rlockTwice() {
+	rwLock.rlock()
+	rwLock.rlock()
+	rwLock.runlock()
+	rwLock.runlock()
+}
+
+// rlockOrder acquires rwOtherLock while reading rwLock, and
+// rlockOrderRev write-locks rwLock while holding rwOtherLock. This
+// deadlocks because the writer waits for the reader.
+func rlockOrder() {
+	rwLock.rlock()
+	lock(&rwOtherLock)
+	unlock(&rwOtherLock)
+	rwLock.runlock()
+}
+
+func rlockOrderRev() {
+	lock(&rwOtherLock)
+	rwLock.lock()
+	rwLock.unlock()
+	unlock(&rwOtherLock)
+}
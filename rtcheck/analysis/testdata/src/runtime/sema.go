@@ -0,0 +1,33 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package runtime
+
+var semaLock mutex
+
+var semaA uint32
+
+// semaThenLock acquires semaLock while holding semaA.
+func semaThenLock() {
+	semacquire(&semaA)
+	lock(&semaLock)
+	unlock(&semaLock)
+	semrelease(&semaA)
+}
+
+// lockThenSema acquires semaA while holding semaLock.
+func lockThenSema() {
+	lock(&semaLock)
+	semacquire(&semaA)
+	semrelease(&semaA)
+	unlock(&semaLock)
+}
+
+// semaSignal releases semaA without acquiring it, as when waking a
+// waiter.
+func semaSignal() {
+	lock(&semaLock)
+	semrelease(&semaA)
+	unlock(&semaLock)
+}
@@ -0,0 +1,48 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package runtime
+
+// sysLock must only be held on the system stack and userLock only on
+// a user stack.
+var sysLock, userLock mutex
+
+func sysLockSystem() {
+	systemstack(func() {
+		lock(&sysLock)
+		unlock(&sysLock)
+	})
+}
+
+func sysLockUser() {
+	lock(&sysLock)
+	unlock(&sysLock)
+}
+
+// sysLockReturn returns to the user stack with sysLock held.
+func sysLockReturn() {
+	systemstack(func() {
+		lock(&sysLock)
+	})
+	unlock(&sysLock)
+}
+
+func userLockUser() {
+	lock(&userLock)
+	unlock(&userLock)
+}
+
+func userLockSystem() {
+	systemstack(func() {
+		lock(&userLock)
+		unlock(&userLock)
+	})
+}
+
+// userLockSwitch switches to the system stack with userLock held.
+func userLockSwitch() {
+	lock(&userLock)
+	systemstack(func() {})
+	unlock(&userLock)
+}
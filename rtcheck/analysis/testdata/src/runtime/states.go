@@ -0,0 +1,51 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package runtime
+
+var statesLock mutex
+
+var statesA, statesB, statesC bool
+
+// manyStates reaches its final block with 8 path states that have
+// the same lock set, but different value states.
+func manyStates() {
+	a, b, c := statesA, statesB, statesC
+	if a {
+		println()
+	}
+	if b {
+		println()
+	}
+	if c {
+		println()
+	}
+	lock(&statesLock)
+	unlock(&statesLock)
+	// Keep a, b, and c live. Only branches that decide whether
+	// a lock operation runs keep their values live.
+	if a == b && b == c {
+		lock(&statesLock)
+		unlock(&statesLock)
+	}
+}
+
+// manyAcquirem holds more locks than the analysis tracks, so its
+// path is trimmed before it acquires statesLock.
+// It doesn't loop, since widening would forget m.locks.
+func manyAcquirem() {
+	acquirem4()
+	acquirem4()
+	acquirem4()
+	acquirem4()
+	lock(&statesLock)
+	unlock(&statesLock)
+}
+
+func acquirem4() {
+	acquirem()
+	acquirem()
+	acquirem()
+	acquirem()
+}
@@ -0,0 +1,16 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package runtime
+
+var stubLockA, stubLockB mutex
+
+// stubbed has no body. TestAnalyze supplies a stub for it.
+func stubbed()
+
+func lockStubbed() {
+	lock(&stubLockA)
+	stubbed()
+	unlock(&stubLockA)
+}
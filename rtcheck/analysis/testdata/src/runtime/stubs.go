@@ -0,0 +1,14 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package runtime
+
+// rtcheck declares its rewriting helpers in stubs.go. The real
+// runtime passes gopark an unsafe.Pointer, but there is no package
+// unsafe here.
+
+func gopark(unlockf func(*g, *mutex) bool, lock *mutex, reason string) {}
+func goparkunlock(lock *mutex, reason string)                          {}
+
+func mcall(fn func(*g)) {}
@@ -0,0 +1,27 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package runtime
+
+var synthA, synthB mutex
+
+type synthInner struct{}
+
+func (synthInner) lockB() {
+	lock(&synthB)
+	unlock(&synthB)
+}
+
+// synthOuter's lockB method is a synthesized wrapper that calls
+// synthInner.lockB.
+type synthOuter struct {
+	synthInner
+}
+
+func lockSynthetic() {
+	var e synthOuter
+	lock(&synthA)
+	(*synthOuter).lockB(&e)
+	unlock(&synthA)
+}
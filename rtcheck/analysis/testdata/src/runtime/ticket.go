@@ -0,0 +1,41 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package runtime
+
+// ticketLock is a custom lock that rtcheck doesn't know about unless
+// it's registered as a Primitive.
+type ticketLock struct {
+	next, serving uint32
+}
+
+func (t *ticketLock) acquire() {}
+func (t *ticketLock) release() {}
+
+// waitq is a custom blocking primitive.
+type waitq struct{ n int }
+
+func (q *waitq) wait() {}
+
+type ticketed struct {
+	tl ticketLock
+	wq waitq
+}
+
+var ticketObj ticketed
+
+var ticketMu mutex
+
+func ticketThenMutex() {
+	ticketObj.tl.acquire()
+	lock(&ticketMu)
+	unlock(&ticketMu)
+	ticketObj.tl.release()
+}
+
+func mutexThenWait() {
+	lock(&ticketMu)
+	ticketObj.wq.wait()
+	unlock(&ticketMu)
+}
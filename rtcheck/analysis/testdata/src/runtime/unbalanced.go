@@ -0,0 +1,33 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package runtime
+
+var unbalA mutex
+
+var unbalFlag bool
+
+// unbalTryLock returns with unbalA held only if it returns true.
+func unbalTryLock() bool {
+	if !unbalFlag {
+		return false
+	}
+	lock(&unbalA)
+	return true
+}
+
+// unbalBalanced acquires and releases unbalA on every path.
+func unbalBalanced() {
+	if unbalFlag {
+		lock(&unbalA)
+		unlock(&unbalA)
+	}
+}
+
+func unbalRoot() {
+	if unbalTryLock() {
+		unlock(&unbalA)
+	}
+	unbalBalanced()
+}
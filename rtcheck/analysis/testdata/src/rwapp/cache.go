@@ -0,0 +1,49 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package rwapp is a non-runtime package for testing sync.RWMutex
+// handling.
+package rwapp
+
+import "sync"
+
+type Cache struct {
+	rw sync.RWMutex
+	mu sync.Mutex
+	m  map[string]int
+}
+
+// Get read-locks rw twice, which isn't a self-deadlock.
+func (c *Cache) Get(k string) int {
+	c.rw.RLock()
+	v := c.peek(k)
+	c.rw.RUnlock()
+	return v
+}
+
+func (c *Cache) peek(k string) int {
+	c.rw.RLock()
+	v := c.m[k]
+	c.rw.RUnlock()
+	return v
+}
+
+// Put acquires rw, then mu.
+func (c *Cache) Put(k string, v int) {
+	c.rw.Lock()
+	c.mu.Lock()
+	c.m[k] = v
+	c.mu.Unlock()
+	c.rw.Unlock()
+}
+
+// Flush acquires mu, then read-locks rw. This deadlocks with Put
+// because readers wait for writers.
+func (c *Cache) Flush() {
+	c.mu.Lock()
+	c.rw.RLock()
+	c.m = nil
+	c.rw.RUnlock()
+	c.mu.Unlock()
+}
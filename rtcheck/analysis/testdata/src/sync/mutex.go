@@ -0,0 +1,29 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package sync is a minimal stand-in for the real sync package for
+// testing -packages.
+package sync
+
+type Locker interface {
+	Lock()
+	Unlock()
+}
+
+type Mutex struct {
+	state int32
+}
+
+func (m *Mutex) Lock()   {}
+func (m *Mutex) Unlock() {}
+
+type RWMutex struct {
+	w           Mutex
+	readerCount int32
+}
+
+func (rw *RWMutex) Lock()    {}
+func (rw *RWMutex) Unlock()  {}
+func (rw *RWMutex) RLock()   {}
+func (rw *RWMutex) RUnlock() {}
@@ -0,0 +1,43 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package synthapp is a non-runtime package for testing how dynamic
+// calls to synthesized wrappers are resolved.
+package synthapp
+
+import "sync"
+
+var outerMu, innerMu sync.Mutex
+
+type inner struct{}
+
+func (inner) lockInner() {
+	innerMu.Lock()
+	innerMu.Unlock()
+}
+
+// outer's lockInner method is a synthesized wrapper that calls
+// inner.lockInner. Only outer implements locker, so every callee of
+// a locker's lockInner is a wrapper.
+type outer struct {
+	inner
+}
+
+func (outer) outerOnly() {}
+
+type locker interface {
+	lockInner()
+	outerOnly()
+}
+
+// defaultLocker makes outer a runtime type, so the call graph
+// considers it a callee of locker's methods.
+var defaultLocker locker = outer{}
+
+// Run calls lockInner with outerMu held.
+func Run(l locker) {
+	outerMu.Lock()
+	l.lockInner()
+	outerMu.Unlock()
+}
@@ -0,0 +1,49 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package analysis
+
+import (
+	"fmt"
+	"io"
+
+	"golang.org/x/tools/go/ssa"
+)
+
+// traceNewEdge is called when edge is added to the lock graph for the
+// first time. If it's the edge named by s.opts.traceEdge, this
+// records the trail of blocks and the call stack that led to it.
+func (s *state) traceNewEdge(edge lockOrderEdge) {
+	if s.edgeTrail != nil {
+		return
+	}
+	lo := s.lockOrder
+	if !lockNameMatches(lo.name(edge.fromId), s.opts.traceEdge[0]) || !lockNameMatches(lo.name(edge.toId), s.opts.traceEdge[1]) {
+		return
+	}
+	s.edgeTrail = append([]*ssa.BasicBlock(nil), s.trail...)
+	s.edgeStack = s.stack
+	s.edgeName = [2]string{lo.name(edge.fromId), lo.name(edge.toId)}
+}
+
+// writeEdgeTrace writes the trail recorded by traceNewEdge to w: the
+// call stack, then the blocks walked in each active function, from
+// the root to the block that acquired the second lock.
+func (s *state) writeEdgeTrace(w io.Writer) {
+	if s.edgeTrail == nil {
+		fmt.Fprintf(w, "no path acquired %s while holding %s\n", s.opts.traceEdge[1], s.opts.traceEdge[0])
+		return
+	}
+	fmt.Fprintf(w, "first path that acquired %s while holding %s:\n", s.edgeName[1], s.edgeName[0])
+	fmt.Fprintf(w, "  call stack:\n%s\n", s.stackString(s.edgeStack))
+	fmt.Fprintf(w, "  blocks walked:\n")
+	var fn *ssa.Function
+	for _, b := range s.edgeTrail {
+		if b.Parent() != fn {
+			fn = b.Parent()
+			fmt.Fprintf(w, "    %s\n", fn)
+		}
+		fmt.Fprintf(w, "      block %d at %s\n", b.Index, s.fset.Position(blockPos(b)))
+	}
+}
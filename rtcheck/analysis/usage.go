@@ -0,0 +1,147 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package analysis
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/go/ssa"
+)
+
+// lockUsage aggregates how a single lock class is used across all
+// explored paths, independent of whether it participates in a cycle.
+type lockUsage struct {
+	// acquiredIn is the set of functions that directly acquire
+	// the lock.
+	acquiredIn map[*ssa.Function]struct{}
+	// heldWith is the set of lock class IDs held when the lock
+	// is acquired.
+	heldWith map[int]struct{}
+	// blocking is the set of blocking functions called while the
+	// lock is held.
+	blocking map[*ssa.Function]struct{}
+}
+
+// usageOf returns the lockUsage for lock class id, creating it if
+// necessary.
+func (s *state) usageOf(id int) *lockUsage {
+	u := s.usage[id]
+	if u == nil {
+		u = &lockUsage{
+			acquiredIn: make(map[*ssa.Function]struct{}),
+			heldWith:   make(map[int]struct{}),
+			blocking:   make(map[*ssa.Function]struct{}),
+		}
+		s.usage[id] = u
+	}
+	return u
+}
+
+// recordAcquire records that lock is acquired at instr while the
+// locks in held are held.
+func (s *state) recordAcquire(held *LockSet, lock *LockClass, instr ssa.Instruction) {
+	if s.usage == nil {
+		return
+	}
+	u := s.usageOf(lock.Id())
+	u.acquiredIn[instr.Parent()] = struct{}{}
+	for _, l := range held.locks {
+		if l.id != lock.Id() {
+			u.heldWith[l.id] = struct{}{}
+		}
+	}
+}
+
+// recordBlocking records that blocking function fn is called while
+// the locks in held are held.
+func (s *state) recordBlocking(held *LockSet, fn *ssa.Function) {
+	if s.usage == nil {
+		return
+	}
+	for _, l := range held.locks {
+		s.usageOf(l.id).blocking[fn] = struct{}{}
+	}
+}
+
+// jsonUsage is the JSON form of a lockUsage.
+type jsonUsage struct {
+	Lock string `json:"lock"`
+	// AcquiredIn is the sorted names of functions that acquire
+	// Lock.
+	AcquiredIn []string `json:"acquiredIn"`
+	// HeldWhenAcquired is the sorted names of locks that may be
+	// held when Lock is acquired.
+	HeldWhenAcquired []string `json:"heldWhenAcquired"`
+	// HeldAcrossBlocking is the sorted names of blocking
+	// functions that may be called with Lock held.
+	HeldAcrossBlocking []string `json:"heldAcrossBlocking"`
+}
+
+// usageReport returns the lock usage summary, sorted by lock name.
+func (s *state) usageReport() []jsonUsage {
+	fnNames := func(m map[*ssa.Function]struct{}) []string {
+		out := []string{}
+		for fn := range m {
+			out = append(out, fn.String())
+		}
+		sort.Strings(out)
+		return out
+	}
+	var out []jsonUsage
+	for id, u := range s.usage {
+		held := []string{}
+		for id := range u.heldWith {
+			held = append(held, s.lca.Lookup(id).String())
+		}
+		sort.Strings(held)
+		out = append(out, jsonUsage{
+			Lock:               s.lca.Lookup(id).String(),
+			AcquiredIn:         fnNames(u.acquiredIn),
+			HeldWhenAcquired:   held,
+			HeldAcrossBlocking: fnNames(u.blocking),
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Lock < out[j].Lock })
+	return out
+}
+
+// WriteUsage writes a text lock usage report to w. Locks held across
+// blocking operations are flagged, since they are prone to becoming
+// part of a deadlock.
+func (s *state) WriteUsage(w io.Writer) {
+	fmt.Fprintf(w, "lock usage:\n")
+	list := func(l []string) string {
+		if len(l) == 0 {
+			return "(none)"
+		}
+		return strings.Join(l, ", ")
+	}
+	for _, u := range s.usageReport() {
+		fmt.Fprintf(w, "  %s\n", u.Lock)
+		fmt.Fprintf(w, "    acquired in: %s\n", list(u.AcquiredIn))
+		fmt.Fprintf(w, "    held when acquired: %s\n", list(u.HeldWhenAcquired))
+		if len(u.HeldAcrossBlocking) > 0 {
+			fmt.Fprintf(w, "    HELD ACROSS BLOCKING: %s\n", list(u.HeldAcrossBlocking))
+		}
+	}
+}
+
+// WriteUsageJSON writes the lock usage report to w as a JSON array.
+func (s *state) WriteUsageJSON(w io.Writer) {
+	out := s.usageReport()
+	if out == nil {
+		out = []jsonUsage{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(out); err != nil {
+		log.Fatal(err)
+	}
+}
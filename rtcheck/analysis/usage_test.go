@@ -0,0 +1,36 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package analysis
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestUsage(t *testing.T) {
+	s := analyzeTestdataOpts(t, options{usage: true}, "lockAB", "lockBA", "noteSleepLocked")
+	var buf bytes.Buffer
+	s.WriteUsageJSON(&buf)
+	var got []jsonUsage
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := []jsonUsage{
+		{"runtime.lockA", []string{"runtime.lockAB", "runtime.lockBA"}, []string{"runtime.lockB"}, []string{}},
+		{"runtime.lockB", []string{"runtime.lockAB", "runtime.lockBA"}, []string{"runtime.lockA"}, []string{}},
+		{"runtime.noteLock", []string{"runtime.noteSleepLocked"}, []string{}, []string{"runtime.notesleep"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got usage\n%+v\nwant\n%+v", got, want)
+	}
+
+	buf.Reset()
+	s.WriteUsage(&buf)
+	if !bytes.Contains(buf.Bytes(), []byte("    HELD ACROSS BLOCKING: runtime.notesleep\n")) {
+		t.Errorf("text report doesn't flag noteLock:\n%s", buf.String())
+	}
+}
@@ -2,7 +2,7 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-package main
+package analysis
 
 import (
 	"fmt"
@@ -11,6 +11,7 @@ import (
 	"go/types"
 	"io"
 	"log"
+	"reflect"
 
 	"golang.org/x/tools/go/ssa"
 )
@@ -65,6 +66,8 @@ func (vs ValState) Get(val ssa.Value) DynValue {
 		return DynConst{val.Value}
 	case *ssa.Global:
 		return DynGlobal{val}
+	case *ssa.Function:
+		return DynClosure{val, nil}
 	}
 	for frame := vs.frame; frame != nil; frame = frame.parent {
 		if frame.flat != nil {
@@ -140,12 +143,212 @@ func (vs ValState) ExtendHeap(h *HeapObject, dyn DynValue) ValState {
 	return vs
 }
 
+// Join returns a ValState containing the bindings that are the same
+// in both vs and o. Values bound in only one of them, or bound to
+// different dynamic values, are unknown in the result.
+func (vs ValState) Join(o ValState) ValState {
+	var out ValState
+	f1, f2 := vs.frame.flatten(), o.frame.flatten()
+	frame := make(map[ssa.Value]DynValue)
+	for k, v1 := range f1 {
+		if v2, ok := f2[k]; ok && dynEqual(v1, v2) {
+			frame[k] = v1
+		}
+	}
+	if len(frame) > 0 {
+		out.frame = &frameValState{budget: len(frame) + 1, flat: frame}
+	}
+	h1, h2 := vs.heap.flatten(), o.heap.flatten()
+	heap := make(map[*HeapObject]DynValue)
+	for k, v1 := range h1 {
+		if v2, ok := h2[k]; ok && dynEqual(v1, v2) {
+			heap[k] = v1
+		}
+	}
+	if len(heap) > 0 {
+		out.heap = &heapValState{budget: len(heap) + 1, flat: heap}
+	}
+	return out
+}
+
+// dynEqual returns whether x and y are the same dynamic value. Unlike
+// DynValue.Equal, x and y may be of different kinds.
+func dynEqual(x, y DynValue) bool {
+	return reflect.TypeOf(x) == reflect.TypeOf(y) && x.Equal(y)
+}
+
+// Bindings returns copies of the frame and heap bindings of vs.
+func (vs ValState) Bindings() (frame map[ssa.Value]DynValue, heap map[*HeapObject]DynValue) {
+	frame = make(map[ssa.Value]DynValue)
+	for k, v := range vs.frame.flatten() {
+		frame[k] = v
+	}
+	heap = make(map[*HeapObject]DynValue)
+	for k, v := range vs.heap.flatten() {
+		heap[k] = v
+	}
+	return
+}
+
 // LimitToHeap returns a ValState containing only the heap bindings in
 // vs.
 func (vs ValState) LimitToHeap() ValState {
 	return ValState{nil, vs.heap}
 }
 
+// Assume returns a ValState that is like vs, but with boolean value
+// cond bound to val. It also back-propagates what this implies about
+// the operands of cond: if cond is !x, x is bound to !val; if cond is
+// an equality comparison that holds, an unknown operand is bound to
+// the value of the other; and if cond is an integer comparison, its
+// operands are narrowed to DynRanges. This lets later branches on the
+// same operands be decided. For example, in
+//
+//     if x == 0 { lock(&l) }
+//     ...
+//     if x == 0 { unlock(&l) }
+//
+// the two comparisons are different SSA values, but taking the true
+// branch of the first binds x to 0, which decides the second.
+func (vs ValState) Assume(cond ssa.Value, val bool) ValState {
+	vs = vs.Extend(cond, DynConst{constant.MakeBool(val)})
+	switch cond := cond.(type) {
+	case *ssa.UnOp:
+		if cond.Op == token.NOT {
+			vs = vs.Assume(cond.X, !val)
+		}
+
+	case *ssa.BinOp:
+		switch cond.Op {
+		case token.EQL, token.NEQ:
+			equal := val == (cond.Op == token.EQL)
+			vs = vs.assumeEqual(cond.X, vs.Get(cond.Y), equal)
+			vs = vs.assumeEqual(cond.Y, vs.Get(cond.X), equal)
+		case token.LSS, token.LEQ, token.GTR, token.GEQ:
+			op := cond.Op
+			if !val {
+				op = negateOrder[op]
+			}
+			vs = vs.assumeOrder(cond.X, op, vs.Get(cond.Y))
+			vs = vs.assumeOrder(cond.Y, mirrorOrder[op], vs.Get(cond.X))
+		}
+	}
+	return vs
+}
+
+// negateOrder maps each ordering comparison to its negation, and
+// mirrorOrder maps each to the comparison with its operands swapped.
+var negateOrder = map[token.Token]token.Token{
+	token.LSS: token.GEQ, token.LEQ: token.GTR,
+	token.GTR: token.LEQ, token.GEQ: token.LSS,
+}
+
+var mirrorOrder = map[token.Token]token.Token{
+	token.LSS: token.GTR, token.LEQ: token.GEQ,
+	token.GTR: token.LSS, token.GEQ: token.LEQ,
+}
+
+// assumeEqual returns vs updated with what's implied about x if x == y
+// (if equal is true) or x != y (if equal is false), where y is the
+// known value of the other operand, or nil.
+func (vs ValState) assumeEqual(x ssa.Value, y DynValue, equal bool) ValState {
+	if y == nil {
+		return vs
+	}
+	xv := vs.Get(x)
+	if yc, ok := y.(DynConst); ok {
+		switch yc.c.Kind() {
+		case constant.Bool:
+			// x is a boolean, so we know its value
+			// either way.
+			if xv == nil {
+				vs = vs.Assume(x, constant.BoolVal(yc.c) == equal)
+			}
+			return vs
+		case constant.Float, constant.Complex:
+			// Equal floats may still differ (e.g., 0 and
+			// -0).
+			return vs
+		}
+	}
+	if xv == nil {
+		if equal {
+			vs = vs.Extend(x, y)
+		}
+		return vs
+	}
+	if _, ok := xv.(DynRange); !ok {
+		return vs
+	}
+	xlo, xhi, _ := intBounds(xv)
+	ylo, yhi, ok := intBounds(y)
+	if !ok {
+		return vs
+	}
+	if equal {
+		return vs.extendRange(x, maxBound(xlo, ylo), minBound(xhi, yhi))
+	}
+	// x != y only narrows x if y is a constant at one of x's
+	// bounds.
+	if _, ok := y.(DynConst); !ok {
+		return vs
+	}
+	one := constant.MakeInt64(1)
+	if boundEqual(xlo, ylo) {
+		xlo = constant.BinaryOp(xlo, token.ADD, one)
+	}
+	if boundEqual(xhi, yhi) {
+		xhi = constant.BinaryOp(xhi, token.SUB, one)
+	}
+	return vs.extendRange(x, xlo, xhi)
+}
+
+// assumeOrder returns vs updated with what's implied about integer x
+// if "x op y" holds, where y is the known value of the other operand,
+// or nil.
+func (vs ValState) assumeOrder(x ssa.Value, op token.Token, y DynValue) ValState {
+	if b, ok := x.Type().Underlying().(*types.Basic); !ok || b.Info()&types.IsInteger == 0 {
+		return vs
+	}
+	ylo, yhi, ok := intBounds(y)
+	if !ok {
+		return vs
+	}
+	var lo, hi constant.Value
+	one := constant.MakeInt64(1)
+	switch op {
+	case token.LSS:
+		hi = addBounds(yhi, token.SUB, one)
+	case token.LEQ:
+		hi = yhi
+	case token.GTR:
+		lo = addBounds(ylo, token.ADD, one)
+	case token.GEQ:
+		lo = ylo
+	}
+	if lo == nil && hi == nil {
+		return vs
+	}
+	switch xv := vs.Get(x).(type) {
+	case nil:
+		return vs.extendRange(x, lo, hi)
+	case DynRange:
+		return vs.extendRange(x, maxBound(xv.lo, lo), minBound(xv.hi, hi))
+	}
+	return vs
+}
+
+// extendRange returns vs with x bound to the integers in [lo, hi]. If
+// the range is empty, the path is impossible, but it's left to the
+// caller's branch decisions to prune it, so vs is returned unchanged.
+func (vs ValState) extendRange(x ssa.Value, lo, hi constant.Value) ValState {
+	r := makeRange(lo, hi)
+	if r == nil {
+		return vs
+	}
+	return vs.Extend(x, r)
+}
+
 // Do applies the effect of instr to the value state and returns an
 // Extended ValState.
 func (vs ValState) Do(instr ssa.Instruction) ValState {
@@ -165,6 +368,13 @@ func (vs ValState) Do(instr ssa.Instruction) ValState {
 			return vs.Extend(instr, x)
 		}
 
+	case *ssa.MakeClosure:
+		bindings := make([]DynValue, len(instr.Bindings))
+		for i, b := range instr.Bindings {
+			bindings[i] = vs.Get(b)
+		}
+		return vs.Extend(instr, DynClosure{instr.Fn.(*ssa.Function), bindings})
+
 	case *ssa.FieldAddr:
 		if x := vs.Get(instr.X); x != nil {
 			switch x := x.(type) {
@@ -184,7 +394,7 @@ func (vs ValState) Do(instr ssa.Instruction) ValState {
 		if addr := vs.Get(instr.Addr); addr != nil {
 			if addr, ok := addr.(DynHeapPtr); ok {
 				val := vs.Get(instr.Val)
-				if val == nil {
+				if _, ok := val.(DynRange); val == nil || ok {
 					val = dynUnknown{}
 				}
 				return vs.ExtendHeap(addr.elem, val)
@@ -273,7 +483,7 @@ func (vs ValState) EqualAt(o ValState, at map[ssa.Value]struct{}) bool {
 		for k := range at {
 			v1, ok1 := i1[k]
 			v2, ok2 := i2[k]
-			if ok1 != ok2 || (ok1 && !v1.Equal(v2)) {
+			if ok1 != ok2 || (ok1 && !dynEqual(v1, v2)) {
 				return false
 			}
 		}
@@ -284,7 +494,7 @@ func (vs ValState) EqualAt(o ValState, at map[ssa.Value]struct{}) bool {
 		return false
 	}
 	for k1, v1 := range h1 {
-		if v2, ok := h2[k1]; !ok || !v1.Equal(v2) {
+		if v2, ok := h2[k1]; !ok || !dynEqual(v1, v2) {
 			return false
 		}
 	}
@@ -334,11 +544,29 @@ type DynConst struct {
 	c constant.Value
 }
 
+// MakeDynInt returns the DynConst for integer x.
+func MakeDynInt(x int64) DynConst {
+	return DynConst{constant.MakeInt64(x)}
+}
+
+// MakeDynBool returns the DynConst for boolean x.
+func MakeDynBool(x bool) DynConst {
+	return DynConst{constant.MakeBool(x)}
+}
+
+// Value returns the constant value of x.
+func (x DynConst) Value() constant.Value {
+	return x.c
+}
+
 func (x DynConst) Equal(y DynValue) bool {
 	return constant.Compare(x.c, token.EQL, y.(DynConst).c)
 }
 
 func (x DynConst) BinOp(op token.Token, y DynValue) DynValue {
+	if _, ok := y.(DynRange); ok {
+		return rangeBinOp(x, op, y)
+	}
 	yc := y.(DynConst).c
 	switch op {
 	case token.EQL, token.NEQ,
@@ -354,6 +582,14 @@ func (x DynConst) BinOp(op token.Token, y DynValue) DynValue {
 			log.Fatalf("bad shift %v", y)
 		}
 		return DynConst{constant.Shift(x.c, op, uint(s))}
+	case token.AND, token.OR, token.XOR, token.AND_NOT, token.REM:
+		// These are only defined on integers, but a
+		// conversion we don't model may have left a
+		// non-integer constant.
+		if x.c.Kind() != constant.Int || yc.Kind() != constant.Int {
+			return dynUnknown{}
+		}
+		return DynConst{constant.BinaryOp(x.c, op, yc)}
 	case token.QUO:
 		if constant.Sign(yc) == 0 {
 			// TODO: It would be nice if we could report
@@ -371,6 +607,183 @@ func (x DynConst) UnOp(op token.Token, vs ValState) DynValue {
 	return DynConst{constant.UnaryOp(op, x.c, 64)}
 }
 
+// DynRange is an integer in the closed interval [lo, hi]. A nil bound
+// is unbounded, but at least one bound is non-nil and lo < hi, so a
+// DynRange is always narrower than an unknown integer and wider than
+// a DynConst. DynRanges come from branching on comparisons, such as
+// the true branch of "if i < 10". Like DynConst, they ignore overflow.
+//
+// Ranges are only tracked in stack frames. Special function handlers
+// expect the heap objects they track to be DynConsts.
+type DynRange struct {
+	lo, hi constant.Value
+}
+
+// makeRange returns the DynValue for the integers in [lo, hi]. It
+// returns a DynConst if lo == hi, dynUnknown if both are unbounded,
+// and nil if the range is empty.
+func makeRange(lo, hi constant.Value) DynValue {
+	if lo != nil && hi != nil {
+		if constant.Compare(lo, token.GTR, hi) {
+			return nil
+		}
+		if constant.Compare(lo, token.EQL, hi) {
+			return DynConst{lo}
+		}
+	}
+	if lo == nil && hi == nil {
+		return dynUnknown{}
+	}
+	return DynRange{lo, hi}
+}
+
+// intBounds returns the bounds of x if it's an integer DynConst or a
+// DynRange.
+func intBounds(x DynValue) (lo, hi constant.Value, ok bool) {
+	switch x := x.(type) {
+	case DynConst:
+		if x.c.Kind() != constant.Int {
+			return nil, nil, false
+		}
+		return x.c, x.c, true
+	case DynRange:
+		return x.lo, x.hi, true
+	}
+	return nil, nil, false
+}
+
+func (x DynRange) String() string {
+	lo, hi := "-inf", "+inf"
+	if x.lo != nil {
+		lo = x.lo.String()
+	}
+	if x.hi != nil {
+		hi = x.hi.String()
+	}
+	return fmt.Sprintf("[%s, %s]", lo, hi)
+}
+
+func (x DynRange) Equal(y DynValue) bool {
+	y2, ok := y.(DynRange)
+	return ok && boundEqual(x.lo, y2.lo) && boundEqual(x.hi, y2.hi)
+}
+
+func boundEqual(a, b constant.Value) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return constant.Compare(a, token.EQL, b)
+}
+
+func (x DynRange) BinOp(op token.Token, y DynValue) DynValue {
+	return rangeBinOp(x, op, y)
+}
+
+func (x DynRange) UnOp(op token.Token, vs ValState) DynValue {
+	if op == token.SUB {
+		return makeRange(negBound(x.hi), negBound(x.lo))
+	}
+	return dynUnknown{}
+}
+
+// rangeBinOp implements BinOp where x or y is a DynRange and the other
+// is a DynRange or an integer DynConst. It returns dynUnknown if the
+// result can't be bounded.
+func rangeBinOp(x DynValue, op token.Token, y DynValue) DynValue {
+	xlo, xhi, ok1 := intBounds(x)
+	ylo, yhi, ok2 := intBounds(y)
+	if !ok1 || !ok2 {
+		return dynUnknown{}
+	}
+	switch op {
+	case token.ADD:
+		return makeRange(addBounds(xlo, token.ADD, ylo), addBounds(xhi, token.ADD, yhi))
+	case token.SUB:
+		return makeRange(addBounds(xlo, token.SUB, yhi), addBounds(xhi, token.SUB, ylo))
+	case token.MUL:
+		// Only scaling by a constant is supported.
+		c, r := x, y
+		if _, ok := c.(DynConst); !ok {
+			c, r = y, x
+		}
+		k, ok := c.(DynConst)
+		if !ok {
+			break
+		}
+		rlo, rhi, _ := intBounds(r)
+		switch constant.Sign(k.c) {
+		case 0:
+			return DynConst{k.c}
+		case 1:
+			return makeRange(addBounds(rlo, token.MUL, k.c), addBounds(rhi, token.MUL, k.c))
+		case -1:
+			return makeRange(addBounds(rhi, token.MUL, k.c), addBounds(rlo, token.MUL, k.c))
+		}
+	case token.LSS:
+		return boundCompare(xhi, token.LSS, ylo, xlo, token.GEQ, yhi)
+	case token.LEQ:
+		return boundCompare(xhi, token.LEQ, ylo, xlo, token.GTR, yhi)
+	case token.GTR:
+		return boundCompare(xlo, token.GTR, yhi, xhi, token.LEQ, ylo)
+	case token.GEQ:
+		return boundCompare(xlo, token.GEQ, yhi, xhi, token.LSS, ylo)
+	case token.EQL, token.NEQ:
+		// Since one side is a DynRange, the two can't be
+		// known equal, but they may be known unequal.
+		disjoint := (xhi != nil && ylo != nil && constant.Compare(xhi, token.LSS, ylo)) ||
+			(xlo != nil && yhi != nil && constant.Compare(xlo, token.GTR, yhi))
+		if disjoint {
+			return DynConst{constant.MakeBool(op == token.NEQ)}
+		}
+	}
+	return dynUnknown{}
+}
+
+// boundCompare returns true if "a op b" holds, false if "c op2 d"
+// holds, and otherwise dynUnknown. Nil bounds never satisfy a
+// comparison.
+func boundCompare(a constant.Value, op token.Token, b, c constant.Value, op2 token.Token, d constant.Value) DynValue {
+	if a != nil && b != nil && constant.Compare(a, op, b) {
+		return DynConst{constant.MakeBool(true)}
+	}
+	if c != nil && d != nil && constant.Compare(c, op2, d) {
+		return DynConst{constant.MakeBool(false)}
+	}
+	return dynUnknown{}
+}
+
+// addBounds returns "a op b", where a nil bound is unbounded and
+// makes the result unbounded.
+func addBounds(a constant.Value, op token.Token, b constant.Value) constant.Value {
+	if a == nil || b == nil {
+		return nil
+	}
+	return constant.BinaryOp(a, op, b)
+}
+
+// maxBound and minBound return the tighter of two lower or upper
+// bounds, respectively, where nil is unbounded.
+func maxBound(a, b constant.Value) constant.Value {
+	if a == nil || (b != nil && constant.Compare(b, token.GTR, a)) {
+		return b
+	}
+	return a
+}
+
+func minBound(a, b constant.Value) constant.Value {
+	if a == nil || (b != nil && constant.Compare(b, token.LSS, a)) {
+		return b
+	}
+	return a
+}
+
+func negBound(a constant.Value) constant.Value {
+	if a == nil {
+		return nil
+	}
+	return constant.UnaryOp(token.SUB, a, 0)
+}
+
 // comparableBinOp implements DynValue.BinOp for values that support
 // only comparison operators.
 func comparableBinOp(x DynValue, op token.Token, y DynValue) DynValue {
@@ -493,6 +906,48 @@ func (x DynHeapPtr) FieldAddr(vs ValState, instr *ssa.FieldAddr) DynValue {
 	return dynUnknown{}
 }
 
+// DynClosure is a function value, either constructed by an
+// ssa.MakeClosure or a reference to an *ssa.Function. It tracks the
+// function and the dynamic values of its free variables, or nil for
+// free variables whose values are unknown.
+type DynClosure struct {
+	fn       *ssa.Function
+	bindings []DynValue
+}
+
+func (x DynClosure) Equal(y DynValue) bool {
+	y2, ok := y.(DynClosure)
+	if !ok || x.fn != y2.fn {
+		return false
+	}
+	for i, b := range x.bindings {
+		b2 := y2.bindings[i]
+		if (b == nil) != (b2 == nil) || (b != nil && !dynEqual(b, b2)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (x DynClosure) BinOp(op token.Token, y DynValue) DynValue {
+	return comparableBinOp(x, op, y)
+}
+
+func (x DynClosure) UnOp(op token.Token, vs ValState) DynValue {
+	return addrUnOp(op)
+}
+
+// Bind returns vs extended with the known values of x's free
+// variables.
+func (x DynClosure) Bind(vs ValState) ValState {
+	for i, b := range x.bindings {
+		if b != nil {
+			vs = vs.Extend(x.fn.FreeVars[i], b)
+		}
+	}
+	return vs
+}
+
 // DynStruct is a struct value consisting of heap objects. It maps
 // from field name to heap object. Note that each tracked field is its
 // own heap object; e.g., even if it's just an int field, it's
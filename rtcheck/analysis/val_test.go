@@ -0,0 +1,272 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package analysis
+
+import (
+	"go/ast"
+	"go/constant"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"testing"
+
+	"golang.org/x/tools/go/ssa"
+	"golang.org/x/tools/go/ssa/ssautil"
+)
+
+// buildSSA builds package p from src and returns it.
+func buildSSA(t *testing.T, src string) *ssa.Package {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "p.go", "package p\n"+src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkg, _, err := ssautil.BuildPackage(&types.Config{}, fset, types.NewPackage("p", ""), []*ast.File{f}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pkg
+}
+
+// doBlock applies each instruction in b to vs and returns the result
+// and the value returned by b, if it ends in a return.
+func doBlock(vs ValState, b *ssa.BasicBlock) (ValState, DynValue) {
+	for _, instr := range b.Instrs {
+		vs = vs.Do(instr)
+		if ret, ok := instr.(*ssa.Return); ok && len(ret.Results) == 1 {
+			return vs, vs.Get(ret.Results[0])
+		}
+	}
+	return vs, nil
+}
+
+func TestValStateDoArith(t *testing.T) {
+	f := buildSSA(t, `func f(x int) int { y := x + 1; return y * 2 }`).Func("f")
+	var vs ValState
+	vs = vs.Extend(f.Params[0], MakeDynInt(3))
+	_, ret := doBlock(vs, f.Blocks[0])
+	if !MakeDynInt(8).Equal(ret) {
+		t.Errorf("want 8, got %v", ret)
+	}
+
+	// With an unknown argument, the result is unknown.
+	if _, ret := doBlock(ValState{}, f.Blocks[0]); ret != nil {
+		t.Errorf("want unknown result, got %v", ret)
+	}
+}
+
+func TestValStateRange(t *testing.T) {
+	pkg := buildSSA(t, `
+func add(x int) int { return x*2 - 1 }
+func less(x int) bool { return x < 10 }
+`)
+	add, less := pkg.Func("add"), pkg.Func("less")
+	nonNeg := DynRange{constant.MakeInt64(0), nil}
+	vs := ValState{}.Extend(add.Params[0], nonNeg)
+	_, ret := doBlock(vs, add.Blocks[0])
+	if want := (DynRange{constant.MakeInt64(-1), nil}); ret == nil || !want.Equal(ret) {
+		t.Errorf("add: want %v, got %v", want, ret)
+	}
+
+	for _, test := range []struct {
+		x    DynRange
+		want DynValue
+	}{
+		{DynRange{constant.MakeInt64(0), constant.MakeInt64(9)}, MakeDynBool(true)},
+		{DynRange{constant.MakeInt64(10), nil}, MakeDynBool(false)},
+		{DynRange{nil, constant.MakeInt64(10)}, nil},
+	} {
+		vs := ValState{}.Extend(less.Params[0], test.x)
+		_, ret := doBlock(vs, less.Blocks[0])
+		if (ret == nil) != (test.want == nil) || (ret != nil && !test.want.Equal(ret)) {
+			t.Errorf("less with x in %v: want %v, got %v", test.x, test.want, ret)
+		}
+	}
+
+	// Assuming the comparison narrows its operand.
+	cond := less.Blocks[0].Instrs[0].(*ssa.BinOp)
+	for _, test := range []struct {
+		val  bool
+		want DynValue
+	}{
+		{true, DynRange{nil, constant.MakeInt64(9)}},
+		{false, DynRange{constant.MakeInt64(10), nil}},
+	} {
+		got := ValState{}.Assume(cond, test.val).Get(less.Params[0])
+		if got == nil || !test.want.Equal(got) {
+			t.Errorf("assume x < 10 is %v: want x in %v, got %v", test.val, test.want, got)
+		}
+	}
+	// Further narrowing intersects the ranges.
+	vs = ValState{}.Extend(less.Params[0], nonNeg).Assume(cond, true)
+	if got, want := vs.Get(less.Params[0]), (DynRange{constant.MakeInt64(0), constant.MakeInt64(9)}); got == nil || !want.Equal(got) {
+		t.Errorf("assume x < 10 with x >= 0: want x in %v, got %v", want, got)
+	}
+}
+
+func TestValStateDoHeap(t *testing.T) {
+	pkg := buildSSA(t, `
+func load(p *int) int { return *p }
+func store(p *int, x int) { *p = x }
+type T struct { a, b int }
+func field(p *T) *int { return &p.b }
+var g T
+func global() *int { return &g.b }
+`)
+	h := NewHeapObject("h")
+	ptr := DynHeapPtr{h}
+
+	// Load of a tracked heap object.
+	load := pkg.Func("load")
+	var vs ValState
+	vs = vs.Extend(load.Params[0], ptr).ExtendHeap(h, MakeDynInt(7))
+	if _, ret := doBlock(vs, load.Blocks[0]); !MakeDynInt(7).Equal(ret) {
+		t.Errorf("load: want 7, got %v", ret)
+	}
+
+	// Store of a known value updates the heap object.
+	store := pkg.Func("store")
+	vs = ValState{}.Extend(store.Params[0], ptr).Extend(store.Params[1], MakeDynInt(5))
+	vs, _ = doBlock(vs, store.Blocks[0])
+	if got := vs.GetHeap(h); !MakeDynInt(5).Equal(got) {
+		t.Errorf("store: want heap 5, got %v", got)
+	}
+	// Store of an unknown value unbinds it.
+	vs = vs.Extend(store.Params[1], dynUnknown{})
+	vs, _ = doBlock(vs, store.Blocks[0])
+	if got := vs.GetHeap(h); got != nil {
+		t.Errorf("store of unknown: want unbound heap, got %v", got)
+	}
+
+	// FieldAddr of a tracked struct.
+	field := pkg.Func("field")
+	hb := NewHeapObject("h.b")
+	vs = ValState{}.Extend(field.Params[0], ptr).ExtendHeap(h, DynStruct{"b": hb})
+	if _, ret := doBlock(vs, field.Blocks[0]); !(DynHeapPtr{hb}).Equal(ret) {
+		t.Errorf("field: want &h.b, got %v", ret)
+	}
+
+	// FieldAddr of a global.
+	_, ret := doBlock(ValState{}, pkg.Func("global").Blocks[0])
+	if want := (DynFieldAddr{pkg.Var("g"), 1}); ret == nil || !want.Equal(ret) {
+		t.Errorf("global: want %v, got %v", want, ret)
+	}
+}
+
+func TestValStateExtend(t *testing.T) {
+	f := buildSSA(t, `func f(a, b, c, d, e, f, g int) {}`).Func("f")
+
+	// Extend past the budget to force flattening and check
+	// that all bindings survive.
+	var vs ValState
+	for i, p := range f.Params {
+		vs = vs.Extend(p, MakeDynInt(int64(i)))
+	}
+	vs = vs.Extend(f.Params[0], MakeDynInt(100))
+	vs = vs.Extend(f.Params[1], dynUnknown{})
+	frame, _ := vs.Bindings()
+	if len(frame) != len(f.Params)-1 {
+		t.Errorf("want %d bindings, got %d", len(f.Params)-1, len(frame))
+	}
+	for i, p := range f.Params {
+		want := DynValue(MakeDynInt(int64(i)))
+		switch i {
+		case 0:
+			want = MakeDynInt(100)
+		case 1:
+			want = nil
+		}
+		got := vs.Get(p)
+		if (want == nil) != (got == nil) || (want != nil && !want.Equal(got)) {
+			t.Errorf("param %d: want %v, got %v", i, want, got)
+		}
+	}
+
+	// Extending a constant is a no-op.
+	c := ssa.NewConst(MakeDynInt(1).Value(), types.Typ[types.Int])
+	if vs2 := vs.Extend(c, MakeDynInt(2)); vs2 != vs {
+		t.Errorf("Extend of constant changed ValState")
+	}
+
+	// LimitToHeap drops frame bindings.
+	h := NewHeapObject("h")
+	vs = vs.ExtendHeap(h, MakeDynBool(true)).LimitToHeap()
+	if frame, heap := vs.Bindings(); len(frame) != 0 || len(heap) != 1 {
+		t.Errorf("LimitToHeap: want 0 frame and 1 heap bindings, got %d and %d", len(frame), len(heap))
+	}
+}
+
+func TestValStateEqualAt(t *testing.T) {
+	f := buildSSA(t, `func f(x, y int) {}`).Func("f")
+	x, y := f.Params[0], f.Params[1]
+	h := NewHeapObject("h")
+
+	var base ValState
+	base = base.ExtendHeap(h, MakeDynInt(0))
+	vs1 := base.Extend(x, MakeDynInt(1)).Extend(y, MakeDynInt(1))
+	vs2 := base.Extend(x, MakeDynInt(1)).Extend(y, MakeDynInt(2))
+
+	onlyX := map[ssa.Value]struct{}{x: {}}
+	both := map[ssa.Value]struct{}{x: {}, y: {}}
+	if !vs1.EqualAt(vs2, onlyX) {
+		t.Errorf("states differing only in y should be equal at {x}")
+	}
+	if vs1.EqualAt(vs2, both) {
+		t.Errorf("states differing in y should not be equal at {x, y}")
+	}
+	if !vs1.EqualAt(vs2, nil) {
+		t.Errorf("states should be equal with no values of interest")
+	}
+
+	// Bound versus unbound is a difference.
+	vs3 := base.Extend(x, MakeDynInt(1))
+	if vs1.EqualAt(vs3, both) {
+		t.Errorf("bound and unbound y should not be equal")
+	}
+
+	// Heap differences always matter.
+	vs4 := vs1.ExtendHeap(h, MakeDynInt(1))
+	if vs1.EqualAt(vs4, nil) {
+		t.Errorf("states with different heaps should not be equal")
+	}
+}
+
+func TestValStateJoin(t *testing.T) {
+	x := buildSSA(t, `func f(x int) {}`).Func("f").Params[0]
+	h := NewHeapObject("h")
+	// nil means unbound.
+	for _, test := range []struct {
+		name   string
+		v1, v2 DynValue
+		want   DynValue
+	}{
+		{"equal", MakeDynInt(1), MakeDynInt(1), MakeDynInt(1)},
+		{"unequal", MakeDynInt(1), MakeDynInt(2), nil},
+		{"different kinds", MakeDynBool(true), DynNil{}, nil},
+		{"missing in first", nil, MakeDynInt(1), nil},
+		{"missing in second", MakeDynInt(1), nil, nil},
+		{"missing in both", nil, nil, nil},
+	} {
+		var frame1, frame2, heap1, heap2 ValState
+		if test.v1 != nil {
+			frame1 = frame1.Extend(x, test.v1)
+			heap1 = heap1.ExtendHeap(h, test.v1)
+		}
+		if test.v2 != nil {
+			frame2 = frame2.Extend(x, test.v2)
+			heap2 = heap2.ExtendHeap(h, test.v2)
+		}
+		check := func(kind string, got DynValue) {
+			if (test.want == nil) != (got == nil) || (test.want != nil && !test.want.Equal(got)) {
+				t.Errorf("%s %s: want %v, got %v", kind, test.name, test.want, got)
+			}
+		}
+		// Join is symmetric.
+		check("frame", frame1.Join(frame2).Get(x))
+		check("frame", frame2.Join(frame1).Get(x))
+		check("heap", heap1.Join(heap2).GetHeap(h))
+		check("heap", heap2.Join(heap1).GetHeap(h))
+	}
+}
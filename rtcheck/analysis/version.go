@@ -0,0 +1,80 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package analysis
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The range of Go 1.x minor versions whose runtime rtcheck knows how
+// to model. The stubs, runtimeFns, and special function handlers all
+// depend on runtime internals that change between releases. Go 1.7
+// is not supported because its runtime has mapassign1 rather than
+// mapassign.
+const (
+	minGoMinor = 8
+	maxGoMinor = 8
+)
+
+// gorootVersion returns the Go version of the tree at goroot, such as
+// "go1.8.3". It uses the VERSION file of release trees, falling back
+// to internal/goversion for development trees.
+func gorootVersion(goroot string) (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(goroot, "VERSION"))
+	if err == nil {
+		line, _ := bufio.NewReader(bytes.NewReader(data)).ReadString('\n')
+		return strings.TrimSpace(line), nil
+	}
+	data, err = ioutil.ReadFile(filepath.Join(goroot, "src", "internal", "goversion", "goversion.go"))
+	if err != nil {
+		return "", fmt.Errorf("cannot determine Go version of GOROOT %s: no VERSION file or internal/goversion", goroot)
+	}
+	m := goversionRe.FindSubmatch(data)
+	if m == nil {
+		return "", fmt.Errorf("cannot determine Go version of GOROOT %s: no Version constant in internal/goversion", goroot)
+	}
+	return "go1." + string(m[1]), nil
+}
+
+var goversionRe = regexp.MustCompile(`(?m)^const Version = ([0-9]+)`)
+
+// goMinor returns the minor version of a Go 1.x version string, such
+// as 8 for "go1.8.3" or "go1.8rc1".
+func goMinor(version string) (int, bool) {
+	if !strings.HasPrefix(version, "go1.") {
+		return 0, false
+	}
+	v := version[len("go1."):]
+	i := 0
+	for i < len(v) && '0' <= v[i] && v[i] <= '9' {
+		i++
+	}
+	n, err := strconv.Atoi(v[:i])
+	return n, err == nil
+}
+
+// CheckGoVersion returns an error explaining why the runtime in
+// goroot can't be analyzed, or nil if its version is supported.
+func CheckGoVersion(goroot string) error {
+	version, err := gorootVersion(goroot)
+	if err != nil {
+		return err
+	}
+	minor, ok := goMinor(version)
+	if !ok {
+		return fmt.Errorf("GOROOT %s has unrecognized Go version %q; rtcheck supports Go 1.%d through 1.%d", goroot, version, minGoMinor, maxGoMinor)
+	}
+	if minor < minGoMinor || minor > maxGoMinor {
+		return fmt.Errorf("GOROOT %s has Go %s, but rtcheck only models the runtime of Go 1.%d through 1.%d; runtime functions, stubs, and compiler-generated roots are likely missing or changed", goroot, version, minGoMinor, maxGoMinor)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package analysis
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckGoVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rtcheck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeFile := func(path, data string) {
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// No version information.
+	if err := CheckGoVersion(dir); err == nil || !strings.Contains(err.Error(), "cannot determine") {
+		t.Errorf("want error for unknown version, got %v", err)
+	}
+
+	// Development tree.
+	writeFile("src/internal/goversion/goversion.go", "package goversion\n\nconst Version = 12\n")
+	if err := CheckGoVersion(dir); err == nil || !strings.Contains(err.Error(), "has Go go1.12,") {
+		t.Errorf("want error for go1.12, got %v", err)
+	}
+
+	// Release trees.
+	for version, ok := range map[string]bool{
+		"go1.6.3":  false,
+		"go1.7":    false,
+		"go1.8rc1": true,
+		"go1.8.3":  true,
+		"go1.9":    false,
+		"devel":    false,
+	} {
+		writeFile("VERSION", version+"\n")
+		err := CheckGoVersion(dir)
+		if ok != (err == nil) {
+			t.Errorf("%s: got error %v", version, err)
+		}
+	}
+}
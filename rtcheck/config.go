@@ -0,0 +1,84 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// applyConfig sets flags in fs from the JSON configuration file r.
+//
+// The configuration is a JSON object mapping flag names (without the
+// leading "-") to values. Values may be strings, numbers, booleans,
+// or, for flags that take comma-separated lists, arrays of strings.
+// For example,
+//
+//     {
+//         "rootlocks": "list",
+//         "lockclasses": "rtcheck.classes",
+//         "alloclocks": ["runtime.mheap_.lock", "runtime.proflock"],
+//         "conservative": true
+//     }
+//
+// Flags that were set on the command line take precedence over the
+// configuration file, so applyConfig must be called after fs has been
+// parsed. Since the configuration file is just another way to set
+// flags, it covers every flag and new flags need no extra support.
+func applyConfig(fs *flag.FlagSet, r io.Reader) error {
+	var config map[string]interface{}
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	if err := dec.Decode(&config); err != nil {
+		return err
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	// Apply in a fixed order so errors are deterministic.
+	names := make([]string, 0, len(config))
+	for name := range config {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name == "config" || fs.Lookup(name) == nil {
+			return fmt.Errorf("unknown option %q", name)
+		}
+		if set[name] {
+			continue
+		}
+		var val string
+		switch v := config[name].(type) {
+		case string:
+			val = v
+		case bool, json.Number:
+			val = fmt.Sprint(v)
+		case []interface{}:
+			var elts []string
+			for _, elt := range v {
+				s, ok := elt.(string)
+				if !ok {
+					return fmt.Errorf("option %q: list elements must be strings", name)
+				}
+				elts = append(elts, s)
+			}
+			val = strings.Join(elts, ",")
+		default:
+			return fmt.Errorf("option %q: unsupported value %v", name, v)
+		}
+		if err := fs.Set(name, val); err != nil {
+			return fmt.Errorf("option %q: %v", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestApplyConfig(t *testing.T) {
+	var mode, list string
+	var on bool
+	var n int
+	newFlagSet := func() *flag.FlagSet {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.SetOutput(ioutil.Discard)
+		fs.StringVar(&mode, "mode", "warn", "")
+		fs.StringVar(&list, "list", "", "")
+		fs.BoolVar(&on, "on", false, "")
+		fs.IntVar(&n, "n", 10, "")
+		return fs
+	}
+	fs := newFlagSet()
+	if err := fs.Parse([]string{"-mode", "ignore"}); err != nil {
+		t.Fatal(err)
+	}
+
+	err := applyConfig(fs, strings.NewReader(`{"mode": "list", "list": ["a", "b"], "on": true, "n": 20}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode != "ignore" {
+		t.Errorf("command line -mode should override config; got %q", mode)
+	}
+	if list != "a,b" {
+		t.Errorf("want -list a,b, got %q", list)
+	}
+	if !on || n != 20 {
+		t.Errorf("want -on true -n 20, got -on %v -n %d", on, n)
+	}
+
+	for _, bad := range []string{
+		`{"bogus": 1}`,
+		`{"n": "many"}`,
+		`{"list": [1]}`,
+		`{"n": {}}`,
+		`[]`,
+	} {
+		if err := applyConfig(newFlagSet(), strings.NewReader(bad)); err == nil {
+			t.Errorf("want error for %s", bad)
+		}
+	}
+}
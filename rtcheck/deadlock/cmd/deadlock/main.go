@@ -0,0 +1,18 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command deadlock runs the deadlock Analyzer. It can be run directly
+// on packages or used as a vet tool:
+//
+//	go vet -vettool=$(which deadlock) ./...
+package main
+
+import (
+	"github.com/aclements/go-misc/rtcheck/deadlock"
+	"golang.org/x/tools/go/analysis/singlechecker"
+)
+
+func main() {
+	singlechecker.Main(deadlock.Analyzer)
+}
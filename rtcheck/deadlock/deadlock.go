@@ -0,0 +1,188 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package deadlock defines an Analyzer that reports potential
+// deadlocks caused by inconsistent lock ordering.
+//
+// The Analyzer runs rtcheck's lock analysis on each package, starting
+// from its exported functions and methods, and records the package's
+// lock order edges as a package fact. A cycle is reported if it is
+// formed by the edges of the package and its dependencies and
+// includes at least one edge from the package being analyzed. Each
+// edge of such a cycle is reported at the acquisition that creates it.
+//
+// Because each package is analyzed on its own, calls into other
+// packages aren't followed: a lock acquired by a callee in another
+// package is only seen if that package's own edges record it. This
+// makes the Analyzer a best-effort check. For whole-program
+// precision, use rtcheck -packages.
+package deadlock
+
+import (
+	"fmt"
+	"go/token"
+	"sort"
+
+	rtanalysis "github.com/aclements/go-misc/rtcheck/analysis"
+	"golang.org/x/tools/go/analysis"
+	"golang.org/x/tools/go/analysis/passes/buildssa"
+)
+
+const doc = `report potential deadlocks from inconsistent lock ordering
+
+The deadlock analyzer finds pairs of sync.Mutex and sync.RWMutex lock
+classes that are acquired in different orders, possibly in different
+packages, and reports the acquisitions that form the cycle.`
+
+// Analyzer reports lock acquisitions that form lock order cycles.
+var Analyzer = &analysis.Analyzer{
+	Name:      "deadlock",
+	Doc:       doc,
+	Requires:  []*analysis.Analyzer{buildssa.Analyzer},
+	Run:       run,
+	FactTypes: []analysis.Fact{new(lockEdges)},
+}
+
+// lockEdges is the package fact recording the lock order edges of a
+// package.
+type lockEdges struct {
+	Edges []lockEdge
+}
+
+// A lockEdge records that lock class To was acquired while From was
+// held, at source position Pos.
+type lockEdge struct {
+	From, To string
+	Pos      string
+}
+
+func (*lockEdges) AFact() {}
+
+func (f *lockEdges) String() string {
+	return fmt.Sprintf("lockEdges(%d)", len(f.Edges))
+}
+
+func run(pass *analysis.Pass) (interface{}, error) {
+	ssaInput := pass.ResultOf[buildssa.Analyzer].(*buildssa.SSA)
+	report, err := rtanalysis.AnalyzeSSA(ssaInput.Pkg, rtanalysis.Config{RootLocks: "ignore"})
+	if err != nil {
+		return nil, err
+	}
+
+	// Collect this package's edges and the sites that create them.
+	type site struct {
+		edge lockEdge
+		pos  token.Pos
+	}
+	var local []site
+	fact := new(lockEdges)
+	for _, e := range report.Edges() {
+		seen := make(map[token.Position]bool)
+		for _, path := range e.Paths {
+			if len(path.To) == 0 {
+				continue
+			}
+			p := path.To[len(path.To)-1].Pos
+			if seen[p] {
+				continue
+			}
+			seen[p] = true
+			edge := lockEdge{e.From, e.To, p.String()}
+			fact.Edges = append(fact.Edges, edge)
+			if pos := findPos(pass, p); pos.IsValid() {
+				local = append(local, site{edge, pos})
+			}
+		}
+	}
+	if len(fact.Edges) > 0 {
+		pass.ExportPackageFact(fact)
+	}
+
+	// Build the lock graph of this package and its dependencies.
+	g := make(map[string]map[string]bool)
+	addEdge := func(e lockEdge) {
+		if g[e.From] == nil {
+			g[e.From] = make(map[string]bool)
+		}
+		g[e.From][e.To] = true
+	}
+	for _, pf := range pass.AllPackageFacts() {
+		if f, ok := pf.Fact.(*lockEdges); ok {
+			for _, e := range f.Edges {
+				addEdge(e)
+			}
+		}
+	}
+	for _, e := range fact.Edges {
+		addEdge(e)
+	}
+
+	// Report each local edge that closes a cycle.
+	for _, s := range local {
+		path := findPath(g, s.edge.To, s.edge.From)
+		if path == nil {
+			continue
+		}
+		cycle := append([]string{s.edge.From}, path[:len(path)-1]...)
+		pass.Reportf(s.pos, "%s acquired while holding %s may deadlock: lock cycle %s", s.edge.To, s.edge.From, formatCycle(cycle))
+	}
+	return nil, nil
+}
+
+// findPos returns the token.Pos of position p in one of pass's files,
+// or token.NoPos if p isn't in this package.
+func findPos(pass *analysis.Pass, p token.Position) token.Pos {
+	for _, f := range pass.Files {
+		tf := pass.Fset.File(f.Pos())
+		if tf == nil || tf.Name() != p.Filename || p.Line > tf.LineCount() {
+			continue
+		}
+		return tf.LineStart(p.Line) + token.Pos(p.Column-1)
+	}
+	return token.NoPos
+}
+
+// findPath returns the shortest path of lock classes from "from" to
+// "to" in g, including both ends, or nil if there is no path.
+func findPath(g map[string]map[string]bool, from, to string) []string {
+	parent := map[string]string{from: ""}
+	queue := []string{from}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		if n == to {
+			var path []string
+			for ; n != ""; n = parent[n] {
+				path = append(path, n)
+			}
+			for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+				path[i], path[j] = path[j], path[i]
+			}
+			return path
+		}
+		// Visit successors in order so reports are deterministic.
+		var succs []string
+		for succ := range g[n] {
+			succs = append(succs, succ)
+		}
+		sort.Strings(succs)
+		for _, succ := range succs {
+			if _, ok := parent[succ]; !ok {
+				parent[succ] = n
+				queue = append(queue, succ)
+			}
+		}
+	}
+	return nil
+}
+
+// formatCycle formats a cycle of lock classes, repeating the first
+// class at the end.
+func formatCycle(cycle []string) string {
+	s := ""
+	for _, name := range cycle {
+		s += name + " -> "
+	}
+	return s + cycle[0]
+}
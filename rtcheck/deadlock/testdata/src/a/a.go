@@ -0,0 +1,28 @@
+package a // want package:"lockEdges\\(3\\)"
+
+import "sync"
+
+var muA, muB sync.Mutex
+
+func AB() {
+	muA.Lock()
+	muB.Lock() // want "a.muB acquired while holding a.muA may deadlock"
+	muB.Unlock()
+	muA.Unlock()
+}
+
+func BA() {
+	muB.Lock()
+	muA.Lock() // want "a.muA acquired while holding a.muB may deadlock"
+	muA.Unlock()
+	muB.Unlock()
+}
+
+var muC sync.Mutex
+
+func Ordered() {
+	muA.Lock()
+	muC.Lock()
+	muC.Unlock()
+	muA.Unlock()
+}
@@ -0,0 +1,10 @@
+package b // want package:"lockEdges\\(1\\)"
+
+import "c"
+
+func YX() {
+	c.MuY.Lock()
+	c.MuX.Lock() // want "c.MuX acquired while holding c.MuY may deadlock: lock cycle c.MuY -> c.MuX -> c.MuY"
+	c.MuX.Unlock()
+	c.MuY.Unlock()
+}
@@ -0,0 +1,12 @@
+package c
+
+import "sync"
+
+var MuX, MuY sync.Mutex
+
+func XY() {
+	MuX.Lock()
+	MuY.Lock()
+	MuY.Unlock()
+	MuX.Unlock()
+}
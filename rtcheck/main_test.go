@@ -0,0 +1,60 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"go/build"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aclements/go-misc/rtcheck/analysis"
+)
+
+func TestCheckMaxCycles(t *testing.T) {
+	goroot, err := filepath.Abs("analysis/testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctxt := build.Default
+	ctxt.GOROOT = goroot
+	ctxt.GOPATH = ""
+	// These roots have two lock cycles.
+	r, err := analysis.Analyze(analysis.Config{
+		Context: &ctxt,
+		Roots:   []string{"lockAB", "lockBA", "lockBC", "lockCA"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		max      int
+		suppress string
+		want     string
+	}{
+		{-1, "", ""},
+		{0, "", "2 lock cycle(s), more than -max-cycles=0"},
+		{1, "", "2 lock cycle(s), more than -max-cycles=1"},
+		{2, "", ""},
+		// Suppressed cycles don't count toward the limit.
+		{1, "runtime.lockA runtime.lockB", ""},
+		{0, "runtime.lockA runtime.lockB", "1 lock cycle(s), more than -max-cycles=0"},
+		{0, "runtime.lockA runtime.lockB\nruntime.lockA runtime.lockB runtime.lockC", ""},
+	} {
+		sigs, err := analysis.ParseSuppressions(strings.NewReader(test.suppress))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Suppress(sigs)
+		got := ""
+		if err := checkMaxCycles(r, test.max); err != nil {
+			got = err.Error()
+		}
+		if got != test.want {
+			t.Errorf("-max-cycles=%d with suppressions %q: want %q, got %q", test.max, test.suppress, test.want, got)
+		}
+	}
+}
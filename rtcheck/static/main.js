@@ -1,6 +1,20 @@
 "use strict";
 
-function initOrder(strings, edges) {
+function initOrder(strings, edges, cycles, index, blocking, srcs) {
+    sources = srcs;
+    var edgesByID = {};
+    $.each(edges, function(_, edge) {
+        edgesByID[edge.EdgeID] = edge;
+    });
+    // The info box initially shows the index. Save it so we can
+    // return to it.
+    var intro = $("#info").children().detach();
+    showIndex = function() {
+        $("#info").empty().scrollTop(0).append(intro);
+        renderIndex(strings, edgesByID, cycles, index, blocking);
+    };
+    showIndex();
+
     // Hook into the graph edges.
     var labelRe = /^l([0-9]+)-l([0-9]+)$/;
     $.each(edges, function(_, edge) {
@@ -21,18 +35,269 @@ function initOrder(strings, edges) {
     $("#graph").css("visibility", "visible");
 }
 
-function showEdge(strings, edge) {
+// showIndex returns the info box to the lock class index. It is set
+// by initOrder.
+var showIndex;
+
+// sources maps from file path ID to line number to the source text
+// around each lock acquisition. It is set by initOrder.
+var sources;
+
+// filter is the current lock class filter. It's kept across calls
+// to showIndex so returning to the index doesn't reset it.
+var filter = "";
+
+// renderIndex fills in the index: a filter box, a table of contents
+// of the lock cycles, and an index that groups lock classes by the
+// type that owns them and links to each cycle a class participates
+// in. It's followed by the list of locks held across blocking
+// operations, if any. Typing in the filter box narrows all of these
+// (and dims the graph) to lock classes whose names contain the
+// filter text.
+function renderIndex(strings, edgesByID, cycles, index, blocking) {
+    var div = $("#index").empty();
+    var input = $("<input>").attr({id: "filter", type: "search", placeholder: "Filter by lock class"}).
+        val(filter).appendTo($("<p>").appendTo(div));
+    var body = $("<div>").appendTo(div);
+    function render() {
+        filter = input.val();
+        var match = filterMatcher(filter);
+        filterGraph(edgesByID, match);
+        renderIndexBody(body.empty(), strings, edgesByID, cycles, index, blocking, match);
+    }
+    input.on("input", render);
+    render();
+}
+
+// filterMatcher returns a function that reports whether a lock class
+// name matches filter text f. The match is a case-insensitive
+// substring match, so an empty filter matches everything.
+function filterMatcher(f) {
+    f = f.toLowerCase();
+    return function(name) {
+        return name.toLowerCase().indexOf(f) >= 0;
+    };
+}
+
+function renderIndexBody(div, strings, edgesByID, cycles, index, blocking, match) {
+    function heading(text) {
+        $("<p>").appendTo(div).text(text).css({fontWeight: "bold"});
+    }
+    function count(n, total, what) {
+        if (filter === "" || n === total)
+            return total + " " + what;
+        return n + " of " + total + " " + what;
+    }
+
+    // Table of contents of cycles.
+    var ol = $("<ol>").addClass("toc");
+    var ncycles = 0;
+    $.each(cycles, function(ci, cycle) {
+        if (!cycle.Locks.some(match))
+            return;
+        ncycles++;
+        var li = $("<li>").attr("value", ci + 1).appendTo(ol);
+        $("<a>").appendTo(li).text(
+            cycle.Locks.concat([cycle.Locks[0]]).join(" \u2192 ")
+        ).on("click", function() {
+            showCycle(strings, edgesByID, cycles, ci);
+        });
+        var note = cycle.Severity + ", " + cycle.Paths + " path(s)";
+        if (cycle.Kind === "self-deadlock")
+            note = "self-deadlock " + note;
+        li.append(" (" + note + ")");
+    });
+    heading(count(ncycles, cycles.length, "lock cycle(s):"));
+    if (ncycles > 0)
+        ol.appendTo(div);
+
+    // Lock classes by owner.
+    var ul = $("<ul>");
+    var nclasses = 0, total = 0;
+    $.each(index, function(_, owner) {
+        var classes = $("<ul>");
+        $.each(owner.Classes, function(_, cls) {
+            total++;
+            if (!match(cls.Name))
+                return;
+            nclasses++;
+            var cli = $("<li>").appendTo(classes).text(cls.Name);
+            $.each(cls.Cycles || [], function(i, ci) {
+                cli.append(i === 0 ? " (cycles: " : ", ");
+                $("<a>").appendTo(cli).text("#" + (ci + 1)).on("click", function() {
+                    showCycle(strings, edgesByID, cycles, ci);
+                });
+                if (i === cls.Cycles.length - 1)
+                    cli.append(")");
+            });
+        });
+        if (classes.children().length > 0)
+            $("<li>").appendTo(ul).text(owner.Owner).append(classes);
+    });
+    heading(count(nclasses, total, "lock class(es) by owner:"));
+    if (nclasses > 0)
+        ul.appendTo(div);
+
+    // When filtering, also list the matching edges, since the
+    // graph may be too large to find them in.
+    if (filter !== "") {
+        var edges = [];
+        $.each(edgesByID, function(_, edge) {
+            if (match(edge.Locks[0]) || match(edge.Locks[1]))
+                edges.push(edge);
+        });
+        edges.sort(function(a, b) {
+            var ka = a.Locks.join("\n"), kb = b.Locks.join("\n");
+            return ka < kb ? -1 : ka > kb ? 1 : 0;
+        });
+        heading(edges.length + " matching edge(s):");
+        var eul = $("<ul>").appendTo(div);
+        $.each(edges, function(_, edge) {
+            $("<a>").appendTo($("<li>").appendTo(eul)).text(
+                edge.Locks[0] + " \u2192 " + edge.Locks[1]
+            ).on("click", function() {
+                showEdge(strings, edge);
+            });
+        });
+    }
+
+    if (!blocking || blocking.length === 0)
+        return;
+    var bul = $("<ul>");
+    var nblocking = 0;
+    $.each(blocking, function(_, b) {
+        if (!match(b.Locks[0]))
+            return;
+        nblocking++;
+        $("<a>").appendTo($("<li>").appendTo(bul)).text(
+            b.Locks[0] + " across " + b.Locks[1]
+        ).on("click", function() {
+            showEdge(strings, b);
+        });
+    });
+    heading(count(nblocking, blocking.length, "lock(s) held across blocking operations:"));
+    if (nblocking > 0)
+        bul.appendTo(div);
+}
+
+// filterGraph dims the nodes and edges of the lock graph that don't
+// involve a lock class matched by match.
+function filterGraph(edgesByID, match) {
+    var keep = {};
+    $(".edge", "#graph").each(function(_, dom) {
+        var edge = edgesByID[dom.id];
+        var m = $("title", dom).text().match(/^(.*)->(.*)$/);
+        var ok = !edge || match(edge.Locks[0]) || match(edge.Locks[1]);
+        if (ok && m) {
+            keep[m[1]] = keep[m[2]] = true;
+        }
+        setFiltered(dom, !ok);
+    });
+    $(".node", "#graph").each(function(_, dom) {
+        setFiltered(dom, !keep[$("title", dom).text()]);
+    });
+}
+
+// filteredOpacity is the opacity of graph elements hidden by the
+// filter.
+var filteredOpacity = 0.1;
+
+function setFiltered(dom, filtered) {
+    $(dom).toggleClass("filtered", filtered).clearQueue().fadeTo("fast", filtered ? filteredOpacity : 1);
+}
+
+// showCycle shows the code paths for each edge of cycles[ci] in the
+// info box, with links to the neighboring cycles.
+function showCycle(strings, edgesByID, cycles, ci) {
+    var cycle = cycles[ci];
     var info = $("#info");
     info.empty().scrollTop(0);
+    var nav = $("<p>").appendTo(info);
+    $("<a>").appendTo(nav).text("\u2190 index").on("click", function() {
+        showIndex();
+    });
+    function navLink(cj, text) {
+        nav.append(" | ");
+        if (cj < 0 || cj >= cycles.length) {
+            nav.append(text);
+            return;
+        }
+        $("<a>").appendTo(nav).text(text).on("click", function() {
+            showCycle(strings, edgesByID, cycles, cj);
+        });
+    }
+    navLink(ci - 1, "previous cycle");
+    navLink(ci + 1, "next cycle");
+    var kind = cycle.Kind === "self-deadlock" ? "Self-deadlock" : "Cycle";
+    $("<p>").appendTo(info).text(
+        kind + " #" + (ci + 1) + " of " + cycles.length + " (" + cycle.Severity + "): " +
+            cycle.Locks.concat([cycle.Locks[0]]).join(" \u2192 ")
+    ).css({fontWeight: "bold"});
+    $.each(cycle.Edges, function(ei, id) {
+        if (ei === cycle.Fix) {
+            $("<p>").appendTo(info).text(
+                "Suggested fix: no edge of this cycle has fewer paths, so fixing them is likely the easiest way to break the cycle."
+            ).css({fontStyle: "italic"});
+        }
+        showEdge(strings, edgesByID[id], true);
+    });
+}
+
+// showEdge shows the code paths demonstrating edge in the info box.
+// If keep is true, they're appended to the info box's current
+// contents. Each path can be collapsed to just its root function by
+// clicking it. Only the first few paths of an edge start expanded.
+function showEdge(strings, edge, keep) {
+    var info = $("#info");
+    if (!keep) {
+        info.empty().scrollTop(0);
+        $("<a>").appendTo($("<p>").appendTo(info)).text("\u2190 index").on("click", function() {
+            showIndex();
+        });
+    }
 
     // Show summary information.
+    var npaths = 0;
+    $.each(edge.Paths, function(_, path) {
+        npaths += path.N;
+    });
     $("<p>").appendTo(info).text(
-        edge.Paths.length + " path(s) acquire " + edge.Locks[0] + ", then " + edge.Locks[1] + ":"
+        npaths + " path(s) acquire " + edge.Locks[0] + ", then " + edge.Locks[1] + ":"
     ).css({fontWeight: "bold"});
 
-    $.each(edge.Paths, function(_, path) {
+    var toggles = [];
+    if (edge.Paths.length > 1) {
+        var all = $("<p>").appendTo(info);
+        $.each([["expand all", true], ["collapse all", false]], function(i, t) {
+            if (i > 0)
+                all.append(" | ");
+            $("<a>").appendTo(all).text(t[0]).on("click", function() {
+                $.each(toggles, function(_, setOpen) {
+                    setOpen(t[1]);
+                });
+            });
+        });
+    }
+
+    var showPaths = 3;
+    $.each(edge.Paths, function(pi, path) {
         var p = $("<p>").appendTo(info).css("white-space", "nowrap");
-        $("<div>").appendTo(p).text(strings[path.RootFn]);
+        var root = strings[path.RootFn];
+        if (path.N > 1) {
+            root += " (" + path.N + " paths like this)";
+        }
+        var head = $("<div>").addClass("toggle").appendTo(p);
+        var body = $("<div>").appendTo(p);
+        var open;
+        function setOpen(o) {
+            open = o;
+            body.toggle(open);
+            head.text((open ? "\u25be " : "\u25b8 ") + root);
+        }
+        head.on("click", function() {
+            setOpen(!open);
+        });
+        toggles.push(setOpen);
         function posText(pathID, line) {
             // Keep only the trailing part of the path.
             return strings[pathID].replace(/.*\//, "") + ":" + line;
@@ -42,21 +307,26 @@ function showEdge(strings, edge) {
             var elideDiv;
             // Render each frame.
             $.each(stack.Op, function(i) {
-                var div = $("<div>").appendTo(p);
+                var div = $("<div>").appendTo(body);
                 var indent = i == 0 ? "1em" : "2em";
                 var showFirst = 2, showLast = 3;
                 if (i >= showFirst && stack.Op.length - i > showLast) {
                     // Elide middle of the path.
                     if (elided.length === 0) {
-                        elideDiv = $("<div>").appendTo(p).css("padding-left", indent);
+                        elideDiv = $("<div>").appendTo(body).css("padding-left", indent);
                     }
                     elided.push(div[0]);
                 }
-                div.appendTo(p);
+                div.appendTo(body);
                 // TODO: Link to path somehow.
                 div.text(strings[stack.Op[i]] + " at " + posText(stack.P[i], stack.L[i]));
                 div.css("padding-left", indent);
             });
+            // Show the source around the acquisition.
+            var last = stack.Op.length - 1;
+            if (last >= 0) {
+                renderSource(stack.P[last], stack.L[last]).appendTo(body);
+            }
             // If we elided frames, update the show link.
             if (elided.length === 1) {
                 // No point in eliding one frame.
@@ -72,20 +342,46 @@ function showEdge(strings, edge) {
         }
         renderStack(path.From);
         renderStack(path.To);
+        setOpen(pi < showPaths);
     });
 }
 
+// renderSource returns a <pre> of the source lines around line of
+// file pathID, with line highlighted.
+function renderSource(pathID, line) {
+    var pre = $("<pre>").addClass("source");
+    var lines = sources[pathID] || {};
+    for (var l = line - 2; l <= line + 2; l++) {
+        if (!(l in lines)) {
+            continue;
+        }
+        var div = $("<div>").appendTo(pre).text(("     " + l).slice(-5) + "  " + lines[l]);
+        if (l === line) {
+            div.addClass("acquire");
+        }
+    }
+    if (pre.children().length === 0) {
+        pre.hide();
+    }
+    return pre;
+}
+
 // enableHighlighting takes an GraphViz-generated SVG and enables
 // interactive highlighting when the mouse hovers over nodes and
 // edges.
 function enableHighlighting(svg) {
     var nodes = {}, edges = {};
     function all(opacity) {
+        // Elements dimmed by the filter stay dimmed.
+        function fade(dom) {
+            var o = $(dom).hasClass("filtered") ? Math.min(opacity, filteredOpacity) : opacity;
+            $(dom).clearQueue().fadeTo('fast', o);
+        }
         $.each(nodes, function(_, node) {
-            $(node.dom).clearQueue().fadeTo('fast', opacity);
+            fade(node.dom);
         })
         $.each(edges, function(_, edge) {
-            $(edge.dom).clearQueue().fadeTo('fast', opacity);
+            fade(edge.dom);
         })
     }
 